@@ -6,6 +6,7 @@ import (
 	"io"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/src-d/borges/lock"
@@ -32,7 +33,7 @@ var (
 	ErrEndpointsEmpty          = errors.NewKind("endpoints is empty")
 	ErrRepositoryIDNotFound    = errors.NewKind("repository id not found: %s")
 	ErrChanges                 = errors.NewKind("error computing changes")
-	ErrAlreadyFetching         = errors.NewKind("repository %s was already in a fetching status")
+	ErrAlreadyFetching         = errors.NewKind("repository %s is already being fetched")
 	ErrSetStatus               = errors.NewKind("unable to set repository to status: %s")
 	ErrFatal                   = errors.NewKind("fatal, %v: stacktrace: %s")
 	ErrCannotProcessRepository = errors.NewKind("cannot process repository")
@@ -53,8 +54,11 @@ type Archiver struct {
 
 	// TemporaryCloner is used to clone repositories into temporary storage.
 	TemporaryCloner TemporaryCloner
-	// Timeout is the deadline to cancel a job.
+	// Timeout is the deadline to cancel a job. Jobs can override it.
 	Timeout time.Duration
+	// RefPolicy selects the references archived. Jobs can override it. All
+	// of them are archived if it is nil.
+	RefPolicy *RefPolicy
 	// Store is the component where repository models are stored.
 	Store RepositoryStore
 	// RootedTransactioner is used to push new references to our repository
@@ -63,9 +67,49 @@ type Archiver struct {
 	// LockSession is a locker service to prevent concurrent access to the same
 	// rooted reporitories.
 	LockSession lock.Session
+	// LeaseSession is a locker service used to lease repositories so the same
+	// repository is never processed by two workers at the same time. It should
+	// have a short timeout, as a lease that cannot be acquired means the
+	// repository is already being processed. If it is nil LockSession is used.
+	LeaseSession lock.Session
+	// DistributedLeases must be set when the leases are shared by all the
+	// consumer processes, as the ones of a distributed locking service or the
+	// ones kept in the database by the store. Otherwise they only exclude the workers of the same
+	// process, so repositories in fetching status are not processed, as
+	// another process may be fetching them, and are set back to pending.
+	DistributedLeases bool
 	// Copier has the same copier struct as RootedTransactioner. Used to
 	// directly copy sivas to remote.
 	Copier *repository.Copier
+	// Notifiers are the functions called when a job is processed.
+	Notifiers ArchiverNotifiers
+	// Blocklist is checked before cloning a repository. Repositories with
+	// blocked endpoints are set to Blocked instead of being fetched. Nothing
+	// is blocked if it is nil.
+	Blocklist *Blocklist
+}
+
+// ArchiverNotifiers holds the functions called by an Archiver while
+// processing jobs. Any of them can be nil.
+type ArchiverNotifiers struct {
+	// Done is called after a job is processed, even if it failed.
+	Done func(*Job, *JobResult)
+}
+
+// JobResult is the outcome of processing a job.
+type JobResult struct {
+	// Repository is the repository model after processing the job. It is nil
+	// if the job failed before the repository was obtained.
+	Repository *model.Repository
+	// Endpoint is the endpoint used to fetch the repository.
+	Endpoint string
+	// Changed is true if any reference of the repository changed.
+	Changed bool
+	// Inits are the initial commits of the rooted repositories where the
+	// changes of the repository were pushed.
+	Inits []model.SHA1
+	// Err is the error returned processing the job, if any.
+	Err error
 }
 
 func NewArchiver(
@@ -106,11 +150,19 @@ func newBackoff() *backoff.Backoff {
 // Do archives a repository according to a job.
 func (a *Archiver) Do(ctx context.Context, j *Job) error {
 	logger := log.New(log.Fields{"job": j.RepositoryID})
+	if j.CorrelationID != "" {
+		logger = logger.New(log.Fields{"correlation-id": j.CorrelationID})
+	}
+
 	logger.Debugf("job started")
 
-	endpoint, err := a.do(ctx, logger, j)
-	if endpoint != "" {
-		logger = logger.New(log.Fields{"endpoint": endpoint})
+	res := &JobResult{}
+	err := a.do(ctx, logger, j, res)
+	res.Err = err
+	a.notifyDone(j, res)
+
+	if res.Endpoint != "" {
+		logger = logger.New(log.Fields{"endpoint": res.Endpoint})
 	}
 	if err != nil {
 		logger.Errorf(err, "job finished with error")
@@ -121,20 +173,57 @@ func (a *Archiver) Do(ctx context.Context, j *Job) error {
 	return nil
 }
 
+func (a *Archiver) notifyDone(j *Job, res *JobResult) {
+	if a.Notifiers.Done == nil {
+		return
+	}
+
+	a.Notifiers.Done(j, res)
+}
+
 func (a *Archiver) do(
 	ctx context.Context,
 	logger log.Logger,
 	j *Job,
-) (endpoint string, err error) {
+	res *JobResult,
+) (err error) {
 	now := time.Now()
-	ctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	timeout := a.Timeout
+	if j.Timeout > 0 {
+		timeout = j.Timeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
+	lease, lost, err := a.acquireLease(j)
+	if err != nil {
+		return ErrCannotProcessRepository.Wrap(err)
+	}
+	defer a.releaseLease(logger, lease)
+
+	released := make(chan struct{})
+	defer close(released)
+	go func() {
+		select {
+		case <-lost:
+			select {
+			case <-released:
+			default:
+				logger.Warningf("repository lease lost, cancelling job")
+				cancel()
+			}
+		case <-released:
+		}
+	}()
+
 	r, err := a.getRepositoryModel(j)
 	if err != nil {
-		return "", err
+		return err
 	}
 
+	res.Repository = r
+
 	defer a.reportMetrics(r, now)
 	defer a.recoverDo(logger, r, &now, &err)
 	defer func() {
@@ -148,43 +237,55 @@ func (a *Archiver) do(
 		"endpoints":  r.Endpoints,
 	}).Debugf("repository model obtained")
 
-	if err := a.isProcessableRepository(r, &now); err != nil {
-		return "", ErrCannotProcessRepository.Wrap(err)
+	if err := a.isProcessableRepository(logger, r, &now); err != nil {
+		return ErrCannotProcessRepository.Wrap(err)
+	}
+
+	blocked, err := a.isBlocked(logger, j, r)
+	if err != nil || blocked {
+		return err
 	}
 
 	if err := a.Store.SetStatus(r, model.Fetching); err != nil {
-		return "", ErrSetStatus.Wrap(err, model.Fetching)
+		return ErrSetStatus.Wrap(err, model.Fetching)
+	}
+
+	endpoint, err := selectEndpoint(FetchEndpoints(DefaultCanonicalizer, r.Endpoints))
+	if j.Endpoint != "" {
+		endpoint, err = j.Endpoint, nil
 	}
 
-	endpoint, err = selectEndpoint(r.Endpoints)
 	if err != nil {
 		a.updateFailed(r, model.Pending)
-		return endpoint, err
+		return err
 	}
 
+	res.Endpoint = endpoint
+
 	logger = logger.New(log.Fields{"endpoint": endpoint})
 	logger.Infof("clone started")
 
 	gr, err := a.doClone(ctx, logger, &now, j, r, endpoint)
 	if err != nil {
-		return endpoint, err
+		return err
 	}
 
 	if gr == nil {
-		return endpoint, nil
+		return nil
 	}
 
 	log.Debugf("remote repository cloned")
-	if err := a.doPush(ctx, logger, &now, j, r, endpoint, gr); err != nil {
+	err = a.doPush(ctx, logger, &now, j, r, endpoint, gr, res)
+	if err != nil {
 		e := gr.Close()
 		if e != nil {
 			logger.Errorf(err, StrRemoveTmpFiles)
 		}
 
-		return endpoint, err
+		return err
 	}
 
-	return endpoint, gr.Close()
+	return gr.Close()
 }
 
 func (a *Archiver) doClone(
@@ -227,15 +328,33 @@ func (a *Archiver) doClone(
 func (a *Archiver) doPush(
 	ctx context.Context, logger log.Logger, now *time.Time,
 	j *Job, r *model.Repository, endpoint string, gr TemporaryRepository,
-) error {
-	changes, err := NewChanges(NewModelReferencer(r), gr)
+	res *JobResult,
+) (err error) {
+	var oldRefs, newRefs Referencer = NewModelReferencer(r), gr
+	if policy := a.refPolicy(j); policy != nil {
+		oldRefs = NewRefPolicyReferencer(oldRefs, policy)
+		newRefs = NewRefPolicyReferencer(newRefs, policy)
+	}
+
+	if j.Force {
+		logger.Debugf("ignoring stored references")
+		oldRefs, newRefs, err = forcedReferencers(oldRefs, newRefs)
+		if err != nil {
+			a.updateFailed(r, model.Pending)
+			return ErrChanges.Wrap(err)
+		}
+	}
+
+	changes, err := NewChanges(oldRefs, newRefs)
 	if err != nil {
 		a.updateFailed(r, model.Pending)
 		return ErrChanges.Wrap(err)
 	}
 
+	res.Changed = len(changes) > 0
 	logger.With(log.Fields{"roots": len(changes)}).Debugf("changes obtained")
-	if err := a.pushChangesToRootedRepositories(ctx, logger, j, r, gr, changes, now); err != nil {
+	res.Inits, err = a.pushChangesToRootedRepositories(ctx, logger, j, r, gr, changes, now)
+	if err != nil {
 		r.FetchErrorAt = now
 		a.updateFailed(r, model.Pending)
 		return ErrProcessedWithErrors.Wrap(err)
@@ -244,6 +363,46 @@ func (a *Archiver) doPush(
 	return nil
 }
 
+// refPolicy returns the RefPolicy used to process the given job.
+func (a *Archiver) refPolicy(j *Job) *RefPolicy {
+	if j.RefPolicy != nil {
+		return j.RefPolicy
+	}
+
+	return a.RefPolicy
+}
+
+// forcedReferencers returns Referencers that make all the new references be
+// created again. Only the old references that do not exist anymore are kept,
+// so they are still deleted.
+func forcedReferencers(old, new Referencer) (Referencer, Referencer, error) {
+	newRefs, err := new.References()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	oldRefs, err := old.References()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make(map[string]bool, len(newRefs))
+	for _, ref := range newRefs {
+		names[ref.Name] = true
+	}
+
+	var deleted []*model.Reference
+	for _, ref := range oldRefs {
+		if !names[ref.Name] {
+			deleted = append(deleted, ref)
+		}
+	}
+
+	return NewModelReferencer(&model.Repository{References: deleted}),
+		NewModelReferencer(&model.Repository{References: newRefs}),
+		nil
+}
+
 func (a *Archiver) updateFailed(r *model.Repository, s model.FetchStatus) {
 	if err := a.Store.UpdateFailed(r, s); err != nil {
 		log.With(log.Fields{"job": r.ID}).Errorf(err, "error setting repository as failed")
@@ -258,6 +417,8 @@ func (a *Archiver) reportMetrics(r *model.Repository, now time.Time) {
 		metrics.RepoNotFound()
 	case model.AuthRequired:
 		metrics.RepoAuthRequired()
+	case Blocked:
+		metrics.RepoBlocked()
 	default:
 		metrics.RepoFailed()
 	}
@@ -276,17 +437,81 @@ func (a *Archiver) recoverDo(logger log.Logger, r *model.Repository, now *time.T
 	*err = ErrFatal.New(rcv, debug.Stack())
 }
 
-func (a *Archiver) isProcessableRepository(r *model.Repository, now *time.Time) error {
+func (a *Archiver) isProcessableRepository(
+	logger log.Logger,
+	r *model.Repository,
+	now *time.Time,
+) error {
 	if r.Status != model.Fetching {
 		return nil
 	}
 
+	if a.DistributedLeases {
+		logger.Warningf("repository left in fetching status by a lost lease, processing it again")
+		return nil
+	}
+
 	r.FetchErrorAt = now
 	a.updateFailed(r, model.Pending)
 
 	return ErrAlreadyFetching.New(r.ID)
 }
 
+// acquireLease takes the lease of the job repository. It returns
+// ErrAlreadyFetching if the lease is held by someone else. The returned
+// channel is closed when the lease is lost.
+func (a *Archiver) acquireLease(j *Job) (lock.Locker, <-chan struct{}, error) {
+	session := a.LeaseSession
+	if session == nil {
+		session = a.LockSession
+	}
+
+	lease := session.NewLocker(RepositoryLeaseID(kallax.ULID(j.RepositoryID)))
+	lost, err := lease.Lock()
+	if lock.ErrCanceled.Is(err) {
+		return nil, nil, ErrAlreadyFetching.New(j.RepositoryID)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return lease, lost, nil
+}
+
+func (a *Archiver) releaseLease(logger log.Logger, lease lock.Locker) {
+	if err := lease.Unlock(); err != nil {
+		logger.Errorf(err, "failed to release repository lease")
+	}
+}
+
+// isBlocked checks the endpoints of the job against the blocklist. The
+// repository is set to Blocked if any of them is blocked.
+func (a *Archiver) isBlocked(
+	logger log.Logger, j *Job, r *model.Repository,
+) (bool, error) {
+	endpoints := r.Endpoints
+	if j.Endpoint != "" {
+		endpoints = append([]string{j.Endpoint}, endpoints...)
+	}
+
+	err := a.Blocklist.Check(endpoints...)
+	if err == nil {
+		return false, nil
+	}
+
+	if !ErrEndpointBlocked.Is(err) {
+		return false, err
+	}
+
+	logger.Warningf("repository not fetched: %s", err)
+	if err := a.Store.SetStatus(r, Blocked); err != nil {
+		return true, ErrSetStatus.Wrap(err, Blocked)
+	}
+
+	return true, nil
+}
+
 func (a *Archiver) getRepositoryModel(j *Job) (*model.Repository, error) {
 	r, err := a.Store.Get(kallax.ULID(j.RepositoryID))
 	if err != nil {
@@ -322,13 +547,19 @@ func (a *Archiver) pushChangesToRootedRepositories(
 	tr TemporaryRepository,
 	changes Changes,
 	now *time.Time,
-) error {
-	fp, err := a.useFastpath(logger, changes, tr)
-	if err != nil {
-		return err
+) ([]model.SHA1, error) {
+	// the fastpath copies every reference of the temporary repository, so it
+	// cannot be used when the references are selected by a policy.
+	var fp bool
+	if a.refPolicy(j) == nil {
+		var err error
+		fp, err = a.useFastpath(logger, changes, tr)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	var failedInits []model.SHA1
+	var pushedInits, failedInits []model.SHA1
 	for ic, cs := range changes {
 		done := make(chan struct{})
 		sessionDone := a.LockSession.Done()
@@ -336,7 +567,7 @@ func (a *Archiver) pushChangesToRootedRepositories(
 		go func(ic model.SHA1, cs []*Command) {
 			defer close(done)
 			logger = logger.New(log.Fields{"root": ic.String()})
-			lock := a.LockSession.NewLocker(fmt.Sprintf("borges/%s", ic.String()))
+			lock := a.LockSession.NewLocker(RootedLockID(ic))
 			ch, err := lock.Lock()
 			if err != nil {
 				failedInits = append(failedInits, ic)
@@ -364,6 +595,7 @@ func (a *Archiver) pushChangesToRootedRepositories(
 			}
 
 			logger.Debugf("push changes to rooted repository finished")
+			pushedInits = append(pushedInits, ic)
 			r.References = updateRepositoryReferences(r.References, cs, ic)
 			for _, ref := range r.References {
 				ref.Repository = r
@@ -396,13 +628,13 @@ func (a *Archiver) pushChangesToRootedRepositories(
 	if len(failedInits) == 0 {
 		if err := a.Store.UpdateFetched(r, *now); err != nil {
 			logger.Errorf(err, "error updating repository in database")
-			return err
+			return pushedInits, err
 		}
 	}
 
 	logger.Debugf("update repository references finished")
 
-	return checkFailedInits(changes, failedInits)
+	return pushedInits, checkFailedInits(changes, failedInits)
 }
 
 // checkEmptySiva check if the siva file contains references if it is
@@ -671,17 +903,26 @@ func checkFailedInits(changes Changes, failed []model.SHA1) error {
 }
 
 // NewArchiverWorkerPool creates a new WorkerPool that uses an Archiver to
-// process jobs. It takes optional start, stop and warn notifier functions that
-// are equal to the Archiver notifiers but with additional WorkerContext.
+// process jobs. The given notifiers and blocklist are set in every Archiver.
+// The rooted repositories are locked through ls and the repositories are
+// leased through leasing, or ls if it is nil. All the jobs of the pool share
+// the same lease session.
 func NewArchiverWorkerPool(
 	r RepositoryStore, tx repository.RootedTransactioner,
 	tc TemporaryCloner,
 	ls lock.Service,
+	leasing lock.Service,
 	timeout time.Duration,
 	lockingTimeout time.Duration,
 	copier *repository.Copier,
+	notifiers ArchiverNotifiers,
+	blocklist *Blocklist,
 ) *WorkerPool {
+	if leasing == nil {
+		leasing = ls
+	}
 
+	leases := &sharedSession{ls: leasing}
 	do := func(ctx context.Context, logger log.Logger, j *Job) error {
 		lsess, err := ls.NewSession(&lock.SessionConfig{
 			TTL:     10 * time.Second,
@@ -698,9 +939,70 @@ func NewArchiverWorkerPool(
 			}
 		}()
 
+		leaseSess, err := leases.get()
+		if err != nil {
+			return err
+		}
+
 		a := NewArchiver(r, tx, tc, lsess, timeout, copier)
+		a.LeaseSession = leaseSess
+		a.DistributedLeases = lock.IsDistributed(leasing)
+		a.Notifiers = notifiers
+		a.Blocklist = blocklist
 		return a.Do(ctx, j)
 	}
 
-	return NewWorkerPool(do)
+	wp := NewWorkerPool(do)
+	wp.close = leases.close
+	return wp
+}
+
+// sharedSession is a lease session shared by the jobs of a worker pool. It
+// is created when it is first needed and again if it expires.
+type sharedSession struct {
+	ls      lock.Service
+	mu      sync.Mutex
+	session lock.Session
+}
+
+func (s *sharedSession) get() (lock.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.session != nil {
+		select {
+		case <-s.session.Done():
+			log.Warningf("lease session expired, creating a new one")
+			if err := s.session.Close(); err != nil {
+				log.Errorf(err, "error closing lease session")
+			}
+
+			s.session = nil
+		default:
+			return s.session, nil
+		}
+	}
+
+	session, err := NewLeaseSession(s.ls)
+	if err != nil {
+		return nil, err
+	}
+
+	s.session = session
+	return session, nil
+}
+
+func (s *sharedSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.session == nil {
+		return
+	}
+
+	if err := s.session.Close(); err != nil {
+		log.Errorf(err, "error closing lease session")
+	}
+
+	s.session = nil
 }
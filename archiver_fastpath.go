@@ -16,19 +16,29 @@ import (
 	"gopkg.in/src-d/go-billy.v4/util"
 	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
 	kallax "gopkg.in/src-d/go-kallax.v1"
 	log "gopkg.in/src-d/go-log.v1"
 )
 
 // useFast path check if there is only one rooted repository and no previous
 // references using it. Also verifies that we can use filesystem and path
-// parameters from the temporary repository.
+// parameters from the temporary repository, or the objects of the local
+// repository when it was opened in place.
 func (a *Archiver) useFastpath(
 	l log.Logger,
 	c Changes,
 	t TemporaryRepository,
 ) (bool, error) {
-	_, ok := t.(*temporaryRepository)
+	var ok bool
+	switch t := t.(type) {
+	case *temporaryRepository:
+		ok = true
+	case *localRepository:
+		ok = !t.hasAlternates()
+	}
+
 	if ok && len(c) == 1 {
 		for k := range c {
 			refs, err := a.Store.InitHasRefs(k)
@@ -60,30 +70,39 @@ func (a *Archiver) fastpathRootedRepository(
 
 	logger.Debugf("using fastpath to create siva file")
 
-	t, ok := tr.(*temporaryRepository)
-	if !ok {
-		return fmt.Errorf("internal error, not a temporaryRepository")
-	}
+	var fill func(billy.Filesystem) error
+	switch t := tr.(type) {
+	case *temporaryRepository:
+		repo := t.Repository
 
-	repo := t.Repository
+		err := renameReferences(repo, r.ID)
+		if err != nil {
+			return err
+		}
 
-	err := renameReferences(repo, r.ID)
-	if err != nil {
-		return err
-	}
+		err = StoreConfig(repo, r)
+		if err != nil {
+			return err
+		}
 
-	err = StoreConfig(repo, r)
-	if err != nil {
-		return err
-	}
+		err = repo.DeleteRemote("origin")
+		if err != nil {
+			return err
+		}
 
-	err = repo.DeleteRemote("origin")
-	if err != nil {
-		return err
+		fill = func(fs billy.Filesystem) error {
+			return RecursiveCopy("/", fs, t.TempPath, t.TempFilesystem)
+		}
+	case *localRepository:
+		fill = func(fs billy.Filesystem) error {
+			return fillFromLocal(fs, t, r)
+		}
+	default:
+		return fmt.Errorf("internal error, not a temporaryRepository")
 	}
 
 	rootedRepoCpStart := time.Now()
-	err = copySivaToRemote(ctx, a, ic, t)
+	err := copySivaToRemote(ctx, a, ic, fill)
 	if err != nil {
 		logger.With(log.Fields{
 			"duration": time.Since(rootedRepoCpStart),
@@ -106,6 +125,26 @@ func rootedRefName(
 	return plumbing.ReferenceName(n)
 }
 
+// rootedReference returns the reference renamed to be stored in the rooted
+// repository of the repository with the given id, or nil if it is not stored.
+func rootedReference(ref *plumbing.Reference, id kallax.ULID) *plumbing.Reference {
+	if !strings.HasPrefix(string(ref.Name()), "refs/") {
+		return nil
+	}
+
+	name := rootedRefName(ref.Name(), id)
+
+	switch ref.Type() {
+	case plumbing.HashReference:
+		return plumbing.NewHashReference(name, ref.Hash())
+	case plumbing.SymbolicReference:
+		target := rootedRefName(ref.Target(), id)
+		return plumbing.NewSymbolicReference(name, target)
+	default:
+		return nil
+	}
+}
+
 func renameReferences(repo *git.Repository, id kallax.ULID) error {
 	it, err := repo.References()
 	if err != nil {
@@ -116,20 +155,8 @@ func renameReferences(repo *git.Repository, id kallax.ULID) error {
 	var add []*plumbing.Reference
 	var del []plumbing.ReferenceName
 	err = it.ForEach(func(ref *plumbing.Reference) error {
-		if !strings.HasPrefix(string(ref.Name()), "refs/") {
-			return nil
-		}
-
-		name := rootedRefName(ref.Name(), id)
-
-		var newRef *plumbing.Reference
-		switch ref.Type() {
-		case plumbing.HashReference:
-			newRef = plumbing.NewHashReference(name, ref.Hash())
-		case plumbing.SymbolicReference:
-			target := rootedRefName(ref.Target(), id)
-			newRef = plumbing.NewSymbolicReference(name, target)
-		default:
+		newRef := rootedReference(ref, id)
+		if newRef == nil {
 			return nil
 		}
 
@@ -159,11 +186,52 @@ func renameReferences(repo *git.Repository, id kallax.ULID) error {
 	return nil
 }
 
+// fillFromLocal creates in fs a repository with the objects of the local
+// repository and its references renamed for the rooted repository. The local
+// repository is not modified.
+func fillFromLocal(
+	fs billy.Filesystem,
+	l *localRepository,
+	r *model.Repository,
+) error {
+	repo, err := git.Init(filesystem.NewStorage(fs, cache.NewObjectLRUDefault()), nil)
+	if err != nil {
+		return err
+	}
+
+	err = RecursiveCopy("objects", fs, "objects", l.Filesystem)
+	if err != nil {
+		return err
+	}
+
+	it, err := l.Repository.References()
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	err = it.ForEach(func(ref *plumbing.Reference) error {
+		newRef := rootedReference(ref, r.ID)
+		if newRef == nil {
+			return nil
+		}
+
+		return repo.Storer.SetReference(newRef)
+	})
+	if err != nil {
+		return err
+	}
+
+	return StoreConfig(repo, r)
+}
+
+// copySivaToRemote creates a siva file for the rooted repository ic with the
+// contents written by fill and copies it to the remote filesystem.
 func copySivaToRemote(
 	ctx context.Context,
 	a *Archiver,
 	ic model.SHA1,
-	t *temporaryRepository,
+	fill func(billy.Filesystem) error,
 ) error {
 	local := a.Copier.Local()
 	origPath := fmt.Sprintf("%s.siva", ic.String())
@@ -186,7 +254,7 @@ func copySivaToRemote(
 		return err
 	}
 
-	err = RecursiveCopy("/", fs, t.TempPath, t.TempFilesystem)
+	err = fill(fs)
 	if err != nil {
 		return err
 	}
@@ -196,7 +264,19 @@ func copySivaToRemote(
 		return err
 	}
 
-	return a.Copier.CopyToRemote(ctx, localSivaPath, origPath)
+	// the siva file is replaced, so a stale copy cannot be left in the cold
+	// tier to be thawed over it later.
+	tiers := rootedTiers(a.RootedTransactioner)
+	if err := tiers.Thaw(ctx, ic); err != nil {
+		return err
+	}
+
+	if err := a.Copier.CopyToRemote(ctx, localSivaPath, origPath); err != nil {
+		return err
+	}
+
+	tiers.recordWritten(ic)
+	return nil
 }
 
 // RecursiveCopy copies a directory to a destination path. It creates all
@@ -30,6 +30,7 @@ import (
 	"gopkg.in/src-d/go-git.v4/storage/filesystem"
 	"gopkg.in/src-d/go-git.v4/storage/memory"
 	kallax "gopkg.in/src-d/go-kallax.v1"
+	log "gopkg.in/src-d/go-log.v1"
 )
 
 func TestArchiver(t *testing.T) {
@@ -48,6 +49,7 @@ type ArchiverSuite struct {
 	txFs     billy.Filesystem
 	tmpFs    billy.Filesystem
 	rootedFs billy.Filesystem
+	locking  lock.Service
 	a        *Archiver
 	bucket   int
 }
@@ -81,13 +83,16 @@ func (s *ArchiverSuite) SetupTest() {
 		s.bucket)
 	s.tx = repository.NewSivaRootedTransactioner(s.copier)
 
-	ls, err := lock.NewLocal().NewSession(&lock.SessionConfig{
+	s.locking = lock.NewLocal()
+	ls, err := s.locking.NewSession(&lock.SessionConfig{
 		Timeout: defaultTimeout,
 	})
 	s.NoError(err)
 
 	s.a = NewArchiver(s.store, s.tx, NewTemporaryCloner(s.tmpFs),
 		ls, defaultTimeout, s.copier)
+	s.a.LeaseSession, err = NewLeaseSession(s.locking)
+	s.NoError(err)
 }
 
 func (s *ArchiverSuite) TearDownTest() {
@@ -345,6 +350,32 @@ func (s *ArchiverSuite) TestProcessingRepository() {
 	_, err = s.rawStore.Save(repo)
 	s.NoError(err)
 
+	// another worker holds the lease of the repository
+	session, err := NewLeaseSession(s.locking)
+	s.NoError(err)
+	lease := session.NewLocker(RepositoryLeaseID(rid))
+	_, err = lease.Lock()
+	s.NoError(err)
+	defer lease.Unlock()
+
+	err = s.a.Do(context.TODO(), &Job{RepositoryID: uuid.UUID(rid)})
+	s.True(ErrAlreadyFetching.Is(err))
+
+	mr, err := s.rawStore.FindOne(model.NewRepositoryQuery().FindByID(rid))
+	s.NoError(err)
+
+	s.Equal(model.Fetching, mr.Status)
+}
+
+func (s *ArchiverSuite) TestProcessingRepositoryLocalLeases() {
+	rid := s.newRepositoryModel("git://foo.bar.baz")
+	repo, err := s.rawStore.FindOne(model.NewRepositoryQuery().FindByID(rid))
+	s.NoError(err)
+	repo.Status = model.Fetching
+	_, err = s.rawStore.Save(repo)
+	s.NoError(err)
+
+	// local leases do not see the workers of other processes
 	err = s.a.Do(context.TODO(), &Job{RepositoryID: uuid.UUID(rid)})
 	s.True(ErrAlreadyFetching.Is(err))
 
@@ -354,6 +385,94 @@ func (s *ArchiverSuite) TestProcessingRepository() {
 	s.Equal(model.Pending, mr.Status)
 }
 
+func (s *ArchiverSuite) TestRefPolicy() {
+	require := s.Require()
+
+	path := fixtures.ByTag("worktree").One().Worktree().Root()
+	rid := s.newRepositoryModel(path)
+
+	err := s.a.Do(context.TODO(), &Job{
+		RepositoryID: uuid.UUID(rid),
+		RefPolicy:    &RefPolicy{Include: []string{"refs/heads/master"}},
+	})
+	require.NoError(err)
+
+	mr, err := s.rawStore.FindOne(
+		model.NewRepositoryQuery().FindByID(rid).WithReferences(nil),
+	)
+	require.NoError(err)
+	require.Equal(model.Fetched, mr.Status)
+	require.Len(mr.References, 1)
+	require.Equal("refs/heads/master", mr.References[0].Name)
+}
+
+func (s *ArchiverSuite) TestJobEndpoint() {
+	require := s.Require()
+
+	path := fixtures.ByTag("worktree").One().Worktree().Root()
+	rid := s.newRepositoryModel("git://foo.invalid/bar")
+
+	err := s.a.Do(context.TODO(), &Job{
+		RepositoryID:  uuid.UUID(rid),
+		Endpoint:      path,
+		CorrelationID: "foo",
+	})
+	require.NoError(err)
+
+	mr, err := s.rawStore.FindOne(
+		model.NewRepositoryQuery().FindByID(rid).WithReferences(nil),
+	)
+	require.NoError(err)
+	require.Equal(model.Fetched, mr.Status)
+	require.Equal([]string{"git://foo.invalid/bar"}, mr.Endpoints)
+	require.NotEmpty(mr.References)
+}
+
+func (s *ArchiverSuite) TestJobForce() {
+	require := s.Require()
+
+	path := fixtures.ByTag("worktree").One().Worktree().Root()
+	rid := s.newRepositoryModel(path)
+
+	require.NoError(s.a.Do(context.TODO(), &Job{RepositoryID: uuid.UUID(rid)}))
+
+	mr, err := s.rawStore.FindOne(
+		model.NewRepositoryQuery().FindByID(rid).WithReferences(nil),
+	)
+	require.NoError(err)
+	refs := mr.References
+
+	var results []*JobResult
+	s.a.Notifiers.Done = func(j *Job, res *JobResult) {
+		results = append(results, res)
+	}
+	defer func() { s.a.Notifiers.Done = nil }()
+
+	err = s.a.Do(context.TODO(), &Job{RepositoryID: uuid.UUID(rid), Force: true})
+	require.NoError(err)
+	require.Len(results, 1)
+	require.True(results[0].Changed)
+	require.NotEmpty(results[0].Inits)
+
+	mr, err = s.rawStore.FindOne(
+		model.NewRepositoryQuery().FindByID(rid).WithReferences(nil),
+	)
+	require.NoError(err)
+	require.Equal(model.Fetched, mr.Status)
+	checkReferencesInDB(s.T(), mr, refs)
+}
+
+func (s *ArchiverSuite) TestJobTimeout() {
+	path := fixtures.ByTag("worktree").One().Worktree().Root()
+	rid := s.newRepositoryModel(path)
+
+	err := s.a.Do(context.TODO(), &Job{
+		RepositoryID: uuid.UUID(rid),
+		Timeout:      time.Nanosecond,
+	})
+	s.Error(err)
+}
+
 func (s *ArchiverSuite) newRepositoryModel(endpoint string) kallax.ULID {
 	mr := model.NewRepository()
 	mr.Endpoints = append(mr.Endpoints, endpoint)
@@ -441,12 +560,81 @@ func (s *ArchiverSuite) TestIsProcessableRepository() {
 	s.NoError(s.store.SetStatus(modelRepo, model.Fetching))
 
 	// the repo can't be processed
-	s.Error(s.a.isProcessableRepository(modelRepo, &now))
+	s.Error(s.a.isProcessableRepository(log.New(nil), modelRepo, &now))
 
 	// the status after the error must be 'pending'
 	s.Assertions.True(modelRepo.Status == model.Pending)
 }
 
+func (s *ArchiverSuite) TestExpiredLeaseRepository() {
+	const endpoint = "file:///this/repository/does/not/exists"
+	var (
+		endpoints = []string{endpoint}
+		isFork    = false
+	)
+
+	id, err := RepositoryID(endpoints, &isFork, s.store)
+	s.NoError(err)
+
+	modelRepos, err := s.store.GetByEndpoints(endpoint)
+	s.NoError(err)
+	s.Assertions.True(len(modelRepos) == 1)
+
+	modelRepo := modelRepos[0]
+	s.Assertions.True(modelRepo.Status == model.Pending)
+
+	// simulate a repository left in fetching status by a crashed consumer
+	s.NoError(s.store.SetStatus(modelRepo, model.Fetching))
+
+	// nobody holds the lease, so the repository is processed again
+	s.a.DistributedLeases = true
+	defer func() { s.a.DistributedLeases = false }()
+	s.NoError(s.a.Do(context.TODO(), &Job{RepositoryID: id}))
+
+	mr, err := s.rawStore.FindOne(model.NewRepositoryQuery().FindByID(modelRepo.ID))
+	s.NoError(err)
+	s.Equal(model.NotFound, mr.Status)
+}
+
+func (s *ArchiverSuite) TestDatabaseLeaseRepository() {
+	require := s.Require()
+
+	rid := s.newRepositoryModel("file:///this/repository/does/not/exists")
+	repo, err := s.rawStore.FindOne(model.NewRepositoryQuery().FindByID(rid))
+	require.NoError(err)
+	repo.Status = model.Fetching
+	_, err = s.rawStore.Save(repo)
+	require.NoError(err)
+
+	leasing := storage.FromDatabase(s.DB).LeaseService()
+	defer leasing.Close()
+
+	a := NewArchiver(s.store, s.tx, NewTemporaryCloner(s.tmpFs),
+		s.a.LockSession, defaultTimeout, s.copier)
+	a.LeaseSession, err = NewLeaseSession(leasing)
+	require.NoError(err)
+	defer a.LeaseSession.Close()
+	a.DistributedLeases = lock.IsDistributed(leasing)
+
+	// another consumer process holds the lease of the repository
+	session, err := NewLeaseSession(leasing)
+	require.NoError(err)
+	lease := session.NewLocker(RepositoryLeaseID(rid))
+	_, err = lease.Lock()
+	require.NoError(err)
+
+	err = a.Do(context.TODO(), &Job{RepositoryID: uuid.UUID(rid)})
+	require.True(ErrAlreadyFetching.Is(err))
+
+	// the consumer process crashed, so its lease expires
+	require.NoError(session.Close())
+	require.NoError(a.Do(context.TODO(), &Job{RepositoryID: uuid.UUID(rid)}))
+
+	mr, err := s.rawStore.FindOne(model.NewRepositoryQuery().FindByID(rid))
+	require.NoError(err)
+	require.Equal(model.NotFound, mr.Status)
+}
+
 func customArchiver(
 	t *testing.T,
 	rootedFs, txFs, tmpFs billy.Filesystem,
@@ -712,3 +900,75 @@ func (fs *BrokenFile) Write(p []byte) (int, error) {
 
 	return fs.File.Write(p)
 }
+
+func TestForcedReferencers(t *testing.T) {
+	require := require.New(t)
+
+	ref := func(name string) *model.Reference {
+		return &model.Reference{Name: name}
+	}
+
+	oldRefs := NewModelReferencer(&model.Repository{
+		References: []*model.Reference{ref("refs/heads/master"), ref("refs/heads/foo")},
+	})
+	newRefs := NewModelReferencer(&model.Repository{
+		References: []*model.Reference{ref("refs/heads/master"), ref("refs/heads/bar")},
+	})
+
+	oldRefs, newRefs, err := forcedReferencers(oldRefs, newRefs)
+	require.NoError(err)
+
+	refs, err := oldRefs.References()
+	require.NoError(err)
+	require.Equal([]*model.Reference{ref("refs/heads/foo")}, refs)
+
+	refs, err = newRefs.References()
+	require.NoError(err)
+	require.Len(refs, 2)
+}
+
+func TestArchiverWorkerPoolSharesLeaseSession(t *testing.T) {
+	require := require.New(t)
+
+	leasing := &countingService{Service: lock.NewLocal()}
+	wp := NewArchiverWorkerPool(
+		storage.Local(), nil, nil, lock.NewLocal(), leasing,
+		defaultTimeout, defaultTimeout, nil, ArchiverNotifiers{}, nil,
+	)
+
+	for i := 0; i < 3; i++ {
+		// the repository does not exist, so the job fails after the lease
+		err := wp.do(context.TODO(), log.New(nil), &Job{RepositoryID: uuid.UUID(kallax.NewULID())})
+		require.Error(err)
+	}
+
+	require.Equal(1, leasing.sessions)
+	require.NoError(wp.Close())
+	require.Equal(1, leasing.closed)
+}
+
+type countingService struct {
+	lock.Service
+	sessions int
+	closed   int
+}
+
+func (s *countingService) NewSession(cfg *lock.SessionConfig) (lock.Session, error) {
+	session, err := s.Service.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sessions++
+	return &countingSession{Session: session, srv: s}, nil
+}
+
+type countingSession struct {
+	lock.Session
+	srv *countingService
+}
+
+func (s *countingSession) Close() error {
+	s.srv.closed++
+	return s.Session.Close()
+}
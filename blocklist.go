@@ -0,0 +1,176 @@
+package borges
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	bstorage "github.com/src-d/borges/storage"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// Blocked is the status of the repositories that were not fetched because
+// their endpoints are in the blocklist.
+const Blocked model.FetchStatus = "blocked"
+
+// ErrEndpointBlocked is returned when an endpoint matches a rule of the
+// blocklist.
+var ErrEndpointBlocked = errors.NewKind("endpoint %s is blocked by %s rule %q")
+
+// BlocklistSource is the storage of the blocklist rules.
+type BlocklistSource interface {
+	// GetBlocklist returns all the rules of the blocklist.
+	GetBlocklist() ([]*bstorage.BlockRule, error)
+}
+
+// BlocklistJobIter is a JobIter that does not return jobs for the endpoints
+// blocked by a Blocklist.
+type BlocklistJobIter interface {
+	JobIter
+	// SetBlocklist sets the blocklist checked before the repository of
+	// every endpoint is found or created.
+	SetBlocklist(b *Blocklist)
+}
+
+// Blocklist checks endpoints against the rules of a BlocklistSource. The
+// rules are loaded again when they are older than the refresh interval, so
+// the changes are applied without restarting the producers and consumers.
+// Blocklist instances are thread-safe. A nil *Blocklist blocks nothing.
+type Blocklist struct {
+	source  BlocklistSource
+	refresh time.Duration
+
+	mu       sync.Mutex
+	rules    []*blockMatcher
+	loadedAt time.Time
+}
+
+type blockMatcher struct {
+	*bstorage.BlockRule
+	re *regexp.Regexp
+}
+
+// NewBlocklist returns a Blocklist with the rules of the given source, loaded
+// again every refresh interval. They are never loaded again if refresh is 0.
+func NewBlocklist(source BlocklistSource, refresh time.Duration) *Blocklist {
+	return &Blocklist{source: source, refresh: refresh}
+}
+
+// Reload loads the rules from the source. The previous rules are kept if they
+// cannot be loaded.
+func (b *Blocklist) Reload() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reload()
+}
+
+func (b *Blocklist) reload() error {
+	rules, err := b.source.GetBlocklist()
+	if err != nil {
+		return err
+	}
+
+	var matchers []*blockMatcher
+	for _, r := range rules {
+		m := &blockMatcher{BlockRule: r}
+		if r.Kind == bstorage.BlockPattern {
+			m.re, err = regexp.Compile(r.Value)
+			if err != nil {
+				log.With(log.Fields{
+					"id":      r.ID,
+					"pattern": r.Value,
+				}).Errorf(err, "invalid blocklist pattern, rule ignored")
+				continue
+			}
+		}
+
+		matchers = append(matchers, m)
+	}
+
+	b.rules = matchers
+	b.loadedAt = time.Now()
+	log.With(log.Fields{"rules": len(matchers)}).Debugf("blocklist loaded")
+	return nil
+}
+
+// Check returns ErrEndpointBlocked if any of the endpoints matches a rule.
+// The endpoints are matched in their canonical form, patterns are also
+// matched against the original endpoints. It only returns other errors if
+// the rules cannot be loaded the first time, afterwards the errors are logged
+// and the previous rules are used.
+func (b *Blocklist) Check(endpoints ...string) error {
+	if b == nil {
+		return nil
+	}
+
+	rules, err := b.getRules()
+	if err != nil {
+		return err
+	}
+
+	for _, ep := range endpoints {
+		canonical := DefaultCanonicalizer.Canonicalize(ep)
+		for _, r := range rules {
+			if r.match(canonical) || (canonical != ep && r.match(ep)) {
+				return ErrEndpointBlocked.New(ep, r.Kind, r.Value)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *Blocklist) getRules() ([]*blockMatcher, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.loadedAt.IsZero() {
+		if err := b.reload(); err != nil {
+			return nil, err
+		}
+	} else if b.refresh > 0 && time.Since(b.loadedAt) > b.refresh {
+		if err := b.reload(); err != nil {
+			log.Errorf(err, "could not reload blocklist, using the previous rules")
+		}
+	}
+
+	return b.rules, nil
+}
+
+func (m *blockMatcher) match(endpoint string) bool {
+	switch m.Kind {
+	case bstorage.BlockPattern:
+		return m.re.MatchString(endpoint)
+	case bstorage.BlockHost:
+		host, _ := endpointHostPath(endpoint)
+		value := strings.ToLower(m.Value)
+		return host != "" && (host == value || strings.HasSuffix(host, "."+value))
+	case bstorage.BlockOrganization:
+		host, path := endpointHostPath(endpoint)
+		if host == "" {
+			return false
+		}
+
+		org := strings.SplitN(path, "/", 2)[0]
+		return org != "" && strings.EqualFold(host+"/"+org, strings.Trim(m.Value, "/"))
+	default:
+		return false
+	}
+}
+
+// endpointHostPath returns the lowercased host name of an endpoint and its
+// path without the leading slash. The host is empty if the endpoint is not an
+// absolute URL.
+func endpointHostPath(endpoint string) (string, string) {
+	u, err := url.Parse(endpoint)
+	if err != nil || !u.IsAbs() {
+		return "", ""
+	}
+
+	return strings.ToLower(u.Hostname()), strings.TrimPrefix(u.Path, "/")
+}
@@ -0,0 +1,196 @@
+package borges
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/src-d/borges/lock"
+	"github.com/src-d/borges/storage"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+type memoryBlocklist struct {
+	rules []*storage.BlockRule
+	err   error
+	loads int
+}
+
+func (b *memoryBlocklist) GetBlocklist() ([]*storage.BlockRule, error) {
+	b.loads++
+	return b.rules, b.err
+}
+
+func newTestBlocklist(refresh time.Duration, rules ...string) (*Blocklist, *memoryBlocklist) {
+	source := new(memoryBlocklist)
+	for i := 0; i+1 < len(rules); i += 2 {
+		source.rules = append(source.rules, &storage.BlockRule{
+			Kind:  storage.BlockKind(rules[i]),
+			Value: rules[i+1],
+		})
+	}
+
+	return NewBlocklist(source, refresh), source
+}
+
+func TestBlocklistCheck(t *testing.T) {
+	require := require.New(t)
+
+	b, _ := newTestBlocklist(0,
+		"host", "example.com",
+		"organization", "github.com/Blocked",
+		"pattern", `^https://gitlab\.com/.*/secret$`,
+		"pattern", `(invalid`,
+	)
+
+	blocked := []string{
+		"git://example.com/foo/bar",
+		"https://git.example.com/foo",
+		"https://github.com/blocked/repo",
+		"git://github.com/BLOCKED/other.git",
+		"https://gitlab.com/foo/bar/secret",
+	}
+
+	for _, ep := range blocked {
+		err := b.Check(ep)
+		require.True(ErrEndpointBlocked.Is(err), ep)
+	}
+
+	allowed := []string{
+		"git://notexample.com/foo/bar",
+		"https://github.com/src-d/borges",
+		"https://github.com/blockedtoo/repo",
+		"https://example.org/example.com",
+		"https://gitlab.com/foo/bar/secrets",
+		"/path/to/repo",
+	}
+
+	for _, ep := range allowed {
+		require.NoError(b.Check(ep), ep)
+	}
+
+	require.NoError(b.Check(allowed...))
+	require.True(ErrEndpointBlocked.Is(b.Check(append(allowed, blocked[0])...)))
+
+	var nilBlocklist *Blocklist
+	require.NoError(nilBlocklist.Check(blocked...))
+}
+
+func TestBlocklistRefresh(t *testing.T) {
+	require := require.New(t)
+
+	b, source := newTestBlocklist(time.Hour, "host", "example.com")
+	require.True(ErrEndpointBlocked.Is(b.Check("git://example.com/foo")))
+	require.Equal(1, source.loads)
+
+	source.rules = nil
+	require.True(ErrEndpointBlocked.Is(b.Check("git://example.com/foo")))
+	require.Equal(1, source.loads)
+
+	require.NoError(b.Reload())
+	require.NoError(b.Check("git://example.com/foo"))
+	require.Equal(2, source.loads)
+
+	b.refresh = time.Nanosecond
+	source.rules = []*storage.BlockRule{{Kind: storage.BlockHost, Value: "example.com"}}
+	time.Sleep(time.Millisecond)
+	require.True(ErrEndpointBlocked.Is(b.Check("git://example.com/foo")))
+
+	// the previous rules are kept if they cannot be reloaded
+	source.err = fmt.Errorf("database is down")
+	time.Sleep(time.Millisecond)
+	require.True(ErrEndpointBlocked.Is(b.Check("git://example.com/foo")))
+}
+
+func TestBlocklistLoadError(t *testing.T) {
+	b, source := newTestBlocklist(0)
+	source.err = fmt.Errorf("database is down")
+
+	err := b.Check("git://example.com/foo")
+	require.Error(t, err)
+	require.False(t, ErrEndpointBlocked.Is(err))
+}
+
+func TestLineJobIterBlocklist(t *testing.T) {
+	require := require.New(t)
+
+	text := "git://example.com/foo/bar\nhttps://github.com/src-d/borges\n"
+	store := storage.Local()
+	iter := NewLineJobIter(ioutil.NopCloser(strings.NewReader(text)), store)
+
+	b, _ := newTestBlocklist(0, "host", "example.com")
+	iter.(BlocklistJobIter).SetBlocklist(b)
+
+	_, err := iter.Next()
+	require.True(ErrEndpointBlocked.Is(err))
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.NotEqual(uuid.Nil, j.RepositoryID)
+
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+
+	repos, err := store.GetByEndpoints("git://example.com/foo/bar")
+	require.NoError(err)
+	require.Len(repos, 0)
+}
+
+func TestJSONLineJobIterBlocklist(t *testing.T) {
+	require := require.New(t)
+
+	text := `{"endpoint": "https://github.com/src-d/borges", "aliases": ["git://example.com/borges"]}
+{"endpoint": "https://github.com/src-d/go-git"}
+`
+	store := storage.Local()
+	iter := NewJSONLineJobIter(ioutil.NopCloser(strings.NewReader(text)), store)
+
+	b, _ := newTestBlocklist(0, "host", "example.com")
+	iter.(BlocklistJobIter).SetBlocklist(b)
+
+	_, err := iter.Next()
+	require.True(ErrEndpointBlocked.Is(err))
+
+	_, err = iter.Next()
+	require.NoError(err)
+
+	repos, err := store.GetByEndpoints("https://github.com/src-d/borges")
+	require.NoError(err)
+	require.Len(repos, 0)
+}
+
+func TestArchiverBlocklist(t *testing.T) {
+	require := require.New(t)
+
+	store := storage.Local()
+	r := model.NewRepository()
+	r.Endpoints = []string{"git://example.com/foo/bar"}
+	require.NoError(store.Create(r))
+
+	locking := lock.NewLocal()
+	session, err := locking.NewSession(&lock.SessionConfig{Timeout: time.Second})
+	require.NoError(err)
+
+	b, _ := newTestBlocklist(0, "host", "example.com")
+	a := NewArchiver(store, nil, nil, session, time.Minute, nil)
+	a.Blocklist = b
+
+	var result *JobResult
+	a.Notifiers.Done = func(j *Job, res *JobResult) { result = res }
+
+	require.NoError(a.Do(context.TODO(), &Job{RepositoryID: uuid.UUID(r.ID)}))
+	require.NotNil(result)
+	require.NoError(result.Err)
+	require.Empty(result.Endpoint)
+
+	r, err = store.Get(r.ID)
+	require.NoError(err)
+	require.Equal(Blocked, r.Status)
+}
@@ -0,0 +1,227 @@
+package borges
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Canonicalizer returns the canonical form of repository endpoints, so the
+// different URLs of the same repository are found as the same endpoint. The
+// canonical form is only used to look up repositories, it may not be
+// possible to fetch a repository from it, such as the https endpoint of a
+// private repository only reachable with ssh.
+type Canonicalizer interface {
+	// Canonicalize returns the canonical form of the endpoint. Endpoints
+	// that are not absolute URLs are returned as they are.
+	Canonicalize(endpoint string) string
+}
+
+// EndpointRule is a provider-specific rule to canonicalize the endpoints of
+// the repositories hosted in it.
+type EndpointRule struct {
+	// Hosts are the host names of the provider. The first one is used in
+	// the canonical endpoints.
+	Hosts []string
+	// Scheme is the scheme of the canonical endpoints, the original one is
+	// kept if empty.
+	Scheme string
+	// CaseInsensitive lowercases the paths of the endpoints.
+	CaseInsensitive bool
+	// TrimGitSuffix removes the .git suffix of the paths.
+	TrimGitSuffix bool
+	// PathSegments is the number of segments of the path that name the
+	// repository, the rest of them are removed. All of them are kept if 0.
+	PathSegments int
+}
+
+var (
+	// GitHubRule canonicalizes GitHub endpoints as
+	// https://github.com/<owner>/<repository>.
+	GitHubRule = &EndpointRule{
+		Hosts:           []string{"github.com", "www.github.com"},
+		Scheme:          "https",
+		CaseInsensitive: true,
+		TrimGitSuffix:   true,
+		PathSegments:    2,
+	}
+	// GitLabRule canonicalizes GitLab endpoints as
+	// https://gitlab.com/<group>/.../<repository>.
+	GitLabRule = &EndpointRule{
+		Hosts:           []string{"gitlab.com", "www.gitlab.com"},
+		Scheme:          "https",
+		CaseInsensitive: true,
+		TrimGitSuffix:   true,
+	}
+	// BitbucketRule canonicalizes Bitbucket endpoints as
+	// https://bitbucket.org/<owner>/<repository>.
+	BitbucketRule = &EndpointRule{
+		Hosts:           []string{"bitbucket.org", "www.bitbucket.org"},
+		Scheme:          "https",
+		CaseInsensitive: true,
+		TrimGitSuffix:   true,
+		PathSegments:    2,
+	}
+)
+
+// DefaultCanonicalizer is the Canonicalizer used by RepositoryID. It can be
+// replaced to use other rules.
+var DefaultCanonicalizer Canonicalizer = NewCanonicalizer(
+	GitHubRule,
+	GitLabRule,
+	BitbucketRule,
+)
+
+// NewCanonicalizer returns a Canonicalizer that applies the first of the
+// given rules matching the host of every endpoint. Besides, the scheme and
+// the host of all the URLs are lowercased, and the default ports and the
+// trailing slashes are removed. scp-like endpoints, such as
+// git@github.com:foo/bar.git, are only canonicalized by the rules, as their
+// paths are relative to the home directory of the user.
+func NewCanonicalizer(rules ...*EndpointRule) Canonicalizer {
+	return &ruleCanonicalizer{rules}
+}
+
+type ruleCanonicalizer struct {
+	rules []*EndpointRule
+}
+
+var (
+	scpLikeURL = regexp.MustCompile(`^(?:([^@/]+)@)?([^:/]+\.[^:/]+):([^/].*)$`)
+
+	defaultPorts = map[string]string{
+		"http":  "80",
+		"https": "443",
+		"git":   "9418",
+		"ssh":   "22",
+	}
+)
+
+func (c *ruleCanonicalizer) Canonicalize(endpoint string) string {
+	endpoint = strings.TrimSpace(endpoint)
+	if m := scpLikeURL.FindStringSubmatch(endpoint); m != nil &&
+		!strings.Contains(endpoint, "://") {
+		host := strings.ToLower(m[2])
+		rule := c.rule(host)
+		if rule == nil {
+			return endpoint
+		}
+
+		return rule.canonicalize(&url.URL{Scheme: "ssh", Host: host, Path: m[3]}).String()
+	}
+
+	raw := endpoint
+
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return endpoint
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme == "file" {
+		if u.Path != "" && u.Path != "/" {
+			u.Path = path.Clean(u.Path)
+		}
+
+		return u.String()
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host = host + ":" + port
+	}
+	u.Host = host
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	u.Fragment = ""
+
+	rule := c.rule(host)
+	if rule == nil {
+		return u.String()
+	}
+
+	return rule.canonicalize(u).String()
+}
+
+func (c *ruleCanonicalizer) rule(host string) *EndpointRule {
+	for _, r := range c.rules {
+		for _, h := range r.Hosts {
+			if h == host {
+				return r
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *EndpointRule) canonicalize(u *url.URL) *url.URL {
+	p := strings.Trim(u.Path, "/")
+	if r.PathSegments > 0 {
+		segments := strings.Split(p, "/")
+		if len(segments) > r.PathSegments {
+			segments = segments[:r.PathSegments]
+		}
+
+		p = strings.Join(segments, "/")
+	}
+
+	if r.TrimGitSuffix {
+		p = strings.TrimSuffix(p, ".git")
+	}
+
+	if r.CaseInsensitive {
+		p = strings.ToLower(p)
+	}
+
+	scheme := u.Scheme
+	if r.Scheme != "" {
+		scheme = r.Scheme
+	}
+
+	return &url.URL{
+		Scheme: scheme,
+		Host:   r.Hosts[0],
+		Path:   "/" + p,
+	}
+}
+
+// FetchEndpoints returns the endpoints a repository can be fetched from. The
+// canonical form of another of the endpoints is left out, as RepositoryID
+// stores it only to look the repository up, and it may not be reachable.
+func FetchEndpoints(c Canonicalizer, endpoints []string) []string {
+	canonical := make(map[string]bool, len(endpoints))
+	for _, e := range endpoints {
+		if ce := c.Canonicalize(e); ce != e {
+			canonical[ce] = true
+		}
+	}
+
+	var result []string
+	for _, e := range endpoints {
+		if !canonical[e] {
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
+
+// CanonicalEndpoints returns the canonical form of the given endpoints
+// without duplicates, keeping their order.
+func CanonicalEndpoints(c Canonicalizer, endpoints []string) []string {
+	var result []string
+	seen := make(map[string]bool, len(endpoints))
+	for _, e := range endpoints {
+		e = c.Canonicalize(e)
+		if seen[e] {
+			continue
+		}
+
+		seen[e] = true
+		result = append(result, e)
+	}
+
+	return result
+}
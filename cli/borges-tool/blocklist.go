@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"text/tabwriter"
+	"time"
+
+	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/storage"
+
+	"gopkg.in/src-d/go-cli.v0"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+)
+
+var blocklistCommandAdder = app.AddCommand(&blocklistCmd{})
+
+func init() {
+	blocklistCommandAdder.AddCommand(&blocklistAddCmd{})
+	blocklistCommandAdder.AddCommand(&blocklistRemoveCmd{})
+	blocklistCommandAdder.AddCommand(&blocklistListCmd{})
+}
+
+type blocklistCmd struct {
+	cli.PlainCommand `name:"blocklist" short-description:"manage the blocklist of endpoints that are not archived"`
+}
+
+type blocklistAddCmd struct {
+	cli.Command `name:"add" short-description:"add a rule to the blocklist"`
+	bcli.DatabaseOpts
+
+	Kind   string `long:"kind" default:"host" choice:"host" choice:"organization" choice:"pattern" description:"kind of the rule: a host and its subdomains, an organization as host/name, or a regular expression matched against the endpoints"`
+	Reason string `long:"reason" required:"yes" description:"reason to block the endpoints"`
+
+	blocklistAddArgs `positional-args:"true" required:"yes"`
+}
+
+type blocklistAddArgs struct {
+	Value string `positional-arg-name:"value" description:"host, organization or pattern blocked" required:"yes"`
+}
+
+func (c *blocklistAddCmd) Execute(args []string) error {
+	if storage.BlockKind(c.Kind) == storage.BlockPattern {
+		if _, err := regexp.Compile(c.Value); err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", c.Value, err)
+		}
+	}
+
+	store, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+
+	rule := &storage.BlockRule{
+		Kind:   storage.BlockKind(c.Kind),
+		Value:  c.Value,
+		Reason: c.Reason,
+	}
+
+	if err := store.AddBlockRule(rule); err != nil {
+		return err
+	}
+
+	fmt.Println(rule.ID)
+	return nil
+}
+
+type blocklistRemoveCmd struct {
+	cli.Command `name:"remove" short-description:"remove a rule from the blocklist"`
+	bcli.DatabaseOpts
+
+	blocklistRemoveArgs `positional-args:"true" required:"yes"`
+}
+
+type blocklistRemoveArgs struct {
+	ID string `positional-arg-name:"id" description:"id of the rule to remove" required:"yes"`
+}
+
+func (c *blocklistRemoveCmd) Execute(args []string) error {
+	id, err := kallax.NewULIDFromText(c.ID)
+	if err != nil {
+		return fmt.Errorf("invalid rule id %q: %s", c.ID, err)
+	}
+
+	store, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+
+	err = store.RemoveBlockRule(id)
+	if err == kallax.ErrNotFound {
+		return fmt.Errorf("rule %s not found", id)
+	}
+
+	return err
+}
+
+type blocklistListCmd struct {
+	cli.Command `name:"list" short-description:"list the rules of the blocklist"`
+	bcli.DatabaseOpts
+}
+
+func (c *blocklistListCmd) Execute(args []string) error {
+	store, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+
+	rules, err := store.GetBlocklist()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tVALUE\tCREATED\tREASON")
+	for _, r := range rules {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			r.ID, r.Kind, r.Value, r.CreatedAt.Format(time.RFC3339), r.Reason)
+	}
+
+	return w.Flush()
+}
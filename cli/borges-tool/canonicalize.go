@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/src-d/borges"
+	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/tool"
+
+	"gopkg.in/src-d/go-cli.v0"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+func init() {
+	app.AddCommand(&canonicalizeCmd{})
+}
+
+type canonicalizeCmd struct {
+	cli.Command `name:"canonicalize" short-description:"merge the repositories with the same canonical endpoints"`
+	bcli.DatabaseOpts
+
+	db  *tool.Database
+	out io.WriteCloser
+
+	Dry        bool   `long:"dry" description:"do not perform modifications in database"`
+	SkipErrors bool   `long:"skip-errors" description:"do not stop on errors"`
+	Output     string `long:"output" short:"o" description:"file where to save the repositories that must be merged with merge-repos, one group per line, if not specified the list will be output to stdout"`
+}
+
+func (c *canonicalizeCmd) init() error {
+	db, err := c.OpenPostgres()
+	if err != nil {
+		return err
+	}
+
+	c.db = tool.NewDatabase(db)
+
+	c.out = os.Stdout
+	if c.Output != "" {
+		c.out, err = os.Create(c.Output)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *canonicalizeCmd) Execute(args []string) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	defer c.out.Close()
+
+	groups, err := c.db.Duplicates(borges.DefaultCanonicalizer)
+	if err != nil {
+		return err
+	}
+
+	var merged, skipped int
+	for _, g := range groups {
+		l := log.With(log.Fields{
+			"repositories": g.Repositories,
+			"endpoints":    g.Endpoints,
+		})
+
+		target, ok := g.Target()
+		if !ok {
+			l.With(log.Fields{"with-references": g.WithReferences}).
+				Warningf("repositories with references must be merged with merge-repos")
+			skipped++
+
+			ids := make([]string, len(g.WithReferences))
+			for i, id := range g.WithReferences {
+				ids[i] = id.String()
+			}
+
+			if _, err := fmt.Fprintln(c.out, strings.Join(ids, " ")); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		l = l.With(log.Fields{"target": target})
+		if c.Dry {
+			l.Infof("repositories would be merged")
+			merged++
+			continue
+		}
+
+		if err := c.db.MergeDuplicates(context.Background(), g); err != nil {
+			l.Errorf(err, "error merging repositories")
+			if !c.SkipErrors {
+				return err
+			}
+
+			continue
+		}
+
+		l.Infof("repositories merged")
+		merged++
+	}
+
+	log.With(log.Fields{
+		"merged":  merged,
+		"skipped": skipped,
+	}).Infof("canonicalize finished")
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/tool"
+
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-cli.v0"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+func init() {
+	app.AddCommand(&forksCmd{})
+}
+
+type forksCmd struct {
+	cli.Command `name:"forks" short-description:"group the repositories sharing root commits and find their main repository"`
+	bcli.DatabaseOpts
+	bcli.RootedRepositoriesOpts
+	bcli.RootedLockingOpts
+
+	db      *tool.Database
+	updater *tool.ForkUpdater
+	out     io.WriteCloser
+
+	UpdateForks bool   `long:"update-forks" description:"set is_fork of the repositories of every group in database, false for the main repository and true for the rest"`
+	UpdateSiva  bool   `long:"update-siva" description:"also set the isfork option of the remotes in the siva files"`
+	TempDir     string `long:"temp-dir" env:"BORGES_TEMP_DIR" default:"/tmp/borges" description:"path of temporary directory to copy siva files into"`
+	Dry         bool   `long:"dry" description:"do not perform modifications in database or siva files"`
+	SkipErrors  bool   `long:"skip-errors" description:"do not stop on errors"`
+	Output      string `long:"output" short:"o" description:"file where to save the groups, one per line with its label, the main repository and the forks, if not specified the list will be output to stdout"`
+}
+
+func (c *forksCmd) init() error {
+	if c.UpdateSiva && !c.UpdateForks {
+		return fmt.Errorf("--update-siva requires --update-forks")
+	}
+
+	db, err := c.OpenPostgres()
+	if err != nil {
+		return err
+	}
+
+	c.db = tool.NewDatabase(db)
+
+	if c.UpdateSiva && !c.Dry {
+		if err := os.MkdirAll(c.TempDir, os.FileMode(0755)); err != nil {
+			return err
+		}
+
+		txer, _, err := c.NewRootedTransactioner(osfs.New(c.TempDir), c.db)
+		if err != nil {
+			return err
+		}
+
+		session, err := c.NewLockSession()
+		if err != nil {
+			return err
+		}
+
+		c.updater = tool.NewForkUpdater(txer, session)
+	}
+
+	c.out = os.Stdout
+	if c.Output != "" {
+		c.out, err = os.Create(c.Output)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *forksCmd) Execute(args []string) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	defer c.out.Close()
+
+	ctx := context.Background()
+	groups, err := c.db.ForkGroups()
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		line := []string{g.Label}
+		for _, id := range g.All() {
+			line = append(line, id.String())
+		}
+
+		if _, err := fmt.Fprintln(c.out, strings.Join(line, " ")); err != nil {
+			return err
+		}
+	}
+
+	if c.Dry {
+		log.With(log.Fields{"groups": len(groups)}).Infof("forks finished")
+		return nil
+	}
+
+	if err := c.db.SaveForkGroups(ctx, groups); err != nil {
+		return err
+	}
+
+	var updated, failed int
+	if c.UpdateForks {
+		for _, g := range groups {
+			if err := c.updateGroup(ctx, g); err != nil {
+				log.With(log.Fields{
+					"label": g.Label,
+					"main":  g.MainRepository,
+				}).Errorf(err, "error updating forks")
+				if !c.SkipErrors {
+					return err
+				}
+
+				failed++
+				continue
+			}
+
+			updated++
+		}
+	}
+
+	log.With(log.Fields{
+		"groups":  len(groups),
+		"updated": updated,
+		"failed":  failed,
+	}).Infof("forks finished")
+
+	return nil
+}
+
+func (c *forksCmd) updateGroup(ctx context.Context, g *tool.ForkGroup) error {
+	if c.updater != nil {
+		if err := c.updater.Update(ctx, g); err != nil {
+			return err
+		}
+	}
+
+	return c.db.SetForks(ctx, g)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/tool"
+
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-cli.v0"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+func init() {
+	app.AddCommand(&mergeCmd{})
+}
+
+type mergeCmd struct {
+	cli.Command `name:"merge-repos" short-description:"merge repositories into one, renaming their references in database and siva files"`
+	bcli.DatabaseOpts
+	bcli.RootedRepositoriesOpts
+	bcli.RootedLockingOpts
+
+	merger *tool.Merger
+	groups [][]kallax.ULID
+	out    io.WriteCloser
+
+	TempDir    string `long:"temp-dir" env:"BORGES_TEMP_DIR" default:"/tmp/borges" description:"path of temporary directory to copy siva files into"`
+	Dry        bool   `long:"dry" description:"do not perform modifications in database or siva files"`
+	SkipErrors bool   `long:"skip-errors" description:"do not stop on errors"`
+	Output     string `long:"output" short:"o" description:"file where to save the overlapping repositories not merged, if not specified the list will be output to stdout"`
+
+	mergeArgs `positional-args:"true" required:"yes"`
+}
+
+type mergeArgs struct {
+	List string `positional-arg-name:"list" description:"file with the repository ids to merge, one group per line separated by spaces, the first one of every line is kept" required:"yes"`
+}
+
+func (c *mergeCmd) init() error {
+	list, err := tool.LoadList(c.List)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range list {
+		var group []kallax.ULID
+		for _, s := range strings.Fields(line) {
+			id, err := kallax.NewULIDFromText(s)
+			if err != nil {
+				return fmt.Errorf("invalid repository id %q: %s", s, err)
+			}
+
+			group = append(group, id)
+		}
+
+		c.groups = append(c.groups, group)
+	}
+
+	db, err := c.OpenPostgres()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.TempDir, os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	tdb := tool.NewDatabase(db)
+	txer, _, err := c.NewRootedTransactioner(osfs.New(c.TempDir), tdb)
+	if err != nil {
+		return err
+	}
+
+	session, err := c.NewLockSession()
+	if err != nil {
+		return err
+	}
+
+	c.merger = tool.NewMerger(tdb, txer, session)
+	c.merger.Dry(c.Dry)
+
+	c.out = os.Stdout
+	if c.Output != "" {
+		c.out, err = os.Create(c.Output)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *mergeCmd) Execute(args []string) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	defer c.out.Close()
+
+	var merged, failed int
+	for _, group := range c.groups {
+		res, err := c.merger.Merge(context.Background(), group)
+		if err != nil {
+			log.With(log.Fields{"repositories": group}).
+				Errorf(err, "error merging repositories")
+			if !c.SkipErrors {
+				return err
+			}
+
+			failed++
+			continue
+		}
+
+		merged++
+		if len(res.Overlapping) == 0 {
+			continue
+		}
+
+		log.With(log.Fields{
+			"target":      res.Target,
+			"overlapping": res.Overlapping,
+		}).Warningf("other repositories share endpoints with the merged ones")
+
+		ids := make([]string, len(res.Overlapping)+1)
+		ids[0] = res.Target.String()
+		for i, id := range res.Overlapping {
+			ids[i+1] = id.String()
+		}
+
+		if _, err := fmt.Fprintln(c.out, strings.Join(ids, " ")); err != nil {
+			return err
+		}
+	}
+
+	log.With(log.Fields{
+		"merged": merged,
+		"failed": failed,
+	}).Infof("merge-repos finished")
+
+	return nil
+}
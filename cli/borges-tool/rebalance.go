@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/tool"
+
+	"gopkg.in/src-d/go-cli.v0"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+func init() {
+	app.AddCommand(&rebalanceCmd{})
+}
+
+type rebalanceCmd struct {
+	cli.Command `name:"rebalance" short-description:"move the siva files to the root repositories directories assigned to them"`
+	bcli.DatabaseOpts
+	bcli.RootedRepositoriesOpts
+	bcli.RootedLockingOpts
+
+	rebalancer *tool.Rebalancer
+	list       []string
+	out        io.WriteCloser
+
+	Dry        bool   `long:"dry" description:"do not move the siva files, only find the misplaced ones"`
+	SkipErrors bool   `long:"skip-errors" description:"do not stop on errors"`
+	Output     string `long:"output" short:"o" description:"file where to save the misplaced siva files, one per line with the init, the directories where it was found and the one assigned, if not specified the list will be output to stdout"`
+
+	rebalanceArgs `positional-args:"true"`
+}
+
+type rebalanceArgs struct {
+	SivaList string `positional-arg-name:"list" description:"file with the list of siva files to rebalance, all the siva files in the database if not specified"`
+}
+
+func (c *rebalanceCmd) init() error {
+	sharded, err := c.NewShardedFs()
+	if err != nil {
+		return err
+	}
+
+	if c.SivaList != "" {
+		c.list, err = tool.LoadHashes(c.SivaList)
+		if err != nil {
+			return err
+		}
+	} else {
+		db, err := c.OpenDatabase()
+		if err != nil {
+			return err
+		}
+
+		c.list, err = tool.NewDatabase(db).Siva()
+		if err != nil {
+			return err
+		}
+	}
+
+	session, err := c.NewLockSession()
+	if err != nil {
+		return err
+	}
+
+	c.rebalancer = tool.NewRebalancer(sharded, session)
+	c.rebalancer.Bucket(c.BucketSize)
+	c.rebalancer.Dry(c.Dry)
+
+	c.out = os.Stdout
+	if c.Output != "" {
+		c.out, err = os.Create(c.Output)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *rebalanceCmd) Execute(args []string) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	defer c.out.Close()
+
+	ctx := context.Background()
+
+	var misplaced, failed int
+	for _, init := range c.list {
+		from, err := c.rebalancer.Rebalance(ctx, init)
+		if err != nil {
+			log.With(log.Fields{"init": init}).Errorf(err, "error rebalancing siva file")
+			if !c.SkipErrors {
+				return err
+			}
+
+			failed++
+			continue
+		}
+
+		if len(from) == 0 {
+			continue
+		}
+
+		misplaced++
+		line := []string{init}
+		for _, sh := range from {
+			line = append(line, sh.Name)
+		}
+		line = append(line, c.rebalancer.Assigned(init).Name)
+
+		if _, err := fmt.Fprintln(c.out, strings.Join(line, " ")); err != nil {
+			return err
+		}
+	}
+
+	log.With(log.Fields{
+		"sivas":     len(c.list),
+		"misplaced": misplaced,
+		"failed":    failed,
+		"dry":       c.Dry,
+	}).Infof("rebalance finished")
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/tool"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-cli.v0"
+)
+
+func init() {
+	app.AddCommand(&statsCmd{})
+}
+
+type statsCmd struct {
+	cli.Command `name:"stats" short-description:"report statistics of the repositories and siva files for capacity planning"`
+	bcli.DatabaseOpts
+	bcli.RootedRepositoriesOpts
+
+	collector *tool.StatsCollector
+	out       io.WriteCloser
+
+	FSString        string `long:"fs" description:"filesystem connection string of the siva files, ex: file:///mnt/rooted-repos, gluster://host/volume/rooted-repos, only database statistics are reported if empty and --rooted is not given"`
+	Rooted          bool   `long:"rooted" description:"report the siva files of every directory of --root-repositories-dir and --cold-repositories-dir instead of --fs"`
+	Top             int    `long:"top" default:"10" description:"number of largest siva files and repositories reported"`
+	AllInits        bool   `long:"all-inits" description:"report every siva file instead of only the largest ones"`
+	RepositoryBytes bool   `long:"repository-bytes" description:"estimate the bytes of every repository splitting the size of the siva files among their repositories by their number of references"`
+	JSON            bool   `long:"json" description:"output the statistics as JSON"`
+	Output          string `long:"output" short:"o" description:"file where to save the statistics, if not specified they will be output to stdout"`
+}
+
+func (c *statsCmd) init() error {
+	if c.Rooted && c.FSString != "" {
+		return fmt.Errorf("--fs and --rooted cannot be used together")
+	}
+
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+
+	var fss []billy.Basic
+	switch {
+	case c.Rooted:
+		rooted, err := c.NewListableFilesystems()
+		if err != nil {
+			return err
+		}
+
+		for _, fs := range rooted {
+			fss = append(fss, fs)
+		}
+	case c.FSString != "":
+		fs, err := tool.OpenFS(c.FSString)
+		if err != nil {
+			return err
+		}
+
+		fss = append(fss, fs)
+	}
+
+	c.collector = tool.NewStatsCollector(tool.NewDatabase(db), fss...)
+	c.collector.Top(c.Top)
+	c.collector.AllInits(c.AllInits)
+	c.collector.RepositoryBytes(c.RepositoryBytes)
+
+	c.out = os.Stdout
+	if c.Output != "" {
+		c.out, err = os.Create(c.Output)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *statsCmd) Execute(args []string) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	defer c.out.Close()
+
+	stats, err := c.collector.Collect()
+	if err != nil {
+		return err
+	}
+
+	if c.JSON {
+		e := json.NewEncoder(c.out)
+		e.SetIndent("", "  ")
+		return e.Encode(stats)
+	}
+
+	return writeStats(c.out, stats)
+}
+
+func writeStats(out io.Writer, stats *tool.Stats) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, "REPOSITORIES")
+	statuses := make([]string, 0, len(stats.Repositories))
+	for status := range stats.Repositories {
+		statuses = append(statuses, string(status))
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "  %s\t%d\n", status, stats.Repositories[model.FetchStatus(status)])
+	}
+	fmt.Fprintf(w, "  references\t%d\n", stats.References)
+
+	s := stats.InitsSummary
+	fmt.Fprintln(w, "\nROOTED REPOSITORIES")
+	fmt.Fprintf(w, "  inits\t%d\n", s.Inits)
+	fmt.Fprintf(w, "  repositories per init\tavg %.2f\tmax %d\n", s.AvgRepositories, s.MaxRepositories)
+	fmt.Fprintf(w, "  references per init\tavg %.2f\tmax %d\n", s.AvgReferences, s.MaxReferences)
+
+	fmt.Fprintln(w, "\nSIVA FILES")
+	fmt.Fprintf(w, "  count\t%d\n", stats.Sivas)
+	fmt.Fprintf(w, "  bytes\t%s\n", formatBytes(stats.Bytes))
+	fmt.Fprintf(w, "  missing\t%d\n", stats.Missing)
+	fmt.Fprintf(w, "  unreferenced\t%d\n", stats.Unreferenced)
+
+	fmt.Fprintln(w, "\nSIZE HISTOGRAM")
+	for _, bar := range stats.Histogram {
+		limit := "> " + formatBytes(stats.Histogram[len(stats.Histogram)-2].Max)
+		if bar.Max > 0 {
+			limit = "<= " + formatBytes(bar.Max)
+		}
+
+		fmt.Fprintf(w, "  %s\t%d\t%s\n", limit, bar.Sivas, formatBytes(bar.Bytes))
+	}
+
+	fmt.Fprintln(w, "\nBUCKETS")
+	buckets := make([]string, 0, len(stats.Buckets))
+	for b := range stats.Buckets {
+		buckets = append(buckets, b)
+	}
+	sort.Strings(buckets)
+	for _, b := range buckets {
+		name := b
+		if name == "" {
+			name = "/"
+		}
+
+		fmt.Fprintf(w, "  %s\t%d\n", name, stats.Buckets[b])
+	}
+
+	fmt.Fprintln(w, "\nLARGEST SIVA FILES")
+	fmt.Fprintln(w, "  INIT\tBYTES\tREPOSITORIES\tREFERENCES")
+	for _, is := range stats.Inits {
+		size := "missing"
+		if is.Bytes >= 0 {
+			size = formatBytes(is.Bytes)
+		}
+
+		fmt.Fprintf(w, "  %s\t%s\t%d\t%d\n", is.Init, size, is.Repositories, is.References)
+	}
+
+	if len(stats.RepositoryBytes) > 0 {
+		fmt.Fprintln(w, "\nLARGEST REPOSITORIES (ESTIMATED)")
+		fmt.Fprintln(w, "  ID\tBYTES\tINITS")
+		for _, rb := range stats.RepositoryBytes {
+			fmt.Fprintf(w, "  %s\t%s\t%d\n", rb.ID, formatBytes(rb.Bytes), rb.Inits)
+		}
+	}
+
+	return w.Flush()
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/tool"
+
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-cli.v0"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+)
+
+func init() {
+	app.AddCommand(&takedownCmd{})
+}
+
+type takedownCmd struct {
+	cli.Command `name:"takedown" short-description:"remove a single repository from the archive and block its endpoints"`
+	bcli.DatabaseOpts
+	bcli.RootedRepositoriesOpts
+	bcli.RootedLockingOpts
+
+	takedown *tool.Takedown
+	id       kallax.ULID
+
+	TempDir string `long:"temp-dir" env:"BORGES_TEMP_DIR" default:"/tmp/borges" description:"path of temporary directory to write siva files into"`
+	Reason  string `long:"reason" required:"yes" description:"reason of the takedown, stored in the audit record"`
+	Dry     bool   `long:"dry" description:"do not perform modifications in database or siva files"`
+
+	takedownArgs `positional-args:"true" required:"yes"`
+}
+
+type takedownArgs struct {
+	ID string `positional-arg-name:"id" description:"id of the repository to take down" required:"yes"`
+}
+
+func (c *takedownCmd) init() error {
+	var err error
+	c.id, err = kallax.NewULIDFromText(c.ID)
+	if err != nil {
+		return fmt.Errorf("invalid repository id %q: %s", c.ID, err)
+	}
+
+	db, err := c.OpenPostgres()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.TempDir, os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	tdb := tool.NewDatabase(db)
+	_, copier, err := c.NewRootedTransactioner(osfs.New(c.TempDir), tdb)
+	if err != nil {
+		return err
+	}
+
+	tiers, err := c.NewTiers(tdb)
+	if err != nil {
+		return err
+	}
+
+	remote, err := c.NewRemoteFs()
+	if err != nil {
+		return err
+	}
+
+	session, err := c.NewLockSession()
+	if err != nil {
+		return err
+	}
+
+	c.takedown = tool.NewTakedown(tdb, copier, remote, session)
+	c.takedown.Bucket(c.BucketSize)
+	c.takedown.Tiers(tiers)
+	c.takedown.Dry(c.Dry)
+
+	return nil
+}
+
+func (c *takedownCmd) Execute(args []string) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	record, err := c.takedown.Remove(context.Background(), c.id, c.Reason)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("takedown %s: repository %s removed, %d references in %d siva files\n",
+		record.ID, record.RepositoryID, record.References, len(record.Inits))
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/storage"
+	"github.com/src-d/borges/tool"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-cli.v0"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+func init() {
+	app.AddCommand(&tierCmd{})
+}
+
+type tierCmd struct {
+	cli.Command `name:"tier" short-description:"move siva files between the hot and cold storage tiers"`
+	bcli.DatabaseOpts
+	bcli.RootedRepositoriesOpts
+	bcli.RootedLockingOpts
+
+	db     *tool.Database
+	tierer *tool.Tierer
+
+	To         string `long:"to" default:"cold" choice:"hot" choice:"cold" description:"tier where the siva files are moved"`
+	OlderThan  int    `long:"older-than" description:"move to the cold tier the siva files not written for the given number of days instead of the given ones"`
+	Dry        bool   `long:"dry" description:"do not move the siva files, only locate them"`
+	SkipErrors bool   `long:"skip-errors" description:"do not stop on errors"`
+
+	tierArgs `positional-args:"true"`
+}
+
+type tierArgs struct {
+	Inits []string `positional-arg-name:"init" description:"init commits of the rooted repositories to move"`
+}
+
+func (c *tierCmd) init() error {
+	if c.ColdRepositoriesDir == "" {
+		return fmt.Errorf("--cold-repositories-dir is needed to move siva files")
+	}
+
+	if c.OlderThan > 0 && (c.To != string(storage.ColdTier) || len(c.Inits) > 0) {
+		return fmt.Errorf("--older-than only moves siva files to the cold tier and does not accept init commits")
+	}
+
+	if c.OlderThan <= 0 && len(c.Inits) == 0 {
+		return fmt.Errorf("either --older-than or init commits are needed")
+	}
+
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+
+	c.db = tool.NewDatabase(db)
+
+	tiers, err := c.NewTiers(c.db)
+	if err != nil {
+		return err
+	}
+
+	session, err := c.NewLockSession()
+	if err != nil {
+		return err
+	}
+
+	c.tierer = tool.NewTierer(tiers, session)
+	c.tierer.Dry(c.Dry)
+
+	return nil
+}
+
+func (c *tierCmd) Execute(args []string) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	inits, err := c.inits()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	to := storage.Tier(c.To)
+
+	var moved, failed int
+	for _, init := range inits {
+		logger := log.With(log.Fields{"init": init, "to": to})
+
+		from, err := c.tierer.Move(ctx, init, to)
+		if err != nil {
+			logger.Errorf(err, "error moving siva file")
+			if !c.SkipErrors {
+				return err
+			}
+
+			failed++
+			continue
+		}
+
+		if from != to {
+			moved++
+		}
+
+		logger.With(log.Fields{"from": from}).Infof("siva file moved")
+	}
+
+	log.With(log.Fields{
+		"inits":  len(inits),
+		"moved":  moved,
+		"failed": failed,
+		"dry":    c.Dry,
+	}).Infof("tier finished")
+
+	return nil
+}
+
+func (c *tierCmd) inits() ([]model.SHA1, error) {
+	if c.OlderThan > 0 {
+		before := time.Now().Add(-time.Duration(c.OlderThan) * 24 * time.Hour)
+		return c.db.ColdCandidates(before)
+	}
+
+	inits := make([]model.SHA1, 0, len(c.Inits))
+	for _, i := range c.Inits {
+		if b, err := hex.DecodeString(i); err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("invalid init commit %q", i)
+		}
+
+		inits = append(inits, model.NewSHA1(i))
+	}
+
+	return inits, nil
+}
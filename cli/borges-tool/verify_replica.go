@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/src-d/borges"
+	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/tool"
+
+	"gopkg.in/src-d/go-cli.v0"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+func init() {
+	app.AddCommand(&verifyReplicaCmd{})
+}
+
+type verifyReplicaCmd struct {
+	cli.Command `name:"verify-replica" short-description:"compare the siva files with their replicas and repair the divergences"`
+	bcli.DatabaseOpts
+	bcli.RootedRepositoriesOpts
+	bcli.RootedLockingOpts
+
+	verifier *tool.ReplicaVerifier
+	list     []string
+	out      io.WriteCloser
+
+	Repair         bool   `long:"repair" description:"copy the siva files missing or different in the replica from the primary"`
+	RestorePrimary bool   `long:"restore-primary" description:"copy the siva files missing in the primary from the replica, only for siva files known to be lost, as deleted siva files may still be in the replica"`
+	Logs           string `long:"replication-logs" env:"BORGES_REPLICATION_LOGS" description:"comma separated list of the replication logs of the consumers replicating in async mode, the siva files with replications pending in them are not compared nor repaired"`
+	SkipErrors     bool   `long:"skip-errors" description:"do not stop on errors"`
+	Output         string `long:"output" short:"o" description:"file where to save the divergent siva files, one per line with the init, the status, and the size and checksum in the primary and the replica, if not specified the list will be output to stdout"`
+
+	verifyReplicaArgs `positional-args:"true"`
+}
+
+type verifyReplicaArgs struct {
+	SivaList string `positional-arg-name:"list" description:"file with the list of siva files to verify, all the siva files in the database if not specified"`
+}
+
+func (c *verifyReplicaCmd) init() error {
+	fs, err := c.NewReplicatedFs()
+	if err != nil {
+		return err
+	}
+
+	if c.SivaList != "" {
+		c.list, err = tool.LoadHashes(c.SivaList)
+		if err != nil {
+			return err
+		}
+	} else {
+		db, err := c.OpenDatabase()
+		if err != nil {
+			return err
+		}
+
+		c.list, err = tool.NewDatabase(db).Siva()
+		if err != nil {
+			return err
+		}
+	}
+
+	session, err := c.NewLockSession()
+	if err != nil {
+		return err
+	}
+
+	tiers, err := c.NewTiersOf(fs, nil)
+	if err != nil {
+		return err
+	}
+
+	var logs []string
+	for _, l := range strings.Split(c.Logs, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			logs = append(logs, l)
+		}
+	}
+
+	c.verifier = tool.NewReplicaVerifier(fs, session)
+	c.verifier.Bucket(c.BucketSize)
+	c.verifier.Tiers(tiers)
+	c.verifier.Logs(logs...)
+	c.verifier.Repair(c.Repair)
+	c.verifier.Restore(c.RestorePrimary)
+
+	c.out = os.Stdout
+	if c.Output != "" {
+		c.out, err = os.Create(c.Output)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *verifyReplicaCmd) Execute(args []string) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	defer c.out.Close()
+
+	ctx := context.Background()
+
+	var divergent, failed int
+	for _, init := range c.list {
+		check, err := c.verifier.Verify(ctx, init)
+		if err != nil {
+			log.With(log.Fields{"init": init}).Errorf(err, "error verifying siva file")
+			if !c.SkipErrors {
+				return err
+			}
+
+			failed++
+			continue
+		}
+
+		if check.Status == borges.ReplicaOK {
+			continue
+		}
+
+		divergent++
+		_, err = fmt.Fprintln(c.out,
+			init,
+			check.Status,
+			check.PrimarySize,
+			checksum(check.PrimarySum),
+			check.ReplicaSize,
+			checksum(check.ReplicaSum),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.With(log.Fields{
+		"sivas":     len(c.list),
+		"divergent": divergent,
+		"failed":    failed,
+		"repaired":  c.Repair,
+		"restored":  c.RestorePrimary,
+	}).Infof("verification finished")
+
+	return nil
+}
+
+// checksum returns the checksum to output, a dash if the file is missing.
+func checksum(sum string) string {
+	if sum == "" {
+		return "-"
+	}
+
+	return sum
+}
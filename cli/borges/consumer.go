@@ -2,19 +2,15 @@ package main
 
 import (
 	"io/ioutil"
-	"net/url"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/src-d/borges"
 	bcli "github.com/src-d/borges/cli"
 	"github.com/src-d/borges/lock"
-	"github.com/src-d/borges/storage"
 
-	"gopkg.in/src-d/core-retrieval.v0/repository"
 	billy "gopkg.in/src-d/go-billy.v4"
 	"gopkg.in/src-d/go-billy.v4/osfs"
 	cli "gopkg.in/src-d/go-cli.v0"
@@ -32,12 +28,21 @@ type consumerCmd struct {
 
 	consumerOpts
 	bcli.DatabaseOpts
+
+	ReaperInterval   string `long:"reaper-interval" env:"BORGES_REAPER_INTERVAL" default:"0" description:"elapsed time between checks for repositories left in fetching status with an expired lease, 0 disables the reaper"`
+	BlocklistRefresh string `long:"blocklist-refresh" env:"BORGES_BLOCKLIST_REFRESH" default:"1m" description:"elapsed time between reloads of the blocklist from the database, 0 loads it only once"`
+
+	Schedule bool `long:"schedule" env:"BORGES_SCHEDULE" description:"update the refresh schedule of the repositories after processing them, used by the schedule producer"`
+	scheduleOpts
 }
 
+// reapedJobRetries is the number of retries of the jobs queued by the reaper.
+const reapedJobRetries = 5
+
 func (c *consumerCmd) Execute(args []string) error {
 	c.MaybeStartMetrics()
 
-	db, err := c.OpenDatabase()
+	store, err := c.OpenStore()
 	if err != nil {
 		return err
 	}
@@ -47,11 +52,13 @@ func (c *consumerCmd) Execute(args []string) error {
 		return err
 	}
 
-	txer, copier, err := c.newRootedTransactioner(tmp)
+	txer, copier, err := c.NewRootedTransactioner(tmp, store)
 	if err != nil {
 		return err
 	}
 
+	defer c.RootedRepositoriesOpts.Close()
+
 	locking, err := lock.New(c.Locking)
 	if err != nil {
 		return err
@@ -78,14 +85,44 @@ func (c *consumerCmd) Execute(args []string) error {
 		return err
 	}
 
+	reaperInterval, err := time.ParseDuration(c.ReaperInterval)
+	if err != nil {
+		return err
+	}
+
+	// local leases are not seen by other processes, so the repositories
+	// are leased in the database instead
+	leasing := locking
+	if !lock.IsDistributed(locking) {
+		leasing = store.LeaseService()
+	}
+
+	blocklistRefresh, err := time.ParseDuration(c.BlocklistRefresh)
+	if err != nil {
+		return err
+	}
+
+	var notifiers borges.ArchiverNotifiers
+	if c.Schedule {
+		config, err := c.schedulerConfig()
+		if err != nil {
+			return err
+		}
+
+		notifiers.Done = borges.NewScheduler(store, config).Record
+	}
+
 	wp := borges.NewArchiverWorkerPool(
-		storage.FromDatabase(db),
+		store,
 		txer,
 		borges.NewTemporaryCloner(tmp),
 		locking,
+		leasing,
 		timeout,
 		lockingTimeout,
 		copier,
+		notifiers,
+		borges.NewBlocklist(store, blocklistRefresh),
 	)
 	wp.SetWorkerCount(c.Workers)
 
@@ -97,6 +134,15 @@ func (c *consumerCmd) Execute(args []string) error {
 		}).Errorf(err, "queue error")
 	}
 
+	if reaperInterval > 0 {
+		reaper := borges.NewReaper(
+			store, leasing, q, queue.PriorityNormal, reapedJobRetries, reaperInterval,
+		)
+
+		go reaper.Start()
+		defer reaper.Stop()
+	}
+
 	var term = make(chan os.Signal)
 	var done = make(chan struct{})
 	go func() {
@@ -125,8 +171,7 @@ type consumerOpts struct {
 	Workers        int    `long:"workers" env:"BORGES_WORKERS" default:"1" description:"number of workers, 0 means the same number as processors"`
 	Timeout        string `long:"timeout" env:"BORGES_TIMEOUT" default:"10h" description:"deadline to process a job"`
 
-	RootRepositoriesDir string `long:"root-repositories-dir" env:"BORGES_ROOT_REPOSITORIES_DIR" default:"/tmp/root-repositories" description:"path to the directory storing rooted repositories (can be local path or hdfs://)"`
-	BucketSize          int    `long:"bucket-size" env:"BORGES_BUCKET_SIZE" default:"0" description:"if higher than zero, repositories are stored in bucket directories with a prefix of the given amount of characters from its root hash"`
+	bcli.RootedRepositoriesOpts
 
 	TempDir      string `long:"temp-dir" env:"BORGES_TEMP_DIR" default:"/tmp/borges" description:"path of temporary directory to clone repositories into"`
 	CleanTempDir bool   `long:"temp-dir-clean" env:"BORGES_TEMP_DIR_CLEAN" description:"clean temporary directory before starting"`
@@ -148,40 +193,3 @@ func (c *consumerOpts) newTemporaryFilesystem() (billy.Filesystem, error) {
 
 	return osfs.New(dir), nil
 }
-
-func (c *consumerOpts) newRootedTransactioner(
-	tmp billy.Filesystem,
-) (repository.RootedTransactioner, *repository.Copier, error) {
-	tmp, err := tmp.Chroot("transactioner")
-	if err != nil {
-		return nil, nil, err
-	}
-
-	var remote repository.Fs
-	if strings.HasPrefix(c.RootRepositoriesDir, "hdfs://") {
-		u, err := url.Parse(c.RootRepositoriesDir)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		path := u.Path
-		u.Path = ""
-
-		remote = repository.NewHDFSFs(
-			u.String(),
-			path,
-		)
-	} else {
-		remote = repository.NewLocalFs(osfs.New(c.RootRepositoriesDir))
-	}
-
-	copier := repository.NewCopier(
-		tmp,
-		remote,
-		c.BucketSize,
-	)
-
-	txer := repository.NewSivaRootedTransactioner(copier)
-
-	return txer, copier, nil
-}
@@ -4,7 +4,6 @@ import (
 	"os"
 
 	"github.com/src-d/borges"
-	"github.com/src-d/borges/storage"
 
 	cli "gopkg.in/src-d/go-cli.v0"
 )
@@ -32,15 +31,9 @@ func (c *fileCmd) Execute(args []string) error {
 }
 
 func (c *fileCmd) jobIter() (borges.JobIter, error) {
-	db, err := c.OpenDatabase()
-	if err != nil {
-		return nil, err
-	}
-
-	storer := storage.FromDatabase(db)
 	f, err := os.Open(c.PositionalArgs.File)
 	if err != nil {
 		return nil, err
 	}
-	return borges.NewLineJobIter(f, storer), nil
+	return borges.NewLineJobIter(f, c.store), nil
 }
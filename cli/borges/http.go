@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/src-d/borges"
+
+	"gopkg.in/src-d/go-cli.v0"
+	"gopkg.in/src-d/go-log.v1"
+	"gopkg.in/src-d/go-queue.v1"
+)
+
+func init() {
+	producerCommandAdder.AddCommand(&httpCmd{}, setPrioritySettings)
+}
+
+// httpCmd is a producer subcommand.
+type httpCmd struct {
+	cli.Command `name:"http" short-description:"produce jobs from requests to an HTTP API" long-description:"This producer runs an HTTP server to request the archiving of repositories. POST /repositories queues a repository and POST /repositories/batch queues a list of them, GET /repositories?endpoint=<url> looks up the repositories with an endpoint and GET /repositories/<id> returns a repository and whether it was queued."`
+	producerOpts
+
+	Address       string `long:"address" env:"BORGES_HTTP_ADDRESS" default:"127.0.0.1:8080" description:"address the HTTP server listens on"`
+	User          string `long:"user" env:"BORGES_HTTP_USER" description:"user required with basic authentication, required unless --no-auth is given"`
+	Password      string `long:"password" env:"BORGES_HTTP_PASSWORD" description:"password required with basic authentication, required with --user"`
+	NoAuth        bool   `long:"no-auth" env:"BORGES_HTTP_NO_AUTH" description:"disable authentication, anyone reaching the server can queue jobs"`
+	MaxBodySize   int64  `long:"max-body-size" env:"BORGES_HTTP_MAX_BODY_SIZE" default:"1048576" description:"maximum size in bytes of a request body"`
+	MaxBatchSize  int    `long:"max-batch-size" env:"BORGES_HTTP_MAX_BATCH_SIZE" default:"1000" description:"maximum number of repositories in a batch request"`
+	MaxRequests   int    `long:"max-requests" env:"BORGES_HTTP_MAX_REQUESTS" default:"32" description:"maximum number of requests served at the same time, 0 means no limit"`
+	QueuedHistory int    `long:"queued-history" env:"BORGES_HTTP_QUEUED_HISTORY" default:"100000" description:"number of queued jobs remembered to report them as queued"`
+}
+
+// httpShutdownTimeout is the time given to the requests being served to
+// finish when the server is stopped.
+const httpShutdownTimeout = 30 * time.Second
+
+func (c *httpCmd) Execute(args []string) error {
+	if err := c.checkAuth(); err != nil {
+		return err
+	}
+
+	if err := c.producerOpts.init(); err != nil {
+		return err
+	}
+	defer c.broker.Close()
+
+	refresh, err := time.ParseDuration(c.BlocklistRefresh)
+	if err != nil {
+		return err
+	}
+
+	server := borges.NewIngestServer(
+		c.store,
+		c.queue,
+		borges.IngestConfig{
+			Username:              c.User,
+			Password:              c.Password,
+			MaxBodySize:           c.MaxBodySize,
+			MaxBatchSize:          c.MaxBatchSize,
+			MaxConcurrentRequests: c.MaxRequests,
+			Priority:              queue.Priority(c.QueuePriority),
+			JobRetries:            c.JobsRetries,
+			QueuedHistory:         c.QueuedHistory,
+		},
+	)
+	server.SetBlocklist(borges.NewBlocklist(c.store, refresh))
+
+	srv := &http.Server{Addr: c.Address, Handler: server}
+
+	var term = make(chan os.Signal, 1)
+	var done = make(chan struct{})
+	go func() {
+		select {
+		case <-term:
+			log.Infof("signal received, stopping...")
+			ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Errorf(err, "error stopping HTTP server")
+			}
+		case <-done:
+		}
+	}()
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+
+	if c.NoAuth {
+		log.Warningf("authentication disabled")
+	}
+
+	log.With(log.Fields{"address": c.Address}).Infof("HTTP server started")
+	err = srv.ListenAndServe()
+	close(done)
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// checkAuth checks that the server is started with authentication, unless
+// it is explicitly disabled.
+func (c *httpCmd) checkAuth() error {
+	switch {
+	case c.NoAuth && (c.User != "" || c.Password != ""):
+		return fmt.Errorf("--no-auth cannot be used with --user or --password")
+	case c.NoAuth:
+		return nil
+	case c.User == "":
+		return fmt.Errorf("--user and --password are required, use --no-auth to disable authentication")
+	case c.Password == "":
+		return fmt.Errorf("--password is required with --user")
+	}
+
+	return nil
+}
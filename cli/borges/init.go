@@ -1,9 +1,12 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 
 	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/storage"
+
 	"gopkg.in/src-d/core-retrieval.v0/schema"
 	"gopkg.in/src-d/go-cli.v0"
 	"gopkg.in/src-d/go-log.v1"
@@ -24,10 +27,24 @@ func (c *initCmd) Execute(args []string) error {
 		return fmt.Errorf("unable to get database: %s", err)
 	}
 
-	if err := schema.Create(db); err != nil {
-		return fmt.Errorf("unable to create database schema: %s", err)
+	if c.IsSQLite() {
+		err = storage.CreateSQLiteSchema(db)
+	} else {
+		err = createSchema(db)
+	}
+
+	if err != nil {
+		return err
 	}
 
 	log.Infof("database was successfully initialized")
 	return nil
 }
+
+func createSchema(db *sql.DB) error {
+	if err := schema.Create(db); err != nil {
+		return fmt.Errorf("unable to create database schema: %s", err)
+	}
+
+	return storage.CreateSchema(db)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+
+	"github.com/src-d/borges"
+
+	cli "gopkg.in/src-d/go-cli.v0"
+)
+
+func init() {
+	producerCommandAdder.AddCommand(&jsonlCmd{}, setPrioritySettings)
+}
+
+type jsonlCmd struct {
+	cli.Command `name:"jsonl" short-description:"produce jobs from a JSON-lines file" long-description:"This producer reads from a file one JSON object per line describing a repository, generates a job and queues it. Each object has the fields of a mention (endpoint, aliases, is_fork, provider and vcs) and can set the priority, retries and ref_policy of its job."`
+	producerOpts
+
+	PositionalArgs struct {
+		File string `positional-arg-name:"path" description:"file with repositories to pack, one JSON object per line"`
+	} `positional-args:"true" required:"1"`
+}
+
+func (c *jsonlCmd) Execute(args []string) error {
+	if err := c.producerOpts.init(); err != nil {
+		return err
+	}
+	defer c.broker.Close()
+
+	return c.generateJobs(c.jobIter)
+}
+
+func (c *jsonlCmd) jobIter() (borges.JobIter, error) {
+	f, err := os.Open(c.PositionalArgs.File)
+	if err != nil {
+		return nil, err
+	}
+
+	return borges.NewJSONLineJobIter(f, c.store), nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"github.com/src-d/borges"
-	"github.com/src-d/borges/storage"
 
 	"gopkg.in/src-d/go-cli.v0"
 )
@@ -30,7 +29,6 @@ func (c *mentionsCmd) Execute(args []string) error {
 }
 
 func (c *mentionsCmd) jobIter() (borges.JobIter, error) {
-	storer := storage.FromDatabase(c.database)
 	q, err := c.broker.Queue(c.QueueMentions)
 	if err != nil {
 		return nil, err
@@ -41,5 +39,5 @@ func (c *mentionsCmd) jobIter() (borges.JobIter, error) {
 			return nil, err
 		}
 	}
-	return borges.NewMentionJobIter(q, storer), nil
+	return borges.NewMentionJobIter(q, c.store), nil
 }
@@ -2,15 +2,23 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/src-d/borges"
+	"github.com/src-d/borges/filequeue"
 	"github.com/src-d/borges/lock"
 	"github.com/src-d/borges/storage"
 
 	cli "gopkg.in/src-d/go-cli.v0"
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+	"gopkg.in/src-d/go-queue.v1"
 	"gopkg.in/src-d/go-queue.v1/memory"
 )
 
@@ -21,12 +29,25 @@ func init() {
 type packerCmd struct {
 	cli.Command `name:"pack" short-description:"pack remote or local repositories into siva files" long-description:""`
 	consumerOpts
+	JSONL          bool   `long:"jsonl" env:"BORGES_PACKER_JSONL" description:"read the file as JSON lines, one object per repository as in the jsonl producer"`
+	StoreFile      string `long:"store-file" env:"BORGES_PACKER_STORE_FILE" description:"file where the repositories and their references are kept, so packing them again only archives their changes, they are only kept in memory if empty"`
+	StateDir       string `long:"state-dir" env:"BORGES_PACKER_STATE_DIR" description:"directory where the queue of jobs is kept to resume the pack if it is interrupted, the jobs are only kept in memory if empty"`
+	BufferSize     int    `long:"buffer-size" env:"BORGES_PACKER_BUFFER_SIZE" default:"1000" description:"maximum number of jobs read from the file that are not finished yet, 0 means no limit"`
+	Report         string `long:"report" env:"BORGES_PACKER_REPORT" description:"file where a JSON-lines report with the outcome of every line of the file is written when the pack finishes"`
+	RerunFailed    bool   `long:"rerun-failed" env:"BORGES_PACKER_RERUN_FAILED" description:"read the file as a report written with --report and pack again only its failed entries"`
+	Discover       bool   `long:"discover" env:"BORGES_PACKER_DISCOVER" description:"read the path as a directory and pack every local repository found under it"`
+	Submodules     bool   `long:"discover-submodules" env:"BORGES_PACKER_DISCOVER_SUBMODULES" description:"also pack the submodule checkouts found with --discover"`
+	Worktrees      bool   `long:"discover-worktrees" env:"BORGES_PACKER_DISCOVER_WORKTREES" description:"also pack the linked worktrees found with --discover"`
 	PositionalArgs struct {
-		File string `positional-arg-name:"path" description:"file with repositories to pack, one per line"`
+		File string `positional-arg-name:"path" description:"file with repositories to pack, one per line, or directory with repositories if --discover is given"`
 	} `positional-args:"true" required:"1"`
 }
 
 func (c *packerCmd) Execute(args []string) error {
+	if c.Discover && (c.JSONL || c.RerunFailed) {
+		return fmt.Errorf("--discover cannot be used with --jsonl or --rerun-failed")
+	}
+
 	tmp, err := c.newTemporaryFilesystem()
 	if err != nil {
 		return err
@@ -37,31 +58,51 @@ func (c *packerCmd) Execute(args []string) error {
 		return err
 	}
 
-	broker := memory.NewFinite(true)
-	q, err := broker.Queue("jobs")
+	store, err := c.openStore()
 	if err != nil {
-		return fmt.Errorf("unable to start an in-memory queue: %s", err)
+		return err
 	}
 
-	store := storage.Local()
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	q, skip, err := c.openQueue(store)
+	if err != nil {
+		return err
+	}
 	timeout, err := time.ParseDuration(c.Timeout)
 	if err != nil {
 		return fmt.Errorf("invalid format in the given `--timeout` flag: %s", err)
 	}
 
-	transactioner, copier, err := c.newRootedTransactioner(tmp)
+	transactioner, copier, err := c.NewRootedTransactioner(tmp, nil)
 	if err != nil {
 		return fmt.Errorf("unable to initialize rooted transactioner: %s", err)
 	}
 
+	defer c.RootedRepositoriesOpts.Close()
+
+	var (
+		report    *borges.Report
+		notifiers borges.ArchiverNotifiers
+	)
+	if c.Report != "" {
+		report = borges.NewReport()
+		notifiers.Done = report.Record
+	}
+
 	wp := borges.NewArchiverWorkerPool(
 		store,
 		transactioner,
 		borges.NewTemporaryCloner(tmp),
 		locking,
+		nil,
 		timeout,
 		0,
 		copier,
+		notifiers,
+		nil,
 	)
 
 	if c.Workers <= 0 {
@@ -69,18 +110,231 @@ func (c *packerCmd) Execute(args []string) error {
 	}
 	wp.SetWorkerCount(c.Workers)
 
-	f, err := os.Open(c.PositionalArgs.File)
+	iter, err := c.newJobIter(store, report)
 	if err != nil {
-		return fmt.Errorf("unable to open file %q with repositories: %s",
-			c.PositionalArgs.File, err)
+		return err
+	}
+
+	if report != nil {
+		iter = report.JobIter(iter.(borges.LineJobIter))
 	}
 
 	executor := borges.NewExecutor(
 		q,
 		wp,
 		store,
-		borges.NewLineJobIter(f, store),
+		&packJobIter{JobIter: iter, skip: skip},
 	)
 
-	return executor.Execute()
+	executor.BufferSize = c.BufferSize
+
+	summary, err := executor.Execute()
+	if report != nil {
+		if err := c.writeReport(report); err != nil {
+			return err
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.With(log.Fields{
+		"queued":    summary.Queued,
+		"invalid":   summary.Invalid,
+		"succeeded": summary.Succeeded,
+		"failed":    summary.Failed,
+		"retried":   summary.Retried,
+	}).Infof("pack finished")
+
+	return nil
+}
+
+// newJobIter returns the JobIter with the repositories to pack.
+func (c *packerCmd) newJobIter(
+	store borges.RepositoryStore,
+	report *borges.Report,
+) (borges.JobIter, error) {
+	if c.Discover {
+		return borges.NewDiscoverJobIter(
+			c.PositionalArgs.File,
+			store,
+			borges.DiscoverOptions{
+				Submodules: c.Submodules,
+				Worktrees:  c.Worktrees,
+			},
+		), nil
+	}
+
+	input, lines, err := c.openInput()
+	if err != nil {
+		return nil, err
+	}
+
+	if report != nil {
+		report.Lines = lines
+	}
+
+	if c.JSONL {
+		return borges.NewJSONLineJobIter(input, store), nil
+	}
+
+	return borges.NewLineJobIter(input, store), nil
+}
+
+// openInput opens the file with the repositories to pack. If only the failed
+// entries of a report are packed, the original numbers of their lines are
+// also returned.
+func (c *packerCmd) openInput() (io.ReadCloser, []int, error) {
+	f, err := os.Open(c.PositionalArgs.File)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open file %q with repositories: %s",
+			c.PositionalArgs.File, err)
+	}
+
+	if !c.RerunFailed {
+		return f, nil, nil
+	}
+
+	defer f.Close()
+	entries, err := borges.ReadReport(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read report %q: %s",
+			c.PositionalArgs.File, err)
+	}
+
+	var (
+		inputs []string
+		lines  []int
+	)
+	for _, e := range entries {
+		if e.Status == borges.ReportFailed {
+			inputs = append(inputs, e.Input)
+			lines = append(lines, e.Line)
+		}
+	}
+
+	log.With(log.Fields{
+		"entries": len(entries),
+		"failed":  len(inputs),
+	}).Infof("packing failed entries of report")
+
+	input := strings.Join(inputs, "\n")
+	return ioutil.NopCloser(strings.NewReader(input)), lines, nil
+}
+
+func (c *packerCmd) writeReport(report *borges.Report) error {
+	f, err := os.Create(c.Report)
+	if err != nil {
+		return fmt.Errorf("unable to create report %q: %s", c.Report, err)
+	}
+
+	if err := report.Write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write report %q: %s", c.Report, err)
+	}
+
+	return f.Close()
+}
+
+// packStateStoreFile is the file of the state directory where the
+// repositories are kept when no store file is given, so the queued jobs find
+// them when the pack is resumed.
+const packStateStoreFile = "repositories.jsonl"
+
+// openStore opens the store of the repositories to pack.
+func (c *packerCmd) openStore() (borges.RepositoryStore, error) {
+	path := c.StoreFile
+	if path == "" && c.StateDir != "" {
+		path = filepath.Join(c.StateDir, packStateStoreFile)
+	}
+
+	if path == "" {
+		return storage.Local(), nil
+	}
+
+	store, err := storage.OpenFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the repository store: %s", err)
+	}
+
+	return store, nil
+}
+
+// openQueue opens the queue of the jobs to pack. If the pack is being
+// resumed, the number of jobs already queued is returned. The repositories
+// of the jobs not finished must be in the store.
+func (c *packerCmd) openQueue(store borges.RepositoryStore) (queue.Queue, int, error) {
+	if c.StateDir == "" {
+		q, err := memory.NewFinite(true).Queue("jobs")
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to start an in-memory queue: %s", err)
+		}
+
+		return q, 0, nil
+	}
+
+	broker, err := filequeue.New(c.StateDir, true)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to open the state directory: %s", err)
+	}
+
+	q, err := broker.Queue("jobs")
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to open the queue of jobs: %s", err)
+	}
+
+	fq := q.(*filequeue.Queue)
+	stats := fq.Stats()
+	if stats.Published == 0 {
+		return q, 0, nil
+	}
+
+	log.With(log.Fields{
+		"queued":  stats.Published,
+		"acked":   stats.Acked,
+		"buried":  stats.Buried,
+		"pending": stats.Pending,
+	}).Infof("resuming pack")
+
+	for _, qj := range fq.Jobs() {
+		var j borges.Job
+		if err := qj.Decode(&j); err != nil {
+			return nil, 0, fmt.Errorf("unable to decode queued job: %s", err)
+		}
+
+		_, err := store.Get(kallax.ULID(j.RepositoryID))
+		if err == kallax.ErrNotFound {
+			return nil, 0, fmt.Errorf("repository %s of a queued job not found, "+
+				"resume the pack with the same --store-file", j.RepositoryID)
+		}
+
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return q, stats.Published, nil
+}
+
+// packJobIter skips the jobs already queued by an interrupted pack.
+type packJobIter struct {
+	borges.JobIter
+	skip int
+}
+
+func (i *packJobIter) Next() (*borges.Job, error) {
+	for {
+		j, err := i.JobIter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if i.skip > 0 {
+			i.skip--
+			continue
+		}
+
+		return j, nil
+	}
 }
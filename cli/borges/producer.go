@@ -1,13 +1,14 @@
 package main
 
 import (
-	"database/sql"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/src-d/borges"
 	bcli "github.com/src-d/borges/cli"
+	"github.com/src-d/borges/storage"
 
 	"github.com/jessevdk/go-flags"
 	"gopkg.in/src-d/go-cli.v0"
@@ -27,12 +28,13 @@ type producerOpts struct {
 	bcli.DatabaseOpts
 	bcli.MetricsOpts
 
-	database *sql.DB
-	broker   queue.Broker
-	queue    queue.Queue
+	store  storage.Store
+	broker queue.Broker
+	queue  queue.Queue
 
-	QueuePriority uint8 `long:"queue-priority" env:"BORGES_QUEUE_PRIORITY" default:"4" description:"priority used to enqueue jobs, goes from 0 (lowest) to :MAX: (highest)"`
-	JobsRetries   int   `long:"job-retries" env:"BORGES_JOB_RETRIES" default:"5" description:"number of times a falied job should be processed again before reject it"`
+	QueuePriority    uint8  `long:"queue-priority" env:"BORGES_QUEUE_PRIORITY" default:"4" description:"priority used to enqueue jobs, goes from 0 (lowest) to :MAX: (highest)"`
+	JobsRetries      int    `long:"job-retries" env:"BORGES_JOB_RETRIES" default:"5" description:"number of times a falied job should be processed again before reject it"`
+	BlocklistRefresh string `long:"blocklist-refresh" env:"BORGES_BLOCKLIST_REFRESH" default:"1m" description:"elapsed time between reloads of the blocklist from the database, 0 loads it only once"`
 }
 
 func (c *producerOpts) init() error {
@@ -51,7 +53,7 @@ func (c *producerOpts) init() error {
 		return err
 	}
 
-	c.database, err = c.OpenDatabase()
+	c.store, err = c.OpenStore()
 	if err != nil {
 		return err
 	}
@@ -70,6 +72,15 @@ func (c *producerOpts) generateJobs(getIter getIterFunc) error {
 	}
 	defer ioutil.CheckClose(ji, &err)
 
+	if iter, ok := ji.(borges.BlocklistJobIter); ok {
+		refresh, err := time.ParseDuration(c.BlocklistRefresh)
+		if err != nil {
+			return err
+		}
+
+		iter.SetBlocklist(borges.NewBlocklist(c.store, refresh))
+	}
+
 	p := borges.NewProducer(ji, c.queue, queue.Priority(c.QueuePriority), c.JobsRetries)
 
 	p.Start()
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+	"github.com/src-d/borges/storage"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-cli.v0"
+)
+
+func init() {
+	producerCommandAdder.AddCommand(&queryCmd{}, setPrioritySettings)
+}
+
+// queryCmd is a producer subcommand.
+type queryCmd struct {
+	cli.Command `name:"query" short-description:"produce jobs for the repositories selected by a database filter" long-description:"This producer queries the database for the repositories matching all the given filters. For each one of them it generates a job and queues it. Use --dry-run to only print how many repositories match."`
+	producerOpts
+
+	Statuses         []string `long:"status" env:"BORGES_QUERY_STATUSES" env-delim:"," description:"select repositories in this status: pending, fetching, fetched, not_found or auth_req (can be repeated)"`
+	Endpoint         string   `long:"endpoint" env:"BORGES_QUERY_ENDPOINT" description:"select repositories with an endpoint matching this SQL LIKE pattern, e.g. %github.com/src-d/%"`
+	Fork             string   `long:"fork" env:"BORGES_QUERY_FORK" choice:"true" choice:"false" description:"select only forks or only non forks"`
+	FetchedAfter     string   `long:"fetched-after" env:"BORGES_QUERY_FETCHED_AFTER" description:"select repositories last fetched at or after this RFC3339 time"`
+	FetchedBefore    string   `long:"fetched-before" env:"BORGES_QUERY_FETCHED_BEFORE" description:"select repositories last fetched at or before this RFC3339 time"`
+	FetchErrorAfter  string   `long:"fetch-error-after" env:"BORGES_QUERY_FETCH_ERROR_AFTER" description:"select repositories whose last fetch error happened at or after this RFC3339 time"`
+	FetchErrorBefore string   `long:"fetch-error-before" env:"BORGES_QUERY_FETCH_ERROR_BEFORE" description:"select repositories whose last fetch error happened at or before this RFC3339 time"`
+	MinCommitAge     string   `long:"min-commit-age" env:"BORGES_QUERY_MIN_COMMIT_AGE" description:"select repositories whose last commit is older than this duration"`
+	MaxCommitAge     string   `long:"max-commit-age" env:"BORGES_QUERY_MAX_COMMIT_AGE" description:"select repositories whose last commit is newer than this duration"`
+	BatchSize        uint64   `long:"batch-size" env:"BORGES_QUERY_BATCH_SIZE" default:"1000" description:"maximum number of repositories obtained from the database in each query"`
+	DryRun           bool     `long:"dry-run" env:"BORGES_QUERY_DRY_RUN" description:"print the number of selected repositories without queuing them"`
+	Locking          string   `long:"locking" env:"BORGES_LOCKING" description:"locking service of the consumers, needed to select the repositories in fetching status whose lease expired"`
+
+	filter  *storage.RepositoryFilter
+	locking lock.Service
+}
+
+var queryStatuses = []model.FetchStatus{
+	model.Pending,
+	model.Fetching,
+	model.Fetched,
+	model.NotFound,
+	model.AuthRequired,
+}
+
+func (c *queryCmd) Execute(args []string) error {
+	var err error
+	c.filter, err = c.buildFilter(time.Now())
+	if err != nil {
+		return err
+	}
+
+	if c.BatchSize == 0 {
+		return fmt.Errorf("`--batch-size` must be greater than 0")
+	}
+
+	if c.DryRun {
+		return c.count()
+	}
+
+	if err := c.producerOpts.init(); err != nil {
+		return err
+	}
+	defer c.broker.Close()
+
+	if err := c.openLocking(); err != nil {
+		return err
+	}
+
+	if c.locking != nil {
+		defer c.locking.Close()
+	}
+
+	return c.generateJobs(c.jobIter)
+}
+
+func (c *queryCmd) count() error {
+	store, err := c.OpenStore()
+	if err != nil {
+		return err
+	}
+
+	n, err := store.CountByFilter(c.filter)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d repositories selected\n", n)
+	return nil
+}
+
+// openLocking opens the locking service used to check the leases of the
+// repositories in fetching status, which must be shared with the consumers.
+// As the consumers, the leases are kept in the database if the service is
+// not distributed.
+func (c *queryCmd) openLocking() error {
+	var fetching bool
+	for _, s := range c.filter.Statuses {
+		if s == model.Fetching {
+			fetching = true
+		}
+	}
+
+	if !fetching {
+		return nil
+	}
+
+	if c.Locking == "" {
+		return fmt.Errorf("`--status fetching` needs the `--locking` service of the consumers")
+	}
+
+	locking, err := lock.New(c.Locking)
+	if err != nil {
+		return err
+	}
+
+	// consumers with local locking lease the repositories in the database
+	if !lock.IsDistributed(locking) {
+		_ = locking.Close()
+		locking = c.store.LeaseService()
+	}
+
+	c.locking = locking
+	return nil
+}
+
+func (c *queryCmd) jobIter() (borges.JobIter, error) {
+	return borges.NewQueryJobIter(c.store, c.filter, c.BatchSize, c.locking), nil
+}
+
+func (c *queryCmd) buildFilter(now time.Time) (*storage.RepositoryFilter, error) {
+	f := &storage.RepositoryFilter{EndpointPattern: c.Endpoint}
+
+	for _, s := range c.Statuses {
+		status, err := parseStatus(s)
+		if err != nil {
+			return nil, err
+		}
+
+		f.Statuses = append(f.Statuses, status)
+	}
+
+	if c.Fork != "" {
+		isFork := c.Fork == "true"
+		f.IsFork = &isFork
+	}
+
+	times := []struct {
+		flag  string
+		value string
+		dst   *time.Time
+	}{
+		{"fetched-after", c.FetchedAfter, &f.FetchedAfter},
+		{"fetched-before", c.FetchedBefore, &f.FetchedBefore},
+		{"fetch-error-after", c.FetchErrorAfter, &f.FetchErrorAfter},
+		{"fetch-error-before", c.FetchErrorBefore, &f.FetchErrorBefore},
+	}
+
+	for _, t := range times {
+		if t.value == "" {
+			continue
+		}
+
+		v, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid format in the given `--%s` flag: %s", t.flag, err)
+		}
+
+		*t.dst = v
+	}
+
+	ages := []struct {
+		flag  string
+		value string
+		dst   *time.Time
+	}{
+		{"min-commit-age", c.MinCommitAge, &f.LastCommitBefore},
+		{"max-commit-age", c.MaxCommitAge, &f.LastCommitAfter},
+	}
+
+	for _, a := range ages {
+		if a.value == "" {
+			continue
+		}
+
+		v, err := time.ParseDuration(a.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid format in the given `--%s` flag: %s", a.flag, err)
+		}
+
+		*a.dst = now.Add(-v)
+	}
+
+	return f, nil
+}
+
+func parseStatus(s string) (model.FetchStatus, error) {
+	for _, status := range queryStatuses {
+		if string(status) == s {
+			return status, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid status %q in the given `--status` flag", s)
+}
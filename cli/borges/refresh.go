@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/src-d/borges"
+
+	"gopkg.in/src-d/go-cli.v0"
+)
+
+func init() {
+	producerCommandAdder.AddCommand(&refreshCmd{}, setPrioritySettings)
+}
+
+// refreshCmd is a producer subcommand.
+type refreshCmd struct {
+	cli.Command `name:"refresh" short-description:"produce jobs to refresh stale repositories" long-description:"This producer periodically queries the database for fetched repositories that were not fetched for a while. For each one of them, the least recently fetched first, it generates a job and queues it."`
+	producerOpts
+
+	Age       string `long:"age" env:"BORGES_REFRESH_AGE" default:"720h" description:"minimum time elapsed since the last fetch of a repository to refresh it"`
+	BatchSize uint64 `long:"batch-size" env:"BORGES_REFRESH_BATCH_SIZE" default:"1000" description:"maximum number of repositories obtained from the database in each query"`
+	Interval  string `long:"interval" env:"BORGES_REFRESH_INTERVAL" short:"t" default:"10m" description:"elapsed time between queries when there are no stale repositories"`
+
+	age      time.Duration
+	interval time.Duration
+}
+
+func (c *refreshCmd) Execute(args []string) error {
+	var err error
+	c.age, err = time.ParseDuration(c.Age)
+	if err != nil {
+		return fmt.Errorf("invalid format in the given `--age` flag: %s", err)
+	}
+
+	c.interval, err = time.ParseDuration(c.Interval)
+	if err != nil {
+		return fmt.Errorf("invalid format in the given `--interval` flag: %s", err)
+	}
+
+	if c.BatchSize == 0 {
+		return fmt.Errorf("`--batch-size` must be greater than 0")
+	}
+
+	if err := c.producerOpts.init(); err != nil {
+		return err
+	}
+	defer c.broker.Close()
+
+	return c.generateJobs(c.jobIter)
+}
+
+func (c *refreshCmd) jobIter() (borges.JobIter, error) {
+	return borges.NewRefreshJobIter(c.store, c.age, c.BatchSize, c.interval), nil
+}
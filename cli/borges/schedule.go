@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/src-d/borges"
+
+	"gopkg.in/src-d/go-cli.v0"
+)
+
+func init() {
+	producerCommandAdder.AddCommand(&scheduleCmd{}, setPrioritySettings)
+}
+
+// scheduleOpts holds the configuration of the refresh scheduler.
+type scheduleOpts struct {
+	ScheduleMin       string   `long:"schedule-min" env:"BORGES_SCHEDULE_MIN" default:"1h" description:"minimum time between two scheduled fetches of a repository"`
+	ScheduleMax       string   `long:"schedule-max" env:"BORGES_SCHEDULE_MAX" default:"2160h" description:"maximum time between two scheduled fetches of a repository"`
+	ScheduleOverrides []string `long:"schedule-override" env:"BORGES_SCHEDULE_OVERRIDES" env-delim:"," description:"fixed time between fetches for the repositories with an endpoint matching a pattern, in the form pattern=duration (can be repeated)"`
+}
+
+func (c *scheduleOpts) schedulerConfig() (borges.SchedulerConfig, error) {
+	var config borges.SchedulerConfig
+	var err error
+
+	config.MinInterval, err = time.ParseDuration(c.ScheduleMin)
+	if err != nil {
+		return config, fmt.Errorf("invalid format in the given `--schedule-min` flag: %s", err)
+	}
+
+	config.MaxInterval, err = time.ParseDuration(c.ScheduleMax)
+	if err != nil {
+		return config, fmt.Errorf("invalid format in the given `--schedule-max` flag: %s", err)
+	}
+
+	if config.MinInterval > config.MaxInterval {
+		return config, fmt.Errorf("`--schedule-min` must not be greater than `--schedule-max`")
+	}
+
+	for _, o := range c.ScheduleOverrides {
+		idx := strings.LastIndex(o, "=")
+		if idx <= 0 {
+			return config, fmt.Errorf("invalid `--schedule-override` %q, expected pattern=duration", o)
+		}
+
+		interval, err := time.ParseDuration(o[idx+1:])
+		if err != nil {
+			return config, fmt.Errorf("invalid duration in the given `--schedule-override` flag %q: %s", o, err)
+		}
+
+		config.Overrides = append(config.Overrides, borges.ScheduleOverride{
+			Pattern:  o[:idx],
+			Interval: interval,
+		})
+	}
+
+	return config, nil
+}
+
+// scheduleCmd is a producer subcommand.
+type scheduleCmd struct {
+	cli.Command `name:"schedule" short-description:"produce jobs for repositories as their scheduled refresh is due" long-description:"This producer schedules the next fetch of every repository based on its activity and periodically queries the database for repositories whose next fetch is due. For each one of them, the earliest first, it generates a job and queues it. Run the consumer with --schedule to update the schedules after each fetch."`
+	producerOpts
+	scheduleOpts
+
+	BatchSize uint64 `long:"batch-size" env:"BORGES_SCHEDULE_BATCH_SIZE" default:"1000" description:"maximum number of repositories obtained from the database in each query"`
+	Interval  string `long:"interval" env:"BORGES_SCHEDULE_INTERVAL" short:"t" default:"1m" description:"elapsed time between queries when there are no due repositories"`
+
+	config   borges.SchedulerConfig
+	interval time.Duration
+}
+
+func (c *scheduleCmd) Execute(args []string) error {
+	var err error
+	c.config, err = c.schedulerConfig()
+	if err != nil {
+		return err
+	}
+
+	c.interval, err = time.ParseDuration(c.Interval)
+	if err != nil {
+		return fmt.Errorf("invalid format in the given `--interval` flag: %s", err)
+	}
+
+	if c.BatchSize == 0 {
+		return fmt.Errorf("`--batch-size` must be greater than 0")
+	}
+
+	if err := c.producerOpts.init(); err != nil {
+		return err
+	}
+	defer c.broker.Close()
+
+	return c.generateJobs(c.jobIter)
+}
+
+func (c *scheduleCmd) jobIter() (borges.JobIter, error) {
+	scheduler := borges.NewScheduler(c.store, c.config)
+	return borges.NewScheduleJobIter(scheduler, c.BatchSize, c.interval), nil
+}
@@ -0,0 +1,313 @@
+package cli
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+// RootedRepositoriesOpts holds cli configuration for the storage of the
+// rooted repositories.
+type RootedRepositoriesOpts struct {
+	RootRepositoriesDir     string `long:"root-repositories-dir" env:"BORGES_ROOT_REPOSITORIES_DIR" default:"/tmp/root-repositories" description:"path to the directory storing rooted repositories (can be local path or hdfs://), a comma separated list of directories spreads the repositories among them"`
+	RootRepositoriesWeights string `long:"root-repositories-weights" env:"BORGES_ROOT_REPOSITORIES_WEIGHTS" description:"comma separated list of the weights of the directories in --root-repositories-dir, the amount of repositories stored in each of them is proportional to its weight, all of them weigh 1 if empty"`
+	BucketSize              int    `long:"bucket-size" env:"BORGES_BUCKET_SIZE" default:"0" description:"if higher than zero, repositories are stored in bucket directories with a prefix of the given amount of characters from its root hash"`
+	ColdRepositoriesDir     string `long:"cold-repositories-dir" env:"BORGES_COLD_REPOSITORIES_DIR" description:"path to the directory storing the rooted repositories moved to the cold tier (can be local path or hdfs://), they are moved back to the root repositories directory when written, tiering is disabled if empty"`
+	ReplicaRepositoriesDir  string `long:"replica-repositories-dir" env:"BORGES_REPLICA_REPOSITORIES_DIR" description:"path to the directory where the rooted repositories are replicated (can be local path or hdfs://), replication is disabled if empty"`
+	ReplicationMode         string `long:"replication-mode" env:"BORGES_REPLICATION_MODE" choice:"sync" choice:"async" default:"sync" description:"sync fails the writes not replicated, async replicates them in the background keeping the pending ones in --replication-log"`
+	ReplicationLog          string `long:"replication-log" env:"BORGES_REPLICATION_LOG" description:"file where the pending replications are kept in async mode, it must not be shared by several processes"`
+	ReplicationRetry        string `long:"replication-retry" env:"BORGES_REPLICATION_RETRY" default:"1m" description:"time to wait before retrying the failed replications in async mode, units can be specified (s, m, h) like 10s or 10h"`
+
+	remote repository.Fs
+}
+
+// RootedLockingOpts holds cli configuration for the locks of the rooted
+// repositories, taken by the commands that modify them while the consumers
+// are running.
+type RootedLockingOpts struct {
+	Locking        string `long:"locking" env:"BORGES_LOCKING" description:"distributed locking service of the consumers, such as etcd:localhost:2379, the siva files are only modified holding their locks"`
+	LockingTimeout string `long:"locking-timeout" env:"BORGES_LOCKING_TIMEOUT" default:"0" description:"timeout to acquire lock, units can be specified (s, m, h) like 10s or 10h, 0 means no timeout"`
+}
+
+// NewLockSession creates a session of the configured locking service. It
+// fails if no service is configured or if it is not a distributed one, as
+// local locks would not exclude the consumers.
+func (c *RootedLockingOpts) NewLockSession() (lock.Session, error) {
+	if c.Locking == "" {
+		return nil, fmt.Errorf("`--locking` must be the distributed locking service of the consumers")
+	}
+
+	timeout, err := time.ParseDuration(c.LockingTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	locking, err := lock.New(c.Locking)
+	if err != nil {
+		return nil, err
+	}
+
+	if !lock.IsDistributed(locking) {
+		_ = locking.Close()
+		return nil, fmt.Errorf("`--locking` must be a distributed locking service, %s only locks the current process", c.Locking)
+	}
+
+	return locking.NewSession(&lock.SessionConfig{
+		TTL:     10 * time.Second,
+		Timeout: timeout,
+	})
+}
+
+// NewRootedTransactioner creates a transactioner of the rooted repositories
+// with the provided configuration, using the given temporary filesystem to
+// keep the siva files while they are modified. If a cold tier is configured
+// the siva files are moved back from it before being modified, and their
+// tiers are recorded in store unless it is nil.
+func (c *RootedRepositoriesOpts) NewRootedTransactioner(
+	tmp billy.Filesystem,
+	store borges.TierStore,
+) (repository.RootedTransactioner, *repository.Copier, error) {
+	tmp, err := tmp.Chroot("transactioner")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remote, err := c.NewRemoteFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	copier := repository.NewCopier(
+		tmp,
+		remote,
+		c.BucketSize,
+	)
+
+	tiers, err := c.NewTiersOf(remote, store)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	txer := borges.NewTieredTransactioner(
+		repository.NewSivaRootedTransactioner(copier),
+		tiers,
+	)
+
+	return txer, copier, nil
+}
+
+// NewTiers returns the tiers of the rooted repositories, recording them in
+// store unless it is nil. It returns nil if no cold tier is configured.
+func (c *RootedRepositoriesOpts) NewTiers(
+	store borges.TierStore,
+) (*borges.Tiers, error) {
+	remote, err := c.NewRemoteFs()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.NewTiersOf(remote, store)
+}
+
+// NewTiersOf returns the tiers of the rooted repositories stored in the
+// given remote filesystem, recording them in store unless it is nil. It
+// returns nil if no cold tier is configured.
+func (c *RootedRepositoriesOpts) NewTiersOf(
+	remote repository.Fs,
+	store borges.TierStore,
+) (*borges.Tiers, error) {
+	if c.ColdRepositoriesDir == "" {
+		return nil, nil
+	}
+
+	cold, err := newFs(c.ColdRepositoriesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the replica keeps the siva files where they were written
+	if r, ok := remote.(*borges.ReplicatedFs); ok {
+		remote = r.Primary()
+	}
+
+	return borges.NewTiers(remote, cold, c.BucketSize, store), nil
+}
+
+// NewRemoteFs returns the filesystem where the rooted repositories are
+// stored. It is a borges.ShardedFs if several directories are configured,
+// and a borges.ReplicatedFs if a replica is configured. The same filesystem
+// is returned by every call, it must be closed with Close.
+func (c *RootedRepositoriesOpts) NewRemoteFs() (repository.Fs, error) {
+	if c.remote != nil {
+		return c.remote, nil
+	}
+
+	primary, err := c.newPrimaryFs()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ReplicaRepositoriesDir == "" {
+		c.remote = primary
+		return c.remote, nil
+	}
+
+	replica, err := newFs(c.ReplicaRepositoriesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ReplicationMode != "async" {
+		c.remote = borges.NewReplicatedFs(primary, replica)
+		return c.remote, nil
+	}
+
+	if c.ReplicationLog == "" {
+		return nil, fmt.Errorf("--replication-log is needed in async replication mode")
+	}
+
+	retry, err := time.ParseDuration(c.ReplicationRetry)
+	if err != nil {
+		return nil, err
+	}
+
+	rlog, err := borges.OpenReplicationLog(c.ReplicationLog)
+	if err != nil {
+		return nil, err
+	}
+
+	c.remote = borges.NewAsyncReplicatedFs(primary, replica, rlog, retry)
+	return c.remote, nil
+}
+
+func (c *RootedRepositoriesOpts) newPrimaryFs() (repository.Fs, error) {
+	dirs := strings.Split(c.RootRepositoriesDir, ",")
+	if len(dirs) == 1 && c.RootRepositoriesWeights == "" {
+		return newFs(c.RootRepositoriesDir)
+	}
+
+	return c.NewShardedFs()
+}
+
+// NewReplicatedFs returns the filesystem where the rooted repositories are
+// stored with their replica, replicating synchronously.
+func (c *RootedRepositoriesOpts) NewReplicatedFs() (*borges.ReplicatedFs, error) {
+	if c.ReplicaRepositoriesDir == "" {
+		return nil, fmt.Errorf("--replica-repositories-dir is needed")
+	}
+
+	primary, err := c.newPrimaryFs()
+	if err != nil {
+		return nil, err
+	}
+
+	replica, err := newFs(c.ReplicaRepositoriesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return borges.NewReplicatedFs(primary, replica), nil
+}
+
+// Close stops the replication of the filesystem returned by NewRemoteFs, if
+// any. The pending asynchronous replications are resumed when it is created
+// again with the same log.
+func (c *RootedRepositoriesOpts) Close() error {
+	if r, ok := c.remote.(*borges.ReplicatedFs); ok {
+		return r.Close()
+	}
+
+	return nil
+}
+
+// NewShardedFs returns the filesystem where the rooted repositories are
+// stored spread among the configured directories, named after them.
+func (c *RootedRepositoriesOpts) NewShardedFs() (*borges.ShardedFs, error) {
+	dirs := strings.Split(c.RootRepositoriesDir, ",")
+	weights := make([]float64, len(dirs))
+	for i := range weights {
+		weights[i] = 1
+	}
+
+	if c.RootRepositoriesWeights != "" {
+		ws := strings.Split(c.RootRepositoriesWeights, ",")
+		if len(ws) != len(dirs) {
+			return nil, fmt.Errorf(
+				"%d weights given for %d root repositories directories",
+				len(ws), len(dirs),
+			)
+		}
+
+		for i, w := range ws {
+			var err error
+			weights[i], err = strconv.ParseFloat(strings.TrimSpace(w), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight %q: %s", w, err)
+			}
+		}
+	}
+
+	shards := make([]*borges.Shard, len(dirs))
+	for i, dir := range dirs {
+		dir = strings.TrimSpace(dir)
+		fs, err := newFs(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		shards[i] = &borges.Shard{Name: dir, Fs: fs, Weight: weights[i]}
+	}
+
+	return borges.NewShardedFs(shards...)
+}
+
+// NewListableFilesystems returns the filesystems of the directories of
+// --root-repositories-dir followed by --cold-repositories-dir, if any, to
+// list the siva files stored in them. The replica is not included. It fails
+// with hdfs:// directories, as they cannot be listed.
+func (c *RootedRepositoriesOpts) NewListableFilesystems() ([]billy.Filesystem, error) {
+	dirs := strings.Split(c.RootRepositoriesDir, ",")
+	if c.ColdRepositoriesDir != "" {
+		dirs = append(dirs, c.ColdRepositoriesDir)
+	}
+
+	var fss []billy.Filesystem
+	for _, dir := range dirs {
+		dir = strings.TrimSpace(dir)
+		if strings.HasPrefix(dir, "hdfs://") {
+			return nil, fmt.Errorf("cannot list the siva files of %s", dir)
+		}
+
+		fss = append(fss, osfs.New(dir))
+	}
+
+	return fss, nil
+}
+
+func newFs(dir string) (repository.Fs, error) {
+	if !strings.HasPrefix(dir, "hdfs://") {
+		return repository.NewLocalFs(osfs.New(dir)), nil
+	}
+
+	u, err := url.Parse(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	path := u.Path
+	u.Path = ""
+
+	return repository.NewHDFSFs(
+		u.String(),
+		path,
+	), nil
+}
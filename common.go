@@ -6,12 +6,39 @@ import (
 
 	"github.com/satori/go.uuid"
 	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-errors.v1"
 	kallax "gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+	"gopkg.in/src-d/go-queue.v1"
 )
 
 // Job represents a borges job to fetch and archive a repository.
+//
+// All the fields but RepositoryID are optional and omitted from the payload
+// when empty, so jobs without options are encoded as they were before the
+// options existed and jobs already queued are still valid.
 type Job struct {
 	RepositoryID uuid.UUID
+	// Force ignores the stored references of the repository, so all the
+	// fetched references are pushed again to the rooted repositories.
+	Force bool `msgpack:",omitempty"`
+	// Endpoint is used to fetch the repository instead of its endpoints.
+	Endpoint string `msgpack:",omitempty"`
+	// RefPolicy selects the references archived. It overrides the policy of
+	// the Archiver. All of them are archived if both are nil.
+	RefPolicy *RefPolicy `msgpack:",omitempty"`
+	// Timeout overrides the timeout of the Archiver to process the job.
+	Timeout time.Duration `msgpack:",omitempty"`
+	// CorrelationID is an identifier given by the caller that is added to
+	// the logs and notifications of the job.
+	CorrelationID string `msgpack:",omitempty"`
+
+	// Priority overrides the priority used by the producer to queue the job.
+	// It is not part of the job payload.
+	Priority *queue.Priority `msgpack:"-"`
+	// Retries overrides the number of retries used by the producer to queue
+	// the job. It is not part of the job payload.
+	Retries *int `msgpack:"-"`
 }
 
 // JobIter is an iterator of Job.
@@ -21,6 +48,24 @@ type JobIter interface {
 	Next() (*Job, error)
 }
 
+// AckJobIter is a JobIter whose jobs come from a source that has to be told
+// when they are safely queued, so they are not lost if they cannot be
+// published.
+type AckJobIter interface {
+	JobIter
+	// Ack is called with the last job returned by Next once it was
+	// published, or failed to be published with the given error.
+	Ack(j *Job, err error) error
+}
+
+// LineJobIter is a JobIter that reads the jobs from the lines of a text.
+type LineJobIter interface {
+	JobIter
+	// Line returns the number, starting at 1, and the content of the line
+	// read by the last call to Next, even if it returned an error.
+	Line() (int, string)
+}
+
 // RepositoryStore is the access layer to the storage of repositories.
 type RepositoryStore interface {
 	// Create inserts a new Repository in the store.
@@ -54,17 +99,59 @@ type RepositoryStore interface {
 	UpdateFetched(repo *model.Repository, fetchedAt time.Time) error
 }
 
+// ErrRepositoryTakenDown is returned by RepositoryID when the endpoints
+// belong to a repository that was taken down.
+var ErrRepositoryTakenDown = errors.NewKind("repository with endpoints %v was taken down")
+
+// TakedownChecker is implemented by the repository stores that keep a record
+// of the repositories taken down.
+type TakedownChecker interface {
+	// IsTakenDown returns true if any of the endpoints belongs to a
+	// repository that was taken down.
+	IsTakenDown(endpoints ...string) (bool, error)
+}
+
 // RepositoryID tries to find a repository by the endpoint into the database.
-// If no repository is found, it creates a new one and returns the ID.
+// If no repository is found, it creates a new one and returns the ID. The
+// repositories are looked up by the endpoints and their canonical form with
+// the DefaultCanonicalizer. The endpoints are stored as they are given,
+// followed by their canonical forms, so the repository is found with any
+// other spelling of them, but it is only fetched from the canonical ones if
+// they were also given, see FetchEndpoints. If the store is a
+// TakedownChecker, ErrRepositoryTakenDown is returned for the endpoints of
+// repositories taken down.
 func RepositoryID(endpoints []string, isFork *bool, storer RepositoryStore) (uuid.UUID, error) {
-	repositories, err := storer.GetByEndpoints(endpoints...)
+	lookup := append([]string(nil), endpoints...)
+	given := make(map[string]bool, len(endpoints))
+	for _, e := range endpoints {
+		given[e] = true
+	}
+
+	for _, e := range CanonicalEndpoints(DefaultCanonicalizer, endpoints) {
+		if !given[e] {
+			lookup = append(lookup, e)
+		}
+	}
+
+	if checker, ok := storer.(TakedownChecker); ok {
+		takenDown, err := checker.IsTakenDown(lookup...)
+		if err != nil {
+			return uuid.Nil, err
+		}
+
+		if takenDown {
+			return uuid.Nil, ErrRepositoryTakenDown.New(endpoints)
+		}
+	}
+
+	repositories, err := storer.GetByEndpoints(lookup...)
 	if err != nil {
 		return uuid.Nil, err
 	}
 
 	if len(repositories) == 0 {
 		r := model.NewRepository()
-		r.Endpoints = endpoints
+		r.Endpoints = lookup
 		r.IsFork = isFork
 		if err := storer.Create(r); err != nil {
 			return uuid.Nil, err
@@ -73,12 +160,22 @@ func RepositoryID(endpoints []string, isFork *bool, storer RepositoryStore) (uui
 		return uuid.UUID(r.ID), nil
 	}
 
-	// TODO log error printing the ids and the endpoint
-
 	r := repositories[0]
+	if len(repositories) > 1 {
+		ids := make([]kallax.ULID, len(repositories))
+		for i, r := range repositories {
+			ids[i] = r.ID
+		}
+
+		log.With(log.Fields{
+			"ids":       ids,
+			"endpoints": endpoints,
+			"used":      r.ID,
+		}).Warningf("several repositories found for the endpoints, they must be merged with merge-repos")
+	}
 
 	// check if the existing repository has all the aliases
-	allEndpoints, update := getUniqueEndpoints(r.Endpoints, endpoints)
+	allEndpoints, update := getUniqueEndpoints(r.Endpoints, lookup)
 
 	if update {
 		if err := storer.SetEndpoints(r, allEndpoints...); err != nil {
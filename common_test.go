@@ -8,6 +8,7 @@ import (
 	"github.com/src-d/borges/storage"
 
 	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"gopkg.in/src-d/core-retrieval.v0/model"
 	"gopkg.in/src-d/core-retrieval.v0/test"
@@ -25,6 +26,32 @@ func TestCommon(t *testing.T) {
 	suite.Run(t, new(RepositoryIDSuite))
 }
 
+func TestRepositoryIDLocalStore(t *testing.T) {
+	require := require.New(t)
+	store := storage.Local()
+
+	id1, err := RepositoryID([]string{"https://github.com/a/b.git"}, nil, store)
+	require.NoError(err)
+
+	id2, err := RepositoryID([]string{"git://github.com/a/b"}, nil, store)
+	require.NoError(err)
+
+	id3, err := RepositoryID([]string{"https://github.com/A/b/"}, nil, store)
+	require.NoError(err)
+
+	require.Equal(id1, id2)
+	require.Equal(id1, id3)
+
+	r, err := store.Get(kallax.ULID(id1))
+	require.NoError(err)
+	require.Contains(r.Endpoints, "https://github.com/a/b")
+	require.ElementsMatch([]string{
+		"https://github.com/a/b.git",
+		"git://github.com/a/b",
+		"https://github.com/A/b/",
+	}, FetchEndpoints(DefaultCanonicalizer, r.Endpoints))
+}
+
 type BaseQueueSuite struct {
 	test.Suite
 	broker    queue.Broker
@@ -40,6 +67,7 @@ func (s *BaseQueueSuite) SetupSuite() {
 func (s *BaseQueueSuite) SetupTest() {
 	s.connectQueue()
 	s.Suite.Setup()
+	s.Require().NoError(storage.CreateSchema(s.DB))
 }
 
 func (s *BaseQueueSuite) TearDownTest() {
@@ -124,6 +152,72 @@ func (s *RepositoryIDSuite) TestRepositoryIDNotEqualID() {
 	s.Equal(2, len(b))
 }
 
+func (s *RepositoryIDSuite) TestRepositoryIDCanonicalUrls() {
+	id1, err := RepositoryID([]string{"https://github.com/src-d/borges"}, nil, s.storer)
+	s.NoError(err)
+
+	id2, err := RepositoryID([]string{"git://github.com/src-d/borges.git"}, nil, s.storer)
+	s.NoError(err)
+
+	id3, err := RepositoryID([]string{"https://GitHub.com/src-d/borges/"}, nil, s.storer)
+	s.NoError(err)
+
+	s.Equal(id1, id2)
+	s.Equal(id1, id3)
+	s.ElementsMatch([]string{
+		"https://github.com/src-d/borges",
+		"git://github.com/src-d/borges.git",
+		"https://GitHub.com/src-d/borges/",
+	}, s.getRepository(id1).Endpoints)
+}
+
+func (s *RepositoryIDSuite) TestRepositoryIDNotCanonicalStored() {
+	r := model.NewRepository()
+	r.Endpoints = []string{"git://github.com/src-d/borges.git"}
+	s.NoError(s.storer.Create(r))
+
+	id, err := RepositoryID([]string{"git://github.com/src-d/borges.git"}, nil, s.storer)
+	s.NoError(err)
+
+	s.Equal(uuid.UUID(r.ID), id)
+	s.ElementsMatch([]string{
+		"git://github.com/src-d/borges.git",
+		"https://github.com/src-d/borges",
+	}, s.getRepository(id).Endpoints)
+}
+
+func (s *RepositoryIDSuite) TestRepositoryIDKeepsOriginalEndpoints() {
+	endpoints := []string{
+		"git@git.example.com:foo/bar.git",
+		"git@github.com:src-d/private.git",
+	}
+
+	id, err := RepositoryID(endpoints, nil, s.storer)
+	s.NoError(err)
+
+	stored := s.getRepository(id).Endpoints
+	s.Equal(append(endpoints, "https://github.com/src-d/private"), stored)
+	s.Equal(endpoints, FetchEndpoints(DefaultCanonicalizer, stored))
+
+	id2, err := RepositoryID(endpoints[1:], nil, s.storer)
+	s.NoError(err)
+	s.Equal(id, id2)
+}
+
+func (s *RepositoryIDSuite) TestRepositoryIDNonCanonicalSpellings() {
+	id1, err := RepositoryID([]string{"https://github.com/src-d/borges.git"}, nil, s.storer)
+	s.NoError(err)
+
+	id2, err := RepositoryID([]string{"git://github.com/src-d/borges"}, nil, s.storer)
+	s.NoError(err)
+
+	id3, err := RepositoryID([]string{"https://github.com/SRC-D/borges/"}, nil, s.storer)
+	s.NoError(err)
+
+	s.Equal(id1, id2)
+	s.Equal(id1, id3)
+}
+
 func (s *RepositoryIDSuite) getRepository(id uuid.UUID) *model.Repository {
 	repo, err := s.storer.Get(kallax.ULID(id))
 	s.NoError(err)
@@ -132,6 +226,7 @@ func (s *RepositoryIDSuite) getRepository(id uuid.UUID) *model.Repository {
 
 func (s *RepositoryIDSuite) SetupTest() {
 	s.Setup()
+	s.Require().NoError(storage.CreateSchema(s.DB))
 
 	s.storer = storage.FromDatabase(s.DB)
 
@@ -0,0 +1,266 @@
+package borges
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// DiscoverOptions are the options of the repositories found by a
+// discovering JobIter.
+type DiscoverOptions struct {
+	// Submodules also returns the checkouts of submodules found inside other
+	// repositories.
+	Submodules bool
+	// Worktrees also returns the linked worktrees of other repositories.
+	Worktrees bool
+}
+
+type discoverJobIter struct {
+	storer RepositoryStore
+	root   string
+	opts   DiscoverOptions
+
+	paths   []string
+	walked  bool
+	current int
+}
+
+// NewDiscoverJobIter returns a JobIter that walks the directory tree under
+// root and returns a job for every local repository found, in lexical order
+// of their paths. Both repositories with a working tree and bare repositories
+// are found, and their endpoints are built the same way as the ones of the
+// paths read by a LineJobIter. Submodule checkouts and linked worktrees are
+// skipped unless they are enabled in the options. The returned iterator is a
+// LineJobIter whose lines are the paths of the repositories.
+func NewDiscoverJobIter(
+	root string,
+	storer RepositoryStore,
+	opts DiscoverOptions,
+) JobIter {
+	return &discoverJobIter{
+		storer: storer,
+		root:   root,
+		opts:   opts,
+	}
+}
+
+func (i *discoverJobIter) Next() (*Job, error) {
+	if !i.walked {
+		paths, err := discoverRepositories(i.root, i.opts)
+		if err != nil {
+			return nil, err
+		}
+
+		i.paths = paths
+		i.walked = true
+	}
+
+	if i.current >= len(i.paths) {
+		return nil, io.EOF
+	}
+
+	i.current++
+	endpoint, err := normalizeEndpoint(i.paths[i.current-1])
+	if err != nil {
+		return nil, err
+	}
+
+	ID, err := RepositoryID([]string{endpoint}, nil, i.storer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Job{RepositoryID: ID}, nil
+}
+
+// Line honors the LineJobIter interface.
+func (i *discoverJobIter) Line() (int, string) {
+	if i.current == 0 {
+		return 0, ""
+	}
+
+	return i.current, i.paths[i.current-1]
+}
+
+// Close honors the JobIter interface.
+func (i *discoverJobIter) Close() error {
+	return nil
+}
+
+type repositoryKind int
+
+const (
+	notRepository repositoryKind = iota
+	workingTreeRepository
+	bareRepository
+	submoduleRepository
+	linkedWorktreeRepository
+)
+
+// discoverRepositories returns the paths of the repositories under root.
+func discoverRepositories(root string, opts DiscoverOptions) ([]string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	var (
+		paths []string
+		// submodules are the paths of the submodules declared by the
+		// repositories found so far.
+		submodules = make(map[string]bool)
+	)
+
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+
+			log.With(log.Fields{"path": path}).Warningf(
+				"skipping path while discovering repositories: %s", err)
+			return nil
+		}
+
+		if !fi.IsDir() {
+			return nil
+		}
+
+		if fi.Name() == ".git" && path != root {
+			return filepath.SkipDir
+		}
+
+		kind := repositoryKindOf(path)
+		if kind == workingTreeRepository && submodules[path] {
+			kind = submoduleRepository
+		}
+
+		switch kind {
+		case notRepository:
+			return nil
+		case bareRepository:
+			paths = append(paths, path)
+			return filepath.SkipDir
+		case submoduleRepository:
+			if !opts.Submodules {
+				return filepath.SkipDir
+			}
+		case linkedWorktreeRepository:
+			if !opts.Worktrees {
+				return filepath.SkipDir
+			}
+		}
+
+		paths = append(paths, path)
+		for _, p := range declaredSubmodules(path) {
+			submodules[p] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// repositoryKindOf returns the kind of repository in the given directory.
+func repositoryKindOf(path string) repositoryKind {
+	dotGit := filepath.Join(path, ".git")
+	fi, err := os.Stat(dotGit)
+	switch {
+	case err == nil && fi.IsDir():
+		if isGitDir(dotGit) {
+			return workingTreeRepository
+		}
+
+		return notRepository
+	case err == nil:
+		gitDir, err := readGitFile(dotGit)
+		if err != nil {
+			return notRepository
+		}
+
+		if _, err := os.Stat(filepath.Join(gitDir, "commondir")); err == nil {
+			return linkedWorktreeRepository
+		}
+
+		return submoduleRepository
+	}
+
+	if isGitDir(path) {
+		if _, err := os.Stat(filepath.Join(path, "refs")); err == nil {
+			return bareRepository
+		}
+	}
+
+	return notRepository
+}
+
+// isGitDir returns whether the given directory looks like a git directory.
+func isGitDir(path string) bool {
+	fi, err := os.Stat(filepath.Join(path, "objects"))
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+
+	_, err = os.Stat(filepath.Join(path, "HEAD"))
+	return err == nil
+}
+
+// readGitFile returns the absolute path of the git directory referenced by
+// a .git file, as the ones of submodule checkouts and linked worktrees.
+func readGitFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	line := strings.TrimSpace(string(content))
+	if !strings.HasPrefix(line, "gitdir:") {
+		return "", os.ErrNotExist
+	}
+
+	gitDir := strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(path), gitDir)
+	}
+
+	return filepath.Clean(gitDir), nil
+}
+
+// declaredSubmodules returns the absolute paths of the submodules declared
+// in the .gitmodules file of the repository with a working tree in path.
+func declaredSubmodules(path string) []string {
+	content, err := ioutil.ReadFile(filepath.Join(path, ".gitmodules"))
+	if err != nil {
+		return nil
+	}
+
+	modules := config.NewModules()
+	if err := modules.Unmarshal(content); err != nil {
+		log.With(log.Fields{"path": path}).Warningf(
+			"unable to read .gitmodules: %s", err)
+		return nil
+	}
+
+	var paths []string
+	for _, m := range modules.Submodules {
+		if m.Path != "" {
+			paths = append(paths, filepath.Join(path, filepath.FromSlash(m.Path)))
+		}
+	}
+
+	return paths
+}
@@ -0,0 +1,162 @@
+package borges
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/src-d/borges/storage"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestDiscoverJobIter(t *testing.T) {
+	suite.Run(t, new(DiscoverJobIterSuite))
+}
+
+type DiscoverJobIterSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *DiscoverJobIterSuite) SetupTest() {
+	require := s.Require()
+
+	var err error
+	s.dir, err = ioutil.TempDir("", "borges-discover")
+	require.NoError(err)
+
+	s.init("a", false)
+	s.init("b.git", true)
+	s.init("c/d", false)
+	s.init("a/nested", false)
+	s.mkdir("empty")
+
+	s.write("a/.gitmodules", "[submodule \"sub\"]\n\tpath = sub\n\turl = git://foo/sub.git\n")
+	_, err = git.PlainInit(s.path("a/.git/modules/sub"), true)
+	require.NoError(err)
+	s.write("a/sub/.git", "gitdir: ../.git/modules/sub\n")
+
+	s.mkdir("a/.git/worktrees/wt")
+	s.write("a/.git/worktrees/wt/commondir", "../..\n")
+	s.write("a/.git/worktrees/wt/HEAD", "ref: refs/heads/wt\n")
+	s.write("wt/.git", "gitdir: "+s.path("a/.git/worktrees/wt")+"\n")
+}
+
+func (s *DiscoverJobIterSuite) TearDownTest() {
+	s.NoError(os.RemoveAll(s.dir))
+}
+
+func (s *DiscoverJobIterSuite) TestDiscover() {
+	s.assertDiscovered(s.dir, DiscoverOptions{},
+		"a", "a/nested", "b.git", "c/d")
+}
+
+func (s *DiscoverJobIterSuite) TestDiscoverSubmodules() {
+	s.assertDiscovered(s.dir, DiscoverOptions{Submodules: true},
+		"a", "a/nested", "a/sub", "b.git", "c/d")
+}
+
+func (s *DiscoverJobIterSuite) TestDiscoverWorktrees() {
+	s.assertDiscovered(s.dir, DiscoverOptions{Worktrees: true},
+		"a", "a/nested", "b.git", "c/d", "wt")
+}
+
+func (s *DiscoverJobIterSuite) TestDiscoverRepositoryRoot() {
+	s.assertDiscovered(s.path("a"), DiscoverOptions{}, "a", "a/nested")
+}
+
+func (s *DiscoverJobIterSuite) TestEndpoints() {
+	require := s.Require()
+
+	store := storage.Local()
+	iter := NewDiscoverJobIter(s.dir, store, DiscoverOptions{Submodules: true})
+
+	expected := map[string]string{
+		"a":        "file://" + s.path("a/.git"),
+		"a/nested": "file://" + s.path("a/nested/.git"),
+		"a/sub":    "file://" + s.path("a/sub/.git"),
+		"b.git":    "file://" + s.path("b.git"),
+		"c/d":      "file://" + s.path("c/d/.git"),
+	}
+
+	for {
+		j, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+
+		_, path := iter.(LineJobIter).Line()
+		rel, err := filepath.Rel(s.dir, path)
+		require.NoError(err)
+
+		r, err := store.Get(kallax.ULID(j.RepositoryID))
+		require.NoError(err)
+		require.Equal([]string{expected[rel]}, r.Endpoints)
+
+		gitDir, ok := localGitDir(r.Endpoints[0])
+		require.True(ok, rel)
+		require.True(isGitDir(gitDir), rel)
+	}
+
+	require.NoError(iter.Close())
+}
+
+func (s *DiscoverJobIterSuite) TestNonExistentRoot() {
+	iter := NewDiscoverJobIter(s.path("missing"), storage.Local(), DiscoverOptions{})
+	_, err := iter.Next()
+	s.True(os.IsNotExist(err))
+}
+
+func (s *DiscoverJobIterSuite) assertDiscovered(
+	root string,
+	opts DiscoverOptions,
+	expected ...string,
+) {
+	require := s.Require()
+
+	iter := NewDiscoverJobIter(root, storage.Local(), opts)
+
+	var obtained []string
+	for {
+		_, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+
+		n, path := iter.(LineJobIter).Line()
+		require.Equal(len(obtained)+1, n)
+		obtained = append(obtained, path)
+	}
+
+	var paths []string
+	for _, p := range expected {
+		paths = append(paths, s.path(p))
+	}
+
+	require.Equal(paths, obtained)
+}
+
+func (s *DiscoverJobIterSuite) init(path string, bare bool) {
+	_, err := git.PlainInit(s.path(path), bare)
+	s.Require().NoError(err)
+}
+
+func (s *DiscoverJobIterSuite) mkdir(path string) {
+	s.Require().NoError(os.MkdirAll(s.path(path), 0755))
+}
+
+func (s *DiscoverJobIterSuite) write(path, content string) {
+	s.mkdir(filepath.Dir(path))
+	s.Require().NoError(ioutil.WriteFile(s.path(path), []byte(content), 0644))
+}
+
+func (s *DiscoverJobIterSuite) path(path string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path))
+}
@@ -2,101 +2,207 @@ package borges
 
 import (
 	"io"
-	"time"
+	"sync"
 
 	"gopkg.in/src-d/go-log.v1"
 	"gopkg.in/src-d/go-queue.v1"
 )
 
+// DefaultExecutorBufferSize is the default maximum number of jobs queued by
+// an Executor that are not finished yet.
+const DefaultExecutorBufferSize = 1000
+
+// ExecutorSummary holds the outcome of the jobs processed by an Executor.
+type ExecutorSummary struct {
+	// Queued is the number of jobs queued from the job iterator.
+	Queued int
+	// Invalid is the number of entries of the job iterator that could not
+	// be turned into jobs.
+	Invalid int
+	// Succeeded is the number of jobs processed successfully.
+	Succeeded int
+	// Failed is the number of jobs that failed and were not retried.
+	Failed int
+	// Retried is the number of times a failed job was queued again.
+	Retried int
+}
+
 // Executor retrieves jobs from an job iterator and passes them to a worker
 // pool to be executed. Executor acts as a producer-consumer in a single
-// component.
+// component: jobs are queued while the previous ones are processed.
 type Executor struct {
+	// BufferSize is the maximum number of jobs queued that are not finished
+	// yet. The iterator is not read while the limit is reached.
+	BufferSize int
+
 	wp    *WorkerPool
 	q     queue.Queue
 	store RepositoryStore
 	iter  JobIter
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queued are the IDs of the jobs queued by the executor that are not
+	// finished yet.
+	queued       map[string]struct{}
+	inflight     int
+	producerDone bool
+	producerErr  error
+	summary      ExecutorSummary
+	// changed receives a value when new jobs may be available in the queue.
+	changed chan struct{}
 }
 
-// NewExecutor creates a new job executor.
+// NewExecutor creates a new job executor. The given queue must be finite,
+// that is, its iterators must return io.EOF when there are no jobs left.
 func NewExecutor(
 	q queue.Queue,
 	pool *WorkerPool,
 	store RepositoryStore, iter JobIter,
 ) *Executor {
-	return &Executor{
-		wp:    pool,
-		q:     q,
-		store: store,
-		iter:  iter,
+	e := &Executor{
+		BufferSize: DefaultExecutorBufferSize,
+		wp:         pool,
+		q:          q,
+		store:      store,
+		iter:       iter,
+		queued:     make(map[string]struct{}),
+		changed:    make(chan struct{}, 1),
 	}
+
+	e.cond = sync.NewCond(&e.mu)
+	return e
 }
 
-// Execute will queue all jobs and distribute them across the worker pool for
-// them to be executed.
-func (p *Executor) Execute() error {
-	if err := p.queueJobs(); err != nil {
-		return err
+// Execute queues the jobs of the iterator and distributes them across the
+// worker pool at the same time. Jobs already in the queue are also processed.
+// It returns when the iterator is exhausted and all the jobs are finished,
+// after closing the worker pool.
+func (p *Executor) Execute() (*ExecutorSummary, error) {
+	go p.produce()
+
+	err := p.consume()
+	if cerr := p.wp.Close(); err == nil {
+		err = cerr
 	}
 
-	var errCh = make(chan error)
-	go func() {
-		errCh <- p.start()
-	}()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		err = p.producerErr
+	}
 
-	return <-errCh
+	summary := p.summary
+	return &summary, err
 }
 
-func (p *Executor) start() error {
-	for {
-		if err := p.consumeJobs(); err == io.EOF {
-			return p.wp.Close()
-		} else if err != nil {
-			log.Errorf(err, "error consuming jobs")
-		}
+func (p *Executor) produce() {
+	log.Debugf("queueing jobs")
+	err := p.queueJobs()
 
-		<-time.After(5 * time.Second)
-	}
+	p.mu.Lock()
+	p.producerDone = true
+	p.producerErr = err
+	queued := p.summary.Queued
+	p.mu.Unlock()
+
+	p.notify()
+	log.With(log.Fields{"jobs": queued}).Debugf("jobs queued")
 }
 
 func (p *Executor) queueJobs() error {
-	log.Debugf("queueing jobs")
-	var n int
 	for {
+		p.waitBuffer()
+
 		job, err := p.iter.Next()
 		if err == io.EOF {
-			log.With(log.Fields{"jobs": n}).Debugf("jobs queued")
 			return nil
 		}
 
 		if err != nil {
 			p.logError(err)
+			p.mu.Lock()
+			p.summary.Invalid++
+			p.mu.Unlock()
 			continue
 		}
 
-		qj, err := queue.NewJob()
+		qj, err := NewQueueJob(job, queue.PriorityNormal, 0)
 		if err != nil {
 			return err
 		}
 
-		if err = qj.Encode(&job); err != nil {
+		p.mu.Lock()
+		p.queued[qj.ID] = struct{}{}
+		p.mu.Unlock()
+
+		if err := p.q.Publish(qj); err != nil {
+			p.mu.Lock()
+			delete(p.queued, qj.ID)
+			p.mu.Unlock()
 			return err
 		}
 
-		if err := p.q.Publish(qj); err != nil {
+		p.mu.Lock()
+		p.summary.Queued++
+		p.mu.Unlock()
+		p.notify()
+	}
+}
+
+// waitBuffer blocks while the number of jobs queued and not finished is
+// over the buffer size.
+func (p *Executor) waitBuffer() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.BufferSize > 0 && len(p.queued) >= p.BufferSize {
+		p.cond.Wait()
+	}
+}
+
+func (p *Executor) consume() error {
+	for {
+		// if nothing can queue more jobs and the queue is empty afterwards,
+		// every job is finished
+		finished := p.finished()
+
+		n, err := p.consumeJobs()
+		if err != nil {
 			return err
 		}
 
-		n++
+		if n > 0 {
+			continue
+		}
+
+		if finished {
+			return nil
+		}
+
+		<-p.changed
 	}
 }
 
-func (p *Executor) consumeJobs() error {
+// finished returns whether the producer is done and there are no jobs being
+// processed, which could be queued again to be retried.
+func (p *Executor) finished() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.producerDone && p.inflight == 0
+}
+
+// consumeJobs passes the jobs in the queue to the worker pool until it is
+// empty and returns how many jobs were passed.
+func (p *Executor) consumeJobs() (int, error) {
 	iter, err := p.q.Consume(p.wp.Len())
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer iter.Close()
 
+	var n int
 	for {
 		j, err := iter.Next()
 		if queue.ErrEmptyJob.Is(err) {
@@ -104,31 +210,115 @@ func (p *Executor) consumeJobs() error {
 			continue
 		}
 
-		if queue.ErrAlreadyClosed.Is(err) {
-			return io.EOF
+		if err == io.EOF || queue.ErrAlreadyClosed.Is(err) {
+			return n, nil
 		}
 
 		if err != nil {
-			return err
+			return n, err
 		}
 
 		if j == nil {
-			_ = iter.Close()
-			return io.EOF
+			return n, nil
 		}
 
+		n++
+		p.mu.Lock()
+		p.inflight++
+		p.mu.Unlock()
+
+		j.Acknowledger = &executorAcknowledger{Acknowledger: j.Acknowledger, e: p, id: j.ID}
+
 		var job Job
 		if err := j.Decode(&job); err != nil {
 			p.logError(err)
 			if err := j.Reject(false); err != nil {
 				p.logError(err)
 			}
-		} else {
-			p.wp.Do(&WorkerJob{&job, j, p.q})
+
+			continue
 		}
+
+		p.wp.Do(&WorkerJob{&job, j, &executorQueue{p.q}})
+	}
+}
+
+// done records the end of the processing of a job. If retried is true, the
+// job was queued again.
+func (p *Executor) done(id string, succeeded, retried bool) {
+	p.mu.Lock()
+	p.inflight--
+	switch {
+	case retried:
+		p.summary.Retried++
+	case succeeded:
+		p.summary.Succeeded++
+	default:
+		p.summary.Failed++
+	}
+
+	if !retried {
+		delete(p.queued, id)
+		p.cond.Broadcast()
+	}
+	p.mu.Unlock()
+
+	p.notify()
+}
+
+func (p *Executor) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
 	}
 }
 
 func (p *Executor) logError(err error) {
 	log.Errorf(err, "error occurred")
 }
+
+// executorAcknowledger records the outcome of the jobs in the Executor.
+type executorAcknowledger struct {
+	queue.Acknowledger
+	e  *Executor
+	id string
+	// retried is true if the job was published again to be retried.
+	retried bool
+}
+
+func (a *executorAcknowledger) Ack() error {
+	err := a.Acknowledger.Ack()
+	a.e.done(a.id, true, a.retried)
+	return err
+}
+
+func (a *executorAcknowledger) Reject(requeue bool) error {
+	err := a.Acknowledger.Reject(requeue)
+	a.e.done(a.id, false, requeue)
+	return err
+}
+
+// executorQueue is the queue used by the workers to publish again the jobs
+// that must be retried.
+type executorQueue struct {
+	queue.Queue
+}
+
+func (q *executorQueue) Publish(j *queue.Job) error {
+	a, ok := j.Acknowledger.(*executorAcknowledger)
+	if !ok {
+		return q.Queue.Publish(j)
+	}
+
+	// a copy is published because the worker acknowledges the job after
+	// publishing it, and the queue may need its own acknowledger to tell
+	// that the job is being retried
+	retry := *j
+	retry.Acknowledger = a.Acknowledger
+	if err := q.Queue.Publish(&retry); err != nil {
+		return err
+	}
+
+	a.retried = true
+	return nil
+}
@@ -2,16 +2,23 @@ package borges
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/src-d/borges/storage"
 
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"gopkg.in/src-d/core-retrieval.v0/test"
 	"gopkg.in/src-d/go-kallax.v1"
 	"gopkg.in/src-d/go-log.v1"
+	"gopkg.in/src-d/go-queue.v1"
 	"gopkg.in/src-d/go-queue.v1/memory"
 )
 
@@ -67,9 +74,146 @@ func (s *ExecutorSuite) runExecutor(repos ...string) ([]*Job, error) {
 
 	e := NewExecutor(q, wp, s.store, NewLineJobIter(r, s.store))
 
-	return jobs, e.Execute()
+	summary, err := e.Execute()
+	if err == nil {
+		s.Equal(&ExecutorSummary{Queued: len(repos), Succeeded: len(repos)}, summary)
+	}
+
+	return jobs, err
 }
 
 func TestExecutor(t *testing.T) {
 	suite.Run(t, new(ExecutorSuite))
 }
+
+func TestExecutorStreaming(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.NewFinite(true).Queue(kallax.NewULID().String())
+	require.NoError(err)
+
+	iter := &sliceJobIter{}
+	for i := 0; i < 100; i++ {
+		iter.jobs = append(iter.jobs, &Job{RepositoryID: uuid.UUID(kallax.NewULID())})
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	wp := NewWorkerPool(func(ctx context.Context, logger log.Logger, j *Job) error {
+		once.Do(func() { close(started) })
+		<-release
+		return nil
+	})
+	wp.SetWorkerCount(2)
+
+	e := NewExecutor(q, wp, storage.Local(), iter)
+	e.BufferSize = 5
+
+	var summary *ExecutorSummary
+	done := make(chan struct{})
+	go func() {
+		summary, err = e.Execute()
+		close(done)
+	}()
+
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(5, iter.read())
+
+	close(release)
+	<-done
+	require.NoError(err)
+	require.Equal(&ExecutorSummary{Queued: 100, Succeeded: 100}, summary)
+	require.Equal(100, iter.read())
+}
+
+func TestExecutorSummary(t *testing.T) {
+	require := require.New(t)
+
+	q, err := memory.NewFinite(true).Queue(kallax.NewULID().String())
+	require.NoError(err)
+
+	// a job queued by a previous execution
+	previous := &Job{RepositoryID: uuid.UUID(kallax.NewULID())}
+	qj, err := NewQueueJob(previous, queue.PriorityNormal, 0)
+	require.NoError(err)
+	require.NoError(q.Publish(qj))
+
+	retries := 1
+	failing := &Job{RepositoryID: uuid.UUID(kallax.NewULID())}
+	retried := &Job{RepositoryID: uuid.UUID(kallax.NewULID()), Retries: &retries}
+	iter := &sliceJobIter{
+		jobs: []*Job{
+			{RepositoryID: uuid.UUID(kallax.NewULID())},
+			failing,
+			nil,
+			retried,
+		},
+	}
+
+	var mu sync.Mutex
+	var attempts int
+	wp := NewWorkerPool(func(ctx context.Context, logger log.Logger, j *Job) error {
+		switch j.RepositoryID {
+		case failing.RepositoryID:
+			return fmt.Errorf("failed")
+		case retried.RepositoryID:
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if attempts == 1 {
+				return fmt.Errorf("temporary failure")
+			}
+		}
+
+		return nil
+	})
+	wp.SetWorkerCount(2)
+
+	summary, err := NewExecutor(q, wp, storage.Local(), iter).Execute()
+	require.NoError(err)
+	require.Equal(&ExecutorSummary{
+		Queued:    3,
+		Invalid:   1,
+		Succeeded: 3,
+		Failed:    1,
+		Retried:   1,
+	}, summary)
+	require.Equal(2, attempts)
+}
+
+// sliceJobIter returns the jobs of a slice. A nil job is returned as an
+// error.
+type sliceJobIter struct {
+	mu   sync.Mutex
+	jobs []*Job
+	pos  int
+}
+
+func (i *sliceJobIter) Next() (*Job, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.pos >= len(i.jobs) {
+		return nil, io.EOF
+	}
+
+	j := i.jobs[i.pos]
+	i.pos++
+	if j == nil {
+		return nil, fmt.Errorf("invalid job")
+	}
+
+	return j, nil
+}
+
+func (i *sliceJobIter) read() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.pos
+}
+
+func (i *sliceJobIter) Close() error {
+	return nil
+}
@@ -0,0 +1,883 @@
+// Package filequeue implements a go-queue broker that persists its queues
+// in a directory, so the jobs survive restarts of single node deployments.
+// Importing the package registers the broker for file:// URIs:
+//
+//	import _ "github.com/src-d/borges/filequeue"
+//
+//	b, err := queue.NewBroker("file:///var/lib/borges/queues")
+//
+// Every queue is an append-only log of operations in its own file, synced to
+// disk after every operation and compacted when the queue is opened. Jobs
+// delivered but not acknowledged when the process stopped are delivered
+// again. A directory must only be used by one process at a time.
+package filequeue
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-queue.v1"
+)
+
+var (
+	// ErrInvalidName is returned when a queue name cannot be used as a file
+	// name.
+	ErrInvalidName = errors.NewKind("invalid queue name %q")
+	// ErrCorrupted is returned when the log of a queue cannot be read.
+	ErrCorrupted = errors.NewKind("corrupted queue log %s at line %d: %s")
+	// ErrAlreadyAcknowledged is returned when a job is acknowledged or
+	// rejected more than once.
+	ErrAlreadyAcknowledged = errors.NewKind("job %s already acknowledged")
+)
+
+const logExtension = ".jobs"
+
+func init() {
+	queue.Register("file", func(uri string) (queue.Broker, error) {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		return New(u.Path, false)
+	})
+}
+
+// Broker is a queue.Broker that keeps its queues in a directory.
+type Broker struct {
+	dir    string
+	finite bool
+
+	mu     sync.Mutex
+	queues map[string]*Queue
+}
+
+// New returns a Broker that keeps its queues in the given directory, which is
+// created if it does not exist. If finite is true, the iterators of the
+// queues return io.EOF when there are no jobs left instead of waiting for
+// new ones.
+func New(dir string, finite bool) (*Broker, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Broker{
+		dir:    dir,
+		finite: finite,
+		queues: make(map[string]*Queue),
+	}, nil
+}
+
+// Queue opens the queue with the given name, restoring the jobs it had.
+func (b *Broker) Queue(name string) (queue.Queue, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, ErrInvalidName.New(name)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if q, ok := b.queues[name]; ok {
+		return q, nil
+	}
+
+	q, err := openQueue(filepath.Join(b.dir, name+logExtension), b.finite)
+	if err != nil {
+		return nil, err
+	}
+
+	b.queues[name] = q
+	return q, nil
+}
+
+// Close closes all the queues opened by the broker.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var firstErr error
+	for name, q := range b.queues {
+		if err := q.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		delete(b.queues, name)
+	}
+
+	return firstErr
+}
+
+// Stats holds the number of jobs of a queue in each state and the number of
+// operations done since it was created.
+type Stats struct {
+	// Pending is the number of jobs waiting to be delivered.
+	Pending int `json:"-"`
+	// InProgress is the number of jobs delivered but not acknowledged.
+	InProgress int `json:"-"`
+	// Buried is the number of rejected jobs that were not requeued.
+	Buried int `json:"-"`
+	// Published is the number of jobs published, not counting the
+	// publications of delivered jobs.
+	Published int `json:"published"`
+	// Acked is the number of jobs acknowledged.
+	Acked int `json:"acked"`
+	// Rejected is the number of jobs rejected without requeuing them.
+	Rejected int `json:"rejected"`
+	// Retried is the number of delivered jobs that were requeued or
+	// published again, as the Worker does to retry them.
+	Retried int `json:"retried"`
+}
+
+// log operations
+const (
+	opStats     = "stats"
+	opPublish   = "publish"
+	opAck       = "ack"
+	opBury      = "bury"
+	opRequeue   = "requeue"
+	opRepublish = "republish"
+)
+
+type record struct {
+	Op    string     `json:"op"`
+	Seq   uint64     `json:"seq,omitempty"`
+	Job   *jobData   `json:"job,omitempty"`
+	At    *time.Time `json:"at,omitempty"`
+	Retry bool       `json:"retry,omitempty"`
+	// Buried is set in the publications of buried jobs of compacted logs.
+	Buried bool   `json:"buried,omitempty"`
+	Stats  *Stats `json:"stats,omitempty"`
+}
+
+type jobData struct {
+	ID          string         `json:"id"`
+	Priority    queue.Priority `json:"priority"`
+	Timestamp   time.Time      `json:"timestamp"`
+	Retries     int32          `json:"retries"`
+	ErrorType   string         `json:"error_type,omitempty"`
+	ContentType string         `json:"content_type"`
+	Raw         []byte         `json:"raw"`
+}
+
+func newJobData(j *queue.Job) *jobData {
+	return &jobData{
+		ID:          j.ID,
+		Priority:    j.Priority,
+		Timestamp:   j.Timestamp,
+		Retries:     j.Retries,
+		ErrorType:   j.ErrorType,
+		ContentType: j.ContentType,
+		Raw:         j.Raw,
+	}
+}
+
+func (d *jobData) job() *queue.Job {
+	return &queue.Job{
+		ID:          d.ID,
+		Priority:    d.Priority,
+		Timestamp:   d.Timestamp,
+		Retries:     d.Retries,
+		ErrorType:   d.ErrorType,
+		ContentType: d.ContentType,
+		Raw:         d.Raw,
+	}
+}
+
+type entry struct {
+	seq uint64
+	job *jobData
+	at  time.Time
+}
+
+// Queue is a queue.Queue persisted in a file.
+type Queue struct {
+	path   string
+	finite bool
+
+	mu    sync.Mutex
+	f     *os.File
+	seq   uint64
+	stats Stats
+	// counted is the last sequence number whose publication is counted in
+	// the stats of a compacted log, set while the log is replayed.
+	counted  uint64
+	pending  entryHeap
+	delayed  map[uint64]*entry
+	inflight map[uint64]*entry
+	buried   map[uint64]*entry
+	// changed is closed and replaced every time jobs become available.
+	changed chan struct{}
+}
+
+func openQueue(path string, finite bool) (*Queue, error) {
+	q := &Queue{
+		path:     path,
+		finite:   finite,
+		delayed:  make(map[uint64]*entry),
+		inflight: make(map[uint64]*entry),
+		buried:   make(map[uint64]*entry),
+		changed:  make(chan struct{}),
+	}
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	q.f = f
+	return q, nil
+}
+
+func (q *Queue) replay() error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	waiting := make(map[uint64]*entry)
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a last line without line break was not completely written
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return ErrCorrupted.New(q.path, line, err)
+		}
+
+		if err := q.apply(waiting, &rec); err != nil {
+			return ErrCorrupted.New(q.path, line, err)
+		}
+	}
+
+	now := time.Now()
+	for _, e := range waiting {
+		if !e.at.IsZero() && e.at.After(now) {
+			q.delayed[e.seq] = e
+		} else {
+			q.pending = append(q.pending, e)
+		}
+	}
+
+	heap.Init(&q.pending)
+	return nil
+}
+
+// apply updates the state being replayed with an operation of the log.
+// Deliveries are not logged, so the jobs acknowledged or rejected are taken
+// from the waiting ones.
+func (q *Queue) apply(waiting map[uint64]*entry, rec *record) error {
+	if rec.Seq > q.seq {
+		q.seq = rec.Seq
+	}
+
+	switch rec.Op {
+	case opStats:
+		if rec.Stats != nil {
+			q.stats = *rec.Stats
+			q.counted = rec.Seq
+		}
+	case opPublish:
+		if rec.Job == nil {
+			return fmt.Errorf("publish without job")
+		}
+
+		e := &entry{seq: rec.Seq, job: rec.Job}
+		if rec.At != nil {
+			e.at = *rec.At
+		}
+
+		if rec.Buried {
+			q.buried[e.seq] = e
+			return nil
+		}
+
+		waiting[e.seq] = e
+
+		// the jobs of compacted logs are already counted in their stats
+		if rec.Seq <= q.counted {
+			return nil
+		}
+
+		if rec.Retry {
+			q.stats.Retried++
+		} else {
+			q.stats.Published++
+		}
+	case opAck:
+		if _, ok := waiting[rec.Seq]; ok {
+			delete(waiting, rec.Seq)
+			q.stats.Acked++
+		}
+	case opBury:
+		if e, ok := waiting[rec.Seq]; ok {
+			delete(waiting, rec.Seq)
+			q.buried[rec.Seq] = e
+			q.stats.Rejected++
+		}
+	case opRequeue:
+		if _, ok := waiting[rec.Seq]; ok {
+			q.stats.Retried++
+		}
+	case opRepublish:
+		if e, ok := q.buried[rec.Seq]; ok {
+			delete(q.buried, rec.Seq)
+			e.at = time.Time{}
+			waiting[rec.Seq] = e
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", rec.Op)
+	}
+
+	return nil
+}
+
+// compact rewrites the log of the queue with only its current state.
+func (q *Queue) compact() error {
+	tmp := q.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(&record{Op: opStats, Seq: q.seq, Stats: &q.stats})
+
+	var entries []*entry
+	entries = append(entries, q.pending...)
+	for _, e := range q.delayed {
+		entries = append(entries, e)
+	}
+
+	for _, e := range entries {
+		if err != nil {
+			break
+		}
+
+		rec := &record{Op: opPublish, Seq: e.seq, Job: e.job}
+		if !e.at.IsZero() {
+			at := e.at
+			rec.At = &at
+		}
+
+		err = enc.Encode(rec)
+	}
+
+	for _, e := range q.buried {
+		if err != nil {
+			break
+		}
+
+		err = enc.Encode(&record{Op: opPublish, Seq: e.seq, Job: e.job, Buried: true})
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, q.path)
+}
+
+// write appends an operation to the log and syncs it to disk.
+func (q *Queue) write(rec *record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := q.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return q.f.Sync()
+}
+
+// push adds an entry to the jobs waiting to be delivered.
+func (q *Queue) push(e *entry) {
+	if !e.at.IsZero() && e.at.After(time.Now()) {
+		q.delayed[e.seq] = e
+		return
+	}
+
+	heap.Push(&q.pending, e)
+}
+
+func (q *Queue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Publish publishes a Job to the queue.
+func (q *Queue) Publish(j *queue.Job) error {
+	return q.PublishDelayed(j, 0)
+}
+
+// PublishDelayed publishes a Job to the queue that is not delivered until
+// the given delay passes.
+func (q *Queue) PublishDelayed(j *queue.Job, delay time.Duration) error {
+	if j == nil || j.Size() == 0 {
+		return queue.ErrEmptyJob.New()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.publish(j, delay)
+}
+
+func (q *Queue) publish(j *queue.Job, delay time.Duration) error {
+	if q.f == nil {
+		return queue.ErrAlreadyClosed.New()
+	}
+
+	// the Worker retries a job publishing it again before acknowledging it
+	a, retry := j.Acknowledger.(*acknowledger)
+	retry = retry && a.q == q
+
+	q.seq++
+	e := &entry{seq: q.seq, job: newJobData(j)}
+	rec := &record{Op: opPublish, Seq: e.seq, Job: e.job, Retry: retry}
+	if delay > 0 {
+		e.at = time.Now().Add(delay)
+		rec.At = &e.at
+	}
+
+	if err := q.write(rec); err != nil {
+		return err
+	}
+
+	if retry {
+		q.stats.Retried++
+	} else {
+		q.stats.Published++
+	}
+
+	q.push(e)
+	q.notify()
+	return nil
+}
+
+// Transaction calls the given callback with a queue whose publications are
+// only done if the callback does not return an error.
+func (q *Queue) Transaction(txcb queue.TxCallback) error {
+	tx := &txQueue{}
+	if err := txcb(tx); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, p := range tx.jobs {
+		if err := q.publish(p.job, p.delay); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Consume returns a JobIter over the jobs of the queue. The advertisedWindow
+// value is the maximum number of unacknowledged jobs. Use 0 for an infinite
+// window.
+func (q *Queue) Consume(advertisedWindow int) (queue.JobIter, error) {
+	iter := &JobIter{q: q, closed: make(chan struct{})}
+	if advertisedWindow > 0 {
+		iter.chn = make(chan struct{}, advertisedWindow)
+	}
+
+	return iter, nil
+}
+
+// RepublishBuried publishes again the buried jobs that comply with any of
+// the given conditions, or all of them if there are no conditions.
+func (q *Queue) RepublishBuried(conditions ...queue.RepublishConditionFunc) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.f == nil {
+		return queue.ErrAlreadyClosed.New()
+	}
+
+	var republished bool
+	for _, seq := range sortedSeqs(q.buried) {
+		e := q.buried[seq]
+		if !queue.RepublishConditions(conditions).Comply(e.job.job()) {
+			continue
+		}
+
+		if err := q.write(&record{Op: opRepublish, Seq: seq}); err != nil {
+			return err
+		}
+
+		delete(q.buried, seq)
+		e.at = time.Time{}
+		q.push(e)
+		republished = true
+	}
+
+	if republished {
+		q.notify()
+	}
+
+	return nil
+}
+
+// Stats returns the statistics of the queue.
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s := q.stats
+	s.Pending = len(q.pending) + len(q.delayed)
+	s.InProgress = len(q.inflight)
+	s.Buried = len(q.buried)
+	return s
+}
+
+// Jobs returns the jobs of the queue that are not acknowledged yet, which
+// are the pending, in progress and buried ones.
+func (q *Queue) Jobs() []*queue.Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := make(map[uint64]*entry)
+	for _, m := range []map[uint64]*entry{q.delayed, q.inflight, q.buried} {
+		for seq, e := range m {
+			entries[seq] = e
+		}
+	}
+
+	for _, e := range q.pending {
+		entries[e.seq] = e
+	}
+
+	var jobs []*queue.Job
+	for _, seq := range sortedSeqs(entries) {
+		jobs = append(jobs, entries[seq].job.job())
+	}
+
+	return jobs
+}
+
+// next returns the next job to deliver. If there is none, it returns a
+// channel closed when new jobs are available and the time until the first
+// delayed job is available, if any.
+func (q *Queue) next() (*queue.Job, <-chan struct{}, time.Duration, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.f == nil {
+		return nil, nil, 0, queue.ErrAlreadyClosed.New()
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for seq, e := range q.delayed {
+		if d := e.at.Sub(now); d <= 0 {
+			delete(q.delayed, seq)
+			heap.Push(&q.pending, e)
+		} else if wait == 0 || d < wait {
+			wait = d
+		}
+	}
+
+	if len(q.pending) == 0 {
+		if q.finite && wait == 0 {
+			return nil, nil, 0, io.EOF
+		}
+
+		return nil, q.changed, wait, nil
+	}
+
+	e := heap.Pop(&q.pending).(*entry)
+	q.inflight[e.seq] = e
+
+	j := e.job.job()
+	j.Acknowledger = &acknowledger{q: q, seq: e.seq, job: j.ID}
+	return j, nil, 0, nil
+}
+
+// finish records the acknowledgement or rejection of a delivered job.
+func (q *Queue) finish(seq uint64, op string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.f == nil {
+		return queue.ErrAlreadyClosed.New()
+	}
+
+	e, ok := q.inflight[seq]
+	if !ok {
+		return nil
+	}
+
+	if err := q.write(&record{Op: op, Seq: seq}); err != nil {
+		return err
+	}
+
+	delete(q.inflight, seq)
+	switch op {
+	case opAck:
+		q.stats.Acked++
+	case opBury:
+		q.stats.Rejected++
+		q.buried[seq] = e
+	case opRequeue:
+		q.stats.Retried++
+		q.push(e)
+		q.notify()
+	}
+
+	return nil
+}
+
+func (q *Queue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.f == nil {
+		return nil
+	}
+
+	f := q.f
+	q.f = nil
+	q.notify()
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+type txQueue struct {
+	queue.Queue
+	jobs []txJob
+}
+
+type txJob struct {
+	job   *queue.Job
+	delay time.Duration
+}
+
+func (q *txQueue) Publish(j *queue.Job) error {
+	return q.PublishDelayed(j, 0)
+}
+
+func (q *txQueue) PublishDelayed(j *queue.Job, delay time.Duration) error {
+	if j == nil || j.Size() == 0 {
+		return queue.ErrEmptyJob.New()
+	}
+
+	q.jobs = append(q.jobs, txJob{j, delay})
+	return nil
+}
+
+func (q *txQueue) Transaction(queue.TxCallback) error {
+	return queue.ErrTxNotSupported.New()
+}
+
+func (q *txQueue) Consume(int) (queue.JobIter, error) {
+	return nil, queue.ErrTxNotSupported.New()
+}
+
+func (q *txQueue) RepublishBuried(...queue.RepublishConditionFunc) error {
+	return queue.ErrTxNotSupported.New()
+}
+
+// JobIter is a queue.JobIter over the jobs of a Queue.
+type JobIter struct {
+	q         *Queue
+	chn       chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Next returns the next job of the queue with the highest priority. It
+// blocks until there is a job available and the number of unacknowledged
+// jobs is lower than the advertised window, unless the broker is finite and
+// there are no jobs left, in which case it returns io.EOF.
+func (i *JobIter) Next() (*queue.Job, error) {
+	if err := i.acquire(); err != nil {
+		return nil, err
+	}
+
+	for {
+		j, changed, wait, err := i.q.next()
+		if err != nil {
+			i.release()
+			return nil, err
+		}
+
+		if j != nil {
+			j.Acknowledger.(*acknowledger).release = i.release
+			return j, nil
+		}
+
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timeout = time.After(wait)
+		}
+
+		select {
+		case <-i.closed:
+			i.release()
+			return nil, queue.ErrAlreadyClosed.New()
+		case <-changed:
+		case <-timeout:
+		}
+	}
+}
+
+// Close closes the iterator. Calls to Next return queue.ErrAlreadyClosed
+// after it is closed. The jobs already returned can still be acknowledged.
+func (i *JobIter) Close() error {
+	i.closeOnce.Do(func() { close(i.closed) })
+	return nil
+}
+
+func (i *JobIter) acquire() error {
+	if i.chn == nil {
+		select {
+		case <-i.closed:
+			return queue.ErrAlreadyClosed.New()
+		default:
+			return nil
+		}
+	}
+
+	select {
+	case <-i.closed:
+		return queue.ErrAlreadyClosed.New()
+	case i.chn <- struct{}{}:
+		return nil
+	}
+}
+
+func (i *JobIter) release() {
+	if i.chn != nil {
+		<-i.chn
+	}
+}
+
+type acknowledger struct {
+	q       *Queue
+	seq     uint64
+	job     string
+	release func()
+
+	mu   sync.Mutex
+	done bool
+}
+
+// Ack removes the job from the queue.
+func (a *acknowledger) Ack() error {
+	return a.finish(opAck)
+}
+
+// Reject buries the job, or makes it available again if requeue is true.
+func (a *acknowledger) Reject(requeue bool) error {
+	if requeue {
+		return a.finish(opRequeue)
+	}
+
+	return a.finish(opBury)
+}
+
+func (a *acknowledger) finish(op string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.done {
+		return ErrAlreadyAcknowledged.New(a.job)
+	}
+
+	a.done = true
+	if a.release != nil {
+		defer a.release()
+	}
+
+	return a.q.finish(a.seq, op)
+}
+
+// entryHeap is a heap of entries ordered by priority and then by publication
+// order.
+type entryHeap []*entry
+
+func (h entryHeap) Len() int { return len(h) }
+
+func (h entryHeap) Less(i, j int) bool {
+	if h[i].job.Priority != h[j].job.Priority {
+		return h[i].job.Priority > h[j].job.Priority
+	}
+
+	return h[i].seq < h[j].seq
+}
+
+func (h entryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *entryHeap) Push(x interface{}) { *h = append(*h, x.(*entry)) }
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+func sortedSeqs(m map[uint64]*entry) []uint64 {
+	seqs := make([]uint64, 0, len(m))
+	for seq := range m {
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
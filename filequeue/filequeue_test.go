@@ -0,0 +1,389 @@
+package filequeue
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/go-queue.v1"
+)
+
+func TestFileQueue(t *testing.T) {
+	suite.Run(t, new(FileQueueSuite))
+}
+
+type FileQueueSuite struct {
+	suite.Suite
+	dir    string
+	broker *Broker
+	queue  *Queue
+}
+
+func (s *FileQueueSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "filequeue")
+	s.Require().NoError(err)
+	s.open()
+}
+
+func (s *FileQueueSuite) TearDownTest() {
+	s.NoError(s.broker.Close())
+	s.NoError(os.RemoveAll(s.dir))
+}
+
+func (s *FileQueueSuite) TestPublishConsume() {
+	require := s.Require()
+
+	s.publish("low", queue.PriorityLow)
+	s.publish("normal", queue.PriorityNormal)
+	s.publish("urgent", queue.PriorityUrgent)
+	s.publish("normal2", queue.PriorityNormal)
+
+	iter, err := s.queue.Consume(0)
+	require.NoError(err)
+
+	for _, expected := range []string{"urgent", "normal", "normal2", "low"} {
+		j, err := iter.Next()
+		require.NoError(err)
+		require.Equal(expected, s.payload(j))
+		require.Equal(int32(3), j.Retries)
+		require.NoError(j.Ack())
+		require.True(ErrAlreadyAcknowledged.Is(j.Ack()))
+	}
+
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+	require.NoError(iter.Close())
+
+	stats := s.queue.Stats()
+	require.Equal(4, stats.Published)
+	require.Equal(4, stats.Acked)
+	require.Equal(0, stats.Pending)
+}
+
+func (s *FileQueueSuite) TestResume() {
+	require := s.Require()
+
+	for i := 0; i < 5; i++ {
+		s.publish(fmt.Sprint(i), queue.PriorityNormal)
+	}
+
+	iter, err := s.queue.Consume(0)
+	require.NoError(err)
+
+	j := s.next(iter)
+	require.NoError(j.Ack())
+
+	j = s.next(iter)
+	require.NoError(j.Reject(false))
+
+	// the Worker publishes again the jobs failed with a temporary error
+	j = s.next(iter)
+	j.Retries--
+	j.ErrorType = "temporary"
+	require.NoError(s.queue.Publish(j))
+	require.NoError(j.Ack())
+
+	// left in progress
+	s.next(iter)
+
+	require.NoError(s.broker.Close())
+	s.open()
+
+	stats := s.queue.Stats()
+	require.Equal(5, stats.Published)
+	require.Equal(2, stats.Acked)
+	require.Equal(1, stats.Rejected)
+	require.Equal(1, stats.Retried)
+	require.Equal(3, stats.Pending)
+	require.Equal(0, stats.InProgress)
+	require.Equal(1, stats.Buried)
+	require.Len(s.queue.Jobs(), 4)
+
+	iter, err = s.queue.Consume(0)
+	require.NoError(err)
+
+	var payloads []string
+	for i := 0; i < 3; i++ {
+		j := s.next(iter)
+		payloads = append(payloads, s.payload(j))
+		if j.ErrorType == "temporary" {
+			require.Equal(int32(2), j.Retries)
+		}
+
+		require.NoError(j.Ack())
+	}
+
+	require.Equal([]string{"3", "4", "2"}, payloads)
+
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+
+	require.NoError(s.broker.Close())
+	s.open()
+
+	stats = s.queue.Stats()
+	require.Equal(5, stats.Acked)
+	require.Equal(1, stats.Buried)
+	require.Equal(0, stats.Pending)
+}
+
+func (s *FileQueueSuite) TestReopenStats() {
+	require := s.Require()
+
+	for i := 0; i < 3; i++ {
+		s.publish(fmt.Sprint(i), queue.PriorityNormal)
+	}
+
+	for i := 0; i < 4; i++ {
+		require.NoError(s.broker.Close())
+		s.open()
+
+		stats := s.queue.Stats()
+		require.Equal(3, stats.Published, "reopened %d times", i+1)
+		require.Equal(3, stats.Pending)
+	}
+
+	iter, err := s.queue.Consume(0)
+	require.NoError(err)
+	require.NoError(s.next(iter).Ack())
+	s.publish("3", queue.PriorityNormal)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(s.broker.Close())
+		s.open()
+
+		stats := s.queue.Stats()
+		require.Equal(4, stats.Published)
+		require.Equal(1, stats.Acked)
+		require.Equal(3, stats.Pending)
+	}
+}
+
+func (s *FileQueueSuite) TestRequeue() {
+	require := s.Require()
+
+	s.publish("foo", queue.PriorityNormal)
+
+	iter, err := s.queue.Consume(1)
+	require.NoError(err)
+
+	j := s.next(iter)
+	require.NoError(j.Reject(true))
+
+	j = s.next(iter)
+	require.Equal("foo", s.payload(j))
+	require.NoError(j.Ack())
+	require.Equal(1, s.queue.Stats().Retried)
+}
+
+func (s *FileQueueSuite) TestRepublishBuried() {
+	require := s.Require()
+
+	s.publish("foo", queue.PriorityNormal)
+	s.publish("bar", queue.PriorityNormal)
+
+	iter, err := s.queue.Consume(0)
+	require.NoError(err)
+
+	j := s.next(iter)
+	j.ErrorType = "temporary"
+	require.NoError(s.queue.Publish(j))
+	require.NoError(j.Ack())
+
+	require.NoError(s.next(iter).Reject(false))
+	require.NoError(s.next(iter).Reject(false))
+	require.Equal(2, s.queue.Stats().Buried)
+
+	require.NoError(s.queue.RepublishBuried(func(j *queue.Job) bool {
+		return j.ErrorType == "temporary"
+	}))
+	require.Equal(1, s.queue.Stats().Buried)
+
+	require.NoError(s.broker.Close())
+	s.open()
+	require.Equal(1, s.queue.Stats().Buried)
+	require.Equal(1, s.queue.Stats().Pending)
+
+	iter, err = s.queue.Consume(0)
+	require.NoError(err)
+
+	j = s.next(iter)
+	require.Equal("foo", s.payload(j))
+	require.NoError(j.Ack())
+
+	require.NoError(s.queue.RepublishBuried())
+	j = s.next(iter)
+	require.Equal("bar", s.payload(j))
+	require.NoError(j.Ack())
+}
+
+func (s *FileQueueSuite) TestPublishDelayed() {
+	require := s.Require()
+
+	j := s.newJob("foo", queue.PriorityUrgent)
+	require.NoError(s.queue.PublishDelayed(j, 100*time.Millisecond))
+	s.publish("bar", queue.PriorityLow)
+
+	iter, err := s.queue.Consume(0)
+	require.NoError(err)
+
+	require.Equal("bar", s.payload(s.next(iter)))
+
+	start := time.Now()
+	require.Equal("foo", s.payload(s.next(iter)))
+	require.True(time.Since(start) > 50*time.Millisecond)
+}
+
+func (s *FileQueueSuite) TestTransaction() {
+	require := s.Require()
+
+	err := s.queue.Transaction(func(q queue.Queue) error {
+		return q.Publish(s.newJob("foo", queue.PriorityNormal))
+	})
+	require.NoError(err)
+
+	err = s.queue.Transaction(func(q queue.Queue) error {
+		if err := q.Publish(s.newJob("bar", queue.PriorityNormal)); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("rollback")
+	})
+	require.EqualError(err, "rollback")
+	require.Equal(1, s.queue.Stats().Pending)
+}
+
+func (s *FileQueueSuite) TestBlockingNext() {
+	require := s.Require()
+
+	b, err := New(filepath.Join(s.dir, "infinite"), false)
+	require.NoError(err)
+	defer b.Close()
+
+	q, err := b.Queue("jobs")
+	require.NoError(err)
+
+	iter, err := q.Consume(1)
+	require.NoError(err)
+
+	done := make(chan *queue.Job)
+	go func() {
+		j, err := iter.Next()
+		s.NoError(err)
+		done <- j
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(q.Publish(s.newJob("foo", queue.PriorityNormal)))
+
+	select {
+	case j := <-done:
+		require.Equal("foo", s.payload(j))
+	case <-time.After(5 * time.Second):
+		require.FailNow("Next was not unblocked by a publication")
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := iter.Next()
+		errs <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(iter.Close())
+
+	select {
+	case err := <-errs:
+		require.True(queue.ErrAlreadyClosed.Is(err))
+	case <-time.After(5 * time.Second):
+		require.FailNow("Next was not unblocked by closing")
+	}
+}
+
+func (s *FileQueueSuite) TestTruncatedLog() {
+	require := s.Require()
+
+	s.publish("foo", queue.PriorityNormal)
+	require.NoError(s.broker.Close())
+
+	path := filepath.Join(s.dir, "jobs"+logExtension)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(err)
+	_, err = f.Write([]byte(`{"op":"publish","seq":2,"job":{"id":`))
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	s.open()
+	require.Equal(1, s.queue.Stats().Pending)
+
+	require.NoError(s.broker.Close())
+	require.NoError(ioutil.WriteFile(path, []byte("foo\n"), 0644))
+
+	b, err := New(s.dir, true)
+	require.NoError(err)
+	_, err = b.Queue("jobs")
+	require.True(ErrCorrupted.Is(err))
+
+	require.NoError(os.Remove(path))
+	s.open()
+}
+
+func (s *FileQueueSuite) TestInvalidName() {
+	for _, name := range []string{"", ".", "..", "foo/bar"} {
+		_, err := s.broker.Queue(name)
+		s.True(ErrInvalidName.Is(err), name)
+	}
+}
+
+func (s *FileQueueSuite) TestNewBroker() {
+	require := s.Require()
+
+	b, err := queue.NewBroker("file://" + filepath.Join(s.dir, "uri"))
+	require.NoError(err)
+	require.IsType(&Broker{}, b)
+	require.NoError(b.Close())
+
+	_, err = os.Stat(filepath.Join(s.dir, "uri"))
+	require.NoError(err)
+}
+
+func (s *FileQueueSuite) open() {
+	var err error
+	s.broker, err = New(s.dir, true)
+	s.Require().NoError(err)
+
+	q, err := s.broker.Queue("jobs")
+	s.Require().NoError(err)
+	s.queue = q.(*Queue)
+}
+
+func (s *FileQueueSuite) newJob(payload string, p queue.Priority) *queue.Job {
+	j, err := queue.NewJob()
+	s.Require().NoError(err)
+	s.Require().NoError(j.Encode(payload))
+	j.SetPriority(p)
+	j.Retries = 3
+	return j
+}
+
+func (s *FileQueueSuite) publish(payload string, p queue.Priority) {
+	s.Require().NoError(s.queue.Publish(s.newJob(payload, p)))
+}
+
+func (s *FileQueueSuite) next(iter queue.JobIter) *queue.Job {
+	j, err := iter.Next()
+	s.Require().NoError(err)
+	return j
+}
+
+func (s *FileQueueSuite) payload(j *queue.Job) string {
+	var payload string
+	s.Require().NoError(j.Decode(&payload))
+	return payload
+}
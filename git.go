@@ -37,6 +37,9 @@ var (
 	// ErrObjectTypeNotSupported returned by ResolveCommit when the referenced
 	// object isn't a Commit nor a Tag.
 	ErrObjectTypeNotSupported = errors.NewKind("object type %q not supported")
+	// ErrReadOnlyRepository is returned when writing to a local repository
+	// opened in place by the TemporaryCloner.
+	ErrReadOnlyRepository = errors.NewKind("local repository is read-only")
 )
 
 type TemporaryRepository interface {
@@ -243,6 +246,9 @@ func ResolveCommit(r *git.Repository, h plumbing.Hash) (*object.Commit, error) {
 	}
 }
 
+// NewTemporaryCloner returns a TemporaryCloner that clones the repositories in
+// the given filesystem. Local repositories in file:// endpoints are not
+// cloned but opened in place, without modifying them.
 func NewTemporaryCloner(tmpFs billy.Filesystem) TemporaryCloner {
 	return &temporaryRepositoryBuilder{tmpFs}
 }
@@ -261,6 +267,17 @@ type temporaryRepository struct {
 func (b *temporaryRepositoryBuilder) Clone(
 	ctx context.Context,
 	id, endpoint string,
+) (TemporaryRepository, error) {
+	if path, ok := localGitDir(endpoint); ok {
+		return openLocalRepository(path)
+	}
+
+	return b.clone(ctx, id, endpoint)
+}
+
+func (b *temporaryRepositoryBuilder) clone(
+	ctx context.Context,
+	id, endpoint string,
 ) (TemporaryRepository, error) {
 	dir := filepath.Join(
 		"local_repos",
@@ -320,10 +337,20 @@ func (r *temporaryRepository) Push(
 	ctx context.Context,
 	url string,
 	refspecs []config.RefSpec,
+) error {
+	return push(ctx, r.Repository, url, refspecs)
+}
+
+// push pushes the given refspecs of the repository to the url.
+func push(
+	ctx context.Context,
+	r *git.Repository,
+	url string,
+	refspecs []config.RefSpec,
 ) error {
 	const remoteName = "tmp"
-	defer func() { _ = r.Repository.DeleteRemote(remoteName) }()
-	remote, err := r.Repository.CreateRemote(&config.RemoteConfig{
+	defer func() { _ = r.DeleteRemote(remoteName) }()
+	remote, err := r.CreateRemote(&config.RemoteConfig{
 		Name: remoteName,
 		URLs: []string{url},
 	})
@@ -0,0 +1,239 @@
+package borges
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// localHEAD is the name of the reference where the HEAD of the repositories
+// is fetched.
+var localHEAD = FetchHEAD.Dst(plumbing.HEAD)
+
+// localGitDir returns the path of the git directory of the repository in the
+// given file:// endpoint, if it is a local repository. The .git files of
+// submodule checkouts are followed to their git directory.
+func localGitDir(endpoint string) (string, bool) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "file" || u.Path == "" {
+		return "", false
+	}
+
+	path := u.Path
+	if filepath.Base(path) != ".git" {
+		path = filepath.Join(path, ".git")
+		if _, err := os.Stat(path); err != nil {
+			path = u.Path
+		}
+	}
+
+	if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+		gitDir, err := readGitFile(path)
+		if err != nil {
+			return "", false
+		}
+
+		path = gitDir
+	}
+
+	if !isGitDir(path) {
+		return "", false
+	}
+
+	return path, true
+}
+
+// localRepository is a TemporaryRepository of a local repository opened in
+// place instead of cloned. The local repository is never modified.
+type localRepository struct {
+	Referencer
+	Repository *git.Repository
+	// Filesystem is the filesystem of the git directory of the repository.
+	Filesystem billy.Filesystem
+}
+
+func openLocalRepository(path string) (*localRepository, error) {
+	fs := osfs.New(path)
+	s := &readOnlyStorer{
+		Storer: filesystem.NewStorage(fs, cache.NewObjectLRUDefault()),
+		refs:   make(memory.ReferenceStorage),
+	}
+
+	r, err := git.Open(s, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localRepository{
+		Referencer: NewGitReferencer(r),
+		Repository: r,
+		Filesystem: fs,
+	}, nil
+}
+
+func (r *localRepository) Push(
+	ctx context.Context,
+	url string,
+	refspecs []config.RefSpec,
+) error {
+	return push(ctx, r.Repository, url, refspecs)
+}
+
+// hasAlternates returns whether some objects of the repository are kept in
+// other repositories.
+func (r *localRepository) hasAlternates() bool {
+	_, err := r.Filesystem.Stat(r.Filesystem.Join("objects", "info", "alternates"))
+	return err == nil
+}
+
+func (r *localRepository) Close() error {
+	r.Repository = nil
+	return nil
+}
+
+// readOnlyStorer is a storage.Storer that does not modify the underlying one.
+// Changes to the references and the configuration, like the ones done while
+// pushing, are kept in memory, and objects cannot be written. The HEAD is
+// also exposed as the reference where it is fetched by the TemporaryCloner.
+type readOnlyStorer struct {
+	storage.Storer
+	refs   memory.ReferenceStorage
+	config *config.Config
+}
+
+func (s *readOnlyStorer) SetEncodedObject(plumbing.EncodedObject) (plumbing.Hash, error) {
+	return plumbing.ZeroHash, ErrReadOnlyRepository.New()
+}
+
+func (s *readOnlyStorer) SetShallow([]plumbing.Hash) error {
+	return ErrReadOnlyRepository.New()
+}
+
+func (s *readOnlyStorer) SetIndex(*index.Index) error {
+	return ErrReadOnlyRepository.New()
+}
+
+func (s *readOnlyStorer) PackRefs() error {
+	return nil
+}
+
+func (s *readOnlyStorer) Config() (*config.Config, error) {
+	if s.config != nil {
+		return s.config, nil
+	}
+
+	c, err := s.Storer.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	s.config = c
+	return c, nil
+}
+
+func (s *readOnlyStorer) SetConfig(c *config.Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	s.config = c
+	return nil
+}
+
+func (s *readOnlyStorer) SetReference(ref *plumbing.Reference) error {
+	return s.refs.SetReference(ref)
+}
+
+func (s *readOnlyStorer) CheckAndSetReference(ref, old *plumbing.Reference) error {
+	if old != nil {
+		current, err := s.Reference(old.Name())
+		if err != nil {
+			return err
+		}
+
+		if current.Hash() != old.Hash() {
+			return storage.ErrReferenceHasChanged
+		}
+	}
+
+	return s.refs.SetReference(ref)
+}
+
+func (s *readOnlyStorer) RemoveReference(n plumbing.ReferenceName) error {
+	return s.refs.RemoveReference(n)
+}
+
+func (s *readOnlyStorer) Reference(n plumbing.ReferenceName) (*plumbing.Reference, error) {
+	if ref, err := s.refs.Reference(n); err == nil {
+		return ref, nil
+	}
+
+	if n == localHEAD {
+		return s.head()
+	}
+
+	return s.Storer.Reference(n)
+}
+
+func (s *readOnlyStorer) IterReferences() (storer.ReferenceIter, error) {
+	iter, err := s.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if _, ok := s.refs[ref.Name()]; !ok && ref.Name() != localHEAD {
+			refs = append(refs, ref)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.refs[localHEAD]; !ok {
+		head, err := s.head()
+		if err == nil {
+			refs = append(refs, head)
+		} else if err != plumbing.ErrReferenceNotFound {
+			return nil, err
+		}
+	}
+
+	for _, ref := range s.refs {
+		refs = append(refs, ref)
+	}
+
+	return storer.NewReferenceSliceIter(refs), nil
+}
+
+func (s *readOnlyStorer) CountLooseRefs() (int, error) {
+	n, err := s.Storer.CountLooseRefs()
+	return n + len(s.refs), err
+}
+
+// head returns the commit pointed by the HEAD as the reference where it is
+// fetched.
+func (s *readOnlyStorer) head() (*plumbing.Reference, error) {
+	ref, err := storer.ResolveReference(s.Storer, plumbing.HEAD)
+	if err != nil {
+		return nil, err
+	}
+
+	return plumbing.NewHashReference(localHEAD, ref.Hash()), nil
+}
@@ -2,8 +2,10 @@ package borges
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,6 +16,7 @@ import (
 	"gopkg.in/src-d/go-billy.v4/osfs"
 	"gopkg.in/src-d/go-git-fixtures.v3"
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/cache"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
@@ -146,6 +149,102 @@ func (s *TemporaryClonerSuite) testNonExistentRepository(url string) {
 	require.Nil(gr)
 }
 
+func (s *TemporaryClonerSuite) TestCloneLocalRepository() {
+	require := s.Require()
+
+	path := fixtures.Basic().One().DotGit().Root()
+	url := "file://" + path
+	gr, err := s.cloner.Clone(context.TODO(), "foo", url)
+	require.NoError(err)
+	require.IsType(&localRepository{}, gr)
+
+	refs, err := gr.References()
+	require.NoError(err)
+
+	files, err := ioutil.ReadDir(s.tmpDir)
+	require.NoError(err)
+	require.Len(files, 0)
+
+	cloned, err := s.cloner.(*temporaryRepositoryBuilder).clone(context.TODO(), "foo", url)
+	require.NoError(err)
+	expected, err := cloned.References()
+	require.NoError(err)
+	require.NoError(cloned.Close())
+
+	require.Len(refs, len(expected))
+	obtained := refsByName(refs)
+	for name, ref := range refsByName(expected) {
+		require.Contains(obtained, name)
+		require.Equal(ref.Hash, obtained[name].Hash)
+		require.Equal(ref.Init, obtained[name].Init)
+	}
+
+	require.NoError(gr.Close())
+}
+
+func (s *TemporaryClonerSuite) TestPushLocalRepository() {
+	require := s.Require()
+
+	path := fixtures.Basic().One().DotGit().Root()
+	before, err := ioutil.ReadFile(filepath.Join(path, "packed-refs"))
+	require.NoError(err)
+
+	gr, err := s.cloner.Clone(context.TODO(), "foo", "file://"+path)
+	require.NoError(err)
+
+	dst := filepath.Join(s.tmpDir, "dst")
+	_, err = git.PlainInit(dst, true)
+	require.NoError(err)
+
+	id := kallax.NewULID()
+	err = gr.Push(context.TODO(), "file://"+dst, []config.RefSpec{
+		config.RefSpec(fmt.Sprintf("+refs/heads/HEAD:refs/heads/HEAD/%s", id)),
+	})
+	require.NoError(err)
+
+	r, err := git.PlainOpen(dst)
+	require.NoError(err)
+	ref, err := r.Reference(plumbing.ReferenceName("refs/heads/HEAD/"+id.String()), false)
+	require.NoError(err)
+	require.Equal("6ecf0ef2c2dffb796033e5a02219af86ec6584e5", ref.Hash().String())
+
+	after, err := ioutil.ReadFile(filepath.Join(path, "packed-refs"))
+	require.NoError(err)
+	require.Equal(before, after)
+
+	_, err = os.Stat(filepath.Join(path, "refs", "heads", "HEAD"))
+	require.True(os.IsNotExist(err))
+
+	require.NoError(gr.Close())
+}
+
+func TestLocalGitDir(t *testing.T) {
+	fixtures.Init()
+	defer fixtures.Clean()
+	require := require.New(t)
+
+	dotGit := fixtures.Basic().One().DotGit().Root()
+	path, ok := localGitDir("file://" + dotGit)
+	require.True(ok)
+	require.Equal(dotGit, path)
+
+	worktree, err := ioutil.TempDir("", "borges-test")
+	require.NoError(err)
+	defer os.RemoveAll(worktree)
+
+	_, err = git.PlainInit(worktree, false)
+	require.NoError(err)
+	path, ok = localGitDir("file://" + worktree)
+	require.True(ok)
+	require.Equal(filepath.Join(worktree, ".git"), path)
+
+	_, ok = localGitDir("git://github.com/src-d/borges.git")
+	require.False(ok)
+
+	_, ok = localGitDir("file://" + filepath.Join(dotGit, "objects"))
+	require.False(ok)
+}
+
 func TestStoreConfig(t *testing.T) {
 	require := require.New(t)
 
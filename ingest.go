@@ -0,0 +1,422 @@
+package borges
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/src-d/borges/metrics"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+	"gopkg.in/src-d/go-queue.v1"
+)
+
+var (
+	// ErrInvalidEndpoint is returned when a submitted endpoint is not an
+	// absolute remote URL.
+	ErrInvalidEndpoint = errors.NewKind("invalid endpoint %q: %s")
+	// ErrInvalidPriority is returned when a submitted priority is out of
+	// range.
+	ErrInvalidPriority = errors.NewKind("priority must be between 0 and %d")
+)
+
+// IngestConfig holds the configuration of an IngestServer.
+type IngestConfig struct {
+	// Username and Password are the basic authentication credentials
+	// required by the server. Authentication is disabled if Username is
+	// empty.
+	Username, Password string
+	// MaxBodySize is the maximum size in bytes of a request body.
+	MaxBodySize int64
+	// MaxBatchSize is the maximum number of repositories submitted in a
+	// single request.
+	MaxBatchSize int
+	// MaxConcurrentRequests is the maximum number of requests served at the
+	// same time. Requests over the limit are rejected.
+	MaxConcurrentRequests int
+	// Priority is the priority of the jobs submitted without priority.
+	Priority queue.Priority
+	// JobRetries is the number of retries of the queued jobs.
+	JobRetries int
+	// QueuedHistory is the number of queued jobs remembered by the server to
+	// report them as queued.
+	QueuedHistory int
+}
+
+// IngestRequest is a request to archive a repository.
+type IngestRequest struct {
+	// Endpoint is the main URL of the repository.
+	Endpoint string `json:"endpoint"`
+	// Aliases are other URLs of the same repository. They may include the
+	// main URL.
+	Aliases []string `json:"aliases,omitempty"`
+	// IsFork tells if the repository is a fork, if known.
+	IsFork *bool `json:"is_fork,omitempty"`
+	// Priority is the priority of the job. The server default is used if it
+	// is nil.
+	Priority *uint8 `json:"priority,omitempty"`
+}
+
+// IngestResult is the result of an IngestRequest.
+type IngestResult struct {
+	Endpoint string `json:"endpoint"`
+	ID       string `json:"id,omitempty"`
+	Queued   bool   `json:"queued"`
+	Error    string `json:"error,omitempty"`
+}
+
+// RepositoryInfo describes a repository and whether a job for it was queued
+// by the server.
+type RepositoryInfo struct {
+	ID        uuid.UUID         `json:"id"`
+	Endpoints []string          `json:"endpoints"`
+	Status    model.FetchStatus `json:"status"`
+	FetchedAt *time.Time        `json:"fetched_at,omitempty"`
+	Queued    bool              `json:"queued"`
+	QueuedAt  *time.Time        `json:"queued_at,omitempty"`
+}
+
+// IngestServer is an HTTP service to request the archiving of repositories.
+// It exposes the following endpoints:
+//
+//	POST /repositories           queues one repository, takes an IngestRequest
+//	POST /repositories/batch     queues many repositories, takes a list of
+//	                             IngestRequest
+//	GET  /repositories?endpoint= returns the repositories with the endpoint
+//	GET  /repositories/<id>      returns a repository and whether it was
+//	                             queued by this server
+type IngestServer struct {
+	store  RepositoryStore
+	queue  queue.Queue
+	config IngestConfig
+	mux    *http.ServeMux
+	slots  chan struct{}
+
+	blocklist *Blocklist
+
+	mu      sync.Mutex
+	queued  map[uuid.UUID]time.Time
+	history []uuid.UUID
+}
+
+// NewIngestServer creates a new IngestServer that stores repositories in the
+// given store and queues jobs in the given queue.
+func NewIngestServer(store RepositoryStore, q queue.Queue, config IngestConfig) *IngestServer {
+	s := &IngestServer{
+		store:  store,
+		queue:  q,
+		config: config,
+		mux:    http.NewServeMux(),
+		queued: make(map[uuid.UUID]time.Time),
+	}
+
+	if config.MaxConcurrentRequests > 0 {
+		s.slots = make(chan struct{}, config.MaxConcurrentRequests)
+	}
+
+	s.mux.HandleFunc("/repositories", s.handleRepositories)
+	s.mux.HandleFunc("/repositories/", s.handleRepository)
+	return s
+}
+
+// SetBlocklist sets the blocklist checked before the repository of every
+// request is found or created.
+func (s *IngestServer) SetBlocklist(b *Blocklist) {
+	s.blocklist = b
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (s *IngestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="borges"`)
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+			defer func() { <-s.slots }()
+		default:
+			writeError(w, http.StatusTooManyRequests, fmt.Errorf("too many requests"))
+			return
+		}
+	}
+
+	if s.config.MaxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxBodySize)
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *IngestServer) authorized(r *http.Request) bool {
+	if s.config.Username == "" {
+		return true
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.config.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.config.Password)) == 1
+	return userOK && passOK
+}
+
+func (s *IngestServer) handleRepositories(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.lookup(w, r)
+	case http.MethodPost:
+		var req IngestRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		res := s.Ingest(&req)
+		status := http.StatusAccepted
+		if !res.Queued {
+			status = http.StatusBadRequest
+		}
+
+		writeJSON(w, status, res)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+}
+
+func (s *IngestServer) handleRepository(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/repositories/")
+	if path == "batch" {
+		s.handleBatch(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	id, err := uuid.FromString(path)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	repo, err := s.store.Get(kallax.ULID(id))
+	if err == kallax.ErrNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.repositoryInfo(repo))
+}
+
+func (s *IngestServer) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	var reqs []*IngestRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if s.config.MaxBatchSize > 0 && len(reqs) > s.config.MaxBatchSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf(
+			"too many repositories in the request, the maximum is %d",
+			s.config.MaxBatchSize,
+		))
+		return
+	}
+
+	results := make([]*IngestResult, len(reqs))
+	for i, req := range reqs {
+		if req == nil {
+			req = &IngestRequest{}
+		}
+
+		results[i] = s.Ingest(req)
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (s *IngestServer) lookup(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.URL.Query().Get("endpoint")
+	if endpoint == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing endpoint parameter"))
+		return
+	}
+
+	repos, err := s.store.GetByEndpoints(endpoint)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	infos := make([]*RepositoryInfo, len(repos))
+	for i, repo := range repos {
+		infos[i] = s.repositoryInfo(repo)
+	}
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// Ingest finds or creates the repository of the request and queues a job
+// for it.
+func (s *IngestServer) Ingest(req *IngestRequest) *IngestResult {
+	res := &IngestResult{Endpoint: req.Endpoint}
+	logger := log.With(log.Fields{"endpoint": req.Endpoint})
+
+	id, err := s.ingest(req)
+	if ErrEndpointBlocked.Is(err) {
+		logger.Warningf("repository skipped: %s", err)
+		res.Error = err.Error()
+		return res
+	}
+
+	if err != nil {
+		logger.Errorf(err, "error ingesting repository")
+		res.Error = err.Error()
+		return res
+	}
+
+	res.ID = id.String()
+	res.Queued = true
+	logger.With(log.Fields{"job": id}).Infof("job queued")
+	return res
+}
+
+func (s *IngestServer) ingest(req *IngestRequest) (uuid.UUID, error) {
+	endpoints := []string{req.Endpoint}
+	for _, alias := range req.Aliases {
+		if alias != req.Endpoint {
+			endpoints = append(endpoints, alias)
+		}
+	}
+
+	for _, ep := range endpoints {
+		if err := checkRemoteEndpoint(ep); err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	if err := s.blocklist.Check(endpoints...); err != nil {
+		return uuid.Nil, err
+	}
+
+	priority := s.config.Priority
+	if req.Priority != nil {
+		if *req.Priority > uint8(queue.PriorityUrgent) {
+			return uuid.Nil, ErrInvalidPriority.New(queue.PriorityUrgent)
+		}
+
+		priority = queue.Priority(*req.Priority)
+	}
+
+	id, err := RepositoryID(endpoints, req.IsFork, s.store)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	qj, err := NewQueueJob(&Job{RepositoryID: id}, priority, s.config.JobRetries)
+	if err != nil {
+		return id, err
+	}
+
+	if err := s.queue.Publish(qj); err != nil {
+		metrics.RepoProduceFailed()
+		return id, err
+	}
+
+	metrics.RepoProduced()
+	s.markQueued(id, time.Now())
+	return id, nil
+}
+
+func checkRemoteEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ErrInvalidEndpoint.New(endpoint, err)
+	}
+
+	if !u.IsAbs() || u.Host == "" {
+		return ErrInvalidEndpoint.New(endpoint, "expected absolute remote URL")
+	}
+
+	if u.Scheme == "file" {
+		return ErrInvalidEndpoint.New(endpoint, "local repositories are not allowed")
+	}
+
+	return nil
+}
+
+func (s *IngestServer) markQueued(id uuid.UUID, t time.Time) {
+	if s.config.QueuedHistory <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.queued[id]; !ok {
+		s.history = append(s.history, id)
+	}
+	s.queued[id] = t
+
+	for len(s.history) > s.config.QueuedHistory {
+		delete(s.queued, s.history[0])
+		s.history = s.history[1:]
+	}
+}
+
+func (s *IngestServer) repositoryInfo(r *model.Repository) *RepositoryInfo {
+	info := &RepositoryInfo{
+		ID:        uuid.UUID(r.ID),
+		Endpoints: r.Endpoints,
+		Status:    r.Status,
+		FetchedAt: r.FetchedAt,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.queued[info.ID]; ok {
+		info.Queued = true
+		info.QueuedAt = &t
+	}
+
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf(err, "error writing response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
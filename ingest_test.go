@@ -0,0 +1,239 @@
+package borges
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/src-d/borges/storage"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-queue.v1"
+	"gopkg.in/src-d/go-queue.v1/memory"
+)
+
+func TestIngestServer(t *testing.T) {
+	suite.Run(t, new(IngestServerSuite))
+}
+
+type IngestServerSuite struct {
+	suite.Suite
+	store  *storage.LocalStore
+	queue  queue.Queue
+	server *IngestServer
+}
+
+func (s *IngestServerSuite) SetupTest() {
+	var err error
+	s.store = storage.Local()
+	s.queue, err = memory.NewFinite(true).Queue(kallax.NewULID().String())
+	s.Require().NoError(err)
+
+	s.server = NewIngestServer(s.store, s.queue, IngestConfig{
+		Username:      "user",
+		Password:      "pass",
+		MaxBodySize:   1024,
+		MaxBatchSize:  2,
+		Priority:      queue.PriorityNormal,
+		JobRetries:    testJobRetries,
+		QueuedHistory: 10,
+	})
+}
+
+func (s *IngestServerSuite) TestAuthentication() {
+	rec := s.do("GET", "/repositories?endpoint=git://foo/bar", "", false)
+	s.Equal(http.StatusUnauthorized, rec.Code)
+
+	req := httptest.NewRequest("GET", "/repositories?endpoint=git://foo/bar", nil)
+	req.SetBasicAuth("user", "wrong")
+	rec = httptest.NewRecorder()
+	s.server.ServeHTTP(rec, req)
+	s.Equal(http.StatusUnauthorized, rec.Code)
+
+	rec = s.do("GET", "/repositories?endpoint=git://foo/bar", "", true)
+	s.Equal(http.StatusOK, rec.Code)
+}
+
+func (s *IngestServerSuite) TestSubmit() {
+	require := s.Require()
+
+	rec := s.do("POST", "/repositories", `{
+		"endpoint": "git://foo/bar",
+		"aliases": ["git://foo/bar"],
+		"is_fork": true,
+		"priority": 8
+	}`, true)
+	require.Equal(http.StatusAccepted, rec.Code)
+
+	var res IngestResult
+	require.NoError(json.Unmarshal(rec.Body.Bytes(), &res))
+	require.True(res.Queued)
+	require.Empty(res.Error)
+
+	id, err := uuid.FromString(res.ID)
+	require.NoError(err)
+
+	repo, err := s.store.Get(kallax.ULID(id))
+	require.NoError(err)
+	require.Equal([]string{"git://foo/bar"}, repo.Endpoints)
+
+	j := s.nextJob()
+	require.Equal(queue.PriorityUrgent, j.Priority)
+	require.Equal(int32(testJobRetries), j.Retries)
+
+	var job Job
+	require.NoError(j.Decode(&job))
+	require.Equal(id, job.RepositoryID)
+
+	rec = s.do("GET", "/repositories/"+res.ID, "", true)
+	require.Equal(http.StatusOK, rec.Code)
+
+	var info RepositoryInfo
+	require.NoError(json.Unmarshal(rec.Body.Bytes(), &info))
+	require.Equal(id, info.ID)
+	require.Equal(model.Pending, info.Status)
+	require.True(info.Queued)
+	require.NotNil(info.QueuedAt)
+
+	rec = s.do("GET", "/repositories?endpoint=git://foo/bar", "", true)
+	require.Equal(http.StatusOK, rec.Code)
+
+	var infos []*RepositoryInfo
+	require.NoError(json.Unmarshal(rec.Body.Bytes(), &infos))
+	require.Len(infos, 1)
+	require.Equal(id, infos[0].ID)
+}
+
+func (s *IngestServerSuite) TestSubmitInvalid() {
+	require := s.Require()
+
+	bodies := []string{
+		`{"endpoint": "foo/bar"}`,
+		`{"endpoint": "file:///foo/bar"}`,
+		`{"endpoint": "git://foo/bar", "priority": 9}`,
+		`{"endpoint": "git://foo/bar", "aliases": ["bar"]}`,
+	}
+
+	for _, body := range bodies {
+		rec := s.do("POST", "/repositories", body, true)
+		require.Equal(http.StatusBadRequest, rec.Code, body)
+
+		var res IngestResult
+		require.NoError(json.Unmarshal(rec.Body.Bytes(), &res))
+		require.False(res.Queued)
+		require.NotEmpty(res.Error)
+	}
+
+	rec := s.do("POST", "/repositories", `{`, true)
+	require.Equal(http.StatusBadRequest, rec.Code)
+
+	rec = s.do("GET", "/repositories/"+uuid.UUID(kallax.NewULID()).String(), "", true)
+	require.Equal(http.StatusNotFound, rec.Code)
+
+	rec = s.do("DELETE", "/repositories", "", true)
+	require.Equal(http.StatusMethodNotAllowed, rec.Code)
+}
+
+func (s *IngestServerSuite) TestBatch() {
+	require := s.Require()
+
+	rec := s.do("POST", "/repositories/batch", `[
+		{"endpoint": "git://foo/bar"},
+		{"endpoint": "foo"}
+	]`, true)
+	require.Equal(http.StatusOK, rec.Code)
+
+	var results []*IngestResult
+	require.NoError(json.Unmarshal(rec.Body.Bytes(), &results))
+	require.Len(results, 2)
+	require.True(results[0].Queued)
+	require.False(results[1].Queued)
+	require.NotEmpty(results[1].Error)
+
+	j := s.nextJob()
+	require.Equal(queue.PriorityNormal, j.Priority)
+}
+
+func (s *IngestServerSuite) TestBlocked() {
+	require := s.Require()
+
+	b, _ := newTestBlocklist(0, string(storage.BlockHost), "example.com")
+	s.server.SetBlocklist(b)
+
+	rec := s.do("POST", "/repositories", `{
+		"endpoint": "git://foo/bar",
+		"aliases": ["https://example.com/bar"]
+	}`, true)
+	require.Equal(http.StatusBadRequest, rec.Code)
+
+	var res IngestResult
+	require.NoError(json.Unmarshal(rec.Body.Bytes(), &res))
+	require.False(res.Queued)
+	require.Contains(res.Error, "blocked")
+
+	repos, err := s.store.GetByEndpoints("git://foo/bar", "https://example.com/bar")
+	require.NoError(err)
+	require.Len(repos, 0)
+
+	rec = s.do("POST", "/repositories", `{"endpoint": "git://foo/bar"}`, true)
+	require.Equal(http.StatusAccepted, rec.Code)
+}
+
+func (s *IngestServerSuite) TestLimits() {
+	require := s.Require()
+
+	rec := s.do("POST", "/repositories/batch", `[
+		{"endpoint": "git://foo/bar"},
+		{"endpoint": "git://foo/baz"},
+		{"endpoint": "git://foo/qux"}
+	]`, true)
+	require.Equal(http.StatusRequestEntityTooLarge, rec.Code)
+
+	body := `{"endpoint": "git://foo/` + strings.Repeat("a", 2048) + `"}`
+	rec = s.do("POST", "/repositories", body, true)
+	require.Equal(http.StatusBadRequest, rec.Code)
+
+	s.server.slots = make(chan struct{}, 1)
+	s.server.slots <- struct{}{}
+	rec = s.do("GET", "/repositories?endpoint=git://foo/bar", "", true)
+	require.Equal(http.StatusTooManyRequests, rec.Code)
+}
+
+func (s *IngestServerSuite) TestQueuedHistory() {
+	s.server.config.QueuedHistory = 1
+
+	ids := []uuid.UUID{uuid.UUID(kallax.NewULID()), uuid.UUID(kallax.NewULID())}
+	s.server.markQueued(ids[0], time.Now())
+	s.server.markQueued(ids[1], time.Now())
+
+	s.Len(s.server.queued, 1)
+	_, ok := s.server.queued[ids[1]]
+	s.True(ok)
+}
+
+func (s *IngestServerSuite) do(method, path, body string, auth bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if auth {
+		req.SetBasicAuth("user", "pass")
+	}
+
+	rec := httptest.NewRecorder()
+	s.server.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *IngestServerSuite) nextJob() *queue.Job {
+	iter, err := s.queue.Consume(1)
+	s.Require().NoError(err)
+
+	j, err := iter.Next()
+	s.Require().NoError(err)
+	s.Require().NoError(iter.Close())
+	return j
+}
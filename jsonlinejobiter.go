@@ -0,0 +1,208 @@
+package borges
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-queue.v1"
+)
+
+// ErrInvalidRecord is returned when a line of a JSON-lines file is not a
+// valid JSONLineRecord.
+var ErrInvalidRecord = errors.NewKind("invalid record at line %d: %s")
+
+// JSONLineRecord is a repository in a JSON-lines file. It holds the same
+// information as a model.Mention plus some options of the job generated for
+// the repository.
+type JSONLineRecord struct {
+	// Endpoint is the main URL of the repository, or the absolute path of a
+	// local repository.
+	Endpoint string `json:"endpoint"`
+	// Aliases are other URLs of the same repository. They may include the
+	// main URL.
+	Aliases []string `json:"aliases,omitempty"`
+	// IsFork tells if the repository is a fork, if known.
+	IsFork *bool `json:"is_fork,omitempty"`
+	// Provider is the repository provider (e.g. github).
+	Provider string `json:"provider,omitempty"`
+	// VCS is the version control system of the repository. Only git is
+	// supported, which is also the default.
+	VCS model.VCS `json:"vcs,omitempty"`
+	// Priority is the priority of the job, the default one is used if it is
+	// nil.
+	Priority *uint8 `json:"priority,omitempty"`
+	// Retries is the number of retries of the job, the default one is used
+	// if it is nil.
+	Retries *int `json:"retries,omitempty"`
+	// RefPolicy selects the references archived.
+	RefPolicy *RefPolicy `json:"ref_policy,omitempty"`
+	// Force makes the job ignore the stored references of the repository.
+	Force bool `json:"force,omitempty"`
+	// Timeout is the deadline to process the job, such as "30m". The
+	// default one is used if it is empty.
+	Timeout string `json:"timeout,omitempty"`
+	// CorrelationID is added to the logs and notifications of the job.
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// Mention returns the model.Mention equivalent to the record.
+func (r *JSONLineRecord) Mention() *model.Mention {
+	m := model.NewMention()
+	m.Endpoint = r.Endpoint
+	m.IsFork = r.IsFork
+	m.Provider = r.Provider
+	m.VCS = r.VCS
+	if m.VCS == "" {
+		m.VCS = model.GIT
+	}
+
+	if len(r.Aliases) > 0 {
+		m.Aliases = []string{r.Endpoint}
+		for _, alias := range r.Aliases {
+			if alias != r.Endpoint {
+				m.Aliases = append(m.Aliases, alias)
+			}
+		}
+	}
+
+	return m
+}
+
+// Job returns the job for the repository of the record with the given ID. The
+// record is expected to be valid.
+func (r *JSONLineRecord) Job(id uuid.UUID) *Job {
+	j := &Job{
+		RepositoryID:  id,
+		Force:         r.Force,
+		RefPolicy:     r.RefPolicy,
+		CorrelationID: r.CorrelationID,
+		Retries:       r.Retries,
+	}
+
+	if r.Timeout != "" {
+		j.Timeout, _ = time.ParseDuration(r.Timeout)
+	}
+
+	if r.Priority != nil {
+		p := queue.Priority(*r.Priority)
+		j.Priority = &p
+	}
+
+	return j
+}
+
+// Validate checks that the record is well formed.
+func (r *JSONLineRecord) Validate() error {
+	if r.Endpoint == "" {
+		return fmt.Errorf("missing endpoint")
+	}
+
+	if r.VCS != "" && r.VCS != model.GIT {
+		return fmt.Errorf("unsupported vcs %q", r.VCS)
+	}
+
+	if r.Priority != nil && *r.Priority > uint8(queue.PriorityUrgent) {
+		return ErrInvalidPriority.New(queue.PriorityUrgent)
+	}
+
+	if r.Retries != nil && *r.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+
+	if r.Timeout != "" {
+		if d, err := time.ParseDuration(r.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q", r.Timeout)
+		}
+	}
+
+	return r.RefPolicy.Validate()
+}
+
+type jsonLineJobIter struct {
+	storer    RepositoryStore
+	blocklist *Blocklist
+	*bufio.Scanner
+	r    io.ReadCloser
+	line int
+}
+
+// NewJSONLineJobIter returns a JobIter that returns jobs generated from a
+// reader with a JSONLineRecord per line. Blank lines are ignored. Local
+// repositories can be given by their absolute path, as in NewLineJobIter.
+// The returned iterator is a LineJobIter and a BlocklistJobIter.
+func NewJSONLineJobIter(r io.ReadCloser, storer RepositoryStore) JobIter {
+	return &jsonLineJobIter{
+		storer:  storer,
+		Scanner: bufio.NewScanner(r),
+		r:       r,
+	}
+}
+
+func (i *jsonLineJobIter) Next() (*Job, error) {
+	var line string
+	for line == "" {
+		if !i.Scan() {
+			if err := i.Err(); err != nil {
+				return nil, err
+			}
+
+			return nil, io.EOF
+		}
+
+		i.line++
+		line = strings.TrimSpace(string(i.Bytes()))
+	}
+
+	var record JSONLineRecord
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return nil, ErrInvalidRecord.New(i.line, err)
+	}
+
+	if err := record.Validate(); err != nil {
+		return nil, ErrInvalidRecord.New(i.line, err)
+	}
+
+	m := record.Mention()
+	endpoints := getEndpoints(m.Aliases, m.Endpoint)
+	for idx, ep := range endpoints {
+		normalized, err := normalizeEndpoint(ep)
+		if err != nil {
+			return nil, ErrInvalidRecord.New(i.line, err)
+		}
+
+		endpoints[idx] = normalized
+	}
+
+	if err := i.blocklist.Check(endpoints...); err != nil {
+		return nil, err
+	}
+
+	id, err := RepositoryID(endpoints, m.IsFork, i.storer)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Job(id), nil
+}
+
+// SetBlocklist honors the BlocklistJobIter interface.
+func (i *jsonLineJobIter) SetBlocklist(b *Blocklist) {
+	i.blocklist = b
+}
+
+// Line honors the LineJobIter interface.
+func (i *jsonLineJobIter) Line() (int, string) {
+	return i.line, string(i.Bytes())
+}
+
+// Close closes the underlying reader.
+func (i *jsonLineJobIter) Close() error {
+	return i.r.Close()
+}
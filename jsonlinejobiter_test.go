@@ -0,0 +1,130 @@
+package borges
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/src-d/borges/storage"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-queue.v1"
+)
+
+func TestJSONLineJobIter(t *testing.T) {
+	suite.Run(t, new(JSONLineJobIterSuite))
+}
+
+type JSONLineJobIterSuite struct {
+	suite.Suite
+	store *storage.LocalStore
+}
+
+func (s *JSONLineJobIterSuite) SetupTest() {
+	s.store = storage.Local()
+}
+
+func (s *JSONLineJobIterSuite) TestNext() {
+	require := s.Require()
+
+	text := `{"endpoint": "git://foo/bar.git"}
+
+{"endpoint": "git://foo/baz.git", "priority": 8, "retries": 2, "ref_policy": {"include": ["refs/heads/*"]}, "force": true, "timeout": "30m", "correlation_id": "foo"}`
+	iter := NewJSONLineJobIter(ioutil.NopCloser(strings.NewReader(text)), s.store)
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Equal(&Job{RepositoryID: s.idByEndpoint("git://foo/bar.git")}, j)
+	n, line := iter.(LineJobIter).Line()
+	require.Equal(1, n)
+	require.Equal(`{"endpoint": "git://foo/bar.git"}`, line)
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.Equal(s.idByEndpoint("git://foo/baz.git"), j.RepositoryID)
+	n, _ = iter.(LineJobIter).Line()
+	require.Equal(3, n)
+	require.Equal(queue.PriorityUrgent, *j.Priority)
+	require.Equal(2, *j.Retries)
+	require.Equal(&RefPolicy{Include: []string{"refs/heads/*"}}, j.RefPolicy)
+	require.True(j.Force)
+	require.Equal(30*time.Minute, j.Timeout)
+	require.Equal("foo", j.CorrelationID)
+
+	qj, err := NewQueueJob(j, queue.PriorityNormal, testJobRetries)
+	require.NoError(err)
+	require.Equal(queue.PriorityUrgent, qj.Priority)
+	require.Equal(int32(2), qj.Retries)
+
+	var decoded Job
+	require.NoError(qj.Decode(&decoded))
+	require.Equal(j.RepositoryID, decoded.RepositoryID)
+	require.Equal(j.RefPolicy, decoded.RefPolicy)
+	require.True(decoded.Force)
+	require.Equal(j.Timeout, decoded.Timeout)
+	require.Equal(j.CorrelationID, decoded.CorrelationID)
+	require.Nil(decoded.Priority)
+	require.Nil(decoded.Retries)
+
+	j, err = iter.Next()
+	require.Equal(io.EOF, err)
+	require.Nil(j)
+	require.NoError(iter.Close())
+}
+
+func (s *JSONLineJobIterSuite) TestInvalidRecords() {
+	require := s.Require()
+
+	text := `{"endpoint": "git://foo/bar.git"
+{"aliases": ["git://foo/bar.git"]}
+{"endpoint": "foo/bar.git"}
+{"endpoint": "git://foo/bar.git", "vcs": "hg"}
+{"endpoint": "git://foo/bar.git", "priority": 9}
+{"endpoint": "git://foo/bar.git", "retries": -1}
+{"endpoint": "git://foo/bar.git", "ref_policy": {"exclude": ["refs/["]}}
+{"endpoint": "git://foo/bar.git", "timeout": "soon"}
+{"endpoint": "git://foo/qux.git"}`
+	iter := NewJSONLineJobIter(ioutil.NopCloser(strings.NewReader(text)), s.store)
+
+	for i := 1; i <= 8; i++ {
+		_, err := iter.Next()
+		require.True(ErrInvalidRecord.Is(err), "line %d: %v", i, err)
+		require.Contains(err.Error(), fmt.Sprintf("line %d:", i))
+	}
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Equal(s.idByEndpoint("git://foo/qux.git"), j.RepositoryID)
+}
+
+func (s *JSONLineJobIterSuite) TestMention() {
+	isFork := true
+	r := &JSONLineRecord{
+		Endpoint: "git://foo/bar.git",
+		Aliases:  []string{"https://foo/bar.git", "git://foo/bar.git"},
+		IsFork:   &isFork,
+		Provider: "github",
+	}
+
+	m := r.Mention()
+	s.Equal("git://foo/bar.git", m.Endpoint)
+	s.Equal([]string{"git://foo/bar.git", "https://foo/bar.git"}, m.Aliases)
+	s.Equal(&isFork, m.IsFork)
+	s.Equal("github", m.Provider)
+	s.Equal(model.GIT, m.VCS)
+
+	m = (&JSONLineRecord{Endpoint: "git://foo/bar.git"}).Mention()
+	s.Nil(m.Aliases)
+}
+
+func (s *JSONLineJobIterSuite) idByEndpoint(endpoint string) uuid.UUID {
+	repos, err := s.store.GetByEndpoints(endpoint)
+	s.Require().NoError(err)
+	s.Require().Len(repos, 1)
+	return uuid.UUID(repos[0].ID)
+}
@@ -0,0 +1,41 @@
+package borges
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/src-d/borges/lock"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+)
+
+const (
+	// LeaseTTL is the time-to-live of repository leases. A lease held by a
+	// process that stops sending heartbeats expires after this time.
+	LeaseTTL = 10 * time.Second
+	// LeaseTimeout is the time to wait for a repository lease before
+	// considering it held by someone else.
+	LeaseTimeout = time.Second
+)
+
+// RepositoryLeaseID returns the lock id used to lease the repository with the
+// given id.
+func RepositoryLeaseID(id kallax.ULID) string {
+	return fmt.Sprintf("borges/repository/%s", id)
+}
+
+// RootedLockID returns the lock id used to modify the rooted repository with
+// the given init commit.
+func RootedLockID(init model.SHA1) string {
+	return fmt.Sprintf("borges/%s", init.String())
+}
+
+// NewLeaseSession creates a locking session suitable to take repository
+// leases.
+func NewLeaseSession(ls lock.Service) (lock.Session, error) {
+	return ls.NewSession(&lock.SessionConfig{
+		TTL:     LeaseTTL,
+		Timeout: LeaseTimeout,
+	})
+}
@@ -12,13 +12,16 @@ import (
 )
 
 type lineJobIter struct {
-	storer RepositoryStore
+	storer    RepositoryStore
+	blocklist *Blocklist
 	*bufio.Scanner
-	r io.ReadCloser
+	r    io.ReadCloser
+	line int
 }
 
 // NewLineJobIter returns a JobIter that returns jobs generated from a reader
-// with a list of repository URLs, one per line.
+// with a list of repository URLs, one per line. The returned iterator is a
+// LineJobIter and a BlocklistJobIter.
 func NewLineJobIter(r io.ReadCloser, storer RepositoryStore) JobIter {
 	return &lineJobIter{
 		storer:  storer,
@@ -36,7 +39,37 @@ func (i *lineJobIter) Next() (*Job, error) {
 		return nil, io.EOF
 	}
 
-	line := strings.TrimSpace(string(i.Bytes()))
+	i.line++
+	line, err := normalizeEndpoint(strings.TrimSpace(string(i.Bytes())))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := i.blocklist.Check(line); err != nil {
+		return nil, err
+	}
+
+	ID, err := RepositoryID([]string{line}, nil, i.storer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Job{RepositoryID: ID}, nil
+}
+
+// SetBlocklist honors the BlocklistJobIter interface.
+func (i *lineJobIter) SetBlocklist(b *Blocklist) {
+	i.blocklist = b
+}
+
+// Line honors the LineJobIter interface.
+func (i *lineJobIter) Line() (int, string) {
+	return i.line, string(i.Bytes())
+}
+
+// normalizeEndpoint returns the URL of a repository given its URL or the
+// absolute path of a local repository.
+func normalizeEndpoint(line string) (string, error) {
 	// check if the line is an absolute path to a directory.
 	// If the path is a directory we can look for the .git directory to try
 	// to guess if it's a git repo or a bare repo.
@@ -47,7 +80,7 @@ func (i *lineJobIter) Next() (*Job, error) {
 		if _, err := os.Stat(dotGit); os.IsNotExist(err) {
 			line = fmt.Sprintf("file://%s", line)
 		} else if err != nil {
-			return nil, fmt.Errorf("expecting remote or local repository, instead %q was found", line)
+			return "", fmt.Errorf("expecting remote or local repository, instead %q was found", line)
 		} else {
 			line = fmt.Sprintf("file://%s", dotGit)
 		}
@@ -55,19 +88,14 @@ func (i *lineJobIter) Next() (*Job, error) {
 
 	u, err := url.Parse(line)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	if !u.IsAbs() {
-		return nil, fmt.Errorf("expected absolute URL: %s", line)
+		return "", fmt.Errorf("expected absolute URL: %s", line)
 	}
 
-	ID, err := RepositoryID([]string{line}, nil, i.storer)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Job{RepositoryID: ID}, nil
+	return line, nil
 }
 
 // Close closes the underlying reader.
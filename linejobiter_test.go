@@ -28,6 +28,7 @@ type LineJobIterSuite struct {
 
 func (s *LineJobIterSuite) SetupTest() {
 	s.Suite.Setup()
+	s.Require().NoError(storage.CreateSchema(s.DB))
 }
 
 func (s *LineJobIterSuite) TearDownTest() {
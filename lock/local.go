@@ -58,6 +58,14 @@ type localSrv struct {
 	closed   bool
 }
 
+// IsDistributed returns whether the locks of the given service are shared
+// by several processes. Local locks only exclude the actors of the process
+// that holds them.
+func IsDistributed(s Service) bool {
+	_, ok := s.(*localSrv)
+	return !ok
+}
+
 // NewLocal creates a new locking service that uses in-process locks. This can
 // be used whenever locking is relevant only to the local process. Local locks
 // are never lost, so TTL is ignored.
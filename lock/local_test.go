@@ -22,6 +22,16 @@ func (s *LocalLockSuite) SetupTest() {
 	s.ConnectionString = "local:"
 }
 
+func TestIsDistributed(t *testing.T) {
+	require := require.New(t)
+
+	require.False(IsDistributed(NewLocal()))
+
+	srv, err := NewEtcd("etcd:localhost:2379")
+	require.NoError(err)
+	require.True(IsDistributed(srv))
+}
+
 func TestInternalLocalLock(t *testing.T) {
 	require := require.New(t)
 
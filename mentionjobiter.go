@@ -2,17 +2,25 @@ package borges
 
 import (
 	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-log.v1"
 	"gopkg.in/src-d/go-queue.v1"
 )
 
 type mentionJobIter struct {
-	storer RepositoryStore
-	q      queue.Queue
-	iter   queue.JobIter
+	storer    RepositoryStore
+	blocklist *Blocklist
+	q         queue.Queue
+	iter      queue.JobIter
+	// pending is the mention of the last job returned, it is acknowledged
+	// once the job is published.
+	pending *queue.Job
 }
 
 // NewMentionJobIter returns a JobIter that returns jobs generated from mentions
-// received from a queue (e.g. from rovers).
+// received from a queue (e.g. from rovers). The returned iterator implements
+// AckJobIter: a mention is only acknowledged after its job is published and
+// it is requeued if the job could not be published. It is also a
+// BlocklistJobIter, the mentions of blocked endpoints are discarded.
 func NewMentionJobIter(q queue.Queue, storer RepositoryStore) JobIter {
 	return &mentionJobIter{
 		storer: storer,
@@ -25,6 +33,12 @@ func (i *mentionJobIter) Next() (*Job, error) {
 		return nil, err
 	}
 
+	// the previous job was not acknowledged, its mention is requeued so it is
+	// not lost
+	if err := i.reject(true); err != nil {
+		return nil, err
+	}
+
 	mention, j, err := i.getMention()
 	if err != nil {
 		if queue.ErrAlreadyClosed.Is(err) {
@@ -32,21 +46,70 @@ func (i *mentionJobIter) Next() (*Job, error) {
 				return nil, err
 			}
 		}
+
+		if j != nil {
+			// the mention cannot be decoded, retrying it is pointless
+			if err := j.Reject(false); err != nil {
+				log.Errorf(err, "error rejecting mention")
+			}
+		}
+
 		return nil, err
 	}
 
-	ID, err := RepositoryID(getEndpoints(mention.Aliases, mention.Endpoint), mention.IsFork, i.storer)
+	endpoints := getEndpoints(mention.Aliases, mention.Endpoint)
+	if err := i.blocklist.Check(endpoints...); err != nil {
+		i.rejectMention(j, err)
+		return nil, err
+	}
+
+	ID, err := RepositoryID(endpoints, mention.IsFork, i.storer)
 	if err != nil {
+		i.rejectMention(j, err)
 		return nil, err
 	}
 
-	bj := &Job{RepositoryID: ID}
+	i.pending = j
+	return &Job{RepositoryID: ID}, nil
+}
 
-	if err := j.Ack(); err != nil {
-		return nil, err
+// rejectMention rejects a mention whose job could not be created because of
+// the given error. It is requeued unless its endpoints are blocked or taken
+// down, as it would be received again and again.
+func (i *mentionJobIter) rejectMention(j *queue.Job, err error) {
+	requeue := !ErrEndpointBlocked.Is(err) && !ErrRepositoryTakenDown.Is(err)
+	if err := j.Reject(requeue); err != nil {
+		log.Errorf(err, "error rejecting mention")
+	}
+}
+
+// SetBlocklist honors the BlocklistJobIter interface.
+func (i *mentionJobIter) SetBlocklist(b *Blocklist) {
+	i.blocklist = b
+}
+
+// Ack acknowledges the mention of the last job returned by Next if it was
+// published, otherwise the mention is requeued.
+func (i *mentionJobIter) Ack(j *Job, err error) error {
+	if err != nil {
+		return i.reject(true)
+	}
+
+	if i.pending == nil {
+		return nil
 	}
 
-	return bj, nil
+	defer func() { i.pending = nil }()
+	return i.pending.Ack()
+}
+
+func (i *mentionJobIter) reject(requeue bool) error {
+	if i.pending == nil {
+		return nil
+	}
+
+	defer func() { i.pending = nil }()
+	return i.pending.Reject(requeue)
 }
 
 // initIter initialize the iterator if it is not already initialized.
@@ -86,7 +149,13 @@ func getEndpoints(aliases []string, mainURL string) []string {
 	return aliases
 }
 
+// Close requeues the mention of the last job if it was not acknowledged and
+// closes the iterator.
 func (i *mentionJobIter) Close() error {
+	if err := i.reject(true); err != nil {
+		log.Errorf(err, "error requeuing mention")
+	}
+
 	if i.iter != nil {
 		defer func() { i.iter = nil }()
 		if err := i.iter.Close(); err != nil {
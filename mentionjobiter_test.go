@@ -0,0 +1,150 @@
+package borges
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/src-d/borges/storage"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-queue.v1"
+	"gopkg.in/src-d/go-queue.v1/memory"
+)
+
+func TestMentionJobIter(t *testing.T) {
+	suite.Run(t, new(MentionJobIterSuite))
+}
+
+type MentionJobIterSuite struct {
+	suite.Suite
+	store    *storage.LocalStore
+	broker   queue.Broker
+	mentions queue.Queue
+	jobs     queue.Queue
+}
+
+func (s *MentionJobIterSuite) SetupTest() {
+	var err error
+	s.store = storage.Local()
+	s.broker = memory.NewFinite(true)
+	s.mentions, err = s.broker.Queue("mentions")
+	s.Require().NoError(err)
+	s.jobs, err = s.broker.Queue("jobs")
+	s.Require().NoError(err)
+}
+
+func (s *MentionJobIterSuite) TearDownTest() {
+	s.NoError(s.broker.Close())
+}
+
+func (s *MentionJobIterSuite) TestPublishFailures() {
+	require := s.Require()
+
+	s.publishMention("git://foo/bar")
+	s.publishMention("git://foo/baz")
+
+	q := &failingQueue{Queue: s.jobs, failures: 3}
+	p := NewProducer(NewMentionJobIter(s.mentions, s.store), q, queue.PriorityNormal, testJobRetries)
+	p.Start()
+
+	require.Equal(0, q.failures)
+	require.Len(s.consumeAll(s.jobs), 2)
+	require.Empty(s.consumeAll(s.mentions))
+
+	for _, ep := range []string{"git://foo/bar", "git://foo/baz"} {
+		repos, err := s.store.GetByEndpoints(ep)
+		require.NoError(err)
+		require.Len(repos, 1)
+	}
+}
+
+func (s *MentionJobIterSuite) TestCloseWithoutAck() {
+	require := s.Require()
+
+	s.publishMention("git://foo/bar")
+
+	iter := NewMentionJobIter(s.mentions, s.store)
+	j, err := iter.Next()
+	require.NoError(err)
+	require.NotNil(j)
+	require.NoError(iter.Close())
+
+	require.Len(s.consumeAll(s.mentions), 1)
+}
+
+func (s *MentionJobIterSuite) TestAck() {
+	require := s.Require()
+
+	s.publishMention("git://foo/bar")
+
+	iter := NewMentionJobIter(s.mentions, s.store)
+	j, err := iter.Next()
+	require.NoError(err)
+	require.NoError(iter.(AckJobIter).Ack(j, nil))
+	require.NoError(iter.Close())
+
+	require.Empty(s.consumeAll(s.mentions))
+}
+
+func (s *MentionJobIterSuite) TestInvalidMention() {
+	require := s.Require()
+
+	qj, err := queue.NewJob()
+	require.NoError(err)
+	require.NoError(qj.Encode("foo"))
+	require.NoError(s.mentions.Publish(qj))
+
+	iter := NewMentionJobIter(s.mentions, s.store)
+	_, err = iter.Next()
+	require.Error(err)
+
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+	require.NoError(iter.Close())
+}
+
+func (s *MentionJobIterSuite) publishMention(endpoint string) {
+	m := model.NewMention()
+	m.Endpoint = endpoint
+	m.VCS = model.GIT
+
+	qj, err := queue.NewJob()
+	s.Require().NoError(err)
+	s.Require().NoError(qj.Encode(m))
+	s.Require().NoError(s.mentions.Publish(qj))
+}
+
+func (s *MentionJobIterSuite) consumeAll(q queue.Queue) []*queue.Job {
+	iter, err := q.Consume(0)
+	s.Require().NoError(err)
+	defer iter.Close()
+
+	var jobs []*queue.Job
+	for {
+		j, err := iter.Next()
+		if err == io.EOF {
+			return jobs
+		}
+
+		s.Require().NoError(err)
+		s.Require().NoError(j.Ack())
+		jobs = append(jobs, j)
+	}
+}
+
+// failingQueue is a queue.Queue whose first publications fail.
+type failingQueue struct {
+	queue.Queue
+	failures int
+}
+
+func (q *failingQueue) Publish(j *queue.Job) error {
+	if q.failures > 0 {
+		q.failures--
+		return errors.New("publish failed")
+	}
+
+	return q.Queue.Publish(j)
+}
@@ -22,6 +22,8 @@ var (
 	reposAuthRequired = expvar.NewInt("repos_auth_req")
 	reposFailed       = expvar.NewInt("repos_failed")
 	reposSkipped      = expvar.NewInt("repos_skipped")
+	reposBlocked      = expvar.NewInt("repos_blocked")
+	reposReaped       = expvar.NewInt("repos_reaped")
 
 	producedRepos       = expvar.NewInt("repos_produced")
 	producedReposFailed = expvar.NewInt("repos_produced_failed")
@@ -59,6 +61,12 @@ func RepoSkipped() {
 	reposSkipped.Add(1)
 }
 
+// RepoBlocked increments the counter of repositories not fetched because
+// they are blocked.
+func RepoBlocked() {
+	reposBlocked.Add(1)
+}
+
 // RepoProduced increments the counter of produced repositories.
 func RepoProduced() {
 	producedRepos.Add(1)
@@ -68,3 +76,9 @@ func RepoProduced() {
 func RepoProduceFailed() {
 	producedReposFailed.Add(1)
 }
+
+// RepoReaped increments the counter of repositories requeued after their
+// lease expired.
+func RepoReaped() {
+	reposReaped.Add(1)
+}
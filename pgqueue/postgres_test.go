@@ -0,0 +1,338 @@
+package pgqueue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/test"
+	"gopkg.in/src-d/go-queue.v1"
+)
+
+func TestPostgresQueue(t *testing.T) {
+	suite.Run(t, new(PostgresQueueSuite))
+}
+
+type PostgresQueueSuite struct {
+	test.Suite
+	broker *Broker
+	queue  queue.Queue
+}
+
+func (s *PostgresQueueSuite) SetupTest() {
+	s.Setup()
+
+	var err error
+	s.broker, err = FromDatabase(s.DB)
+	s.Require().NoError(err)
+
+	s.queue, err = s.broker.Queue("jobs")
+	s.Require().NoError(err)
+}
+
+func (s *PostgresQueueSuite) TearDownTest() {
+	s.NoError(s.broker.Close())
+	s.TearDown()
+}
+
+func (s *PostgresQueueSuite) TestPublishConsume() {
+	require := s.Require()
+
+	s.publish("low", queue.PriorityLow)
+	s.publish("normal", queue.PriorityNormal)
+	s.publish("urgent", queue.PriorityUrgent)
+	s.publish("normal2", queue.PriorityNormal)
+
+	other, err := s.broker.Queue("other")
+	require.NoError(err)
+	j := s.newJob("other", queue.PriorityUrgent)
+	require.NoError(other.Publish(j))
+
+	iter, err := s.queue.Consume(0)
+	require.NoError(err)
+
+	for _, expected := range []string{"urgent", "normal", "normal2", "low"} {
+		j, err := iter.Next()
+		require.NoError(err)
+
+		var payload string
+		require.NoError(j.Decode(&payload))
+		require.Equal(expected, payload)
+		require.Equal(int32(3), j.Retries)
+		require.NoError(j.Ack())
+	}
+
+	require.NoError(iter.Close())
+	s.assertCount("jobs", 0)
+	s.assertCount("other", 1)
+}
+
+func (s *PostgresQueueSuite) TestSkipLocked() {
+	require := s.Require()
+
+	s.publish("foo", queue.PriorityNormal)
+	s.publish("bar", queue.PriorityNormal)
+
+	iter1, err := s.queue.Consume(1)
+	require.NoError(err)
+	iter2, err := s.queue.Consume(1)
+	require.NoError(err)
+
+	j1, err := iter1.Next()
+	require.NoError(err)
+	j2, err := iter2.Next()
+	require.NoError(err)
+	require.NotEqual(j1.ID, j2.ID)
+
+	require.NoError(j1.Ack())
+	require.True(ErrAlreadyAcknowledged.Is(j1.Ack()))
+	require.NoError(j2.Reject(true))
+
+	j, err := iter1.Next()
+	require.NoError(err)
+	require.Equal(j2.ID, j.ID)
+	require.NoError(j.Ack())
+
+	require.NoError(iter1.Close())
+	require.NoError(iter2.Close())
+	s.assertCount("jobs", 0)
+}
+
+func (s *PostgresQueueSuite) TestLockExpired() {
+	require := s.Require()
+
+	s.publish("foo", queue.PriorityNormal)
+
+	iter1, err := s.queue.Consume(1)
+	require.NoError(err)
+	iter2, err := s.queue.Consume(1)
+	require.NoError(err)
+
+	j1, err := iter1.Next()
+	require.NoError(err)
+
+	_, err = s.DB.Exec(`UPDATE queue_jobs SET locked_until = now() - interval '1 second'`)
+	require.NoError(err)
+
+	j2, err := iter2.Next()
+	require.NoError(err)
+	require.Equal(j1.ID, j2.ID)
+
+	require.True(ErrLockLost.Is(j1.Ack()))
+	require.NoError(j2.Ack())
+
+	require.NoError(iter1.Close())
+	require.NoError(iter2.Close())
+	s.assertCount("jobs", 0)
+}
+
+func (s *PostgresQueueSuite) TestLockRenewed() {
+	require := s.Require()
+
+	ttl := LockTTL
+	LockTTL = 300 * time.Millisecond
+	defer func() { LockTTL = ttl }()
+
+	s.publish("foo", queue.PriorityNormal)
+
+	iter, err := s.queue.Consume(1)
+	require.NoError(err)
+
+	j, err := iter.Next()
+	require.NoError(err)
+
+	time.Sleep(time.Second)
+
+	var locked bool
+	err = s.DB.QueryRow(`SELECT locked_until > now() FROM queue_jobs`).Scan(&locked)
+	require.NoError(err)
+	require.True(locked)
+
+	require.NoError(j.Ack())
+	require.NoError(iter.Close())
+	s.assertCount("jobs", 0)
+}
+
+func (s *PostgresQueueSuite) TestCloseUnblocksNext() {
+	require := s.Require()
+
+	iter, err := s.queue.Consume(1)
+	require.NoError(err)
+
+	done := make(chan error)
+	go func() {
+		_, err := iter.Next()
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(iter.Close())
+
+	select {
+	case err := <-done:
+		require.True(queue.ErrAlreadyClosed.Is(err))
+	case <-time.After(5 * time.Second):
+		require.FailNow("Next was not unblocked")
+	}
+}
+
+func (s *PostgresQueueSuite) TestRepublishBuried() {
+	require := s.Require()
+
+	for i := 0; i < 4; i++ {
+		s.publish(fmt.Sprint(i), queue.PriorityNormal)
+	}
+
+	iter, err := s.queue.Consume(0)
+	require.NoError(err)
+
+	for i := 0; i < 4; i++ {
+		j, err := iter.Next()
+		require.NoError(err)
+
+		if i%2 == 0 {
+			// as the Worker does with temporary errors
+			j.Retries = 0
+			j.ErrorType = "temporary"
+			require.NoError(s.queue.Publish(j))
+			require.NoError(j.Ack())
+		} else {
+			require.NoError(j.Reject(false))
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		j, err := iter.Next()
+		require.NoError(err)
+		require.Equal("temporary", j.ErrorType)
+		require.Equal(int32(0), j.Retries)
+		require.NoError(j.Reject(false))
+	}
+
+	require.NoError(iter.Close())
+	s.assertBuried(4)
+
+	require.NoError(s.queue.RepublishBuried(func(j *queue.Job) bool {
+		return j.ErrorType == "temporary" && j.Retries == 0
+	}))
+	s.assertBuried(2)
+
+	s.consumeAll(func(j *queue.Job) {
+		require.Equal("temporary", j.ErrorType)
+	})
+	s.assertBuried(2)
+
+	require.NoError(s.queue.RepublishBuried())
+	s.assertBuried(0)
+
+	s.consumeAll(func(j *queue.Job) {
+		require.Empty(j.ErrorType)
+	})
+	s.assertCount("jobs", 0)
+}
+
+func (s *PostgresQueueSuite) TestTransaction() {
+	require := s.Require()
+
+	err := s.queue.Transaction(func(q queue.Queue) error {
+		j := s.newJob("foo", queue.PriorityNormal)
+		return q.Publish(j)
+	})
+	require.NoError(err)
+	s.assertCount("jobs", 1)
+
+	err = s.queue.Transaction(func(q queue.Queue) error {
+		j := s.newJob("bar", queue.PriorityNormal)
+		if err := q.Publish(j); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("rollback")
+	})
+	require.EqualError(err, "rollback")
+	s.assertCount("jobs", 1)
+}
+
+func (s *PostgresQueueSuite) TestPublishDelayed() {
+	require := s.Require()
+
+	j := s.newJob("foo", queue.PriorityNormal)
+	require.NoError(s.queue.PublishDelayed(j, time.Hour))
+	s.publish("bar", queue.PriorityLow)
+
+	iter, err := s.queue.Consume(0)
+	require.NoError(err)
+
+	j, err = iter.Next()
+	require.NoError(err)
+
+	var payload string
+	require.NoError(j.Decode(&payload))
+	require.Equal("bar", payload)
+	require.NoError(j.Ack())
+	require.NoError(iter.Close())
+
+	s.assertCount("jobs", 1)
+}
+
+func (s *PostgresQueueSuite) TestPublishEmpty() {
+	j, err := queue.NewJob()
+	s.Require().NoError(err)
+	s.True(queue.ErrEmptyJob.Is(s.queue.Publish(j)))
+}
+
+func (s *PostgresQueueSuite) newJob(payload string, p queue.Priority) *queue.Job {
+	j, err := queue.NewJob()
+	s.Require().NoError(err)
+	s.Require().NoError(j.Encode(payload))
+	j.SetPriority(p)
+	j.Retries = 3
+	return j
+}
+
+func (s *PostgresQueueSuite) publish(payload string, p queue.Priority) {
+	s.Require().NoError(s.queue.Publish(s.newJob(payload, p)))
+}
+
+// consumeAll acknowledges all the available jobs of the queue after calling
+// the given function with each of them.
+func (s *PostgresQueueSuite) consumeAll(f func(*queue.Job)) {
+	iter, err := s.queue.Consume(0)
+	s.Require().NoError(err)
+	defer iter.Close()
+
+	for {
+		var n int
+		err := s.DB.QueryRow(
+			`SELECT COUNT(*) FROM queue_jobs WHERE queue = 'jobs' AND NOT buried`,
+		).Scan(&n)
+		s.Require().NoError(err)
+		if n == 0 {
+			return
+		}
+
+		j, err := iter.Next()
+		s.Require().NoError(err)
+		f(j)
+		s.Require().NoError(j.Ack())
+	}
+}
+
+func (s *PostgresQueueSuite) assertCount(name string, expected int) {
+	var n int
+	err := s.DB.QueryRow(
+		`SELECT COUNT(*) FROM queue_jobs WHERE queue = $1`, name,
+	).Scan(&n)
+	s.Require().NoError(err)
+	s.Equal(expected, n)
+}
+
+func (s *PostgresQueueSuite) assertBuried(expected int) {
+	var n int
+	err := s.DB.QueryRow(
+		`SELECT COUNT(*) FROM queue_jobs WHERE queue = 'jobs' AND buried`,
+	).Scan(&n)
+	s.Require().NoError(err)
+	s.Equal(expected, n)
+}
@@ -82,32 +82,58 @@ func (p *Producer) start() {
 
 		nextJobSameErr = 0
 
-		if err := p.add(j); err != nil {
+		err = p.add(j)
+		if err != nil {
 			metrics.RepoProduceFailed()
 			log.With(log.Fields{"job": j.RepositoryID}).Errorf(err, "error adding job to the queue")
 		} else {
 			metrics.RepoProduced()
 			log.With(log.Fields{"job": j.RepositoryID}).Infof("job queued")
 		}
+
+		if iter, ok := p.jobIter.(AckJobIter); ok {
+			if err := iter.Ack(j, err); err != nil {
+				log.With(log.Fields{"job": j.RepositoryID}).Errorf(err, "error acknowledging job source")
+			}
+		}
 	}
 
 	log.Infof("stopping")
 }
 
 func (p *Producer) add(j *Job) error {
-	qj, err := queue.NewJob()
+	qj, err := NewQueueJob(j, p.priority, p.maxJobRetries)
 	if err != nil {
 		return err
 	}
 
-	qj.Retries = int32(p.maxJobRetries)
+	return p.queue.Publish(qj)
+}
+
+// NewQueueJob encodes a Job into a new queue job with the given priority and
+// number of retries. The priority and retries set in the Job take precedence.
+func NewQueueJob(j *Job, p queue.Priority, retries int) (*queue.Job, error) {
+	qj, err := queue.NewJob()
+	if err != nil {
+		return nil, err
+	}
+
+	if j.Priority != nil {
+		p = *j.Priority
+	}
+
+	if j.Retries != nil {
+		retries = *j.Retries
+	}
+
+	qj.Retries = int32(retries)
 	if err := qj.Encode(j); err != nil {
-		return err
+		return nil, err
 	}
 
-	qj.SetPriority(p.priority)
+	qj.SetPriority(p)
 
-	return p.queue.Publish(qj)
+	return qj, nil
 }
 
 func (p *Producer) stop() {
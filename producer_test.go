@@ -12,6 +12,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
 	"gopkg.in/src-d/go-queue.v1"
 )
 
@@ -152,3 +153,39 @@ type DummyJobIter struct{}
 
 func (j DummyJobIter) Close() error        { return errors.New("SOME CLOSE ERROR") }
 func (j DummyJobIter) Next() (*Job, error) { return &Job{RepositoryID: uuid.Nil}, nil }
+
+func TestNewQueueJobCompatibility(t *testing.T) {
+	require := require.New(t)
+
+	// payload of the jobs queued before the job options existed
+	type oldJob struct {
+		RepositoryID uuid.UUID
+	}
+
+	id := uuid.UUID(kallax.NewULID())
+	old, err := queue.NewJob()
+	require.NoError(err)
+	require.NoError(old.Encode(&oldJob{RepositoryID: id}))
+
+	var j Job
+	require.NoError(old.Decode(&j))
+	require.Equal(Job{RepositoryID: id}, j)
+
+	qj, err := NewQueueJob(&Job{RepositoryID: id}, queue.PriorityNormal, 0)
+	require.NoError(err)
+	require.Equal(old.Raw, qj.Raw)
+
+	qj, err = NewQueueJob(&Job{
+		RepositoryID:  id,
+		Force:         true,
+		Endpoint:      "git://foo/bar",
+		RefPolicy:     &RefPolicy{Include: []string{"refs/heads/*"}},
+		Timeout:       time.Minute,
+		CorrelationID: "foo",
+	}, queue.PriorityNormal, 0)
+	require.NoError(err)
+
+	var o oldJob
+	require.NoError(qj.Decode(&o))
+	require.Equal(id, o.RepositoryID)
+}
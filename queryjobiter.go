@@ -0,0 +1,224 @@
+package borges
+
+import (
+	"io"
+
+	"github.com/src-d/borges/lock"
+	bstorage "github.com/src-d/borges/storage"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// FilterStore is a RepositoryStore that is also able to find repositories
+// using a filter.
+type FilterStore interface {
+	RepositoryStore
+	// GetByFilter returns up to limit repositories selected by the filter
+	// with an ID greater than after, ordered by ID.
+	GetByFilter(f *bstorage.RepositoryFilter, after kallax.ULID, limit uint64) ([]*model.Repository, error)
+}
+
+type queryJobIter struct {
+	storer    FilterStore
+	filter    *bstorage.RepositoryFilter
+	batchSize uint64
+	blocklist *Blocklist
+	locking   lock.Service
+	session   lock.Session
+
+	last    kallax.ULID
+	pending []*model.Repository
+	done    bool
+	unacked *model.Repository
+	lease   lock.Locker
+}
+
+// NewQueryJobIter returns a JobIter that returns jobs for all the
+// repositories selected by the given filter, ordered by ID. Repositories are
+// read from the store in batches of batchSize and they are set to Pending
+// once their job is acknowledged as published. It returns io.EOF once every
+// selected repository has been returned. The returned iterator is a
+// BlocklistJobIter, the repositories with blocked endpoints are set to Blocked
+// and skipped.
+//
+// Repositories in Fetching status are only returned if their lease in the
+// given locking service has expired, as they may be being fetched right now.
+// The lease is held until the job is acknowledged. If locking is nil, they
+// are always skipped.
+func NewQueryJobIter(
+	storer FilterStore,
+	filter *bstorage.RepositoryFilter,
+	batchSize uint64,
+	locking lock.Service,
+) JobIter {
+	return &queryJobIter{
+		storer:    storer,
+		filter:    filter,
+		batchSize: batchSize,
+		locking:   locking,
+	}
+}
+
+func (i *queryJobIter) Next() (*Job, error) {
+	i.unacked = nil
+	i.releaseLease()
+
+	for {
+		r, err := i.next()
+		if err != nil {
+			return nil, err
+		}
+
+		err = i.blocklist.Check(r.Endpoints...)
+		if ErrEndpointBlocked.Is(err) {
+			log.With(log.Fields{"id": r.ID}).Warningf("repository skipped: %s", err)
+			if err := i.storer.SetStatus(r, Blocked); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Status == model.Fetching {
+			ok, err := i.takeLease(r)
+			if err != nil {
+				return nil, err
+			}
+
+			if !ok {
+				log.With(log.Fields{"id": r.ID}).
+					Debugf("repository skipped, it is being fetched")
+				continue
+			}
+		}
+
+		i.unacked = r
+		return &Job{RepositoryID: uuid.UUID(r.ID)}, nil
+	}
+}
+
+// Ack honors the AckJobIter interface. The repository of the job is set to
+// Pending only if the job was published.
+func (i *queryJobIter) Ack(j *Job, err error) error {
+	r := i.unacked
+	i.unacked = nil
+	defer i.releaseLease()
+
+	if err != nil || r == nil || uuid.UUID(r.ID) != j.RepositoryID {
+		return nil
+	}
+
+	return i.storer.SetStatus(r, model.Pending)
+}
+
+// takeLease takes the lease of a repository in Fetching status and returns
+// whether it was expired and the repository is still in Fetching status.
+func (i *queryJobIter) takeLease(r *model.Repository) (bool, error) {
+	if i.locking == nil {
+		return false, nil
+	}
+
+	if i.session == nil {
+		session, err := NewLeaseSession(i.locking)
+		if err != nil {
+			return false, err
+		}
+
+		i.session = session
+	}
+
+	lease := i.session.NewLocker(RepositoryLeaseID(r.ID))
+	if _, err := lease.Lock(); err != nil {
+		if lock.ErrCanceled.Is(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	i.lease = lease
+
+	// the status is read again with the lease held as it may have changed
+	// since the repositories were listed
+	repo, err := i.storer.Get(r.ID)
+	if err != nil {
+		i.releaseLease()
+		return false, err
+	}
+
+	if repo.Status != model.Fetching {
+		i.releaseLease()
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (i *queryJobIter) releaseLease() {
+	if i.lease == nil {
+		return
+	}
+
+	if err := i.lease.Unlock(); err != nil {
+		log.Errorf(err, "failed to release repository lease")
+	}
+
+	i.lease = nil
+}
+
+// SetBlocklist honors the BlocklistJobIter interface.
+func (i *queryJobIter) SetBlocklist(b *Blocklist) {
+	i.blocklist = b
+}
+
+// next returns the next selected repository, reading a new batch if needed.
+func (i *queryJobIter) next() (*model.Repository, error) {
+	if len(i.pending) == 0 {
+		if i.done {
+			return nil, io.EOF
+		}
+
+		repos, err := i.storer.GetByFilter(i.filter, i.last, i.batchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if uint64(len(repos)) < i.batchSize {
+			i.done = true
+		}
+
+		if len(repos) == 0 {
+			return nil, io.EOF
+		}
+
+		i.pending = repos
+		i.last = repos[len(repos)-1].ID
+	}
+
+	r := i.pending[0]
+	i.pending = i.pending[1:]
+	return r, nil
+}
+
+// Close stops the iterator. Any call to Next after Close returns io.EOF.
+func (i *queryJobIter) Close() error {
+	i.pending = nil
+	i.done = true
+	i.unacked = nil
+	i.releaseLease()
+
+	if i.session != nil {
+		err := i.session.Close()
+		i.session = nil
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package borges
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/src-d/borges/lock"
+	"github.com/src-d/borges/storage"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/test"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestQueryJobIter(t *testing.T) {
+	suite.Run(t, new(QueryJobIterSuite))
+}
+
+type QueryJobIterSuite struct {
+	test.Suite
+	rawStore *model.RepositoryStore
+	store    *storage.DatabaseStore
+}
+
+func (s *QueryJobIterSuite) SetupTest() {
+	s.Suite.Setup()
+	s.rawStore = model.NewRepositoryStore(s.DB)
+	s.store = storage.FromDatabase(s.DB)
+}
+
+func (s *QueryJobIterSuite) TearDownTest() {
+	s.Suite.TearDown()
+}
+
+func (s *QueryJobIterSuite) TestNext() {
+	require := s.Require()
+
+	selected := map[uuid.UUID]kallax.ULID{}
+	for i := 0; i < 3; i++ {
+		id := s.createRepo(model.NotFound)
+		selected[uuid.UUID(id)] = id
+	}
+
+	s.createRepo(model.Fetched)
+
+	iter := NewQueryJobIter(s.store, &storage.RepositoryFilter{
+		Statuses: []model.FetchStatus{model.NotFound},
+	}, 2, nil)
+
+	ackIter, ok := iter.(AckJobIter)
+	require.True(ok)
+
+	for i := 0; i < 3; i++ {
+		j, err := iter.Next()
+		require.NoError(err)
+
+		id, ok := selected[j.RepositoryID]
+		require.True(ok)
+		delete(selected, j.RepositoryID)
+		s.assertStatus(id, model.NotFound)
+
+		if i == 0 {
+			require.NoError(ackIter.Ack(j, fmt.Errorf("publish failed")))
+			s.assertStatus(id, model.NotFound)
+			continue
+		}
+
+		require.NoError(ackIter.Ack(j, nil))
+		s.assertStatus(id, model.Pending)
+	}
+
+	j, err := iter.Next()
+	require.Equal(io.EOF, err)
+	require.Nil(j)
+	require.NoError(iter.Close())
+}
+
+func (s *QueryJobIterSuite) TestNextBlocked() {
+	require := s.Require()
+
+	blocked := s.createRepo(model.NotFound)
+	allowed := s.createRepo(model.NotFound)
+
+	iter := NewQueryJobIter(s.store, &storage.RepositoryFilter{
+		Statuses: []model.FetchStatus{model.NotFound},
+	}, 10, nil)
+
+	b, _ := newTestBlocklist(0, "pattern", blocked.String())
+	iter.(BlocklistJobIter).SetBlocklist(b)
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Equal(uuid.UUID(allowed), j.RepositoryID)
+	require.NoError(iter.(AckJobIter).Ack(j, nil))
+
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+
+	s.assertStatus(blocked, Blocked)
+	s.assertStatus(allowed, model.Pending)
+}
+
+func (s *QueryJobIterSuite) TestNextFetching() {
+	require := s.Require()
+
+	expired := s.createRepo(model.Fetching)
+	leased := s.createRepo(model.Fetching)
+
+	locking := lock.NewLocal()
+	session, err := NewLeaseSession(locking)
+	require.NoError(err)
+	lease := session.NewLocker(RepositoryLeaseID(leased))
+	_, err = lease.Lock()
+	require.NoError(err)
+	defer lease.Unlock()
+
+	filter := &storage.RepositoryFilter{
+		Statuses: []model.FetchStatus{model.Fetching},
+	}
+
+	iter := NewQueryJobIter(s.store, filter, 10, nil)
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+
+	iter = NewQueryJobIter(s.store, filter, 10, locking)
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Equal(uuid.UUID(expired), j.RepositoryID)
+
+	// the lease of the returned repository is held until it is acknowledged
+	other := session.NewLocker(RepositoryLeaseID(expired))
+	_, err = other.Lock()
+	require.True(lock.ErrCanceled.Is(err))
+
+	require.NoError(iter.(AckJobIter).Ack(j, nil))
+	s.assertStatus(expired, model.Pending)
+
+	_, err = other.Lock()
+	require.NoError(err)
+	require.NoError(other.Unlock())
+
+	_, err = iter.Next()
+	require.Equal(io.EOF, err)
+	require.NoError(iter.Close())
+
+	s.assertStatus(leased, model.Fetching)
+}
+
+func (s *QueryJobIterSuite) createRepo(status model.FetchStatus) kallax.ULID {
+	r := model.NewRepository()
+	r.Endpoints = []string{"git://foo/" + r.ID.String()}
+	r.Status = status
+	s.Require().NoError(s.rawStore.Insert(r))
+	return r.ID
+}
+
+func (s *QueryJobIterSuite) assertStatus(id kallax.ULID, status model.FetchStatus) {
+	r, err := s.store.Get(id)
+	s.Require().NoError(err)
+	s.Equal(status, r.Status)
+}
@@ -0,0 +1,183 @@
+package borges
+
+import (
+	"sync"
+	"time"
+
+	"github.com/src-d/borges/lock"
+	"github.com/src-d/borges/metrics"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+	"gopkg.in/src-d/go-queue.v1"
+)
+
+// ReaperStore is a RepositoryStore that is also able to find repositories by
+// their status.
+type ReaperStore interface {
+	RepositoryStore
+	// GetByStatus returns all the repositories with the given status.
+	GetByStatus(status model.FetchStatus) ([]*model.Repository, error)
+}
+
+// Reaper looks periodically for repositories left in Fetching status whose
+// lease is not held by anyone, for example because the consumer processing
+// them crashed. These repositories are set back to Pending and queued again.
+type Reaper struct {
+	store         ReaperStore
+	locking       lock.Service
+	queue         queue.Queue
+	priority      queue.Priority
+	maxJobRetries int
+	interval      time.Duration
+
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce *sync.Once
+}
+
+// NewReaper creates a new reaper that checks for expired leases every
+// interval and queues the reaped repositories in q.
+func NewReaper(
+	s ReaperStore,
+	ls lock.Service,
+	q queue.Queue,
+	p queue.Priority,
+	jobRetries int,
+	interval time.Duration,
+) *Reaper {
+	return &Reaper{
+		store:         s,
+		locking:       ls,
+		queue:         q,
+		priority:      p,
+		maxJobRetries: jobRetries,
+		interval:      interval,
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+		stopOnce:      &sync.Once{},
+	}
+}
+
+// Start reaps repositories periodically. It blocks until Stop is called.
+func (r *Reaper) Start() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	log.With(log.Fields{"interval": r.interval}).Debugf("starting reaper")
+	for {
+		if _, err := r.Reap(); err != nil {
+			log.Errorf(err, "error reaping repositories")
+		}
+
+		select {
+		case <-r.quit:
+			log.Debugf("stopping reaper")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops the reaper and waits until it is finished.
+func (r *Reaper) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.quit)
+		<-r.done
+	})
+}
+
+// Reap looks for repositories in Fetching status with an expired lease, sets
+// them to Pending and queues them again. It returns the number of reaped
+// repositories.
+func (r *Reaper) Reap() (int, error) {
+	repos, err := r.store.GetByStatus(model.Fetching)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(repos) == 0 {
+		return 0, nil
+	}
+
+	session, err := NewLeaseSession(r.locking)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err := session.Close(); err != nil {
+			log.Errorf(err, "error closing lease session")
+		}
+	}()
+
+	var reaped int
+	for _, repo := range repos {
+		logger := log.New(log.Fields{"repository": repo.ID})
+
+		ok, err := r.reapOne(session, repo.ID)
+		if err != nil {
+			logger.Errorf(err, "error reaping repository")
+			continue
+		}
+
+		if ok {
+			metrics.RepoReaped()
+			logger.Infof("repository lease expired, queued again")
+			reaped++
+		}
+	}
+
+	return reaped, nil
+}
+
+func (r *Reaper) reapOne(session lock.Session, id kallax.ULID) (bool, error) {
+	lease := session.NewLocker(RepositoryLeaseID(id))
+	if _, err := lease.Lock(); err != nil {
+		if lock.ErrCanceled.Is(err) {
+			// the lease is held, so the repository is being processed
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	defer func() {
+		if err := lease.Unlock(); err != nil {
+			log.With(log.Fields{"repository": id}).
+				Errorf(err, "failed to release repository lease")
+		}
+	}()
+
+	// the status is read again with the lease held as it may have changed
+	// since the repositories were listed
+	repo, err := r.store.Get(id)
+	if err != nil {
+		return false, err
+	}
+
+	if repo.Status != model.Fetching {
+		return false, nil
+	}
+
+	qj, err := NewQueueJob(&Job{RepositoryID: uuid.UUID(id)}, r.priority, r.maxJobRetries)
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.queue.Publish(qj); err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	repo.FetchErrorAt = &now
+	if err := r.store.UpdateFailed(repo, model.Pending); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,111 @@
+package borges
+
+import (
+	"testing"
+	"time"
+
+	"github.com/src-d/borges/lock"
+	"github.com/src-d/borges/storage"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-queue.v1"
+	"gopkg.in/src-d/go-queue.v1/memory"
+)
+
+func TestReaper(t *testing.T) {
+	suite.Run(t, new(ReaperSuite))
+}
+
+type ReaperSuite struct {
+	suite.Suite
+	store   *storage.LocalStore
+	locking lock.Service
+	queue   queue.Queue
+	reaper  *Reaper
+}
+
+func (s *ReaperSuite) SetupTest() {
+	var err error
+	s.store = storage.Local()
+	s.locking = lock.NewLocal()
+	s.queue, err = memory.NewFinite(true).Queue(kallax.NewULID().String())
+	s.Require().NoError(err)
+
+	s.reaper = NewReaper(s.store, s.locking, s.queue,
+		queue.PriorityNormal, testJobRetries, time.Hour)
+}
+
+func (s *ReaperSuite) TestReap() {
+	require := s.Require()
+
+	expired := s.createRepo("git://foo/expired", model.Fetching)
+	leased := s.createRepo("git://foo/leased", model.Fetching)
+	fetched := s.createRepo("git://foo/fetched", model.Fetched)
+
+	session, err := NewLeaseSession(s.locking)
+	require.NoError(err)
+	lease := session.NewLocker(RepositoryLeaseID(leased))
+	_, err = lease.Lock()
+	require.NoError(err)
+	defer lease.Unlock()
+
+	n, err := s.reaper.Reap()
+	require.NoError(err)
+	require.Equal(1, n)
+
+	s.assertStatus(expired, model.Pending)
+	s.assertStatus(leased, model.Fetching)
+	s.assertStatus(fetched, model.Fetched)
+
+	iter, err := s.queue.Consume(0)
+	require.NoError(err)
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Equal(int32(testJobRetries), j.Retries)
+
+	var job Job
+	require.NoError(j.Decode(&job))
+	require.Equal(uuid.UUID(expired), job.RepositoryID)
+
+	_, err = iter.Next()
+	require.Error(err)
+}
+
+func (s *ReaperSuite) TestStartStop() {
+	require := s.Require()
+
+	expired := s.createRepo("git://foo/expired", model.Fetching)
+
+	done := make(chan struct{})
+	go func() {
+		s.reaper.Start()
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	s.reaper.Stop()
+	<-done
+
+	s.assertStatus(expired, model.Pending)
+
+	_, err := s.reaper.Reap()
+	require.NoError(err)
+}
+
+func (s *ReaperSuite) createRepo(endpoint string, status model.FetchStatus) kallax.ULID {
+	r := model.NewRepository()
+	r.Endpoints = []string{endpoint}
+	r.Status = status
+	s.Require().NoError(s.store.Create(r))
+	return r.ID
+}
+
+func (s *ReaperSuite) assertStatus(id kallax.ULID, status model.FetchStatus) {
+	r, err := s.store.Get(id)
+	s.Require().NoError(err)
+	s.Equal(status, r.Status)
+}
@@ -0,0 +1,101 @@
+package borges
+
+import (
+	"path"
+	"strings"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-errors.v1"
+)
+
+// ErrInvalidRefPolicy is returned when a pattern of a RefPolicy is malformed.
+var ErrInvalidRefPolicy = errors.NewKind("invalid reference pattern %q: %s")
+
+// RefPolicy selects the references of a repository that are archived.
+// References not allowed by the policy are neither created, updated nor
+// deleted in the rooted repositories, they are left as they are.
+//
+// Patterns are matched against the reference names using the syntax of
+// path.Match. Besides, a pattern ending in "/*" matches any reference under
+// that prefix, so "refs/heads/*" matches "refs/heads/feature/foo".
+type RefPolicy struct {
+	// Include are the patterns of the references archived. Every reference
+	// is included if it is empty.
+	Include []string `json:"include,omitempty" msgpack:",omitempty"`
+	// Exclude are the patterns of the references that are never archived,
+	// even if they are included.
+	Exclude []string `json:"exclude,omitempty" msgpack:",omitempty"`
+}
+
+// Allows returns true if the reference with the given name is archived
+// according to the policy. A nil policy allows every reference.
+func (p *RefPolicy) Allows(name string) bool {
+	if p == nil {
+		return true
+	}
+
+	if len(p.Include) > 0 && !matchesAny(p.Include, name) {
+		return false
+	}
+
+	return !matchesAny(p.Exclude, name)
+}
+
+// Validate checks that all the patterns of the policy are well formed.
+func (p *RefPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+
+	for _, patterns := range [][]string{p.Include, p.Exclude} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return ErrInvalidRefPolicy.New(pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/*") &&
+			strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewRefPolicyReferencer returns a Referencer that only returns the
+// references of the given one allowed by the policy.
+func NewRefPolicyReferencer(r Referencer, p *RefPolicy) Referencer {
+	return &refPolicyReferencer{r, p}
+}
+
+type refPolicyReferencer struct {
+	Referencer
+	policy *RefPolicy
+}
+
+func (r *refPolicyReferencer) References() ([]*model.Reference, error) {
+	refs, err := r.Referencer.References()
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []*model.Reference
+	for _, ref := range refs {
+		if r.policy.Allows(ref.Name) {
+			allowed = append(allowed, ref)
+		}
+	}
+
+	return allowed, nil
+}
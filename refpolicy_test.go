@@ -0,0 +1,68 @@
+package borges
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+func TestRefPolicyAllows(t *testing.T) {
+	require := require.New(t)
+
+	var nilPolicy *RefPolicy
+	require.True(nilPolicy.Allows("refs/heads/master"))
+
+	p := &RefPolicy{
+		Include: []string{"refs/heads/*", "refs/tags/v*"},
+		Exclude: []string{"refs/heads/tmp/*", "refs/heads/HEAD"},
+	}
+
+	testCases := map[string]bool{
+		"refs/heads/master":      true,
+		"refs/heads/feature/foo": true,
+		"refs/tags/v1.0.0":       true,
+		"refs/tags/foo":          false,
+		"refs/pull/1/head":       false,
+		"refs/heads/tmp/foo":     false,
+		"refs/heads/HEAD":        false,
+	}
+
+	for name, expected := range testCases {
+		require.Equal(expected, p.Allows(name), name)
+	}
+
+	p = &RefPolicy{Exclude: []string{"refs/pull/*"}}
+	require.True(p.Allows("refs/heads/master"))
+	require.False(p.Allows("refs/pull/1/head"))
+}
+
+func TestRefPolicyValidate(t *testing.T) {
+	require := require.New(t)
+
+	var nilPolicy *RefPolicy
+	require.NoError(nilPolicy.Validate())
+	require.NoError((&RefPolicy{Include: []string{"refs/heads/*"}}).Validate())
+
+	err := (&RefPolicy{Exclude: []string{"refs/["}}).Validate()
+	require.True(ErrInvalidRefPolicy.Is(err))
+}
+
+func TestRefPolicyReferencer(t *testing.T) {
+	require := require.New(t)
+
+	r := model.NewRepository()
+	for _, name := range []string{"refs/heads/master", "refs/pull/1/head"} {
+		ref := model.NewReference()
+		ref.Name = name
+		r.References = append(r.References, ref)
+	}
+
+	refs, err := NewRefPolicyReferencer(
+		NewModelReferencer(r),
+		&RefPolicy{Exclude: []string{"refs/pull/*"}},
+	).References()
+	require.NoError(err)
+	require.Len(refs, 1)
+	require.Equal("refs/heads/master", refs[0].Name)
+}
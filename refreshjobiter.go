@@ -0,0 +1,123 @@
+package borges
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+// RefreshStore is a RepositoryStore that is also able to find the
+// repositories that were not fetched for a while.
+type RefreshStore interface {
+	RepositoryStore
+	// GetFetchedBefore returns up to limit repositories in Fetched status
+	// that were last fetched before the given time, the least recently
+	// fetched first.
+	GetFetchedBefore(before time.Time, limit uint64) ([]*model.Repository, error)
+}
+
+type refreshJobIter struct {
+	storer    RefreshStore
+	age       time.Duration
+	batchSize uint64
+	interval  time.Duration
+
+	pending   []*model.Repository
+	unacked   *model.Repository
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// NewRefreshJobIter returns a JobIter that returns jobs for the repositories
+// in Fetched status that were last fetched more than age ago, the least
+// recently fetched first. Repositories are read from the store in batches of
+// batchSize and they are set to Pending once their job is acknowledged as
+// published, so they are not queued again until they are fetched. A
+// repository whose job could not be published stays in Fetched status and is
+// returned again. Repositories in Pending or
+// Fetching status are never returned. When there are no stale repositories
+// the store is queried again after interval.
+func NewRefreshJobIter(
+	storer RefreshStore,
+	age time.Duration,
+	batchSize uint64,
+	interval time.Duration,
+) JobIter {
+	return &refreshJobIter{
+		storer:    storer,
+		age:       age,
+		batchSize: batchSize,
+		interval:  interval,
+		closed:    make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+}
+
+func (i *refreshJobIter) Next() (*Job, error) {
+	for len(i.pending) == 0 {
+		if i.isClosed() {
+			return nil, io.EOF
+		}
+
+		repos, err := i.storer.GetFetchedBefore(time.Now().Add(-i.age), i.batchSize)
+		if err != nil {
+			i.wait()
+			return nil, err
+		}
+
+		if len(repos) == 0 {
+			i.wait()
+			continue
+		}
+
+		i.pending = repos
+	}
+
+	if i.isClosed() {
+		return nil, io.EOF
+	}
+
+	r := i.pending[0]
+	i.pending = i.pending[1:]
+	i.unacked = r
+
+	return &Job{RepositoryID: uuid.UUID(r.ID)}, nil
+}
+
+// Ack honors the AckJobIter interface. The repository of the job is set to
+// Pending only if the job was published.
+func (i *refreshJobIter) Ack(j *Job, err error) error {
+	r := i.unacked
+	i.unacked = nil
+	if err != nil || r == nil || uuid.UUID(r.ID) != j.RepositoryID {
+		return nil
+	}
+
+	return i.storer.SetStatus(r, model.Pending)
+}
+
+// wait blocks until interval elapses or the iterator is closed.
+func (i *refreshJobIter) wait() {
+	select {
+	case <-i.closed:
+	case <-time.After(i.interval):
+	}
+}
+
+func (i *refreshJobIter) isClosed() bool {
+	select {
+	case <-i.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the iterator. Any call to Next after Close returns io.EOF.
+func (i *refreshJobIter) Close() error {
+	i.closeOnce.Do(func() { close(i.closed) })
+	return nil
+}
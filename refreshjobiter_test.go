@@ -0,0 +1,107 @@
+package borges
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/src-d/borges/storage"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/test"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestRefreshJobIter(t *testing.T) {
+	suite.Run(t, new(RefreshJobIterSuite))
+}
+
+type RefreshJobIterSuite struct {
+	test.Suite
+	rawStore *model.RepositoryStore
+	store    *storage.DatabaseStore
+}
+
+func (s *RefreshJobIterSuite) SetupTest() {
+	s.Suite.Setup()
+	s.rawStore = model.NewRepositoryStore(s.DB)
+	s.store = storage.FromDatabase(s.DB)
+}
+
+func (s *RefreshJobIterSuite) TearDownTest() {
+	s.Suite.TearDown()
+}
+
+func (s *RefreshJobIterSuite) TestNext() {
+	require := s.Require()
+
+	now := time.Now()
+	oldest := s.createRepo(model.Fetched, now.Add(-72*time.Hour))
+	old := s.createRepo(model.Fetched, now.Add(-48*time.Hour))
+	s.createRepo(model.Fetched, now)
+	s.createRepo(model.Pending, now.Add(-72*time.Hour))
+	s.createRepo(model.Fetching, now.Add(-72*time.Hour))
+
+	iter := NewRefreshJobIter(s.store, 24*time.Hour, 1, time.Millisecond)
+	ackIter, ok := iter.(AckJobIter)
+	require.True(ok)
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Equal(uuid.UUID(oldest), j.RepositoryID)
+	s.assertStatus(oldest, model.Fetched)
+
+	require.NoError(ackIter.Ack(j, fmt.Errorf("publish failed")))
+	s.assertStatus(oldest, model.Fetched)
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.Equal(uuid.UUID(oldest), j.RepositoryID)
+
+	require.NoError(ackIter.Ack(j, nil))
+	s.assertStatus(oldest, model.Pending)
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.Equal(uuid.UUID(old), j.RepositoryID)
+
+	require.NoError(ackIter.Ack(j, nil))
+	s.assertStatus(old, model.Pending)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		j, err := iter.Next()
+		s.Equal(io.EOF, err)
+		s.Nil(j)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(iter.Close())
+	<-done
+
+	j, err = iter.Next()
+	require.Equal(io.EOF, err)
+	require.Nil(j)
+}
+
+func (s *RefreshJobIterSuite) createRepo(
+	status model.FetchStatus,
+	fetchedAt time.Time,
+) kallax.ULID {
+	r := model.NewRepository()
+	r.Endpoints = []string{"git://foo/" + r.ID.String()}
+	r.Status = status
+	r.FetchedAt = &fetchedAt
+	s.Require().NoError(s.rawStore.Insert(r))
+	return r.ID
+}
+
+func (s *RefreshJobIterSuite) assertStatus(id kallax.ULID, status model.FetchStatus) {
+	r, err := s.store.Get(id)
+	s.Require().NoError(err)
+	s.Equal(status, r.Status)
+}
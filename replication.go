@@ -0,0 +1,601 @@
+package borges
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+var (
+	// ErrReplication is returned when a file could not be replicated
+	// synchronously.
+	ErrReplication = errors.NewKind("could not replicate %s")
+	// ErrCorruptedReplicationLog is returned when the replication log
+	// cannot be read.
+	ErrCorruptedReplicationLog = errors.NewKind("corrupted replication log %s at line %d: %s")
+)
+
+// ReplicationOp is an operation replicated from the primary filesystem to
+// the replica.
+type ReplicationOp string
+
+const (
+	// ReplicateCopy copies the file from the primary to the replica.
+	ReplicateCopy ReplicationOp = "copy"
+	// ReplicateDelete deletes the file from the replica.
+	ReplicateDelete ReplicationOp = "delete"
+
+	replicationDone ReplicationOp = "done"
+)
+
+// ReplicationEntry is an operation of the replication log.
+type ReplicationEntry struct {
+	// Seq is the sequence number of the operation in the log.
+	Seq uint64 `json:"seq"`
+	// Op is the operation.
+	Op ReplicationOp `json:"op"`
+	// Path is the path of the file, relative to the base of the
+	// filesystems.
+	Path string `json:"path"`
+}
+
+// ReplicationLog is a durable log of the operations not replicated yet. It is
+// an append-only file with the operations added and done that is compacted
+// when opened, so the operations pending when the process stopped are
+// replicated when it is opened again. Only the last operation of every path
+// is kept, as it replaces the previous ones. A log must only be used by one
+// process at a time.
+type ReplicationLog struct {
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	seq     uint64
+	pending map[string]*ReplicationEntry
+}
+
+// OpenReplicationLog opens the replication log in the given file, which is
+// created if it does not exist.
+func OpenReplicationLog(path string) (*ReplicationLog, error) {
+	l := &ReplicationLog{
+		path:    path,
+		pending: make(map[string]*ReplicationEntry),
+	}
+
+	if err := l.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	l.f = f
+	return l, nil
+}
+
+func (l *ReplicationLog) replay() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a last line without line break was not completely written
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var e ReplicationEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return ErrCorruptedReplicationLog.New(l.path, line, err)
+		}
+
+		l.apply(&e)
+	}
+
+	return nil
+}
+
+func (l *ReplicationLog) apply(e *ReplicationEntry) {
+	if e.Seq > l.seq {
+		l.seq = e.Seq
+	}
+
+	if e.Op != replicationDone {
+		l.pending[e.Path] = e
+		return
+	}
+
+	// an operation added again while it was being replicated is not done
+	if p, ok := l.pending[e.Path]; ok && p.Seq == e.Seq {
+		delete(l.pending, e.Path)
+	}
+}
+
+// compact rewrites the log with only the pending operations.
+func (l *ReplicationLog) compact() error {
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range l.sorted() {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, l.path)
+}
+
+// write appends an entry to the log and syncs it to disk.
+func (l *ReplicationLog) write(e *ReplicationEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return l.f.Sync()
+}
+
+// ReadReplicationLog returns the operations pending in the replication log
+// in the given file, the oldest first, without modifying it. It can be used
+// while the log is open by another process.
+func ReadReplicationLog(path string) ([]*ReplicationEntry, error) {
+	l := &ReplicationLog{
+		path:    path,
+		pending: make(map[string]*ReplicationEntry),
+	}
+
+	if err := l.replay(); err != nil {
+		return nil, err
+	}
+
+	return l.sorted(), nil
+}
+
+// Add adds an operation to the log, replacing the pending one of the same
+// path.
+func (l *ReplicationLog) Add(op ReplicationOp, path string) (*ReplicationEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := &ReplicationEntry{Seq: l.seq + 1, Op: op, Path: path}
+	if err := l.write(e); err != nil {
+		return nil, err
+	}
+
+	l.apply(e)
+	return e, nil
+}
+
+// Done marks an operation as replicated. It is kept pending if another
+// operation was added for the same path since it was returned by Pending.
+func (l *ReplicationLog) Done(e *ReplicationEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	done := &ReplicationEntry{Seq: e.Seq, Op: replicationDone, Path: e.Path}
+	if err := l.write(done); err != nil {
+		return err
+	}
+
+	l.apply(done)
+	return nil
+}
+
+// Pending returns the operations not replicated yet, the oldest first.
+func (l *ReplicationLog) Pending() []*ReplicationEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.sorted()
+}
+
+func (l *ReplicationLog) sorted() []*ReplicationEntry {
+	entries := make([]*ReplicationEntry, 0, len(l.pending))
+	for _, e := range l.pending {
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+
+	return entries
+}
+
+// Close closes the log.
+func (l *ReplicationLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	f := l.f
+	l.f = nil
+	return f.Close()
+}
+
+// ReplicatedFs is a repository.Fs that writes the files to a primary
+// filesystem and replicates them to a replica. Files are read only from the
+// primary. The files renamed, the last step of writing a siva file, are
+// copied to the replica and the files deleted are deleted from it, except
+// the temporary copies. Replication can be synchronous, so the operation on
+// the primary fails if it cannot be replicated even though the primary is
+// already modified, or asynchronous, so the operations are added to a
+// ReplicationLog and replicated in the background, retrying them until they
+// succeed.
+type ReplicatedFs struct {
+	primary, replica repository.Fs
+
+	log    *ReplicationLog
+	retry  time.Duration
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var _ repository.Fs = new(ReplicatedFs)
+
+// NewReplicatedFs returns a ReplicatedFs that replicates the files
+// synchronously.
+func NewReplicatedFs(primary, replica repository.Fs) *ReplicatedFs {
+	return &ReplicatedFs{primary: primary, replica: replica}
+}
+
+// NewAsyncReplicatedFs returns a ReplicatedFs that replicates the files
+// asynchronously, keeping the pending operations in the given log and
+// retrying the failed ones after the retry interval. The pending operations
+// of the log are replicated first. It must be closed to stop replicating.
+func NewAsyncReplicatedFs(
+	primary, replica repository.Fs,
+	log *ReplicationLog,
+	retry time.Duration,
+) *ReplicatedFs {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &ReplicatedFs{
+		primary: primary,
+		replica: replica,
+		log:     log,
+		retry:   retry,
+		wake:    make(chan struct{}, 1),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go r.run(ctx)
+	return r
+}
+
+// Primary returns the primary filesystem.
+func (r *ReplicatedFs) Primary() repository.Fs {
+	return r.primary
+}
+
+// Replica returns the replica filesystem.
+func (r *ReplicatedFs) Replica() repository.Fs {
+	return r.replica
+}
+
+func (r *ReplicatedFs) primaryPath(path string) string {
+	return filepath.Join(r.primary.Base(), path)
+}
+
+func (r *ReplicatedFs) replicaPath(path string) string {
+	return filepath.Join(r.replica.Base(), path)
+}
+
+// Open implements the repository.Fs interface.
+func (r *ReplicatedFs) Open(path string) (io.ReadCloser, error) {
+	return r.primary.Open(r.primaryPath(path))
+}
+
+// WriteTo implements the repository.Fs interface.
+func (r *ReplicatedFs) WriteTo(path string) (io.WriteCloser, error) {
+	return r.primary.WriteTo(r.primaryPath(path))
+}
+
+// Rename implements the repository.Fs interface. The file is copied to the
+// replica with its new name.
+func (r *ReplicatedFs) Rename(src, dst string) error {
+	if err := r.primary.Rename(r.primaryPath(src), r.primaryPath(dst)); err != nil {
+		return err
+	}
+
+	return r.replicate(ReplicateCopy, dst)
+}
+
+// DeleteIfExists implements the repository.Fs interface. The file is also
+// deleted from the replica, unless it is a temporary copy.
+func (r *ReplicatedFs) DeleteIfExists(path string) error {
+	if err := r.primary.DeleteIfExists(r.primaryPath(path)); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(path, ".copy") {
+		return nil
+	}
+
+	return r.replicate(ReplicateDelete, path)
+}
+
+// Base implements the repository.Fs interface. The primary and the replica
+// have their own base paths, the paths given are relative to them.
+func (r *ReplicatedFs) Base() string {
+	return "/"
+}
+
+func (r *ReplicatedFs) replicate(op ReplicationOp, path string) error {
+	if r.log == nil {
+		if err := r.apply(context.Background(), op, path); err != nil {
+			return ErrReplication.Wrap(err, path)
+		}
+
+		return nil
+	}
+
+	if _, err := r.log.Add(op, path); err != nil {
+		return ErrReplication.Wrap(err, path)
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (r *ReplicatedFs) apply(ctx context.Context, op ReplicationOp, path string) error {
+	if op == ReplicateDelete {
+		return r.replica.DeleteIfExists(r.replicaPath(path))
+	}
+
+	// a file deleted since it was written has a delete operation after
+	_, err := copyFile(ctx, r.primary, r.replica, r.primaryPath(path), r.replicaPath(path))
+	return err
+}
+
+func (r *ReplicatedFs) run(ctx context.Context) {
+	defer close(r.done)
+
+	for {
+		var failed bool
+		for _, e := range r.log.Pending() {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logger := log.With(log.Fields{"op": e.Op, "path": e.Path})
+			if err := r.apply(ctx, e.Op, e.Path); err != nil {
+				logger.Errorf(err, "could not replicate file")
+				failed = true
+				continue
+			}
+
+			if err := r.log.Done(e); err != nil {
+				logger.Errorf(err, "could not mark file as replicated")
+				failed = true
+				continue
+			}
+
+			logger.Debugf("file replicated")
+		}
+
+		var retry <-chan time.Time
+		if failed {
+			retry = time.After(r.retry)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-retry:
+		}
+	}
+}
+
+// Close stops replicating and closes the log. The operations pending are
+// replicated when the log is opened again.
+func (r *ReplicatedFs) Close() error {
+	if r.log == nil {
+		return nil
+	}
+
+	r.cancel()
+	<-r.done
+	return r.log.Close()
+}
+
+// ReplicaStatus is the result of comparing a file in the primary and the
+// replica.
+type ReplicaStatus string
+
+const (
+	// ReplicaOK means that both copies are equal.
+	ReplicaOK ReplicaStatus = "ok"
+	// ReplicaMissing means that the file is not in the replica.
+	ReplicaMissing ReplicaStatus = "missing-replica"
+	// PrimaryMissing means that the file is only in the replica.
+	PrimaryMissing ReplicaStatus = "missing-primary"
+	// ReplicaDiffers means that the copies have different size or checksum.
+	ReplicaDiffers ReplicaStatus = "differs"
+	// BothMissing means that the file is in none of them.
+	BothMissing ReplicaStatus = "missing"
+	// ReplicaPending means that the file has operations pending in a
+	// replication log, so the copies are expected to differ.
+	ReplicaPending ReplicaStatus = "pending"
+)
+
+// ReplicaCheck is the comparison of a file in the primary and the replica.
+type ReplicaCheck struct {
+	// Path is the path of the file.
+	Path string
+	// Status is the result of the comparison.
+	Status ReplicaStatus
+	// PrimarySize is the size in the primary, -1 if it is missing.
+	PrimarySize int64
+	// ReplicaSize is the size in the replica, -1 if it is missing.
+	ReplicaSize int64
+	// PrimarySum is the SHA-1 checksum in the primary.
+	PrimarySum string
+	// ReplicaSum is the SHA-1 checksum in the replica.
+	ReplicaSum string
+}
+
+// Check compares the size and checksum of a file in the primary and the
+// replica. Files with pending asynchronous operations may differ.
+func (r *ReplicatedFs) Check(ctx context.Context, path string) (*ReplicaCheck, error) {
+	c := &ReplicaCheck{Path: path}
+
+	var err error
+	c.PrimarySize, c.PrimarySum, err = fileSum(ctx, r.primary, r.primaryPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	c.ReplicaSize, c.ReplicaSum, err = fileSum(ctx, r.replica, r.replicaPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c.PrimarySize < 0 && c.ReplicaSize < 0:
+		c.Status = BothMissing
+	case c.PrimarySize < 0:
+		c.Status = PrimaryMissing
+	case c.ReplicaSize < 0:
+		c.Status = ReplicaMissing
+	case c.PrimarySize != c.ReplicaSize || c.PrimarySum != c.ReplicaSum:
+		c.Status = ReplicaDiffers
+	default:
+		c.Status = ReplicaOK
+	}
+
+	return c, nil
+}
+
+// Repair fixes the divergence found by a check writing the primary copy to
+// the replica, when the replica is missing or differs. A file missing in the
+// primary is left untouched, as it may have been deleted or moved on purpose,
+// see Restore. The file must not be written while it is repaired.
+func (r *ReplicatedFs) Repair(ctx context.Context, c *ReplicaCheck) error {
+	switch c.Status {
+	case ReplicaMissing, ReplicaDiffers:
+		_, err := copyFile(ctx, r.primary, r.replica, r.primaryPath(c.Path), r.replicaPath(c.Path))
+		return err
+	}
+
+	return nil
+}
+
+// Restore writes the replica copy of a file missing in the primary found by
+// a check. It must only be used for files known to be lost, as the files
+// deleted from the primary may not have been deleted from the replica yet.
+// The file must not be written while it is restored.
+func (r *ReplicatedFs) Restore(ctx context.Context, c *ReplicaCheck) error {
+	if c.Status != PrimaryMissing {
+		return nil
+	}
+
+	_, err := copyFile(ctx, r.replica, r.primary, r.replicaPath(c.Path), r.primaryPath(c.Path))
+	return err
+}
+
+// WithPrimary returns a ReplicatedFs with the same replica and the given
+// primary, that replicates synchronously. It can be used to check the files
+// moved from the primary to another filesystem, such as a cold tier.
+func (r *ReplicatedFs) WithPrimary(primary repository.Fs) *ReplicatedFs {
+	return NewReplicatedFs(primary, r.replica)
+}
+
+// fileSum returns the size and SHA-1 checksum of a file, or -1 if it does not
+// exist.
+func fileSum(ctx context.Context, fs repository.Fs, path string) (int64, string, error) {
+	f, err := fs.Open(path)
+	if os.IsNotExist(err) {
+		return -1, "", nil
+	}
+
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	w := &countWriter{w: h}
+	if err := copyWithContext(ctx, w, f); err != nil {
+		return 0, "", err
+	}
+
+	return w.n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
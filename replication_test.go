@@ -0,0 +1,298 @@
+package borges
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+func TestReplicationLog(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-replication")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "replication.log")
+	l, err := OpenReplicationLog(path)
+	require.NoError(err)
+	require.Len(l.Pending(), 0)
+
+	a, err := l.Add(ReplicateCopy, "a.siva")
+	require.NoError(err)
+	b, err := l.Add(ReplicateCopy, "b.siva")
+	require.NoError(err)
+	_, err = l.Add(ReplicateCopy, "c.siva")
+	require.NoError(err)
+
+	require.NoError(l.Done(a))
+
+	// b is deleted while it is being copied
+	_, err = l.Add(ReplicateDelete, "b.siva")
+	require.NoError(err)
+	require.NoError(l.Done(b))
+
+	expected := []*ReplicationEntry{
+		{Seq: 3, Op: ReplicateCopy, Path: "c.siva"},
+		{Seq: 4, Op: ReplicateDelete, Path: "b.siva"},
+	}
+	require.Equal(expected, l.Pending())
+	require.NoError(l.Close())
+
+	// an incomplete last line is ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(err)
+	_, err = f.Write([]byte(`{"seq":5,"op":"copy"`))
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	l, err = OpenReplicationLog(path)
+	require.NoError(err)
+	require.Equal(expected, l.Pending())
+
+	d, err := l.Add(ReplicateCopy, "d.siva")
+	require.NoError(err)
+	require.Equal(uint64(5), d.Seq)
+	require.NoError(l.Close())
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	require.Equal(
+		`{"seq":3,"op":"copy","path":"c.siva"}`+"\n"+
+			`{"seq":4,"op":"delete","path":"b.siva"}`+"\n"+
+			`{"seq":5,"op":"copy","path":"d.siva"}`+"\n",
+		string(content),
+	)
+
+	entries, err := ReadReplicationLog(path)
+	require.NoError(err)
+	require.Len(entries, 3)
+
+	require.NoError(ioutil.WriteFile(path, []byte("foo\n"), 0644))
+	_, err = OpenReplicationLog(path)
+	require.True(ErrCorruptedReplicationLog.Is(err))
+}
+
+func TestReplicatedFsSync(t *testing.T) {
+	require := require.New(t)
+
+	primary, replica := memfs.New(), memfs.New()
+	failing := &failingFs{Fs: repository.NewLocalFs(replica)}
+	fs := NewReplicatedFs(repository.NewLocalFs(primary), failing)
+
+	local := memfs.New()
+	copier := repository.NewCopier(local, fs, 2)
+	ctx := context.TODO()
+
+	path := testSivaPath(1)
+	name := path[4:]
+	require.NoError(util.WriteFile(local, name, []byte("siva"), 0644))
+	require.NoError(copier.CopyToRemote(ctx, name, name))
+
+	for _, fs := range []billy.Filesystem{primary, replica} {
+		content, err := readFile(fs, path)
+		require.NoError(err)
+		require.Equal("siva", string(content))
+
+		_, err = fs.Stat(path + ".copy")
+		require.Error(err)
+	}
+
+	failing.fail(true)
+	require.NoError(util.WriteFile(local, name, []byte("new"), 0644))
+	err := copier.CopyToRemote(ctx, name, name)
+	require.True(ErrReplication.Is(err))
+
+	check, err := fs.Check(ctx, path)
+	require.NoError(err)
+	require.Equal(ReplicaDiffers, check.Status)
+	require.Equal(int64(3), check.PrimarySize)
+	require.Equal(int64(4), check.ReplicaSize)
+
+	failing.fail(false)
+	require.NoError(fs.Repair(ctx, check))
+	check, err = fs.Check(ctx, path)
+	require.NoError(err)
+	require.Equal(ReplicaOK, check.Status)
+
+	require.NoError(fs.DeleteIfExists(path))
+	check, err = fs.Check(ctx, path)
+	require.NoError(err)
+	require.Equal(BothMissing, check.Status)
+}
+
+func TestReplicatedFsAsync(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-replication")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "replication.log")
+	l, err := OpenReplicationLog(logPath)
+	require.NoError(err)
+
+	primary, replica := memfs.New(), memfs.New()
+	failing := &failingFs{Fs: repository.NewLocalFs(replica)}
+	failing.fail(true)
+	fs := NewAsyncReplicatedFs(
+		repository.NewLocalFs(primary),
+		failing,
+		l,
+		10*time.Millisecond,
+	)
+
+	local := memfs.New()
+	copier := repository.NewCopier(local, fs, 2)
+	ctx := context.TODO()
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path := testSivaPath(i)
+		name := path[4:]
+		require.NoError(util.WriteFile(local, name, []byte(name), 0644))
+		require.NoError(copier.CopyToRemote(ctx, name, name))
+		paths = append(paths, path)
+	}
+
+	require.NoError(fs.DeleteIfExists(paths[2]))
+	require.Len(l.Pending(), 3)
+	require.NoError(fs.Close())
+
+	// pending replications are resumed with the log
+	l, err = OpenReplicationLog(logPath)
+	require.NoError(err)
+	require.Len(l.Pending(), 3)
+
+	failing.fail(false)
+	fs = NewAsyncReplicatedFs(
+		repository.NewLocalFs(primary),
+		failing,
+		l,
+		10*time.Millisecond,
+	)
+	defer fs.Close()
+	copier = repository.NewCopier(local, fs, 2)
+
+	require.True(waitReplicated(l, time.Second))
+
+	for i, path := range paths {
+		check, err := fs.Check(ctx, path)
+		require.NoError(err)
+		if i == 2 {
+			require.Equal(BothMissing, check.Status)
+		} else {
+			require.Equal(ReplicaOK, check.Status)
+		}
+	}
+
+	// failed replications are retried
+	failing.fail(true)
+	path := testSivaPath(3)
+	name := path[4:]
+	require.NoError(util.WriteFile(local, name, []byte(name), 0644))
+	require.NoError(copier.CopyToRemote(ctx, name, name))
+	time.Sleep(30 * time.Millisecond)
+	require.Len(l.Pending(), 1)
+
+	failing.fail(false)
+	require.True(waitReplicated(l, time.Second))
+
+	check, err := fs.Check(ctx, path)
+	require.NoError(err)
+	require.Equal(ReplicaOK, check.Status)
+}
+
+func TestReplicatedFsRepairPrimary(t *testing.T) {
+	require := require.New(t)
+
+	primary, replica := memfs.New(), memfs.New()
+	fs := NewReplicatedFs(
+		repository.NewLocalFs(primary),
+		repository.NewLocalFs(replica),
+	)
+
+	ctx := context.TODO()
+	path := testSivaPath(1)
+	require.NoError(util.WriteFile(replica, path, []byte("siva"), 0644))
+
+	check, err := fs.Check(ctx, path)
+	require.NoError(err)
+	require.Equal(PrimaryMissing, check.Status)
+	require.Equal(int64(-1), check.PrimarySize)
+
+	// files missing in the primary are only restored explicitly
+	require.NoError(fs.Repair(ctx, check))
+	_, err = primary.Stat(path)
+	require.Error(err)
+
+	require.NoError(fs.Restore(ctx, check))
+	content, err := readFile(primary, path)
+	require.NoError(err)
+	require.Equal("siva", string(content))
+}
+
+func waitReplicated(l *ReplicationLog, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if len(l.Pending()) == 0 {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+// failingFs is a repository.Fs that fails writing while failing is set.
+type failingFs struct {
+	repository.Fs
+
+	mu      sync.Mutex
+	failing bool
+}
+
+func (f *failingFs) fail(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func (f *failingFs) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return fmt.Errorf("replica is failing")
+	}
+
+	return nil
+}
+
+func (f *failingFs) WriteTo(path string) (io.WriteCloser, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+
+	return f.Fs.WriteTo(path)
+}
+
+func (f *failingFs) DeleteIfExists(path string) error {
+	if err := f.err(); err != nil {
+		return err
+	}
+
+	return f.Fs.DeleteIfExists(path)
+}
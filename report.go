@@ -0,0 +1,212 @@
+package borges
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+// ReportStatus is the final status of an entry of a Report. Besides the
+// following ones, it can be the status of the repository of the entry, such
+// as fetched or not_found.
+type ReportStatus string
+
+const (
+	// ReportInvalid is the status of the lines that could not be read as
+	// a job.
+	ReportInvalid ReportStatus = "invalid"
+	// ReportFailed is the status of the lines whose job failed.
+	ReportFailed ReportStatus = "failed"
+	// ReportUnknown is the status of the lines whose job was not processed
+	// while the report was recorded, such as the jobs finished before a pack
+	// was resumed.
+	ReportUnknown ReportStatus = "unknown"
+)
+
+// ReportEntry is the outcome of a line of the input of a pack.
+type ReportEntry struct {
+	// Line is the number of the line in the input, starting at 1.
+	Line int `json:"line"`
+	// Input is the content of the line.
+	Input string `json:"input"`
+	// RepositoryID is the ID of the repository of the line. It is empty if
+	// the line is invalid.
+	RepositoryID string `json:"repository_id,omitempty"`
+	// Status is the final status of the line.
+	Status ReportStatus `json:"status"`
+	// Inits are the initial commits of the rooted repositories, that is, the
+	// siva files, where the repository was archived.
+	Inits []string `json:"inits,omitempty"`
+	// Error is the last error of the line, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Report records the outcome of every line of the input of a pack. It is
+// safe for concurrent use.
+type Report struct {
+	// Lines are the numbers reported for the lines read, in order. They are
+	// only needed when the input is a subset of the original one, such as
+	// the failed entries of a previous report.
+	Lines []int
+
+	mu      sync.Mutex
+	entries []*ReportEntry
+	results map[uuid.UUID]*reportResult
+}
+
+type reportResult struct {
+	status ReportStatus
+	inits  []model.SHA1
+	err    string
+}
+
+// NewReport creates an empty report.
+func NewReport() *Report {
+	return &Report{results: make(map[uuid.UUID]*reportResult)}
+}
+
+// JobIter returns a JobIter that records in the report every line read by
+// the given iterator.
+func (r *Report) JobIter(iter LineJobIter) JobIter {
+	return &reportJobIter{LineJobIter: iter, report: r}
+}
+
+// Record records the result of a job. Jobs of the same repository share
+// their result, and the last one of them is kept, but the inits of all of
+// them are reported. It can be used as the Done notifier of an Archiver.
+func (r *Report) Record(j *Job, res *JobResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result, ok := r.results[j.RepositoryID]
+	if !ok {
+		result = &reportResult{}
+		r.results[j.RepositoryID] = result
+	}
+
+	result.err = ""
+	switch {
+	case res.Err != nil:
+		result.status = ReportFailed
+		result.err = res.Err.Error()
+	case res.Repository == nil:
+		result.status = ReportFailed
+	default:
+		result.status = ReportStatus(res.Repository.Status)
+	}
+
+	for _, init := range res.Inits {
+		if !containsInit(result.inits, init) {
+			result.inits = append(result.inits, init)
+		}
+	}
+}
+
+// Entries returns the entries of the report in the order they were read.
+func (r *Report) Entries() []*ReportEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make([]*ReportEntry, len(r.entries))
+	for i, e := range r.entries {
+		entry := *e
+		if e.Status == "" {
+			entry.Status = ReportUnknown
+			id := uuid.FromStringOrNil(e.RepositoryID)
+			if result, ok := r.results[id]; ok {
+				entry.Status = result.status
+				entry.Error = result.err
+				for _, init := range result.inits {
+					entry.Inits = append(entry.Inits, init.String())
+				}
+			}
+		}
+
+		entries[i] = &entry
+	}
+
+	return entries
+}
+
+// Write writes the entries of the report to the given writer as JSON lines.
+func (r *Report) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, e := range r.Entries() {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+func (r *Report) add(n int, input string, id uuid.UUID, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.Lines) > 0 && n > 0 && n <= len(r.Lines) {
+		n = r.Lines[n-1]
+	}
+
+	e := &ReportEntry{Line: n, Input: input}
+	if err != nil {
+		e.Status = ReportInvalid
+		e.Error = err.Error()
+	} else {
+		e.RepositoryID = id.String()
+	}
+
+	r.entries = append(r.entries, e)
+}
+
+// ReadReport reads the entries of a report written by Report.Write.
+func ReadReport(r io.Reader) ([]*ReportEntry, error) {
+	var entries []*ReportEntry
+	dec := json.NewDecoder(r)
+	for {
+		var e ReportEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &e)
+	}
+}
+
+type reportJobIter struct {
+	LineJobIter
+	report *Report
+}
+
+func (i *reportJobIter) Next() (*Job, error) {
+	j, err := i.LineJobIter.Next()
+	if err == io.EOF {
+		return nil, err
+	}
+
+	n, input := i.Line()
+	if err != nil {
+		i.report.add(n, input, uuid.Nil, err)
+		return nil, err
+	}
+
+	i.report.add(n, input, j.RepositoryID, nil)
+	return j, nil
+}
+
+func containsInit(inits []model.SHA1, init model.SHA1) bool {
+	for _, i := range inits {
+		if i == init {
+			return true
+		}
+	}
+
+	return false
+}
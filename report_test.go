@@ -0,0 +1,124 @@
+package borges
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/src-d/borges/storage"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestReport(t *testing.T) {
+	require := require.New(t)
+
+	store := storage.Local()
+	text := strings.Join([]string{
+		"git://foo/bar.git",
+		"foo",
+		"git://foo/baz.git",
+		"git://foo/bar.git",
+		"git://foo/qux.git",
+	}, "\n")
+
+	report := NewReport()
+	iter := report.JobIter(
+		NewLineJobIter(ioutil.NopCloser(strings.NewReader(text)), store).(LineJobIter),
+	)
+
+	var jobs []*Job
+	for {
+		j, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err == nil {
+			jobs = append(jobs, j)
+		}
+	}
+
+	require.Len(jobs, 4)
+	require.NoError(iter.Close())
+
+	r, err := store.Get(kallax.ULID(jobs[0].RepositoryID))
+	require.NoError(err)
+
+	init1 := model.NewSHA1("b029517f6300c2da0f4b651b8642506cd6aaf45d")
+	init2 := model.NewSHA1("6ecf0ef2c2dffb796033e5a02219af86ec6584e5")
+
+	// failed and retried
+	report.Record(jobs[0], &JobResult{
+		Repository: r,
+		Inits:      []model.SHA1{init1},
+		Err:        fmt.Errorf("foo"),
+	})
+	r.Status = model.Fetched
+	report.Record(jobs[2], &JobResult{Repository: r, Inits: []model.SHA1{init1, init2}})
+	report.Record(jobs[1], &JobResult{Err: fmt.Errorf("bar")})
+
+	entries := report.Entries()
+	require.Len(entries, 5)
+
+	require.Equal(&ReportEntry{
+		Line:         1,
+		Input:        "git://foo/bar.git",
+		RepositoryID: jobs[0].RepositoryID.String(),
+		Status:       "fetched",
+		Inits:        []string{init1.String(), init2.String()},
+	}, entries[0])
+
+	require.Equal(2, entries[1].Line)
+	require.Equal("foo", entries[1].Input)
+	require.Equal(ReportInvalid, entries[1].Status)
+	require.Empty(entries[1].RepositoryID)
+	require.NotEmpty(entries[1].Error)
+
+	require.Equal(&ReportEntry{
+		Line:         3,
+		Input:        "git://foo/baz.git",
+		RepositoryID: jobs[1].RepositoryID.String(),
+		Status:       ReportFailed,
+		Error:        "bar",
+	}, entries[2])
+
+	require.Equal(entries[0].Status, entries[3].Status)
+	require.Equal(4, entries[3].Line)
+
+	require.Equal(ReportUnknown, entries[4].Status)
+
+	var buf bytes.Buffer
+	require.NoError(report.Write(&buf))
+	require.Equal(5, strings.Count(buf.String(), "\n"))
+
+	read, err := ReadReport(&buf)
+	require.NoError(err)
+	require.Equal(entries, read)
+}
+
+func TestReportLines(t *testing.T) {
+	require := require.New(t)
+
+	text := "git://foo/bar.git\ngit://foo/baz.git"
+	report := NewReport()
+	report.Lines = []int{3, 7}
+	iter := report.JobIter(
+		NewLineJobIter(ioutil.NopCloser(strings.NewReader(text)), storage.Local()).(LineJobIter),
+	)
+
+	for i := 0; i < 2; i++ {
+		_, err := iter.Next()
+		require.NoError(err)
+	}
+
+	entries := report.Entries()
+	require.Len(entries, 2)
+	require.Equal(3, entries[0].Line)
+	require.Equal(7, entries[1].Line)
+}
@@ -0,0 +1,141 @@
+package borges
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+type scheduleJobIter struct {
+	scheduler *Scheduler
+	batchSize uint64
+	interval  time.Duration
+
+	pending   []*model.Repository
+	unacked   *model.Repository
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// NewScheduleJobIter returns a JobIter that returns jobs for the repositories
+// whose next fetch, as computed by the given scheduler, is due. Repositories
+// that have not been scheduled yet are scheduled first. Repositories are read
+// from the store in batches of batchSize and they are set to Pending once
+// their job is acknowledged as published, so they are not queued again until
+// they are fetched. A repository whose job could not be published keeps its
+// status and is returned again. The repositories whose last fetch failed are
+// also returned when they are due, see Scheduler.Queued. When there are no
+// due repositories the store is queried again after interval.
+func NewScheduleJobIter(
+	scheduler *Scheduler,
+	batchSize uint64,
+	interval time.Duration,
+) JobIter {
+	return &scheduleJobIter{
+		scheduler: scheduler,
+		batchSize: batchSize,
+		interval:  interval,
+		closed:    make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+}
+
+func (i *scheduleJobIter) Next() (*Job, error) {
+	store := i.scheduler.store
+	for len(i.pending) == 0 {
+		if i.isClosed() {
+			return nil, io.EOF
+		}
+
+		scheduled, err := i.scheduleNew()
+		if err != nil {
+			i.wait()
+			return nil, err
+		}
+
+		repos, err := store.GetDue(i.scheduler.now(), i.batchSize)
+		if err != nil {
+			i.wait()
+			return nil, err
+		}
+
+		if len(repos) == 0 {
+			if scheduled == 0 {
+				i.wait()
+			}
+
+			continue
+		}
+
+		i.pending = repos
+	}
+
+	if i.isClosed() {
+		return nil, io.EOF
+	}
+
+	r := i.pending[0]
+	i.pending = i.pending[1:]
+	i.unacked = r
+
+	return &Job{RepositoryID: uuid.UUID(r.ID)}, nil
+}
+
+// Ack honors the AckJobIter interface. The repository of the job is set to
+// Pending and its next fetch moved forward only if the job was published.
+func (i *scheduleJobIter) Ack(j *Job, err error) error {
+	r := i.unacked
+	i.unacked = nil
+	if err != nil || r == nil || uuid.UUID(r.ID) != j.RepositoryID {
+		return nil
+	}
+
+	if err := i.scheduler.store.SetStatus(r, model.Pending); err != nil {
+		return err
+	}
+
+	return i.scheduler.Queued(r)
+}
+
+// scheduleNew schedules a batch of the repositories without schedule and
+// returns how many of them were scheduled.
+func (i *scheduleJobIter) scheduleNew() (int, error) {
+	repos, err := i.scheduler.store.GetUnscheduled(i.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for n, r := range repos {
+		if err := i.scheduler.Schedule(r); err != nil {
+			return n, err
+		}
+	}
+
+	return len(repos), nil
+}
+
+// wait blocks until interval elapses or the iterator is closed.
+func (i *scheduleJobIter) wait() {
+	select {
+	case <-i.closed:
+	case <-time.After(i.interval):
+	}
+}
+
+func (i *scheduleJobIter) isClosed() bool {
+	select {
+	case <-i.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the iterator. Any call to Next after Close returns io.EOF.
+func (i *scheduleJobIter) Close() error {
+	i.closeOnce.Do(func() { close(i.closed) })
+	return nil
+}
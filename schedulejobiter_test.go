@@ -0,0 +1,142 @@
+package borges
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/src-d/borges/storage"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/test"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestScheduleJobIter(t *testing.T) {
+	suite.Run(t, new(ScheduleJobIterSuite))
+}
+
+type ScheduleJobIterSuite struct {
+	test.Suite
+	rawStore  *model.RepositoryStore
+	store     *storage.DatabaseStore
+	scheduler *Scheduler
+}
+
+func (s *ScheduleJobIterSuite) SetupTest() {
+	s.Suite.Setup()
+	s.Require().NoError(storage.CreateSchema(s.DB))
+	s.rawStore = model.NewRepositoryStore(s.DB)
+	s.store = storage.FromDatabase(s.DB)
+	s.scheduler = NewScheduler(s.store, SchedulerConfig{
+		MinInterval: time.Hour,
+		MaxInterval: 30 * 24 * time.Hour,
+	})
+}
+
+func (s *ScheduleJobIterSuite) TearDownTest() {
+	s.Suite.TearDown()
+}
+
+func (s *ScheduleJobIterSuite) TestNext() {
+	require := s.Require()
+
+	now := time.Now()
+	due := s.createRepo(model.Fetched, now.Add(-60*24*time.Hour))
+	recent := s.createRepo(model.Fetched, now)
+	pending := s.createRepo(model.Pending, now.Add(-60*24*time.Hour))
+	scheduled := s.createRepo(model.Fetched, now.Add(-60*24*time.Hour))
+	require.NoError(s.store.SetSchedule(&storage.Schedule{
+		RepositoryID: scheduled,
+		NextFetchAt:  now.Add(-90 * 24 * time.Hour),
+		UpdatedAt:    now,
+	}))
+
+	failed := s.createRepo(model.Pending, now.Add(-60*24*time.Hour))
+	require.NoError(s.store.SetSchedule(&storage.Schedule{
+		RepositoryID: failed,
+		NextFetchAt:  now.Add(-45 * 24 * time.Hour),
+		UpdatedAt:    now,
+		Failures:     1,
+	}))
+
+	iter := NewScheduleJobIter(s.scheduler, 10, time.Millisecond)
+	ackIter, ok := iter.(AckJobIter)
+	require.True(ok)
+
+	j, err := iter.Next()
+	require.NoError(err)
+	require.Equal(uuid.UUID(scheduled), j.RepositoryID)
+	s.assertStatus(scheduled, model.Fetched)
+	require.NoError(ackIter.Ack(j, fmt.Errorf("publish failed")))
+	s.assertStatus(scheduled, model.Fetched)
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.Equal(uuid.UUID(failed), j.RepositoryID)
+	require.NoError(ackIter.Ack(j, nil))
+	s.assertStatus(failed, model.Pending)
+
+	sch, err := s.store.GetSchedule(failed)
+	require.NoError(err)
+	require.True(sch.NextFetchAt.After(now))
+	require.Equal(1, sch.Failures)
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.Equal(uuid.UUID(due), j.RepositoryID)
+	require.NoError(ackIter.Ack(j, nil))
+	s.assertStatus(due, model.Pending)
+
+	j, err = iter.Next()
+	require.NoError(err)
+	require.Equal(uuid.UUID(scheduled), j.RepositoryID)
+	require.NoError(ackIter.Ack(j, nil))
+	s.assertStatus(scheduled, model.Pending)
+
+	sch, err = s.store.GetSchedule(recent)
+	require.NoError(err)
+	require.NotNil(sch)
+	require.True(sch.NextFetchAt.After(now))
+
+	sch, err = s.store.GetSchedule(pending)
+	require.NoError(err)
+	require.Nil(sch)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		j, err := iter.Next()
+		s.Equal(io.EOF, err)
+		s.Nil(j)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(iter.Close())
+	<-done
+
+	j, err = iter.Next()
+	require.Equal(io.EOF, err)
+	require.Nil(j)
+}
+
+func (s *ScheduleJobIterSuite) createRepo(
+	status model.FetchStatus,
+	fetchedAt time.Time,
+) kallax.ULID {
+	r := model.NewRepository()
+	r.Endpoints = []string{"git://foo/" + r.ID.String()}
+	r.Status = status
+	r.FetchedAt = &fetchedAt
+	s.Require().NoError(s.rawStore.Insert(r))
+	return r.ID
+}
+
+func (s *ScheduleJobIterSuite) assertStatus(id kallax.ULID, status model.FetchStatus) {
+	r, err := s.store.Get(id)
+	s.Require().NoError(err)
+	s.Equal(status, r.Status)
+}
@@ -0,0 +1,235 @@
+package borges
+
+import (
+	"path"
+	"time"
+
+	bstorage "github.com/src-d/borges/storage"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+const (
+	// initialChangeRate is the change rate of the repositories without any
+	// recorded fetch. It neither shortens nor lengthens their interval.
+	initialChangeRate = 0.5
+	// changeRateWeight is the weight of the last fetch in the moving average
+	// of the change rate.
+	changeRateWeight = 0.3
+	// maxFailureBackoff is the maximum exponent used to back off failing
+	// repositories.
+	maxFailureBackoff = 16
+)
+
+// ScheduleStore is a RepositoryStore that also stores the refresh schedules
+// of the repositories.
+type ScheduleStore interface {
+	RepositoryStore
+	// GetSchedule returns the schedule of a repository, or nil if the
+	// repository has not been scheduled yet.
+	GetSchedule(id kallax.ULID) (*bstorage.Schedule, error)
+	// SetSchedule creates or replaces the schedule of a repository.
+	SetSchedule(*bstorage.Schedule) error
+	// GetUnscheduled returns up to limit repositories that are not queued
+	// nor being fetched and have not been scheduled yet.
+	GetUnscheduled(limit uint64) ([]*model.Repository, error)
+	// GetDue returns up to limit repositories whose next fetch is scheduled
+	// at or before now, the earliest first. They must not be queued nor
+	// being fetched, or be in Pending status after their last recorded fetch
+	// failed.
+	GetDue(now time.Time, limit uint64) ([]*model.Repository, error)
+}
+
+// ScheduleOverride sets a fixed refresh interval for the repositories with
+// an endpoint matching Pattern, as it is stored or canonicalized with the
+// DefaultCanonicalizer. Patterns use the syntax of path.Match.
+type ScheduleOverride struct {
+	Pattern  string
+	Interval time.Duration
+}
+
+// SchedulerConfig holds the bounds and overrides of the refresh intervals
+// computed by a Scheduler.
+type SchedulerConfig struct {
+	// MinInterval is the minimum time between two fetches of a repository.
+	MinInterval time.Duration
+	// MaxInterval is the maximum time between two fetches of a repository.
+	MaxInterval time.Duration
+	// Overrides take precedence over the computed intervals and the bounds.
+	// The first matching override is used.
+	Overrides []ScheduleOverride
+}
+
+// Scheduler computes the next fetch time of repositories based on their
+// activity and stores it in a ScheduleStore.
+//
+// The interval between fetches starts from half the time elapsed since the
+// last commit of the repository, or the maximum interval if it is unknown.
+// It is shortened for repositories whose references changed in most of
+// their recent fetches and lengthened for the ones that rarely changed.
+// Every consecutive failure doubles it. The result is always kept within
+// the configured bounds.
+type Scheduler struct {
+	store  ScheduleStore
+	config SchedulerConfig
+	now    func() time.Time
+}
+
+// NewScheduler creates a new Scheduler.
+func NewScheduler(store ScheduleStore, config SchedulerConfig) *Scheduler {
+	return &Scheduler{
+		store:  store,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+// Interval returns the time to wait before fetching the given repository
+// again, according to its schedule. The schedule can be nil.
+func (s *Scheduler) Interval(
+	r *model.Repository,
+	sch *bstorage.Schedule,
+	now time.Time,
+) time.Duration {
+	if interval, ok := s.override(r); ok {
+		return interval
+	}
+
+	interval := s.config.MaxInterval
+	if r.LastCommitAt != nil && r.LastCommitAt.Before(now) {
+		interval = now.Sub(*r.LastCommitAt) / 2
+	}
+
+	rate := initialChangeRate
+	failures := 0
+	if sch != nil {
+		rate = sch.ChangeRate
+		failures = sch.Failures
+	}
+
+	interval = time.Duration(float64(interval) * 2 * (1 - rate))
+
+	if failures > maxFailureBackoff {
+		failures = maxFailureBackoff
+	}
+
+	for i := 0; i < failures && interval < s.config.MaxInterval; i++ {
+		interval *= 2
+	}
+
+	if interval < s.config.MinInterval {
+		interval = s.config.MinInterval
+	}
+
+	if interval > s.config.MaxInterval {
+		interval = s.config.MaxInterval
+	}
+
+	return interval
+}
+
+func (s *Scheduler) override(r *model.Repository) (time.Duration, bool) {
+	for _, o := range s.config.Overrides {
+		for _, ep := range r.Endpoints {
+			if ok, _ := path.Match(o.Pattern, ep); ok {
+				return o.Interval, true
+			}
+
+			canonical := DefaultCanonicalizer.Canonicalize(ep)
+			if ok, _ := path.Match(o.Pattern, canonical); ok {
+				return o.Interval, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// Schedule creates the schedule of a repository that has not been scheduled
+// yet. Its next fetch is computed from its last fetch time, or now if it was
+// never fetched.
+func (s *Scheduler) Schedule(r *model.Repository) error {
+	now := s.now()
+	from := now
+	if r.FetchedAt != nil {
+		from = *r.FetchedAt
+	}
+
+	return s.store.SetSchedule(&bstorage.Schedule{
+		RepositoryID: r.ID,
+		NextFetchAt:  from.Add(s.Interval(r, nil, now)),
+		ChangeRate:   initialChangeRate,
+		UpdatedAt:    now,
+	})
+}
+
+// Queued moves the next fetch of a queued repository an interval forward,
+// so the repositories whose last fetch failed, which stay in Pending status,
+// are not queued again until their job is recorded or the interval passes.
+// Nothing is done for the repositories not scheduled.
+func (s *Scheduler) Queued(r *model.Repository) error {
+	sch, err := s.store.GetSchedule(r.ID)
+	if err != nil || sch == nil {
+		return err
+	}
+
+	now := s.now()
+	sch.NextFetchAt = now.Add(s.Interval(r, sch, now))
+	sch.UpdatedAt = now
+	return s.store.SetSchedule(sch)
+}
+
+// Record updates the schedule of a repository with the result of a job.
+// Results without repository are ignored, as those jobs were not processed.
+// It can be used as the Done notifier of an Archiver.
+func (s *Scheduler) Record(j *Job, res *JobResult) {
+	r := res.Repository
+	if r == nil {
+		return
+	}
+
+	logger := log.With(log.Fields{"job": j.RepositoryID})
+	sch, err := s.store.GetSchedule(r.ID)
+	if err != nil {
+		logger.Errorf(err, "error getting repository schedule")
+		return
+	}
+
+	if sch == nil {
+		sch = &bstorage.Schedule{
+			RepositoryID: r.ID,
+			ChangeRate:   initialChangeRate,
+		}
+	}
+
+	now := s.now()
+	sch.Fetches++
+	if res.Err != nil || r.Status != model.Fetched {
+		sch.Failures++
+	} else {
+		sch.Failures = 0
+
+		var changed float64
+		if res.Changed {
+			changed = 1
+		}
+
+		sch.ChangeRate = changeRateWeight*changed + (1-changeRateWeight)*sch.ChangeRate
+	}
+
+	sch.NextFetchAt = now.Add(s.Interval(r, sch, now))
+	sch.UpdatedAt = now
+
+	if err := s.store.SetSchedule(sch); err != nil {
+		logger.Errorf(err, "error setting repository schedule")
+		return
+	}
+
+	logger.With(log.Fields{
+		"next-fetch-at": sch.NextFetchAt,
+		"change-rate":   sch.ChangeRate,
+		"failures":      sch.Failures,
+	}).Debugf("repository scheduled")
+}
@@ -0,0 +1,198 @@
+package borges
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/src-d/borges/storage"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestScheduler(t *testing.T) {
+	suite.Run(t, new(SchedulerSuite))
+}
+
+type SchedulerSuite struct {
+	suite.Suite
+	store     *memoryScheduleStore
+	scheduler *Scheduler
+	now       time.Time
+}
+
+func (s *SchedulerSuite) SetupTest() {
+	s.store = &memoryScheduleStore{
+		LocalStore: storage.Local(),
+		schedules:  make(map[kallax.ULID]*storage.Schedule),
+	}
+
+	s.now = time.Date(2018, time.June, 1, 0, 0, 0, 0, time.UTC)
+	s.scheduler = NewScheduler(s.store, SchedulerConfig{
+		MinInterval: time.Hour,
+		MaxInterval: 30 * 24 * time.Hour,
+		Overrides: []ScheduleOverride{
+			{Pattern: "git://github.com/src-d/*", Interval: 2 * time.Hour},
+		},
+	})
+	s.scheduler.now = func() time.Time { return s.now }
+}
+
+func (s *SchedulerSuite) TestInterval() {
+	day := 24 * time.Hour
+
+	testCases := []struct {
+		name       string
+		endpoint   string
+		idle       time.Duration
+		changeRate float64
+		failures   int
+		expected   time.Duration
+	}{
+		{"unknown last commit", "git://foo/bar", 0, initialChangeRate, 0, 30 * day},
+		{"half the idle time", "git://foo/bar", 10 * day, initialChangeRate, 0, 5 * day},
+		{"never changed", "git://foo/bar", 10 * day, 0, 0, 10 * day},
+		{"mostly changed", "git://foo/bar", 10 * day, 0.75, 0, 2*day + 12*time.Hour},
+		{"always changed", "git://foo/bar", 10 * day, 1, 0, time.Hour},
+		{"failures", "git://foo/bar", 10 * day, initialChangeRate, 2, 20 * day},
+		{"many failures", "git://foo/bar", 10 * day, initialChangeRate, 100, 30 * day},
+		{"min bound", "git://foo/bar", time.Hour, initialChangeRate, 0, time.Hour},
+		{"max bound", "git://foo/bar", 365 * day, initialChangeRate, 0, 30 * day},
+		{"override", "git://github.com/src-d/borges", 365 * day, 0, 3, 2 * time.Hour},
+	}
+
+	for _, tc := range testCases {
+		r := model.NewRepository()
+		r.Endpoints = []string{tc.endpoint}
+		if tc.idle > 0 {
+			lastCommit := s.now.Add(-tc.idle)
+			r.LastCommitAt = &lastCommit
+		}
+
+		sch := &storage.Schedule{
+			RepositoryID: r.ID,
+			ChangeRate:   tc.changeRate,
+			Failures:     tc.failures,
+		}
+
+		s.Equal(tc.expected, s.scheduler.Interval(r, sch, s.now), tc.name)
+	}
+}
+
+func (s *SchedulerSuite) TestSchedule() {
+	require := s.Require()
+
+	fetchedAt := s.now.Add(-20 * 24 * time.Hour)
+	lastCommit := s.now.Add(-24 * time.Hour)
+	r := model.NewRepository()
+	r.Endpoints = []string{"git://foo/bar"}
+	r.FetchedAt = &fetchedAt
+	r.LastCommitAt = &lastCommit
+
+	require.NoError(s.scheduler.Schedule(r))
+
+	sch := s.store.schedules[r.ID]
+	require.NotNil(sch)
+	require.Equal(fetchedAt.Add(12*time.Hour), sch.NextFetchAt)
+	require.Equal(initialChangeRate, sch.ChangeRate)
+	require.Equal(0, sch.Fetches)
+}
+
+func (s *SchedulerSuite) TestRecord() {
+	require := s.Require()
+
+	lastCommit := s.now.Add(-10 * 24 * time.Hour)
+	r := model.NewRepository()
+	r.Endpoints = []string{"git://foo/bar"}
+	r.LastCommitAt = &lastCommit
+	r.Status = model.Fetched
+	j := &Job{RepositoryID: uuid.UUID(r.ID)}
+
+	s.scheduler.Record(j, &JobResult{Repository: r, Changed: true})
+	sch := s.store.schedules[r.ID]
+	require.NotNil(sch)
+	require.InDelta(0.65, sch.ChangeRate, 0.0001)
+	require.Equal(1, sch.Fetches)
+	require.Equal(0, sch.Failures)
+	require.True(sch.NextFetchAt.Before(s.now.Add(5 * 24 * time.Hour)))
+
+	s.scheduler.Record(j, &JobResult{Repository: r, Err: errors.New("foo")})
+	sch = s.store.schedules[r.ID]
+	require.Equal(2, sch.Fetches)
+	require.Equal(1, sch.Failures)
+	require.InDelta(0.65, sch.ChangeRate, 0.0001)
+
+	r.Status = model.NotFound
+	s.scheduler.Record(j, &JobResult{Repository: r})
+	sch = s.store.schedules[r.ID]
+	require.Equal(2, sch.Failures)
+
+	r.Status = model.Fetched
+	s.scheduler.Record(j, &JobResult{Repository: r})
+	sch = s.store.schedules[r.ID]
+	require.Equal(0, sch.Failures)
+	require.InDelta(0.455, sch.ChangeRate, 0.0001)
+	require.Equal(4, sch.Fetches)
+}
+
+func (s *SchedulerSuite) TestQueued() {
+	require := s.Require()
+
+	r := model.NewRepository()
+	r.Endpoints = []string{"git://foo/bar"}
+	require.NoError(s.scheduler.Queued(r))
+	require.Len(s.store.schedules, 0)
+
+	require.NoError(s.store.SetSchedule(&storage.Schedule{
+		RepositoryID: r.ID,
+		NextFetchAt:  s.now.Add(-time.Hour),
+		ChangeRate:   initialChangeRate,
+		Failures:     1,
+	}))
+
+	require.NoError(s.scheduler.Queued(r))
+	sch := s.store.schedules[r.ID]
+	require.Equal(s.now.Add(30*24*time.Hour), sch.NextFetchAt)
+	require.Equal(s.now, sch.UpdatedAt)
+	require.Equal(1, sch.Failures)
+}
+
+func (s *SchedulerSuite) TestRecordWithoutRepository() {
+	s.scheduler.Record(&Job{RepositoryID: uuid.UUID(kallax.NewULID())}, &JobResult{
+		Err: ErrAlreadyFetching.New("foo"),
+	})
+
+	s.Len(s.store.schedules, 0)
+}
+
+type memoryScheduleStore struct {
+	*storage.LocalStore
+	schedules map[kallax.ULID]*storage.Schedule
+}
+
+func (s *memoryScheduleStore) GetSchedule(id kallax.ULID) (*storage.Schedule, error) {
+	sch, ok := s.schedules[id]
+	if !ok {
+		return nil, nil
+	}
+
+	copy := *sch
+	return &copy, nil
+}
+
+func (s *memoryScheduleStore) SetSchedule(sch *storage.Schedule) error {
+	copy := *sch
+	s.schedules[sch.RepositoryID] = &copy
+	return nil
+}
+
+func (s *memoryScheduleStore) GetUnscheduled(limit uint64) ([]*model.Repository, error) {
+	return nil, nil
+}
+
+func (s *memoryScheduleStore) GetDue(now time.Time, limit uint64) ([]*model.Repository, error) {
+	return nil, nil
+}
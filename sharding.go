@@ -0,0 +1,331 @@
+package borges
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+var (
+	// ErrNoShards is returned when a ShardedFs is created without shards.
+	ErrNoShards = errors.NewKind("at least one shard is needed")
+	// ErrInvalidShard is returned when a shard has no name, filesystem or a
+	// weight lower or equal to zero.
+	ErrInvalidShard = errors.NewKind("invalid shard %q: %s")
+	// ErrShardConflict is returned when a file is found in several shards
+	// and none of them is the one assigned to it, or its copies differ.
+	ErrShardConflict = errors.NewKind("file %s is in several shards: %s")
+)
+
+// Shard is a storage volume of a ShardedFs.
+type Shard struct {
+	// Name identifies the shard in the placement of the files. Renaming a
+	// shard changes the files assigned to it.
+	Name string
+	// Fs is the filesystem of the shard.
+	Fs repository.Fs
+	// Weight is the relative amount of files assigned to the shard.
+	Weight float64
+}
+
+// ShardedFs is a repository.Fs that spreads the siva files among several
+// shards. Each siva file is assigned to a shard by its init commit using
+// weighted rendezvous hashing, so adding a shard only moves to it the files
+// it takes, in proportion to its weight, and removing one only moves its
+// files. Files are assigned by their name without the bucket directories,
+// so temporary copies of a siva file are in the same shard. Files not in
+// their assigned shard, after the shards change and until they are placed,
+// are read and written in the shard where they are.
+type ShardedFs struct {
+	shards []*Shard
+}
+
+var _ repository.Fs = new(ShardedFs)
+
+// NewShardedFs creates a new ShardedFs with the given shards.
+func NewShardedFs(shards ...*Shard) (*ShardedFs, error) {
+	if len(shards) == 0 {
+		return nil, ErrNoShards.New()
+	}
+
+	names := make(map[string]bool)
+	for _, s := range shards {
+		switch {
+		case s.Name == "":
+			return nil, ErrInvalidShard.New(s.Name, "empty name")
+		case s.Fs == nil:
+			return nil, ErrInvalidShard.New(s.Name, "no filesystem")
+		case s.Weight <= 0 || math.IsInf(s.Weight, 0) || math.IsNaN(s.Weight):
+			return nil, ErrInvalidShard.New(s.Name, "weight must be a positive number")
+		case names[s.Name]:
+			return nil, ErrInvalidShard.New(s.Name, "duplicated name")
+		}
+
+		names[s.Name] = true
+	}
+
+	return &ShardedFs{shards: shards}, nil
+}
+
+// Shards returns the shards of the filesystem.
+func (s *ShardedFs) Shards() []*Shard {
+	return s.shards
+}
+
+// Locate returns the shard assigned to the file in the given path.
+func (s *ShardedFs) Locate(path string) *Shard {
+	key := shardKey(path)
+
+	var (
+		best  *Shard
+		score = math.Inf(-1)
+	)
+
+	for _, sh := range s.shards {
+		if sc := shardScore(sh, key); sc > score {
+			best, score = sh, sc
+		}
+	}
+
+	return best
+}
+
+// shardKey returns the name used to assign a file to a shard, the name of
+// the siva file without bucket directories nor extensions.
+func shardKey(path string) string {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, ".copy")
+	return strings.TrimSuffix(name, ".siva")
+}
+
+// shardScore is the weighted rendezvous score of a key in a shard. The hash
+// is mapped to a uniform number in (0, 1) so the probability of a shard
+// having the highest score is proportional to its weight.
+func shardScore(sh *Shard, key string) float64 {
+	sum := sha1.Sum([]byte(sh.Name + "\x00" + key))
+	h := binary.BigEndian.Uint64(sum[:8])
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return -sh.Weight / math.Log(u)
+}
+
+// shardPath returns the filesystem and path of the file in the given path
+// in the shard holding it, which is the assigned one unless the file is
+// only in another shard, as happens after adding shards or changing their
+// weights until they are rebalanced. Temporary copies are kept in the shard
+// of their file.
+func (s *ShardedFs) shardPath(path string) (repository.Fs, string, error) {
+	sh, err := s.holder(strings.TrimSuffix(path, ".copy"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return sh.Fs, filepath.Join(sh.Fs.Base(), path), nil
+}
+
+// holder returns the assigned shard if the file is there or it is in no
+// shard, and otherwise the first shard where it is misplaced.
+func (s *ShardedFs) holder(path string) (*Shard, error) {
+	assigned := s.Locate(path)
+	ok, err := fileExists(assigned.Fs, filepath.Join(assigned.Fs.Base(), path))
+	if err != nil || ok {
+		return assigned, err
+	}
+
+	misplaced, err := s.Misplaced(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(misplaced) > 0 {
+		return misplaced[0], nil
+	}
+
+	return assigned, nil
+}
+
+// Open implements the repository.Fs interface.
+func (s *ShardedFs) Open(path string) (io.ReadCloser, error) {
+	fs, p, err := s.shardPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.Open(p)
+}
+
+// WriteTo implements the repository.Fs interface.
+func (s *ShardedFs) WriteTo(path string) (io.WriteCloser, error) {
+	fs, p, err := s.shardPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.WriteTo(p)
+}
+
+// Rename implements the repository.Fs interface. Both paths must be in the
+// same shard, which is always true for a siva file and its copies.
+func (s *ShardedFs) Rename(src, dst string) error {
+	srcFs, srcPath, err := s.shardPath(src)
+	if err != nil {
+		return err
+	}
+
+	dstFs, dstPath, err := s.shardPath(dst)
+	if err != nil {
+		return err
+	}
+
+	if srcFs != dstFs {
+		return fmt.Errorf("cannot rename %s to %s in another shard", src, dst)
+	}
+
+	return srcFs.Rename(srcPath, dstPath)
+}
+
+// DeleteIfExists implements the repository.Fs interface. The file is deleted
+// from all the shards.
+func (s *ShardedFs) DeleteIfExists(path string) error {
+	for _, sh := range s.shards {
+		if err := sh.Fs.DeleteIfExists(filepath.Join(sh.Fs.Base(), path)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Base implements the repository.Fs interface. The shards have their own
+// base paths, the paths given are relative to them.
+func (s *ShardedFs) Base() string {
+	return "/"
+}
+
+// Misplaced returns the shards, other than the assigned one, where the file
+// in the given path exists.
+func (s *ShardedFs) Misplaced(path string) ([]*Shard, error) {
+	assigned := s.Locate(path)
+
+	var misplaced []*Shard
+	for _, sh := range s.shards {
+		if sh == assigned {
+			continue
+		}
+
+		ok, err := fileExists(sh.Fs, filepath.Join(sh.Fs.Base(), path))
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			misplaced = append(misplaced, sh)
+		}
+	}
+
+	return misplaced, nil
+}
+
+// Place moves the file in the given path to its assigned shard from the
+// shard where it is misplaced, and returns the shards where it was found.
+// If it is already in the assigned shard the misplaced copies are deleted if
+// they are equal, as left by interrupted moves. If a misplaced copy differs
+// from the one in the assigned shard, or the file is misplaced in several
+// shards, it is not moved and ErrShardConflict is returned. The file must
+// not be written while it is placed.
+func (s *ShardedFs) Place(ctx context.Context, path string) ([]*Shard, error) {
+	misplaced, err := s.Misplaced(path)
+	if err != nil || len(misplaced) == 0 {
+		return nil, err
+	}
+
+	assigned := s.Locate(path)
+	dstPath := filepath.Join(assigned.Fs.Base(), path)
+	ok, err := fileExists(assigned.Fs, dstPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok && len(misplaced) > 1 {
+		return nil, ErrShardConflict.New(path, shardNames(misplaced))
+	}
+
+	if ok {
+		var differ []*Shard
+		for _, sh := range misplaced {
+			same, err := sameFile(ctx, assigned.Fs, sh.Fs, dstPath, filepath.Join(sh.Fs.Base(), path))
+			if err != nil {
+				return nil, err
+			}
+
+			if !same {
+				differ = append(differ, sh)
+			}
+		}
+
+		if len(differ) > 0 {
+			return nil, ErrShardConflict.New(
+				path,
+				shardNames(append([]*Shard{assigned}, differ...)),
+			)
+		}
+	}
+
+	for _, sh := range misplaced {
+		srcPath := filepath.Join(sh.Fs.Base(), path)
+		if ok {
+			err = sh.Fs.DeleteIfExists(srcPath)
+		} else {
+			_, err = moveFile(ctx, sh.Fs, assigned.Fs, srcPath, dstPath)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		log.With(log.Fields{
+			"path":    path,
+			"from":    sh.Name,
+			"to":      assigned.Name,
+			"deleted": ok,
+		}).Debugf("file placed in its shard")
+	}
+
+	return misplaced, nil
+}
+
+func shardNames(shards []*Shard) string {
+	names := make([]string, len(shards))
+	for i, sh := range shards {
+		names[i] = sh.Name
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// sameFile returns whether two files have the same size and checksum.
+func sameFile(
+	ctx context.Context,
+	fs1, fs2 repository.Fs,
+	path1, path2 string,
+) (bool, error) {
+	size1, sum1, err := fileSum(ctx, fs1, path1)
+	if err != nil {
+		return false, err
+	}
+
+	size2, sum2, err := fileSum(ctx, fs2, path2)
+	if err != nil {
+		return false, err
+	}
+
+	return size1 == size2 && sum1 == sum2, nil
+}
@@ -0,0 +1,272 @@
+package borges
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func newTestShards(weights ...float64) ([]*Shard, []billy.Filesystem) {
+	var (
+		shards []*Shard
+		fss    []billy.Filesystem
+	)
+
+	for i, w := range weights {
+		fs := memfs.New()
+		fss = append(fss, fs)
+		shards = append(shards, &Shard{
+			Name:   fmt.Sprintf("shard-%d", i),
+			Fs:     repository.NewLocalFs(fs),
+			Weight: w,
+		})
+	}
+
+	return shards, fss
+}
+
+func testSivaPath(i int) string {
+	h := model.NewSHA1(fmt.Sprintf("%040x", i*7919))
+	return fmt.Sprintf("/%s/%s.siva", h.String()[:2], h)
+}
+
+func TestNewShardedFs(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewShardedFs()
+	require.True(ErrNoShards.Is(err))
+
+	shards, _ := newTestShards(1, 0)
+	_, err = NewShardedFs(shards...)
+	require.True(ErrInvalidShard.Is(err))
+
+	shards, _ = newTestShards(1, 1)
+	shards[1].Name = shards[0].Name
+	_, err = NewShardedFs(shards...)
+	require.True(ErrInvalidShard.Is(err))
+}
+
+func TestShardedFsLocate(t *testing.T) {
+	require := require.New(t)
+
+	shards, _ := newTestShards(1, 1, 2)
+	fs, err := NewShardedFs(shards...)
+	require.NoError(err)
+
+	const files = 10000
+	counts := make(map[*Shard]int)
+	for i := 0; i < files; i++ {
+		path := testSivaPath(i)
+		sh := fs.Locate(path)
+		require.Equal(sh, fs.Locate(path+".copy"))
+		require.Equal(sh, fs.Locate(path[4:]))
+		counts[sh]++
+	}
+
+	require.InDelta(files/4, counts[shards[0]], files/20)
+	require.InDelta(files/4, counts[shards[1]], files/20)
+	require.InDelta(files/2, counts[shards[2]], files/20)
+
+	// adding a shard only moves files to it
+	more, _ := newTestShards(1, 1, 2, 1)
+	more = append(shards, more[3])
+	fs2, err := NewShardedFs(more...)
+	require.NoError(err)
+
+	var moved int
+	for i := 0; i < files; i++ {
+		path := testSivaPath(i)
+		sh := fs2.Locate(path)
+		if sh != fs.Locate(path) {
+			require.Equal(more[3], sh)
+			moved++
+		}
+	}
+
+	require.InDelta(files/5, moved, files/20)
+}
+
+func TestShardedFsCopier(t *testing.T) {
+	require := require.New(t)
+
+	shards, fss := newTestShards(1, 1)
+	fs, err := NewShardedFs(shards...)
+	require.NoError(err)
+
+	local := memfs.New()
+	copier := repository.NewCopier(local, fs, 2)
+	ctx := context.TODO()
+
+	for i := 0; i < 10; i++ {
+		path := testSivaPath(i)
+		name := path[4:]
+		require.NoError(util.WriteFile(local, name, []byte(name), 0644))
+		require.NoError(copier.CopyToRemote(ctx, name, name))
+
+		sh := fs.Locate(path)
+		for j, s := range shards {
+			_, err := fss[j].Stat(path)
+			if s == sh {
+				require.NoError(err)
+			} else {
+				require.Error(err)
+			}
+		}
+
+		require.NoError(copier.CopyFromRemote(ctx, name, "copy"))
+		content, err := readFile(local, "copy")
+		require.NoError(err)
+		require.Equal(name, string(content))
+	}
+}
+
+func TestShardedFsPlace(t *testing.T) {
+	require := require.New(t)
+
+	shards, fss := newTestShards(1, 1, 1)
+	fs, err := NewShardedFs(shards...)
+	require.NoError(err)
+
+	index := func(sh *Shard) int {
+		for i, s := range shards {
+			if s == sh {
+				return i
+			}
+		}
+
+		return -1
+	}
+
+	ctx := context.TODO()
+	path := testSivaPath(1)
+	assigned := index(fs.Locate(path))
+	others := []int{(assigned + 1) % 3, (assigned + 2) % 3}
+
+	// not in any shard
+	moved, err := fs.Place(ctx, path)
+	require.NoError(err)
+	require.Len(moved, 0)
+
+	// misplaced in one shard
+	require.NoError(util.WriteFile(fss[others[0]], path, []byte("siva"), 0644))
+	moved, err = fs.Place(ctx, path)
+	require.NoError(err)
+	require.Equal([]*Shard{shards[others[0]]}, moved)
+	_, err = fss[others[0]].Stat(path)
+	require.Error(err)
+	content, err := readFile(fss[assigned], path)
+	require.NoError(err)
+	require.Equal("siva", string(content))
+
+	// already placed
+	moved, err = fs.Place(ctx, path)
+	require.NoError(err)
+	require.Len(moved, 0)
+
+	// copy left in another shard by an interrupted move
+	require.NoError(util.WriteFile(fss[others[1]], path, []byte("siva"), 0644))
+	moved, err = fs.Place(ctx, path)
+	require.NoError(err)
+	require.Equal([]*Shard{shards[others[1]]}, moved)
+	_, err = fss[others[1]].Stat(path)
+	require.Error(err)
+	content, err = readFile(fss[assigned], path)
+	require.NoError(err)
+	require.Equal("siva", string(content))
+
+	// different copy in another shard
+	require.NoError(util.WriteFile(fss[others[1]], path, []byte("other"), 0644))
+	_, err = fs.Place(ctx, path)
+	require.True(ErrShardConflict.Is(err))
+	content, err = readFile(fss[others[1]], path)
+	require.NoError(err)
+	require.Equal("other", string(content))
+	content, err = readFile(fss[assigned], path)
+	require.NoError(err)
+	require.Equal("siva", string(content))
+
+	// misplaced in several shards
+	path = testSivaPath(2)
+	assigned = index(fs.Locate(path))
+	for i := range shards {
+		if i != assigned {
+			require.NoError(util.WriteFile(fss[i], path, []byte("siva"), 0644))
+		}
+	}
+
+	_, err = fs.Place(ctx, path)
+	require.True(ErrShardConflict.Is(err))
+}
+
+func TestShardedFsAddShard(t *testing.T) {
+	require := require.New(t)
+
+	shards, fss := newTestShards(1, 1, 1)
+	fs, err := NewShardedFs(shards[0])
+	require.NoError(err)
+
+	all, err := NewShardedFs(shards...)
+	require.NoError(err)
+
+	// find a siva file assigned to the new shards
+	ctx := context.TODO()
+	var h plumbing.Hash
+	for i := 0; ; i++ {
+		h = plumbing.NewHash(fmt.Sprintf("%040x", i*7919))
+		if all.Locate(h.String()+".siva") != shards[0] {
+			break
+		}
+	}
+
+	path := fmt.Sprintf("/%s/%s.siva", h.String()[:2], h)
+	commit := func(fs *ShardedFs, endpoint string) {
+		copier := repository.NewCopier(memfs.New(), fs, 2)
+		txer := repository.NewSivaRootedTransactioner(copier)
+		tx, err := txer.Begin(ctx, h)
+		require.NoError(err)
+
+		r, err := git.Open(tx.Storer(), nil)
+		require.NoError(err)
+		repo := model.NewRepository()
+		repo.Endpoints = []string{endpoint}
+		require.NoError(StoreConfig(r, repo))
+		require.NoError(tx.Commit(ctx))
+	}
+
+	commit(fs, "https://github.com/src-d/borges")
+
+	fs = all
+
+	// written in the shard where it is before rebalancing
+	commit(fs, "https://github.com/src-d/gitbase")
+	for i, sh := range shards {
+		if sh != shards[0] {
+			_, err := fss[i].Stat(path)
+			require.Error(err)
+		}
+	}
+
+	moved, err := fs.Place(ctx, path)
+	require.NoError(err)
+	require.Equal([]*Shard{shards[0]}, moved)
+	_, err = fss[0].Stat(path)
+	require.Error(err)
+
+	copier := repository.NewCopier(memfs.New(), fs, 2)
+	tx, err := repository.NewSivaRootedTransactioner(copier).Begin(ctx, h)
+	require.NoError(err)
+	defer tx.Rollback()
+
+	c, err := tx.Storer().Config()
+	require.NoError(err)
+	require.Len(c.Remotes, 2)
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// BlockKind is the kind of endpoints matched by a BlockRule.
+type BlockKind string
+
+const (
+	// BlockHost blocks the endpoints of a host and its subdomains, the value
+	// is the host name, such as example.com.
+	BlockHost BlockKind = "host"
+	// BlockOrganization blocks the endpoints of an organization or user of a
+	// host, the value is the host and the first segment of the path, such as
+	// github.com/src-d.
+	BlockOrganization BlockKind = "organization"
+	// BlockPattern blocks the endpoints matching a regular expression, the
+	// value is the expression.
+	BlockPattern BlockKind = "pattern"
+)
+
+// BlockRule is a rule of the blocklist of endpoints that must not be
+// archived.
+type BlockRule struct {
+	// ID is the identifier of the rule.
+	ID kallax.ULID
+	// Kind is the kind of endpoints matched by Value.
+	Kind BlockKind
+	// Value is the host, organization or pattern blocked.
+	Value string
+	// Reason is the reason given to block the endpoints.
+	Reason string
+	// CreatedAt is the time when the rule was added.
+	CreatedAt time.Time
+}
+
+// GetBlocklist returns all the rules of the blocklist.
+func (s *DatabaseStore) GetBlocklist() ([]*BlockRule, error) {
+	return getBlocklist(s.db)
+}
+
+// AddBlockRule adds a rule to the blocklist.
+func (s *DatabaseStore) AddBlockRule(r *BlockRule) error {
+	return addBlockRule(s.db, postgresDialect, r)
+}
+
+// RemoveBlockRule removes the rule with the given ID from the blocklist. It
+// returns kallax.ErrNotFound if it does not exist.
+func (s *DatabaseStore) RemoveBlockRule(id kallax.ULID) error {
+	return removeBlockRule(s.db, postgresDialect, id)
+}
+
+// GetBlocklist returns all the rules of the blocklist.
+func (s *SQLiteStore) GetBlocklist() ([]*BlockRule, error) {
+	return getBlocklist(s.db)
+}
+
+// AddBlockRule adds a rule to the blocklist.
+func (s *SQLiteStore) AddBlockRule(r *BlockRule) error {
+	return addBlockRule(s.db, sqliteDialect, r)
+}
+
+// RemoveBlockRule removes the rule with the given ID from the blocklist. It
+// returns kallax.ErrNotFound if it does not exist.
+func (s *SQLiteStore) RemoveBlockRule(id kallax.ULID) error {
+	return removeBlockRule(s.db, sqliteDialect, id)
+}
+
+func getBlocklist(db *sql.DB) ([]*BlockRule, error) {
+	start := time.Now()
+
+	rules, err := queryBlocklist(db)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"rules":    len(rules),
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get blocklist")
+		return nil, err
+	}
+
+	logger.Debugf("get blocklist finished")
+	return rules, nil
+}
+
+func queryBlocklist(db *sql.DB) ([]*BlockRule, error) {
+	rows, err := db.Query(
+		`SELECT id, kind, value, reason, created_at
+		FROM repository_blocklist ORDER BY created_at, id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*BlockRule
+	for rows.Next() {
+		var r BlockRule
+		err := rows.Scan(&r.ID, &r.Kind, &r.Value, &r.Reason, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, &r)
+	}
+
+	return rules, rows.Err()
+}
+
+func addBlockRule(db *sql.DB, d *dialect, r *BlockRule) error {
+	if r.ID.IsEmpty() {
+		r.ID = kallax.NewULID()
+	}
+
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+
+	_, err := db.Exec(fmt.Sprintf(
+		`INSERT INTO repository_blocklist (id, kind, value, reason, created_at)
+		VALUES (%s, %s, %s, %s, %s)`,
+		d.param(1), d.param(2), d.param(3), d.param(4), d.param(5),
+	), r.ID, r.Kind, r.Value, r.Reason, r.CreatedAt.UTC())
+
+	logger := log.With(log.Fields{
+		"id":    r.ID,
+		"kind":  r.Kind,
+		"value": r.Value,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not add block rule")
+		return err
+	}
+
+	logger.Debugf("block rule added")
+	return nil
+}
+
+func removeBlockRule(db *sql.DB, d *dialect, id kallax.ULID) error {
+	res, err := db.Exec(fmt.Sprintf(
+		"DELETE FROM repository_blocklist WHERE id = %s", d.param(1),
+	), id)
+	if err != nil {
+		log.With(log.Fields{"id": id}).Errorf(err, "could not remove block rule")
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return kallax.ErrNotFound
+	}
+
+	return nil
+}
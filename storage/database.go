@@ -12,12 +12,13 @@ import (
 // DatabaseStore implements a borges.RepositoryStorage based on a database.
 type DatabaseStore struct {
 	*model.RepositoryStore
+	db *sql.DB
 }
 
 // FromDatabase returns a new repository store that interacts with a PostgreSQL
 // FromDatabase to store all the data.
 func FromDatabase(db *sql.DB) *DatabaseStore {
-	return &DatabaseStore{model.NewRepositoryStore(db)}
+	return &DatabaseStore{model.NewRepositoryStore(db), db}
 }
 
 // Create honors the borges.RepositoryStore interface.
@@ -99,6 +100,74 @@ func (s *DatabaseStore) GetByEndpoints(
 	return repositories, nil
 }
 
+// GetByStatus returns all the repositories with the given status.
+func (s *DatabaseStore) GetByStatus(
+	status model.FetchStatus,
+) ([]*model.Repository, error) {
+	start := time.Now()
+
+	rs, err := s.Find(
+		model.NewRepositoryQuery().
+			WithReferences(nil).
+			FindByStatus(status),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	repositories, err := rs.All()
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"status":   status,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get repositories by status")
+		return nil, err
+	}
+
+	logger.Debugf("get repositories by status finished")
+	return repositories, nil
+}
+
+// GetFetchedBefore returns up to limit repositories in Fetched status that
+// were last fetched before the given time, the least recently fetched first.
+func (s *DatabaseStore) GetFetchedBefore(
+	before time.Time,
+	limit uint64,
+) ([]*model.Repository, error) {
+	start := time.Now()
+
+	rs, err := s.Find(
+		model.NewRepositoryQuery().
+			WithReferences(nil).
+			FindByStatus(model.Fetched).
+			FindByFetchedAt(kallax.Lt, before).
+			Order(kallax.Asc(model.Schema.Repository.FetchedAt)).
+			Limit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	repositories, err := rs.All()
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"before":   before,
+		"limit":    limit,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get repositories fetched before")
+		return nil, err
+	}
+
+	logger.Debugf("get repositories fetched before finished")
+	return repositories, nil
+}
+
 // GetRefsByInit honors the borges.RepositoryStore interface.
 func (s *DatabaseStore) GetRefsByInit(
 	init model.SHA1,
@@ -0,0 +1,585 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+// ErrCorruptedFile is returned when the file of a FileStore cannot be read.
+var ErrCorruptedFile = errors.NewKind("corrupted repository store %s at line %d: %s")
+
+// ErrFileLocked is returned when the file of a FileStore is being used by
+// another FileStore, in this or other process.
+var ErrFileLocked = errors.NewKind("repository store %s is being used by another process")
+
+// fileOpPut is the operation of the log of a FileStore that stores a
+// repository.
+const fileOpPut = "put"
+
+// FileStore is a borges.RepositoryStore that keeps the repositories and their
+// references in a file, so it needs no database but keeps the same
+// information across executions. It is safe for concurrent use, but a file
+// can only be used by one store at a time, which is enforced with an
+// exclusive lock on a file next to it with the ".lock" suffix.
+//
+// The file is an append-only log of the changes of the repositories that is
+// compacted when the store is opened.
+type FileStore struct {
+	path string
+
+	mu    sync.RWMutex
+	lock  *os.File
+	f     *os.File
+	repos map[kallax.ULID]*fileRepository
+	// endpoints and inits index the repositories by their endpoints and by
+	// the inits of their references.
+	endpoints map[string]map[kallax.ULID]struct{}
+	inits     map[string]map[kallax.ULID]struct{}
+}
+
+// OpenFile opens the FileStore kept in the given file, which is created with
+// its directory if it does not exist. It returns ErrFileLocked if the file is
+// already opened by another store.
+func OpenFile(path string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{
+		path:      path,
+		lock:      lock,
+		repos:     make(map[kallax.ULID]*fileRepository),
+		endpoints: make(map[string]map[kallax.ULID]struct{}),
+		inits:     make(map[string]map[kallax.ULID]struct{}),
+	}
+
+	if err := s.open(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) open() error {
+	if err := s.replay(); err != nil {
+		return err
+	}
+
+	if err := s.compact(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.f = f
+	return nil
+}
+
+// lockFile opens the given file, creating it if needed, and takes an
+// exclusive lock on it that is released when it is closed.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrFileLocked.New(strings.TrimSuffix(path, ".lock"))
+		}
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Close closes the file of the store and releases its lock.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+
+	err := s.f.Close()
+	s.f = nil
+	if lerr := s.lock.Close(); err == nil {
+		err = lerr
+	}
+
+	return err
+}
+
+type fileRecord struct {
+	Op   string          `json:"op"`
+	Repo *fileRepository `json:"repo,omitempty"`
+}
+
+type fileRepository struct {
+	ID           string            `json:"id"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+	Endpoints    []string          `json:"endpoints"`
+	Status       model.FetchStatus `json:"status"`
+	FetchedAt    *time.Time        `json:"fetched_at,omitempty"`
+	FetchErrorAt *time.Time        `json:"fetch_error_at,omitempty"`
+	LastCommitAt *time.Time        `json:"last_commit_at,omitempty"`
+	IsFork       *bool             `json:"is_fork,omitempty"`
+	References   []*fileReference  `json:"references,omitempty"`
+
+	id kallax.ULID
+}
+
+type fileReference struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Init      string    `json:"init"`
+	Roots     []string  `json:"roots,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+func newFileRepository(r *model.Repository) *fileRepository {
+	fr := &fileRepository{
+		ID:           r.ID.String(),
+		CreatedAt:    r.CreatedAt,
+		UpdatedAt:    r.UpdatedAt,
+		Endpoints:    append([]string(nil), r.Endpoints...),
+		Status:       r.Status,
+		FetchedAt:    copyTime(r.FetchedAt),
+		FetchErrorAt: copyTime(r.FetchErrorAt),
+		LastCommitAt: copyTime(r.LastCommitAt),
+		IsFork:       copyBool(r.IsFork),
+		id:           r.ID,
+	}
+
+	for _, ref := range r.References {
+		if ref.ID.IsEmpty() {
+			ref.ID = kallax.NewULID()
+		}
+
+		if ref.CreatedAt.IsZero() {
+			ref.CreatedAt = r.UpdatedAt
+		}
+
+		if ref.UpdatedAt.IsZero() {
+			ref.UpdatedAt = r.UpdatedAt
+		}
+
+		fref := &fileReference{
+			ID:        ref.ID.String(),
+			CreatedAt: ref.CreatedAt,
+			UpdatedAt: ref.UpdatedAt,
+			Name:      ref.Name,
+			Hash:      ref.Hash.String(),
+			Init:      ref.Init.String(),
+			Time:      ref.Time,
+		}
+
+		for _, root := range ref.Roots {
+			fref.Roots = append(fref.Roots, root.String())
+		}
+
+		fr.References = append(fr.References, fref)
+	}
+
+	return fr
+}
+
+// toRepo returns a new model of the repository. The references are not
+// included if withRefs is false.
+func (r *fileRepository) toRepo(withRefs bool) *model.Repository {
+	repo := &model.Repository{
+		ID:           r.id,
+		Endpoints:    append([]string(nil), r.Endpoints...),
+		Status:       r.Status,
+		FetchedAt:    copyTime(r.FetchedAt),
+		FetchErrorAt: copyTime(r.FetchErrorAt),
+		LastCommitAt: copyTime(r.LastCommitAt),
+		IsFork:       copyBool(r.IsFork),
+	}
+
+	repo.CreatedAt = r.CreatedAt
+	repo.UpdatedAt = r.UpdatedAt
+
+	if !withRefs {
+		return repo
+	}
+
+	for _, ref := range r.References {
+		repo.References = append(repo.References, ref.toReference(repo))
+	}
+
+	return repo
+}
+
+func (r *fileReference) toReference(repo *model.Repository) *model.Reference {
+	ref := &model.Reference{
+		Name:       r.Name,
+		Repository: repo,
+		Hash:       model.NewSHA1(r.Hash),
+		Init:       model.NewSHA1(r.Init),
+		Time:       r.Time,
+	}
+
+	ref.ID, _ = kallax.NewULIDFromText(r.ID)
+	ref.CreatedAt = r.CreatedAt
+	ref.UpdatedAt = r.UpdatedAt
+	for _, root := range r.Roots {
+		ref.Roots = append(ref.Roots, model.NewSHA1(root))
+	}
+
+	return ref
+}
+
+func (s *FileStore) replay() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a last line without line break was not completely written
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var rec fileRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return ErrCorruptedFile.New(s.path, line, err)
+		}
+
+		if err := s.apply(&rec); err != nil {
+			return ErrCorruptedFile.New(s.path, line, err)
+		}
+	}
+}
+
+func (s *FileStore) apply(rec *fileRecord) error {
+	if rec.Op != fileOpPut {
+		return fmt.Errorf("unknown operation %q", rec.Op)
+	}
+
+	if rec.Repo == nil {
+		return fmt.Errorf("put without repository")
+	}
+
+	id, err := kallax.NewULIDFromText(rec.Repo.ID)
+	if err != nil {
+		return err
+	}
+
+	rec.Repo.id = id
+	s.put(rec.Repo)
+	return nil
+}
+
+// compact rewrites the file of the store with only its current state.
+func (s *FileStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range s.repos {
+		if err = enc.Encode(&fileRecord{Op: fileOpPut, Repo: r}); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// write appends an operation to the file.
+func (s *FileStore) write(rec *fileRecord) error {
+	if s.f == nil {
+		return fmt.Errorf("repository store %s is closed", s.path)
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.f.Write(append(data, '\n'))
+	return err
+}
+
+// save writes the given repository and replaces the stored one.
+func (s *FileStore) save(r *fileRepository) error {
+	if err := s.write(&fileRecord{Op: fileOpPut, Repo: r}); err != nil {
+		return err
+	}
+
+	s.put(r)
+	return nil
+}
+
+// put replaces the stored repository, updating the indexes.
+func (s *FileStore) put(r *fileRepository) {
+	s.remove(r.id)
+	s.repos[r.id] = r
+
+	for _, ep := range r.Endpoints {
+		addToIndex(s.endpoints, ep, r.id)
+	}
+
+	for _, ref := range r.References {
+		addToIndex(s.inits, ref.Init, r.id)
+	}
+}
+
+// remove removes a repository and its entries of the indexes.
+func (s *FileStore) remove(id kallax.ULID) {
+	r, ok := s.repos[id]
+	if !ok {
+		return
+	}
+
+	delete(s.repos, id)
+	for _, ep := range r.Endpoints {
+		removeFromIndex(s.endpoints, ep, id)
+	}
+
+	for _, ref := range r.References {
+		removeFromIndex(s.inits, ref.Init, id)
+	}
+}
+
+// Create honors the borges.RepositoryStore interface.
+func (s *FileStore) Create(r *model.Repository) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = now
+	}
+	r.UpdatedAt = now
+
+	return s.save(newFileRepository(r))
+}
+
+// Get honors the borges.RepositoryStore interface.
+func (s *FileStore) Get(id kallax.ULID) (*model.Repository, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.repos[id]
+	if !ok {
+		return nil, kallax.ErrNotFound
+	}
+
+	return r.toRepo(true), nil
+}
+
+// GetByEndpoints honors the borges.RepositoryStore interface.
+func (s *FileStore) GetByEndpoints(endpoints ...string) ([]*model.Repository, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make(map[kallax.ULID]struct{})
+	var repos []*model.Repository
+	for _, ep := range endpoints {
+		for id := range s.endpoints[ep] {
+			if _, ok := found[id]; ok {
+				continue
+			}
+
+			found[id] = struct{}{}
+			repos = append(repos, s.repos[id].toRepo(true))
+		}
+	}
+
+	return repos, nil
+}
+
+// GetByStatus returns all the repositories with the given status.
+func (s *FileStore) GetByStatus(status model.FetchStatus) ([]*model.Repository, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var repos []*model.Repository
+	for _, r := range s.repos {
+		if r.Status == status {
+			repos = append(repos, r.toRepo(true))
+		}
+	}
+
+	return repos, nil
+}
+
+// GetRefsByInit honors the borges.RepositoryStore interface.
+func (s *FileStore) GetRefsByInit(init model.SHA1) ([]*model.Reference, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hash := init.String()
+	var refs []*model.Reference
+	for id := range s.inits[hash] {
+		r := s.repos[id]
+		repo := r.toRepo(false)
+		for _, ref := range r.References {
+			if ref.Init == hash {
+				refs = append(refs, ref.toReference(repo))
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+// InitHasRefs honors the borges.RepositoryStore interface.
+func (s *FileStore) InitHasRefs(init model.SHA1) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.inits[init.String()]) > 0, nil
+}
+
+// SetStatus honors the borges.RepositoryStore interface.
+func (s *FileStore) SetStatus(r *model.Repository, status model.FetchStatus) error {
+	r.Status = status
+	return s.update(r, false)
+}
+
+// SetEndpoints honors the borges.RepositoryStore interface.
+func (s *FileStore) SetEndpoints(r *model.Repository, endpoints ...string) error {
+	r.Endpoints = endpoints
+	return s.update(r, false)
+}
+
+// UpdateFailed honors the borges.RepositoryStore interface.
+func (s *FileStore) UpdateFailed(r *model.Repository, status model.FetchStatus) error {
+	r.Status = status
+	return s.update(r, true)
+}
+
+// UpdateFetched honors the borges.RepositoryStore interface.
+func (s *FileStore) UpdateFetched(r *model.Repository, fetchedAt time.Time) error {
+	r.Status = model.Fetched
+	r.FetchedAt = &fetchedAt
+	r.LastCommitAt = lastCommitTime(r.References)
+	return s.update(r, true)
+}
+
+// update replaces the stored repository with the given one, as well as its
+// references. The time of the last update is only changed if touch is true.
+func (s *FileStore) update(r *model.Repository, touch bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.repos[r.ID]
+	if !ok {
+		return kallax.ErrNotFound
+	}
+
+	r.CreatedAt = stored.CreatedAt
+	if touch {
+		r.UpdatedAt = time.Now()
+	} else {
+		r.UpdatedAt = stored.UpdatedAt
+	}
+
+	return s.save(newFileRepository(r))
+}
+
+func addToIndex(
+	index map[string]map[kallax.ULID]struct{},
+	key string,
+	id kallax.ULID,
+) {
+	ids, ok := index[key]
+	if !ok {
+		ids = make(map[kallax.ULID]struct{})
+		index[key] = ids
+	}
+
+	ids[id] = struct{}{}
+}
+
+func removeFromIndex(
+	index map[string]map[kallax.ULID]struct{},
+	key string,
+	id kallax.ULID,
+) {
+	delete(index[key], id)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	c := *t
+	return &c
+}
+
+func copyBool(b *bool) *bool {
+	if b == nil {
+		return nil
+	}
+
+	c := *b
+	return &c
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestFile(t *testing.T) {
+	suite.Run(t, new(FileSuite))
+}
+
+type FileSuite struct {
+	suite.Suite
+	dir   string
+	path  string
+	store *FileStore
+}
+
+func (s *FileSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "borges-file-store")
+	s.Require().NoError(err)
+
+	s.path = filepath.Join(s.dir, "store", "repositories.jsonl")
+	s.open()
+}
+
+func (s *FileSuite) TearDownTest() {
+	s.NoError(s.store.Close())
+	s.NoError(os.RemoveAll(s.dir))
+}
+
+func (s *FileSuite) TestCreateGet() {
+	require := s.Require()
+
+	isFork := true
+	r := model.NewRepository()
+	r.Endpoints = []string{"git://foo/bar.git", "https://foo/bar.git"}
+	r.IsFork = &isFork
+	require.NoError(s.store.Create(r))
+	require.False(r.CreatedAt.IsZero())
+
+	obtained, err := s.store.Get(r.ID)
+	require.NoError(err)
+	require.Equal(r.ID, obtained.ID)
+	require.Equal(r.Endpoints, obtained.Endpoints)
+	require.Equal(model.Pending, obtained.Status)
+	require.Equal(&isFork, obtained.IsFork)
+	require.True(r.CreatedAt.Equal(obtained.CreatedAt))
+
+	_, err = s.store.Get(kallax.NewULID())
+	require.Equal(kallax.ErrNotFound, err)
+}
+
+func (s *FileSuite) TestGetByEndpoints() {
+	require := s.Require()
+
+	foo := s.create("git://foo", "https://foo")
+	s.create("git://bar")
+	baz := s.create("git://baz")
+
+	repos, err := s.store.GetByEndpoints("git://foo", "https://foo", "git://baz")
+	require.NoError(err)
+	require.ElementsMatch(
+		[]kallax.ULID{foo.ID, baz.ID},
+		[]kallax.ULID{repos[0].ID, repos[1].ID},
+	)
+
+	require.NoError(s.store.SetEndpoints(foo, "git://qux"))
+	repos, err = s.store.GetByEndpoints("git://foo")
+	require.NoError(err)
+	require.Len(repos, 0)
+
+	repos, err = s.store.GetByEndpoints("git://qux")
+	require.NoError(err)
+	require.Len(repos, 1)
+	require.Equal(foo.ID, repos[0].ID)
+}
+
+func (s *FileSuite) TestUpdateFetched() {
+	require := s.Require()
+
+	r := s.create("git://foo")
+	init := model.NewSHA1("b029517f6300c2da0f4b651b8642506cd6aaf45d")
+	other := model.NewSHA1("6ecf0ef2c2dffb796033e5a02219af86ec6584e5")
+	commitTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	r.References = []*model.Reference{{
+		Name:  "refs/heads/master",
+		Hash:  model.NewSHA1("918c48b83bd081e863dbe1b80f8998f058cd8294"),
+		Init:  init,
+		Roots: model.SHA1List{init},
+		Time:  commitTime,
+	}}
+
+	fetchedAt := time.Now().Truncate(time.Second)
+	require.NoError(s.store.UpdateFetched(r, fetchedAt))
+	require.Equal(model.Fetched, r.Status)
+	require.True(r.LastCommitAt.Equal(commitTime))
+
+	s.reopen()
+
+	obtained, err := s.store.Get(r.ID)
+	require.NoError(err)
+	require.Equal(model.Fetched, obtained.Status)
+	require.True(obtained.FetchedAt.Equal(fetchedAt))
+	require.True(obtained.LastCommitAt.Equal(commitTime))
+	require.Len(obtained.References, 1)
+
+	ref := obtained.References[0]
+	require.False(ref.ID.IsEmpty())
+	require.Equal("refs/heads/master", ref.Name)
+	require.Equal(r.References[0].Hash, ref.Hash)
+	require.Equal(init, ref.Init)
+	require.Equal(model.SHA1List{init}, ref.Roots)
+	require.True(ref.Time.Equal(commitTime))
+	require.Equal(obtained, ref.Repository)
+
+	ok, err := s.store.InitHasRefs(init)
+	require.NoError(err)
+	require.True(ok)
+
+	ok, err = s.store.InitHasRefs(other)
+	require.NoError(err)
+	require.False(ok)
+
+	refs, err := s.store.GetRefsByInit(init)
+	require.NoError(err)
+	require.Len(refs, 1)
+	require.Equal(r.ID, refs[0].Repository.ID)
+
+	obtained.References = nil
+	require.NoError(s.store.UpdateFailed(obtained, model.Pending))
+
+	ok, err = s.store.InitHasRefs(init)
+	require.NoError(err)
+	require.False(ok)
+}
+
+func (s *FileSuite) TestStatus() {
+	require := s.Require()
+
+	foo := s.create("git://foo")
+	s.create("git://bar")
+	updatedAt := foo.UpdatedAt
+
+	require.NoError(s.store.SetStatus(foo, model.Fetching))
+	require.True(updatedAt.Equal(foo.UpdatedAt))
+
+	repos, err := s.store.GetByStatus(model.Fetching)
+	require.NoError(err)
+	require.Len(repos, 1)
+	require.Equal(foo.ID, repos[0].ID)
+
+	errorAt := time.Now()
+	foo.FetchErrorAt = &errorAt
+	require.NoError(s.store.UpdateFailed(foo, model.NotFound))
+	require.False(updatedAt.Equal(foo.UpdatedAt))
+
+	s.reopen()
+
+	obtained, err := s.store.Get(foo.ID)
+	require.NoError(err)
+	require.Equal(model.NotFound, obtained.Status)
+	require.True(obtained.FetchErrorAt.Equal(errorAt))
+
+	r := model.NewRepository()
+	require.Equal(kallax.ErrNotFound, s.store.SetStatus(r, model.Fetching))
+}
+
+func (s *FileSuite) TestCompaction() {
+	require := s.Require()
+
+	r := s.create("git://foo")
+	for i := 0; i < 10; i++ {
+		require.NoError(s.store.SetStatus(r, model.Fetching))
+	}
+
+	before, err := ioutil.ReadFile(s.path)
+	require.NoError(err)
+
+	s.reopen()
+
+	after, err := ioutil.ReadFile(s.path)
+	require.NoError(err)
+	require.True(len(after) < len(before))
+
+	obtained, err := s.store.Get(r.ID)
+	require.NoError(err)
+	require.Equal(model.Fetching, obtained.Status)
+}
+
+func (s *FileSuite) TestTruncatedFile() {
+	require := s.Require()
+
+	r := s.create("git://foo")
+	require.NoError(s.store.Close())
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(err)
+	_, err = f.Write([]byte(`{"op":"put","repo":{"id":`))
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	s.open()
+	_, err = s.store.Get(r.ID)
+	require.NoError(err)
+
+	require.NoError(s.store.Close())
+	require.NoError(ioutil.WriteFile(s.path, []byte("foo\n"), 0644))
+
+	_, err = OpenFile(s.path)
+	require.True(ErrCorruptedFile.Is(err))
+
+	require.NoError(os.Remove(s.path))
+	s.open()
+}
+
+func (s *FileSuite) TestLocked() {
+	require := s.Require()
+
+	_, err := OpenFile(s.path)
+	require.True(ErrFileLocked.Is(err))
+
+	s.reopen()
+	r := s.create("git://foo")
+
+	require.NoError(s.store.Close())
+	s.open()
+	_, err = s.store.Get(r.ID)
+	require.NoError(err)
+}
+
+func (s *FileSuite) create(endpoints ...string) *model.Repository {
+	r := model.NewRepository()
+	r.Endpoints = endpoints
+	s.Require().NoError(s.store.Create(r))
+	return r
+}
+
+func (s *FileSuite) open() {
+	var err error
+	s.store, err = OpenFile(s.path)
+	s.Require().NoError(err)
+}
+
+func (s *FileSuite) reopen() {
+	s.Require().NoError(s.store.Close())
+	s.open()
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// RepositoryFilter selects repositories by the values of their fields. Zero
+// values are not used to filter, so the zero RepositoryFilter selects all the
+// repositories. Time ranges are inclusive.
+type RepositoryFilter struct {
+	// Statuses selects repositories in any of the given statuses.
+	Statuses []model.FetchStatus
+	// EndpointPattern selects repositories with any endpoint matching the
+	// given SQL LIKE pattern.
+	EndpointPattern string
+	// IsFork selects forks if true or non forks if false. Repositories not
+	// known to be forks or not are only selected if it is nil.
+	IsFork *bool
+	// FetchedAfter and FetchedBefore select repositories last fetched in the
+	// given range.
+	FetchedAfter, FetchedBefore time.Time
+	// FetchErrorAfter and FetchErrorBefore select repositories whose last
+	// fetch error happened in the given range.
+	FetchErrorAfter, FetchErrorBefore time.Time
+	// LastCommitAfter and LastCommitBefore select repositories whose last
+	// commit is in the given range.
+	LastCommitAfter, LastCommitBefore time.Time
+}
+
+// dialect holds the parts of the queries that differ between the databases
+// supported by the stores.
+type dialect struct {
+	// placeholder is the format of a positional parameter given its
+	// position.
+	placeholder string
+	// endpointLike is the format of the condition of a repository with any
+	// endpoint matching the LIKE pattern of the given parameter.
+	endpointLike string
+}
+
+func (d *dialect) param(n int) string {
+	return fmt.Sprintf(d.placeholder, n)
+}
+
+var postgresDialect = &dialect{
+	placeholder:  "$%d",
+	endpointLike: "EXISTS (SELECT 1 FROM unnest(endpoints) AS e WHERE e LIKE %s)",
+}
+
+// where returns the SQL condition of the filter, using positional
+// parameters after the given arguments, and the arguments with the values of
+// the parameters appended.
+func (f *RepositoryFilter) where(
+	d *dialect,
+	args []interface{},
+) (string, []interface{}) {
+	conds := []string{"TRUE"}
+	param := func(v interface{}) string {
+		args = append(args, v)
+		return d.param(len(args))
+	}
+
+	if len(f.Statuses) > 0 {
+		params := make([]string, len(f.Statuses))
+		for i, s := range f.Statuses {
+			params[i] = param(s)
+		}
+
+		conds = append(conds, fmt.Sprintf("status IN (%s)", strings.Join(params, ", ")))
+	}
+
+	if f.EndpointPattern != "" {
+		conds = append(conds, fmt.Sprintf(
+			d.endpointLike, param(f.EndpointPattern),
+		))
+	}
+
+	if f.IsFork != nil {
+		conds = append(conds, fmt.Sprintf("is_fork = %s", param(*f.IsFork)))
+	}
+
+	timeRange := func(column string, after, before time.Time) {
+		if !after.IsZero() {
+			conds = append(conds, fmt.Sprintf("%s >= %s", column, param(after.UTC())))
+		}
+
+		if !before.IsZero() {
+			conds = append(conds, fmt.Sprintf("%s <= %s", column, param(before.UTC())))
+		}
+	}
+
+	timeRange("fetched_at", f.FetchedAfter, f.FetchedBefore)
+	timeRange("fetch_error_at", f.FetchErrorAfter, f.FetchErrorBefore)
+	timeRange("last_commit_at", f.LastCommitAfter, f.LastCommitBefore)
+
+	return strings.Join(conds, " AND "), args
+}
+
+// CountByFilter returns the number of repositories selected by the filter.
+func (s *DatabaseStore) CountByFilter(f *RepositoryFilter) (int, error) {
+	start := time.Now()
+
+	where, args := f.where(postgresDialect, nil)
+
+	var count int
+	err := s.db.QueryRow(
+		"SELECT COUNT(*) FROM repositories WHERE "+where, args...,
+	).Scan(&count)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"filter":   where,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not count repositories by filter")
+		return 0, err
+	}
+
+	logger.Debugf("count repositories by filter finished")
+	return count, nil
+}
+
+// GetByFilter returns up to limit repositories selected by the filter with an
+// ID greater than after, ordered by ID. The zero ULID can be used to get the
+// first page.
+func (s *DatabaseStore) GetByFilter(
+	f *RepositoryFilter,
+	after kallax.ULID,
+	limit uint64,
+) ([]*model.Repository, error) {
+	start := time.Now()
+
+	where, args := f.where(postgresDialect, []interface{}{after, limit})
+	repositories, err := s.findByQueryIDs(
+		"SELECT id FROM repositories WHERE id > $1 AND "+where+
+			" ORDER BY id ASC LIMIT $2",
+		args...,
+	)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"filter":   where,
+		"limit":    limit,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get repositories by filter")
+		return nil, err
+	}
+
+	logger.Debugf("get repositories by filter finished")
+	return repositories, nil
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+func TestRepositoryFilterWhere(t *testing.T) {
+	require := require.New(t)
+
+	where, args := (&RepositoryFilter{}).where(postgresDialect, nil)
+	require.Equal("TRUE", where)
+	require.Len(args, 0)
+
+	isFork := false
+	now := time.Now()
+	f := &RepositoryFilter{
+		Statuses:         []model.FetchStatus{model.Fetched, model.NotFound},
+		EndpointPattern:  "%github.com%",
+		IsFork:           &isFork,
+		FetchedBefore:    now,
+		LastCommitAfter:  now.Add(-time.Hour),
+		LastCommitBefore: now,
+	}
+
+	where, args = f.where(postgresDialect, []interface{}{"foo"})
+	require.Equal(
+		"TRUE AND status IN ($2, $3) AND "+
+			"EXISTS (SELECT 1 FROM unnest(endpoints) AS e WHERE e LIKE $4) AND "+
+			"is_fork = $5 AND fetched_at <= $6 AND "+
+			"last_commit_at >= $7 AND last_commit_at <= $8",
+		where,
+	)
+	require.Equal([]interface{}{
+		"foo", model.Fetched, model.NotFound, "%github.com%", false,
+		now.UTC(), now.Add(-time.Hour).UTC(), now.UTC(),
+	}, args)
+
+	where, _ = (&RepositoryFilter{
+		Statuses:        []model.FetchStatus{model.Fetched},
+		EndpointPattern: "%github.com%",
+	}).where(sqliteDialect, nil)
+	require.Equal(
+		"TRUE AND status IN (?1) AND "+
+			"EXISTS (SELECT 1 FROM repository_endpoints AS e "+
+			"WHERE e.repository_id = repositories.id AND e.endpoint LIKE ?2)",
+		where,
+	)
+}
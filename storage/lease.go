@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/src-d/borges/lock"
+
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// leasePollInterval is the time a locker waits before trying again to take a
+// lock held by someone else.
+var leasePollInterval = 100 * time.Millisecond
+
+// LeaseService returns a lock.Service that keeps the locks in the
+// repository_leases table of the database, so they are shared by all the
+// processes using it, as with a distributed locking service.
+func (s *DatabaseStore) LeaseService() lock.Service {
+	return newLeaseService(s.db, postgresDialect)
+}
+
+// LeaseService returns a lock.Service that keeps the locks in the
+// repository_leases table of the database, so they are shared by all the
+// processes using it, as with a distributed locking service.
+func (s *SQLiteStore) LeaseService() lock.Service {
+	return newLeaseService(s.db, sqliteDialect)
+}
+
+// leaseService is a lock.Service whose locks are rows with an owner and an
+// expiration time. A lock is renewed by its locker every third of the TTL of
+// its session, and it can be taken by someone else once it expires, so the
+// locks of a process that dies are released after the TTL. The expiration
+// times are taken from the clock of each process, so the clocks of the hosts
+// sharing the database must be synchronized.
+type leaseService struct {
+	db *sql.DB
+	d  *dialect
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newLeaseService(db *sql.DB, d *dialect) *leaseService {
+	return &leaseService{db: db, d: d}
+}
+
+// NewSession honors the lock.Service interface. The TTL of the session is
+// mandatory.
+func (s *leaseService) NewSession(cfg *lock.SessionConfig) (lock.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, lock.ErrAlreadyClosed.New()
+	}
+
+	if cfg.TTL <= 0 {
+		return nil, fmt.Errorf("database leases need a TTL")
+	}
+
+	return &leaseSession{
+		srv:   s,
+		cfg:   *cfg,
+		owner: kallax.NewULID().String(),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// Close honors the lock.Service interface. The database is not closed.
+func (s *leaseService) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return lock.ErrAlreadyClosed.New()
+	}
+
+	s.closed = true
+	return nil
+}
+
+type leaseSession struct {
+	srv   *leaseService
+	cfg   lock.SessionConfig
+	owner string
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewLocker honors the lock.Session interface.
+func (s *leaseSession) NewLocker(id string) lock.Locker {
+	return &leaseLocker{sess: s, id: id}
+}
+
+// Close honors the lock.Session interface. The locks of the session are
+// released.
+func (s *leaseSession) Close() error {
+	closed := false
+	s.closeOnce.Do(func() {
+		closed = true
+		close(s.done)
+	})
+
+	if !closed {
+		return lock.ErrAlreadyClosed.New()
+	}
+
+	_, err := s.srv.db.Exec(fmt.Sprintf(
+		`DELETE FROM repository_leases WHERE owner = %s`, s.srv.d.param(1),
+	), s.owner)
+	return err
+}
+
+// Done honors the lock.Session interface.
+func (s *leaseSession) Done() <-chan struct{} {
+	return s.done
+}
+
+type leaseLocker struct {
+	sess *leaseSession
+	id   string
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+// Lock honors the lock.Locker interface. It waits for the lock until the
+// timeout of the session, if any, and returns lock.ErrCanceled when it
+// elapses.
+func (l *leaseLocker) Lock() (<-chan struct{}, error) {
+	var deadline <-chan time.Time
+	if l.sess.cfg.Timeout > 0 {
+		timer := time.NewTimer(l.sess.cfg.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		expires, ok, err := l.acquire()
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return l.keepAlive(expires), nil
+		}
+
+		select {
+		case <-deadline:
+			return nil, lock.ErrCanceled.New()
+		case <-l.sess.done:
+			return nil, lock.ErrCanceled.New()
+		case <-time.After(leasePollInterval):
+		}
+	}
+}
+
+// acquire takes the lock if it is free or expired. It returns its expiration
+// time and whether it was taken.
+func (l *leaseLocker) acquire() (time.Time, bool, error) {
+	d := l.sess.srv.d
+	now := time.Now().UTC()
+	expires := now.Add(l.sess.cfg.TTL)
+
+	res, err := l.sess.srv.db.Exec(fmt.Sprintf(
+		`INSERT INTO repository_leases (id, owner, expires_at)
+		VALUES (%s, %s, %s)
+		ON CONFLICT (id) DO UPDATE
+		SET owner = excluded.owner, expires_at = excluded.expires_at
+		WHERE repository_leases.expires_at <= %s`,
+		d.param(1), d.param(2), d.param(3), d.param(4),
+	), l.id, l.sess.owner, expires, now)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	n, err := res.RowsAffected()
+	return expires, n > 0, err
+}
+
+// keepAlive renews the lock until it is unlocked. The returned channel is
+// closed if the lock expires before it could be renewed.
+func (l *leaseLocker) keepAlive(expires time.Time) <-chan struct{} {
+	lost := make(chan struct{})
+	stop := make(chan struct{})
+
+	l.mu.Lock()
+	l.stop = stop
+	l.mu.Unlock()
+
+	go func() {
+		defer close(lost)
+
+		ticker := time.NewTicker(l.sess.cfg.TTL / 3)
+		defer ticker.Stop()
+
+		logger := log.With(log.Fields{"lock": l.id})
+		for {
+			select {
+			case <-stop:
+				return
+			case <-l.sess.done:
+				return
+			case <-ticker.C:
+			}
+
+			renewed, ok, err := l.renew()
+			if err != nil {
+				logger.Errorf(err, "could not renew database lease")
+			}
+
+			if ok {
+				expires = renewed
+				continue
+			}
+
+			if err == nil || time.Now().After(expires) {
+				logger.Warningf("database lease lost")
+				return
+			}
+		}
+	}()
+
+	return lost
+}
+
+func (l *leaseLocker) renew() (time.Time, bool, error) {
+	d := l.sess.srv.d
+	expires := time.Now().UTC().Add(l.sess.cfg.TTL)
+
+	res, err := l.sess.srv.db.Exec(fmt.Sprintf(
+		`UPDATE repository_leases SET expires_at = %s
+		WHERE id = %s AND owner = %s`,
+		d.param(1), d.param(2), d.param(3),
+	), expires, l.id, l.sess.owner)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	n, err := res.RowsAffected()
+	return expires, n > 0, err
+}
+
+// Unlock honors the lock.Locker interface.
+func (l *leaseLocker) Unlock() error {
+	l.mu.Lock()
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	l.mu.Unlock()
+
+	d := l.sess.srv.d
+	_, err := l.sess.srv.db.Exec(fmt.Sprintf(
+		`DELETE FROM repository_leases WHERE id = %s AND owner = %s`,
+		d.param(1), d.param(2),
+	), l.id, l.sess.owner)
+	return err
+}
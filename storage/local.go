@@ -11,7 +11,7 @@ import (
 
 type localRepository struct {
 	ID         kallax.ULID
-	Endpoint   string
+	Endpoints  []string
 	Status     model.FetchStatus
 	References []*localReference
 }
@@ -20,7 +20,7 @@ func (r *localRepository) toRepo() *model.Repository {
 	repo := &model.Repository{
 		ID:        r.ID,
 		Status:    r.Status,
-		Endpoints: []string{r.Endpoint},
+		Endpoints: append([]string(nil), r.Endpoints...),
 	}
 
 	var refs []*model.Reference
@@ -63,14 +63,14 @@ func (s *LocalStore) Create(r *model.Repository) error {
 	s.Lock()
 	defer s.Unlock()
 
-	if len(r.Endpoints) != 1 {
-		return fmt.Errorf("expecting only 1 endpoint for repository %q, got %d", r.ID, len(r.Endpoints))
+	if len(r.Endpoints) == 0 {
+		return fmt.Errorf("expecting at least 1 endpoint for repository %q", r.ID)
 	}
 
 	s.repos[r.ID] = &localRepository{
-		ID:       r.ID,
-		Endpoint: r.Endpoints[0],
-		Status:   r.Status,
+		ID:        r.ID,
+		Endpoints: append([]string(nil), r.Endpoints...),
+		Status:    r.Status,
 	}
 	return nil
 }
@@ -98,7 +98,25 @@ func (s *LocalStore) GetByEndpoints(endpoints ...string) ([]*model.Repository, e
 
 	var repos []*model.Repository
 	for _, r := range s.repos {
-		if containsString(endpoints, r.Endpoint) {
+		for _, e := range r.Endpoints {
+			if containsString(endpoints, e) {
+				repos = append(repos, r.toRepo())
+				break
+			}
+		}
+	}
+
+	return repos, nil
+}
+
+// GetByStatus returns all the repositories with the given status.
+func (s *LocalStore) GetByStatus(status model.FetchStatus) ([]*model.Repository, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var repos []*model.Repository
+	for _, r := range s.repos {
+		if r.Status == status {
 			repos = append(repos, r.toRepo())
 		}
 	}
@@ -165,8 +183,8 @@ func (s *LocalStore) SetStatus(r *model.Repository, status model.FetchStatus) er
 
 // SetEndpoints honors the borges.RepositoryStore interface.
 func (s *LocalStore) SetEndpoints(r *model.Repository, endpoints ...string) error {
-	if len(endpoints) != 1 {
-		return fmt.Errorf("expecting only 1 endpoint for repo %q, got %d", r.ID, len(endpoints))
+	if len(endpoints) == 0 {
+		return fmt.Errorf("expecting at least 1 endpoint for repo %q", r.ID)
 	}
 
 	s.Lock()
@@ -178,7 +196,7 @@ func (s *LocalStore) SetEndpoints(r *model.Repository, endpoints ...string) erro
 		return kallax.ErrNotFound
 	}
 
-	localRepo.Endpoint = endpoints[0]
+	localRepo.Endpoints = append([]string(nil), endpoints...)
 	return nil
 }
 
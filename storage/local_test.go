@@ -24,9 +24,9 @@ func (s *LocalSuite) TestGet() {
 
 	id := kallax.NewULID()
 	expected := &localRepository{
-		ID:       id,
-		Endpoint: "foo",
-		Status:   model.Pending,
+		ID:        id,
+		Endpoints: []string{"foo"},
+		Status:    model.Pending,
 	}
 	s.store.repos[id] = expected
 	repo, err := s.store.Get(id)
@@ -45,9 +45,9 @@ func (s *LocalSuite) TestGetByEndpoints() {
 		ids = append(ids, kallax.NewULID())
 	}
 	repos := []*localRepository{
-		{ids[0], "foo", model.Pending, nil},
-		{ids[1], "bar", model.Pending, nil},
-		{ids[2], "baz", model.Pending, nil},
+		{ids[0], []string{"foo"}, model.Pending, nil},
+		{ids[1], []string{"bar"}, model.Pending, nil},
+		{ids[2], []string{"baz"}, model.Pending, nil},
 	}
 
 	for i, id := range ids {
@@ -69,12 +69,42 @@ func (s *LocalSuite) TestGetByEndpoints() {
 	require.NoError(err)
 }
 
+func (s *LocalSuite) TestGetByStatus() {
+	require := s.Require()
+
+	var ids []kallax.ULID
+	for i := 0; i < 3; i++ {
+		ids = append(ids, kallax.NewULID())
+	}
+	repos := []*localRepository{
+		{ids[0], []string{"foo"}, model.Fetching, nil},
+		{ids[1], []string{"bar"}, model.Pending, nil},
+		{ids[2], []string{"baz"}, model.Fetching, nil},
+	}
+
+	for i, id := range ids {
+		s.store.repos[id] = repos[i]
+	}
+
+	result, err := s.store.GetByStatus(model.Fetching)
+	require.NoError(err)
+	require.Len(result, 2)
+	require.ElementsMatch(
+		[]kallax.ULID{ids[0], ids[2]},
+		[]kallax.ULID{result[0].ID, result[1].ID},
+	)
+
+	result, err = s.store.GetByStatus(model.NotFound)
+	require.NoError(err)
+	require.Len(result, 0)
+}
+
 func (s *LocalSuite) TestSetStatus() {
 	require := s.Require()
 	repo := &localRepository{
-		ID:       kallax.NewULID(),
-		Endpoint: "foo",
-		Status:   model.Pending,
+		ID:        kallax.NewULID(),
+		Endpoints: []string{"foo"},
+		Status:    model.Pending,
 	}
 	s.store.repos[repo.ID] = repo
 	modelRepo := repo.toRepo()
@@ -88,9 +118,9 @@ func (s *LocalSuite) TestSetStatus() {
 func (s *LocalSuite) TestSetEndpoints() {
 	require := s.Require()
 	repo := &localRepository{
-		ID:       kallax.NewULID(),
-		Endpoint: "foo",
-		Status:   model.Pending,
+		ID:        kallax.NewULID(),
+		Endpoints: []string{"foo"},
+		Status:    model.Pending,
 	}
 	s.store.repos[repo.ID] = repo
 	modelRepo := repo.toRepo()
@@ -99,18 +129,22 @@ func (s *LocalSuite) TestSetEndpoints() {
 	require.NoError(err)
 	require.Len(modelRepo.Endpoints, 1)
 	require.Equal("bar", modelRepo.Endpoints[0])
-	require.Equal("bar", s.store.repos[repo.ID].Endpoint)
+	require.Equal([]string{"bar"}, s.store.repos[repo.ID].Endpoints)
 
 	err = s.store.SetEndpoints(modelRepo, "bar", "baz")
+	require.NoError(err)
+	require.Equal([]string{"bar", "baz"}, s.store.repos[repo.ID].Endpoints)
+
+	err = s.store.SetEndpoints(modelRepo)
 	require.Error(err)
 }
 
 func (s *LocalSuite) TestUpdateFailed() {
 	require := s.Require()
 	repo := &localRepository{
-		ID:       kallax.NewULID(),
-		Endpoint: "foo",
-		Status:   model.Fetched,
+		ID:        kallax.NewULID(),
+		Endpoints: []string{"foo"},
+		Status:    model.Fetched,
 	}
 	s.store.repos[repo.ID] = repo
 	modelRepo := repo.toRepo()
@@ -124,9 +158,9 @@ func (s *LocalSuite) TestUpdateFailed() {
 func (s *LocalSuite) TestUpdateFetched() {
 	require := s.Require()
 	repo := &localRepository{
-		ID:       kallax.NewULID(),
-		Endpoint: "foo",
-		Status:   model.Pending,
+		ID:        kallax.NewULID(),
+		Endpoints: []string{"foo"},
+		Status:    model.Pending,
 	}
 	s.store.repos[repo.ID] = repo
 	modelRepo := repo.toRepo()
@@ -159,14 +193,14 @@ func (s *LocalSuite) TestGetByInitCommit() {
 
 	r1 := &localRepository{
 		ID:         kallax.NewULID(),
-		Endpoint:   "foo",
+		Endpoints:  []string{"foo"},
 		Status:     model.Pending,
 		References: localRefsFromInits(h0, h1),
 	}
 
 	r2 := &localRepository{
 		ID:         kallax.NewULID(),
-		Endpoint:   "bar",
+		Endpoints:  []string{"bar"},
 		Status:     model.Pending,
 		References: localRefsFromInits(h1, h2),
 	}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// Schedule holds the refresh schedule of a repository.
+type Schedule struct {
+	// RepositoryID is the ID of the scheduled repository.
+	RepositoryID kallax.ULID
+	// NextFetchAt is the time when the repository should be fetched again.
+	NextFetchAt time.Time
+	// ChangeRate is the moving average, between 0 and 1, of the fetches that
+	// found changes in the references of the repository.
+	ChangeRate float64
+	// Failures is the number of consecutive failed fetches.
+	Failures int
+	// Fetches is the number of fetches recorded.
+	Fetches int
+	// UpdatedAt is the last time the schedule was updated.
+	UpdatedAt time.Time
+}
+
+// GetSchedule returns the schedule of the repository with the given ID, or
+// nil if the repository has not been scheduled yet.
+func (s *DatabaseStore) GetSchedule(id kallax.ULID) (*Schedule, error) {
+	start := time.Now()
+
+	sch := &Schedule{RepositoryID: id}
+	err := s.db.QueryRow(
+		`SELECT next_fetch_at, change_rate, failures, fetches, updated_at
+		FROM repository_schedules WHERE repository_id = $1`, id,
+	).Scan(&sch.NextFetchAt, &sch.ChangeRate, &sch.Failures, &sch.Fetches, &sch.UpdatedAt)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"id":       id,
+	})
+
+	if err == sql.ErrNoRows {
+		logger.Debugf("repository not scheduled")
+		return nil, nil
+	}
+
+	if err != nil {
+		logger.Errorf(err, "could not get repository schedule")
+		return nil, err
+	}
+
+	logger.Debugf("get repository schedule finished")
+	return sch, nil
+}
+
+// SetSchedule creates or replaces the schedule of a repository.
+func (s *DatabaseStore) SetSchedule(sch *Schedule) error {
+	start := time.Now()
+
+	_, err := s.db.Exec(
+		`INSERT INTO repository_schedules
+		(repository_id, next_fetch_at, change_rate, failures, fetches, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (repository_id) DO UPDATE SET
+			next_fetch_at = EXCLUDED.next_fetch_at,
+			change_rate = EXCLUDED.change_rate,
+			failures = EXCLUDED.failures,
+			fetches = EXCLUDED.fetches,
+			updated_at = EXCLUDED.updated_at`,
+		sch.RepositoryID, sch.NextFetchAt, sch.ChangeRate,
+		sch.Failures, sch.Fetches, sch.UpdatedAt,
+	)
+
+	logger := log.With(log.Fields{
+		"duration":      time.Since(start),
+		"id":            sch.RepositoryID,
+		"next-fetch-at": sch.NextFetchAt,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not set repository schedule")
+		return err
+	}
+
+	logger.Debugf("set repository schedule finished")
+	return nil
+}
+
+// GetUnscheduled returns up to limit repositories in Fetched, NotFound or
+// AuthRequired status that have not been scheduled yet.
+func (s *DatabaseStore) GetUnscheduled(limit uint64) ([]*model.Repository, error) {
+	start := time.Now()
+
+	repositories, err := s.findByQueryIDs(
+		`SELECT r.id FROM repositories r
+		WHERE r.status IN ($1, $2, $3) AND NOT EXISTS (
+			SELECT 1 FROM repository_schedules s WHERE s.repository_id = r.id
+		)
+		LIMIT $4`,
+		model.Fetched, model.NotFound, model.AuthRequired, limit,
+	)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"limit":    limit,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get unscheduled repositories")
+		return nil, err
+	}
+
+	logger.Debugf("get unscheduled repositories finished")
+	return repositories, nil
+}
+
+// GetDue returns up to limit repositories in Fetched, NotFound or
+// AuthRequired status, or in Pending status with failures recorded in their
+// schedule, whose next fetch is scheduled at or before the given time, the
+// earliest first.
+func (s *DatabaseStore) GetDue(now time.Time, limit uint64) ([]*model.Repository, error) {
+	start := time.Now()
+
+	repositories, err := s.findByQueryIDs(
+		`SELECT r.id FROM repositories r
+		INNER JOIN repository_schedules s ON s.repository_id = r.id
+		WHERE (r.status IN ($1, $2, $3) OR (r.status = $4 AND s.failures > 0))
+		AND s.next_fetch_at <= $5
+		ORDER BY s.next_fetch_at ASC
+		LIMIT $6`,
+		model.Fetched, model.NotFound, model.AuthRequired, model.Pending, now, limit,
+	)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"now":      now,
+		"limit":    limit,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get due repositories")
+		return nil, err
+	}
+
+	logger.Debugf("get due repositories finished")
+	return repositories, nil
+}
+
+// findByQueryIDs returns the repositories, with their references, whose IDs
+// are returned by the given query, in the same order.
+func (s *DatabaseStore) findByQueryIDs(
+	query string,
+	args ...interface{},
+) ([]*model.Repository, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []kallax.ULID
+	for rows.Next() {
+		var id kallax.ULID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	rs, err := s.Find(
+		model.NewRepositoryQuery().
+			WithReferences(nil).
+			FindByID(ids...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := rs.All()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[kallax.ULID]*model.Repository, len(found))
+	for _, r := range found {
+		byID[r.ID] = r
+	}
+
+	repositories := make([]*model.Repository, 0, len(ids))
+	for _, id := range ids {
+		if r, ok := byID[id]; ok {
+			repositories = append(repositories, r)
+		}
+	}
+
+	return repositories, nil
+}
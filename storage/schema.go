@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// schemaSQL holds the tables used by borges on top of the core-retrieval
+// schema.
+const schemaSQL = `
+CREATE TABLE IF NOT EXISTS repository_schedules (
+	repository_id uuid PRIMARY KEY REFERENCES repositories(id) ON DELETE CASCADE,
+	next_fetch_at timestamptz NOT NULL,
+	change_rate double precision NOT NULL,
+	failures integer NOT NULL,
+	fetches integer NOT NULL,
+	updated_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_repository_schedules_next_fetch_at ON "repository_schedules" ("next_fetch_at");
+
+CREATE TABLE IF NOT EXISTS repository_takedowns (
+	id uuid PRIMARY KEY,
+	repository_id uuid NOT NULL,
+	endpoints text[] NOT NULL,
+	inits text[] NOT NULL,
+	"references" integer NOT NULL,
+	reason text NOT NULL,
+	created_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_repository_takedowns_endpoints ON "repository_takedowns" USING GIN ("endpoints");
+
+CREATE TABLE IF NOT EXISTS repository_blocklist (
+	id uuid PRIMARY KEY,
+	kind varchar(20) NOT NULL,
+	value text NOT NULL,
+	reason text NOT NULL,
+	created_at timestamptz NOT NULL,
+	UNIQUE (kind, value)
+);
+
+CREATE TABLE IF NOT EXISTS repository_groups (
+	label text PRIMARY KEY,
+	main_repository uuid NOT NULL,
+	repositories uuid[] NOT NULL,
+	updated_at timestamptz NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS repository_tiers (
+	init text PRIMARY KEY,
+	tier varchar(10) NOT NULL,
+	written_at timestamptz NOT NULL,
+	updated_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_repository_tiers_written_at ON "repository_tiers" ("tier", "written_at");
+
+CREATE TABLE IF NOT EXISTS repository_leases (
+	id text PRIMARY KEY,
+	owner text NOT NULL,
+	expires_at timestamptz NOT NULL
+);
+`
+
+// CreateSchema creates the borges tables in the given database. The
+// core-retrieval schema must be created before.
+func CreateSchema(db *sql.DB) error {
+	if _, err := db.Exec(schemaSQL); err != nil {
+		return fmt.Errorf("unable to create borges database schema: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,932 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// sqliteSchemaSQL holds the tables of the core-retrieval schema and the
+// borges ones for SQLite. Endpoints are kept in their own table, as SQLite has
+// no arrays, and the roots of the references are kept as text arrays.
+const sqliteSchemaSQL = `
+CREATE TABLE IF NOT EXISTS repositories (
+	id text PRIMARY KEY,
+	created_at timestamp,
+	updated_at timestamp,
+	status varchar(20),
+	fetched_at timestamp,
+	fetch_error_at timestamp,
+	last_commit_at timestamp,
+	is_fork boolean
+);
+
+CREATE INDEX IF NOT EXISTS idx_repositories_status ON "repositories" ("status");
+
+CREATE TABLE IF NOT EXISTS repository_endpoints (
+	repository_id text NOT NULL REFERENCES repositories(id) ON DELETE CASCADE,
+	position integer NOT NULL,
+	endpoint text NOT NULL,
+	PRIMARY KEY (repository_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS idx_repository_endpoints_endpoint ON "repository_endpoints" ("endpoint");
+
+CREATE TABLE IF NOT EXISTS repository_references (
+	id text PRIMARY KEY,
+	created_at timestamp,
+	updated_at timestamp,
+	name text,
+	repository_id text REFERENCES repositories(id) ON DELETE CASCADE,
+	hash text,
+	init text,
+	roots text,
+	reference_time timestamp
+);
+
+CREATE INDEX IF NOT EXISTS idx_references_repository_id ON "repository_references" ("repository_id");
+CREATE INDEX IF NOT EXISTS idx_references_init ON "repository_references" ("init");
+
+CREATE TABLE IF NOT EXISTS repository_schedules (
+	repository_id text PRIMARY KEY REFERENCES repositories(id) ON DELETE CASCADE,
+	next_fetch_at timestamp NOT NULL,
+	change_rate double precision NOT NULL,
+	failures integer NOT NULL,
+	fetches integer NOT NULL,
+	updated_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_repository_schedules_next_fetch_at ON "repository_schedules" ("next_fetch_at");
+
+CREATE TABLE IF NOT EXISTS repository_blocklist (
+	id text PRIMARY KEY,
+	kind varchar(20) NOT NULL,
+	value text NOT NULL,
+	reason text NOT NULL,
+	created_at timestamp NOT NULL,
+	UNIQUE (kind, value)
+);
+
+CREATE TABLE IF NOT EXISTS repository_tiers (
+	init text PRIMARY KEY,
+	tier varchar(10) NOT NULL,
+	written_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_repository_tiers_written_at ON "repository_tiers" ("tier", "written_at");
+
+CREATE TABLE IF NOT EXISTS repository_leases (
+	id text PRIMARY KEY,
+	owner text NOT NULL,
+	expires_at timestamp NOT NULL
+);
+`
+
+// sqliteOptions are the connection options of the SQLite databases. LIKE is
+// made case sensitive to behave as in PostgreSQL.
+const sqliteOptions = "_foreign_keys=1&_busy_timeout=10000&_cslike=1&_journal_mode=WAL"
+
+var sqliteDialect = &dialect{
+	placeholder: "?%d",
+	endpointLike: "EXISTS (SELECT 1 FROM repository_endpoints AS e " +
+		"WHERE e.repository_id = repositories.id AND e.endpoint LIKE %s)",
+}
+
+const (
+	repositoryColumns = `id, created_at, updated_at, status, fetched_at,
+		fetch_error_at, last_commit_at, is_fork`
+	referenceColumns = `id, created_at, updated_at, name, repository_id, hash,
+		init, roots, reference_time`
+)
+
+// ErrSQLiteNotSupported is returned when a SQLite database is opened by a
+// binary built without the sqlite tag.
+var ErrSQLiteNotSupported = errors.NewKind("SQLite databases are not supported by this binary, build it with cgo and the sqlite tag")
+
+// OpenSQLite opens the SQLite database in the given path, which is created if
+// it does not exist. The database only uses one connection, as SQLite does
+// not allow concurrent writes. The SQLite driver is only included when borges
+// is built with cgo and the sqlite tag, otherwise ErrSQLiteNotSupported is
+// returned.
+func OpenSQLite(path string) (*sql.DB, error) {
+	if !sqliteSupported() {
+		return nil, ErrSQLiteNotSupported.New()
+	}
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?%s", path, sqliteOptions))
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func sqliteSupported() bool {
+	for _, d := range sql.Drivers() {
+		if d == "sqlite3" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CreateSQLiteSchema creates all the tables used by borges in the given
+// SQLite database.
+func CreateSQLiteSchema(db *sql.DB) error {
+	if _, err := db.Exec(sqliteSchemaSQL); err != nil {
+		return fmt.Errorf("unable to create borges sqlite schema: %s", err)
+	}
+
+	return nil
+}
+
+// SQLiteStore implements a borges.RepositoryStore based on a SQLite database
+// with the same semantics as DatabaseStore.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// FromSQLite returns a new repository store that interacts with a SQLite
+// database opened with OpenSQLite to store all the data.
+func FromSQLite(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db}
+}
+
+// Create honors the borges.RepositoryStore interface.
+func (s *SQLiteStore) Create(repo *model.Repository) error {
+	start := time.Now()
+
+	now := time.Now()
+	if repo.CreatedAt.IsZero() {
+		repo.CreatedAt = now
+	}
+	repo.UpdatedAt = now
+
+	err := s.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`INSERT INTO repositories (`+repositoryColumns+`)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`,
+			repo.ID, repo.CreatedAt.UTC(), repo.UpdatedAt.UTC(), repo.Status,
+			utc(repo.FetchedAt), utc(repo.FetchErrorAt), utc(repo.LastCommitAt),
+			repo.IsFork,
+		)
+		if err != nil {
+			return err
+		}
+
+		if err := insertEndpoints(tx, repo); err != nil {
+			return err
+		}
+
+		return insertReferences(tx, repo)
+	})
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"endpoint": repo.Endpoints,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not create repository")
+		return err
+	}
+
+	logger.Debugf("create repository finished")
+	return nil
+}
+
+// Get honors the borges.RepositoryStore interface.
+func (s *SQLiteStore) Get(id kallax.ULID) (*model.Repository, error) {
+	start := time.Now()
+
+	r, err := s.load(id, true)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"id":       id,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get repository")
+		return nil, err
+	}
+
+	logger.Debugf("get repository finished")
+	return r, nil
+}
+
+// GetByEndpoints honors the borges.RepositoryStore interface.
+func (s *SQLiteStore) GetByEndpoints(
+	endpoints ...string,
+) ([]*model.Repository, error) {
+	start := time.Now()
+
+	var repositories []*model.Repository
+	var err error
+	if len(endpoints) > 0 {
+		params := make([]string, len(endpoints))
+		args := make([]interface{}, len(endpoints))
+		for i, ep := range endpoints {
+			params[i] = sqliteDialect.param(i + 1)
+			args[i] = ep
+		}
+
+		repositories, err = s.findByQueryIDs(
+			`SELECT DISTINCT repository_id FROM repository_endpoints
+			WHERE endpoint IN (`+strings.Join(params, ", ")+`)
+			ORDER BY repository_id ASC`,
+			args...,
+		)
+	}
+
+	logger := log.With(log.Fields{
+		"duration":  time.Since(start),
+		"endpoints": endpoints,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get repository by endpoints")
+		return nil, err
+	}
+
+	logger.Debugf("get repository by endpoints finished")
+	return repositories, nil
+}
+
+// GetByStatus returns all the repositories with the given status.
+func (s *SQLiteStore) GetByStatus(
+	status model.FetchStatus,
+) ([]*model.Repository, error) {
+	start := time.Now()
+
+	repositories, err := s.findByQueryIDs(
+		`SELECT id FROM repositories WHERE status = ?1 ORDER BY id ASC`, status,
+	)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"status":   status,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get repositories by status")
+		return nil, err
+	}
+
+	logger.Debugf("get repositories by status finished")
+	return repositories, nil
+}
+
+// GetFetchedBefore returns up to limit repositories in Fetched status that
+// were last fetched before the given time, the least recently fetched first.
+func (s *SQLiteStore) GetFetchedBefore(
+	before time.Time,
+	limit uint64,
+) ([]*model.Repository, error) {
+	start := time.Now()
+
+	repositories, err := s.findByQueryIDs(
+		`SELECT id FROM repositories
+		WHERE status = ?1 AND fetched_at < ?2
+		ORDER BY fetched_at ASC
+		LIMIT ?3`,
+		model.Fetched, before.UTC(), int64(limit),
+	)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"before":   before,
+		"limit":    limit,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get repositories fetched before")
+		return nil, err
+	}
+
+	logger.Debugf("get repositories fetched before finished")
+	return repositories, nil
+}
+
+// GetRefsByInit honors the borges.RepositoryStore interface.
+func (s *SQLiteStore) GetRefsByInit(
+	init model.SHA1,
+) ([]*model.Reference, error) {
+	start := time.Now()
+
+	refs, err := s.getRefsByInit(init)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"init":     init,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get repository by init")
+		return nil, err
+	}
+
+	logger.Debugf("get repository by init finished")
+	return refs, nil
+}
+
+func (s *SQLiteStore) getRefsByInit(init model.SHA1) ([]*model.Reference, error) {
+	refs, ids, err := s.queryReferences(
+		`SELECT `+referenceColumns+` FROM repository_references
+		WHERE init = ?1 ORDER BY rowid ASC`, init,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	repositories := make(map[kallax.ULID]*model.Repository)
+	for i, ref := range refs {
+		repo, ok := repositories[ids[i]]
+		if !ok {
+			repo, err = s.load(ids[i], false)
+			if err != nil {
+				return nil, err
+			}
+
+			repositories[ids[i]] = repo
+		}
+
+		ref.Repository = repo
+	}
+
+	return refs, nil
+}
+
+// InitHasRefs honors the borges.RepositoryStore interface.
+func (s *SQLiteStore) InitHasRefs(
+	init model.SHA1,
+) (bool, error) {
+	start := time.Now()
+
+	var ok bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM repository_references WHERE init = ?1)`,
+		init,
+	).Scan(&ok)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"init":     init,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could check if init has references")
+		return false, err
+	}
+
+	logger.Debugf("init has refs finished")
+	return ok, nil
+}
+
+// SetStatus honors the borges.RepositoryStore interface.
+func (s *SQLiteStore) SetStatus(repo *model.Repository, status model.FetchStatus) error {
+	repo.Status = status
+	return s.updateWithRefsChanged(repo, "status")
+}
+
+// SetEndpoints honors the borges.RepositoryStore interface.
+func (s *SQLiteStore) SetEndpoints(repo *model.Repository, endpoints ...string) error {
+	repo.Endpoints = endpoints
+	return s.updateWithRefsChanged(repo, "endpoints")
+}
+
+// UpdateFailed honors the borges.RepositoryStore interface.
+func (s *SQLiteStore) UpdateFailed(repo *model.Repository, status model.FetchStatus) error {
+	repo.Status = status
+	return s.updateWithRefsChanged(repo,
+		"updated_at",
+		"fetch_error_at",
+		"status",
+	)
+}
+
+// UpdateFetched honors the borges.RepositoryStore interface.
+func (s *SQLiteStore) UpdateFetched(repo *model.Repository, fetchedAt time.Time) error {
+	repo.Status = model.Fetched
+	repo.FetchedAt = &fetchedAt
+	repo.LastCommitAt = lastCommitTime(repo.References)
+
+	return s.updateWithRefsChanged(repo,
+		"updated_at",
+		"fetched_at",
+		"last_commit_at",
+		"status",
+	)
+}
+
+// updateWithRefsChanged replaces the references of the repository and updates
+// the given columns in a transaction. The endpoints are updated if the
+// endpoints column is given.
+func (s *SQLiteStore) updateWithRefsChanged(
+	repo *model.Repository,
+	columns ...string,
+) error {
+	start := time.Now()
+
+	repo.UpdatedAt = time.Now()
+
+	var sets []string
+	var args []interface{}
+	var endpoints bool
+	for _, c := range columns {
+		if c == "endpoints" {
+			endpoints = true
+			continue
+		}
+
+		args = append(args, repositoryValue(repo, c))
+		sets = append(sets, fmt.Sprintf("%s = %s", c, sqliteDialect.param(len(args))))
+	}
+
+	err := s.transaction(func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM repositories WHERE id = ?1)`, repo.ID,
+		).Scan(&exists)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return kallax.ErrNotFound
+		}
+
+		if len(sets) > 0 {
+			args = append(args, repo.ID)
+			_, err := tx.Exec(fmt.Sprintf(
+				"UPDATE repositories SET %s WHERE id = %s",
+				strings.Join(sets, ", "), sqliteDialect.param(len(args)),
+			), args...)
+			if err != nil {
+				return err
+			}
+		}
+
+		if endpoints {
+			_, err := tx.Exec(
+				`DELETE FROM repository_endpoints WHERE repository_id = ?1`,
+				repo.ID,
+			)
+			if err != nil {
+				return err
+			}
+
+			if err := insertEndpoints(tx, repo); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(
+			`DELETE FROM repository_references WHERE repository_id = ?1`,
+			repo.ID,
+		)
+		if err != nil {
+			return err
+		}
+
+		return insertReferences(tx, repo)
+	})
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"id":       repo.ID,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not update with references")
+		return err
+	}
+
+	logger.Debugf("update with references finished")
+	return nil
+}
+
+// GetSchedule returns the schedule of the repository with the given ID, or
+// nil if the repository has not been scheduled yet.
+func (s *SQLiteStore) GetSchedule(id kallax.ULID) (*Schedule, error) {
+	start := time.Now()
+
+	sch := &Schedule{RepositoryID: id}
+	err := s.db.QueryRow(
+		`SELECT next_fetch_at, change_rate, failures, fetches, updated_at
+		FROM repository_schedules WHERE repository_id = ?1`, id,
+	).Scan(&sch.NextFetchAt, &sch.ChangeRate, &sch.Failures, &sch.Fetches, &sch.UpdatedAt)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"id":       id,
+	})
+
+	if err == sql.ErrNoRows {
+		logger.Debugf("repository not scheduled")
+		return nil, nil
+	}
+
+	if err != nil {
+		logger.Errorf(err, "could not get repository schedule")
+		return nil, err
+	}
+
+	logger.Debugf("get repository schedule finished")
+	return sch, nil
+}
+
+// SetSchedule creates or replaces the schedule of a repository.
+func (s *SQLiteStore) SetSchedule(sch *Schedule) error {
+	start := time.Now()
+
+	_, err := s.db.Exec(
+		`INSERT INTO repository_schedules
+		(repository_id, next_fetch_at, change_rate, failures, fetches, updated_at)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6)
+		ON CONFLICT (repository_id) DO UPDATE SET
+			next_fetch_at = excluded.next_fetch_at,
+			change_rate = excluded.change_rate,
+			failures = excluded.failures,
+			fetches = excluded.fetches,
+			updated_at = excluded.updated_at`,
+		sch.RepositoryID, sch.NextFetchAt.UTC(), sch.ChangeRate,
+		sch.Failures, sch.Fetches, sch.UpdatedAt.UTC(),
+	)
+
+	logger := log.With(log.Fields{
+		"duration":      time.Since(start),
+		"id":            sch.RepositoryID,
+		"next-fetch-at": sch.NextFetchAt,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not set repository schedule")
+		return err
+	}
+
+	logger.Debugf("set repository schedule finished")
+	return nil
+}
+
+// GetUnscheduled returns up to limit repositories in Fetched, NotFound or
+// AuthRequired status that have not been scheduled yet.
+func (s *SQLiteStore) GetUnscheduled(limit uint64) ([]*model.Repository, error) {
+	start := time.Now()
+
+	repositories, err := s.findByQueryIDs(
+		`SELECT r.id FROM repositories r
+		WHERE r.status IN (?1, ?2, ?3) AND NOT EXISTS (
+			SELECT 1 FROM repository_schedules s WHERE s.repository_id = r.id
+		)
+		LIMIT ?4`,
+		model.Fetched, model.NotFound, model.AuthRequired, int64(limit),
+	)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"limit":    limit,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get unscheduled repositories")
+		return nil, err
+	}
+
+	logger.Debugf("get unscheduled repositories finished")
+	return repositories, nil
+}
+
+// GetDue returns up to limit repositories in Fetched, NotFound or
+// AuthRequired status, or in Pending status with failures recorded in their
+// schedule, whose next fetch is scheduled at or before the given time, the
+// earliest first.
+func (s *SQLiteStore) GetDue(now time.Time, limit uint64) ([]*model.Repository, error) {
+	start := time.Now()
+
+	repositories, err := s.findByQueryIDs(
+		`SELECT r.id FROM repositories r
+		INNER JOIN repository_schedules s ON s.repository_id = r.id
+		WHERE (r.status IN (?1, ?2, ?3) OR (r.status = ?4 AND s.failures > 0))
+		AND s.next_fetch_at <= ?5
+		ORDER BY s.next_fetch_at ASC
+		LIMIT ?6`,
+		model.Fetched, model.NotFound, model.AuthRequired, model.Pending, now.UTC(), int64(limit),
+	)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"now":      now,
+		"limit":    limit,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get due repositories")
+		return nil, err
+	}
+
+	logger.Debugf("get due repositories finished")
+	return repositories, nil
+}
+
+// CountByFilter returns the number of repositories selected by the filter.
+func (s *SQLiteStore) CountByFilter(f *RepositoryFilter) (int, error) {
+	start := time.Now()
+
+	where, args := f.where(sqliteDialect, nil)
+
+	var count int
+	err := s.db.QueryRow(
+		"SELECT COUNT(*) FROM repositories WHERE "+where, args...,
+	).Scan(&count)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"filter":   where,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not count repositories by filter")
+		return 0, err
+	}
+
+	logger.Debugf("count repositories by filter finished")
+	return count, nil
+}
+
+// GetByFilter returns up to limit repositories selected by the filter with an
+// ID greater than after, ordered by ID. The zero ULID can be used to get the
+// first page.
+func (s *SQLiteStore) GetByFilter(
+	f *RepositoryFilter,
+	after kallax.ULID,
+	limit uint64,
+) ([]*model.Repository, error) {
+	start := time.Now()
+
+	where, args := f.where(sqliteDialect, []interface{}{after, int64(limit)})
+	repositories, err := s.findByQueryIDs(
+		"SELECT id FROM repositories WHERE id > ?1 AND "+where+
+			" ORDER BY id ASC LIMIT ?2",
+		args...,
+	)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"filter":   where,
+		"limit":    limit,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not get repositories by filter")
+		return nil, err
+	}
+
+	logger.Debugf("get repositories by filter finished")
+	return repositories, nil
+}
+
+// findByQueryIDs returns the repositories, with their references, whose IDs
+// are returned by the given query, in the same order.
+func (s *SQLiteStore) findByQueryIDs(
+	query string,
+	args ...interface{},
+) ([]*model.Repository, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []kallax.ULID
+	for rows.Next() {
+		var id kallax.ULID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	var repositories []*model.Repository
+	for _, id := range ids {
+		r, err := s.load(id, true)
+		if err == kallax.ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		repositories = append(repositories, r)
+	}
+
+	return repositories, nil
+}
+
+// load returns the repository with the given ID and its endpoints, and its
+// references if withRefs is true.
+func (s *SQLiteStore) load(id kallax.ULID, withRefs bool) (*model.Repository, error) {
+	repo := &model.Repository{}
+	err := s.db.QueryRow(
+		`SELECT `+repositoryColumns+` FROM repositories WHERE id = ?1`, id,
+	).Scan(
+		&repo.ID, &repo.CreatedAt, &repo.UpdatedAt, &repo.Status,
+		&repo.FetchedAt, &repo.FetchErrorAt, &repo.LastCommitAt, &repo.IsFork,
+	)
+	if err == sql.ErrNoRows {
+		return nil, kallax.ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(
+		`SELECT endpoint FROM repository_endpoints
+		WHERE repository_id = ?1 ORDER BY position ASC`, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var ep string
+		if err := rows.Scan(&ep); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		repo.Endpoints = append(repo.Endpoints, ep)
+	}
+
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	if !withRefs {
+		return repo, nil
+	}
+
+	repo.References, _, err = s.queryReferences(
+		`SELECT `+referenceColumns+` FROM repository_references
+		WHERE repository_id = ?1 ORDER BY rowid ASC`, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range repo.References {
+		ref.Repository = repo
+	}
+
+	return repo, nil
+}
+
+// queryReferences returns the references returned by the given query, which
+// must select the referenceColumns, and the IDs of their repositories.
+func (s *SQLiteStore) queryReferences(
+	query string,
+	args ...interface{},
+) ([]*model.Reference, []kallax.ULID, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var refs []*model.Reference
+	var ids []kallax.ULID
+	for rows.Next() {
+		var ref model.Reference
+		var id kallax.ULID
+		err := rows.Scan(
+			&ref.ID, &ref.CreatedAt, &ref.UpdatedAt, &ref.Name, &id,
+			&ref.Hash, &ref.Init, &ref.Roots, &ref.Time,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		refs = append(refs, &ref)
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return refs, ids, nil
+}
+
+func (s *SQLiteStore) transaction(fn func(*sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertEndpoints(tx *sql.Tx, repo *model.Repository) error {
+	for i, ep := range repo.Endpoints {
+		_, err := tx.Exec(
+			`INSERT INTO repository_endpoints (repository_id, position, endpoint)
+			VALUES (?1, ?2, ?3)`,
+			repo.ID, i, ep,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func insertReferences(tx *sql.Tx, repo *model.Repository) error {
+	now := time.Now()
+	for _, ref := range repo.References {
+		if ref.ID.IsEmpty() {
+			ref.ID = kallax.NewULID()
+		}
+
+		if ref.CreatedAt.IsZero() {
+			ref.CreatedAt = now
+		}
+		ref.UpdatedAt = now
+
+		_, err := tx.Exec(
+			`INSERT INTO repository_references (`+referenceColumns+`)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)`,
+			ref.ID, ref.CreatedAt.UTC(), ref.UpdatedAt.UTC(), ref.Name, repo.ID,
+			ref.Hash, ref.Init, ref.Roots, ref.Time.UTC(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// repositoryValue returns the value of the given column of the repository.
+func repositoryValue(repo *model.Repository, column string) interface{} {
+	switch column {
+	case "updated_at":
+		return repo.UpdatedAt.UTC()
+	case "status":
+		return repo.Status
+	case "fetched_at":
+		return utc(repo.FetchedAt)
+	case "fetch_error_at":
+		return utc(repo.FetchErrorAt)
+	case "last_commit_at":
+		return utc(repo.LastCommitAt)
+	default:
+		panic(fmt.Sprintf("unknown repository column %q", column))
+	}
+}
+
+// utc returns the given time in UTC, or nil if there is no time. SQLite
+// stores times as text, so they must be in the same location to be compared.
+func utc(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+
+	return t.UTC()
+}
@@ -0,0 +1,5 @@
+// +build sqlite
+
+package storage
+
+import _ "github.com/mattn/go-sqlite3" // load sqlite driver
@@ -0,0 +1,74 @@
+// +build sqlite
+
+package storage
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+)
+
+type SQLiteSuite struct {
+	StoreSuite
+	dir string
+	db  *sql.DB
+}
+
+func (s *SQLiteSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "borges-sqlite")
+	s.Require().NoError(err)
+
+	s.db, err = OpenSQLite(filepath.Join(s.dir, "borges.db"))
+	s.Require().NoError(err)
+	s.Require().NoError(CreateSQLiteSchema(s.db))
+	s.store = FromSQLite(s.db)
+}
+
+func (s *SQLiteSuite) TearDownTest() {
+	s.NoError(s.db.Close())
+	s.NoError(os.RemoveAll(s.dir))
+}
+
+func (s *SQLiteSuite) TestReopen() {
+	require := s.Require()
+
+	repo := s.createFetchedRepo(withoutNs(model.NewRepository().CreatedAt), "foo")
+
+	require.NoError(s.db.Close())
+	var err error
+	s.db, err = OpenSQLite(filepath.Join(s.dir, "borges.db"))
+	require.NoError(err)
+	require.NoError(CreateSQLiteSchema(s.db))
+	s.store = FromSQLite(s.db)
+
+	obtained, err := s.store.Get(repo.ID)
+	require.NoError(err)
+	require.Equal(model.Fetched, obtained.Status)
+	require.True(repo.FetchedAt.Equal(*obtained.FetchedAt))
+	require.Len(obtained.References, 2)
+	require.Equal(repo.References[0].Hash, obtained.References[0].Hash)
+}
+
+func (s *SQLiteSuite) TestEndpointPatternIsCaseSensitive() {
+	require := s.Require()
+
+	s.createRepo(model.Pending, "git://github.com/foo/bar")
+
+	n, err := s.store.CountByFilter(&RepositoryFilter{EndpointPattern: "%GitHub%"})
+	require.NoError(err)
+	require.Equal(0, n)
+
+	n, err = s.store.CountByFilter(&RepositoryFilter{EndpointPattern: "%github%"})
+	require.NoError(err)
+	require.Equal(1, n)
+}
+
+func TestSQLite(t *testing.T) {
+	suite.Run(t, new(SQLiteSuite))
+}
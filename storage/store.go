@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/src-d/borges/lock"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+// Store is a repository store backed by a database, with all the queries
+// needed by borges. It is implemented by DatabaseStore and SQLiteStore.
+type Store interface {
+	// Create inserts a new repository in the store.
+	Create(repo *model.Repository) error
+	// Get returns the repository with the given ID.
+	Get(id kallax.ULID) (*model.Repository, error)
+	// GetByEndpoints returns the repositories with any of the given
+	// endpoints.
+	GetByEndpoints(endpoints ...string) ([]*model.Repository, error)
+	// GetByStatus returns all the repositories with the given status.
+	GetByStatus(status model.FetchStatus) ([]*model.Repository, error)
+	// GetFetchedBefore returns up to limit repositories in Fetched status
+	// that were last fetched before the given time.
+	GetFetchedBefore(before time.Time, limit uint64) ([]*model.Repository, error)
+	// GetRefsByInit returns the references with the given init commit.
+	GetRefsByInit(init model.SHA1) ([]*model.Reference, error)
+	// InitHasRefs returns true if there is at least one reference with the
+	// given init commit.
+	InitHasRefs(init model.SHA1) (bool, error)
+	// SetStatus changes the status of the given repository.
+	SetStatus(repo *model.Repository, status model.FetchStatus) error
+	// SetEndpoints updates the endpoints of the repository.
+	SetEndpoints(repo *model.Repository, endpoints ...string) error
+	// UpdateFailed updates the given repository as failed with the given
+	// status.
+	UpdateFailed(repo *model.Repository, status model.FetchStatus) error
+	// UpdateFetched updates the given repository as successfully fetched.
+	UpdateFetched(repo *model.Repository, fetchedAt time.Time) error
+	// GetSchedule returns the schedule of the repository with the given ID,
+	// or nil if it has not been scheduled yet.
+	GetSchedule(id kallax.ULID) (*Schedule, error)
+	// SetSchedule creates or replaces the schedule of a repository.
+	SetSchedule(sch *Schedule) error
+	// GetUnscheduled returns up to limit repositories that have not been
+	// scheduled yet.
+	GetUnscheduled(limit uint64) ([]*model.Repository, error)
+	// GetDue returns up to limit repositories whose next fetch is due.
+	GetDue(now time.Time, limit uint64) ([]*model.Repository, error)
+	// CountByFilter returns the number of repositories selected by the
+	// filter.
+	CountByFilter(f *RepositoryFilter) (int, error)
+	// GetByFilter returns up to limit repositories selected by the filter
+	// with an ID greater than after, ordered by ID.
+	GetByFilter(f *RepositoryFilter, after kallax.ULID, limit uint64) ([]*model.Repository, error)
+	// GetBlocklist returns all the rules of the blocklist.
+	GetBlocklist() ([]*BlockRule, error)
+	// AddBlockRule adds a rule to the blocklist.
+	AddBlockRule(r *BlockRule) error
+	// RemoveBlockRule removes the rule with the given ID from the
+	// blocklist.
+	RemoveBlockRule(id kallax.ULID) error
+	// GetTier returns the tier of the siva file of the given rooted
+	// repository, or nil if it has not been recorded.
+	GetTier(init model.SHA1) (*SivaTier, error)
+	// SetTier creates or replaces the tier of the siva file of a rooted
+	// repository.
+	SetTier(t *SivaTier) error
+	// LeaseService returns a locking service whose locks are kept in the
+	// database, shared by all the processes using it.
+	LeaseService() lock.Service
+}
@@ -0,0 +1,620 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/src-d/borges/lock"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-kallax.v1"
+)
+
+// StoreSuite tests the behaviour shared by all the Store implementations.
+// The suites embedding it must set the store before each test.
+type StoreSuite struct {
+	suite.Suite
+	store Store
+}
+
+func (s *StoreSuite) TestGet() {
+	require := s.Require()
+
+	expected := s.createRepo(model.Pending, "foo")
+	repo, err := s.store.Get(expected.ID)
+	require.NoError(err)
+	require.Equal(expected.ID, repo.ID)
+	require.Equal(expected.Endpoints, repo.Endpoints)
+	require.Equal(expected.Status, repo.Status)
+
+	_, err = s.store.Get(kallax.NewULID())
+	require.Equal(kallax.ErrNotFound, err)
+}
+
+func (s *StoreSuite) TestGetByEndpoints() {
+	require := s.Require()
+
+	repos := []*model.Repository{
+		s.createRepo(model.Pending, "foo"),
+		s.createRepo(model.Pending, "bar"),
+		s.createRepo(model.Pending, "baz", "bar"),
+		s.createRepo(model.Pending, "baz"),
+	}
+
+	result, err := s.store.GetByEndpoints("bar", "baz")
+	require.Len(result, 3)
+	require.NoError(err)
+
+	expected := []kallax.ULID{
+		repos[1].ID,
+		repos[2].ID,
+		repos[3].ID,
+	}
+
+	got := []kallax.ULID{
+		result[0].ID,
+		result[1].ID,
+		result[2].ID,
+	}
+
+	require.ElementsMatch(expected, got)
+
+	result, err = s.store.GetByEndpoints("notfound")
+	require.Len(result, 0)
+	require.NoError(err)
+}
+
+func (s *StoreSuite) TestGetByStatus() {
+	require := s.Require()
+
+	repos := []*model.Repository{
+		s.createRepo(model.Fetching, "foo"),
+		s.createRepo(model.Pending, "bar"),
+		s.createRepo(model.Fetching, "baz"),
+	}
+
+	result, err := s.store.GetByStatus(model.Fetching)
+	require.NoError(err)
+	require.Len(result, 2)
+	require.ElementsMatch(
+		[]kallax.ULID{repos[0].ID, repos[2].ID},
+		[]kallax.ULID{result[0].ID, result[1].ID},
+	)
+
+	result, err = s.store.GetByStatus(model.NotFound)
+	require.NoError(err)
+	require.Len(result, 0)
+}
+
+func (s *StoreSuite) TestGetFetchedBefore() {
+	require := s.Require()
+
+	now := time.Now()
+	repos := []*model.Repository{
+		s.createFetchedRepo(now.Add(-2*time.Hour), "foo"),
+		s.createFetchedRepo(now.Add(-3*time.Hour), "bar"),
+		s.createFetchedRepo(now, "baz"),
+		s.createRepo(model.Pending, "qux"),
+	}
+
+	result, err := s.store.GetFetchedBefore(now.Add(-time.Hour), 10)
+	require.NoError(err)
+	require.Len(result, 2)
+	require.Equal(repos[1].ID, result[0].ID)
+	require.Equal(repos[0].ID, result[1].ID)
+	require.Len(result[0].References, 2)
+
+	result, err = s.store.GetFetchedBefore(now.Add(-time.Hour), 1)
+	require.NoError(err)
+	require.Len(result, 1)
+	require.Equal(repos[1].ID, result[0].ID)
+}
+
+func (s *StoreSuite) TestSchedule() {
+	require := s.Require()
+	repo := s.createRepo(model.Fetched, "foo")
+
+	sch, err := s.store.GetSchedule(repo.ID)
+	require.NoError(err)
+	require.Nil(sch)
+
+	now := withoutNs(time.Now())
+	expected := &Schedule{
+		RepositoryID: repo.ID,
+		NextFetchAt:  now.Add(time.Hour),
+		ChangeRate:   0.5,
+		Fetches:      1,
+		UpdatedAt:    now,
+	}
+	require.NoError(s.store.SetSchedule(expected))
+
+	sch, err = s.store.GetSchedule(repo.ID)
+	require.NoError(err)
+	require.True(expected.NextFetchAt.Equal(sch.NextFetchAt))
+	require.Equal(0.5, sch.ChangeRate)
+	require.Equal(0, sch.Failures)
+	require.Equal(1, sch.Fetches)
+
+	expected.Failures = 2
+	expected.NextFetchAt = now.Add(2 * time.Hour)
+	require.NoError(s.store.SetSchedule(expected))
+
+	sch, err = s.store.GetSchedule(repo.ID)
+	require.NoError(err)
+	require.True(expected.NextFetchAt.Equal(sch.NextFetchAt))
+	require.Equal(2, sch.Failures)
+}
+
+func (s *StoreSuite) TestGetUnscheduled() {
+	require := s.Require()
+
+	repos := []*model.Repository{
+		s.createRepo(model.Fetched, "foo"),
+		s.createRepo(model.NotFound, "bar"),
+		s.createRepo(model.Pending, "baz"),
+		s.createRepo(model.Fetched, "qux"),
+	}
+
+	require.NoError(s.store.SetSchedule(&Schedule{
+		RepositoryID: repos[3].ID,
+		NextFetchAt:  time.Now(),
+		UpdatedAt:    time.Now(),
+	}))
+
+	result, err := s.store.GetUnscheduled(10)
+	require.NoError(err)
+	require.Len(result, 2)
+	require.ElementsMatch(
+		[]kallax.ULID{repos[0].ID, repos[1].ID},
+		[]kallax.ULID{result[0].ID, result[1].ID},
+	)
+	require.Len(result[0].References, 2)
+
+	result, err = s.store.GetUnscheduled(1)
+	require.NoError(err)
+	require.Len(result, 1)
+}
+
+func (s *StoreSuite) TestGetDue() {
+	require := s.Require()
+
+	now := time.Now()
+	repos := []*model.Repository{
+		s.createRepo(model.Fetched, "foo"),
+		s.createRepo(model.Fetched, "bar"),
+		s.createRepo(model.Fetched, "baz"),
+		s.createRepo(model.Pending, "qux"),
+		s.createRepo(model.Fetched, "quux"),
+	}
+
+	nextFetches := []time.Time{
+		now.Add(-time.Hour),
+		now.Add(-2 * time.Hour),
+		now.Add(time.Hour),
+		now.Add(-time.Hour),
+	}
+
+	for i, next := range nextFetches {
+		require.NoError(s.store.SetSchedule(&Schedule{
+			RepositoryID: repos[i].ID,
+			NextFetchAt:  next,
+			UpdatedAt:    now,
+		}))
+	}
+
+	result, err := s.store.GetDue(now, 10)
+	require.NoError(err)
+	require.Len(result, 2)
+	require.Equal(repos[1].ID, result[0].ID)
+	require.Equal(repos[0].ID, result[1].ID)
+	require.Len(result[0].References, 2)
+
+	result, err = s.store.GetDue(now, 1)
+	require.NoError(err)
+	require.Len(result, 1)
+	require.Equal(repos[1].ID, result[0].ID)
+}
+
+func (s *StoreSuite) TestGetDueFailed() {
+	require := s.Require()
+
+	now := time.Now()
+	failed := s.createRepo(model.Pending, "foo")
+	queued := s.createRepo(model.Pending, "bar")
+	later := s.createRepo(model.Pending, "baz")
+
+	schedules := []*Schedule{
+		{RepositoryID: failed.ID, NextFetchAt: now.Add(-time.Hour), Failures: 1},
+		{RepositoryID: queued.ID, NextFetchAt: now.Add(-time.Hour)},
+		{RepositoryID: later.ID, NextFetchAt: now.Add(time.Hour), Failures: 2},
+	}
+
+	for _, sch := range schedules {
+		sch.UpdatedAt = now
+		require.NoError(s.store.SetSchedule(sch))
+	}
+
+	result, err := s.store.GetDue(now, 10)
+	require.NoError(err)
+	require.Len(result, 1)
+	require.Equal(failed.ID, result[0].ID)
+}
+
+func (s *StoreSuite) TestGetByFilter() {
+	require := s.Require()
+
+	now := time.Now()
+	repos := []*model.Repository{
+		s.createFetchedRepo(now.Add(-2*time.Hour), "git://github.com/foo/bar"),
+		s.createFetchedRepo(now.Add(-2*time.Hour), "git://gitlab.com/foo/bar"),
+		s.createFetchedRepo(now, "git://github.com/foo/baz"),
+		s.createRepo(model.Pending, "git://github.com/foo/qux"),
+		s.createFetchedRepo(now.Add(-3*time.Hour), "git://github.com/foo/quux"),
+	}
+
+	f := &RepositoryFilter{
+		Statuses:        []model.FetchStatus{model.Fetched},
+		EndpointPattern: "%github.com%",
+		FetchedBefore:   now.Add(-time.Hour),
+	}
+
+	n, err := s.store.CountByFilter(f)
+	require.NoError(err)
+	require.Equal(2, n)
+
+	expected := []kallax.ULID{repos[0].ID, repos[4].ID}
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i].String() < expected[j].String()
+	})
+
+	result, err := s.store.GetByFilter(f, kallax.ULID{}, 1)
+	require.NoError(err)
+	require.Len(result, 1)
+	require.Equal(expected[0], result[0].ID)
+	require.Len(result[0].References, 2)
+
+	result, err = s.store.GetByFilter(f, result[0].ID, 1)
+	require.NoError(err)
+	require.Len(result, 1)
+	require.Equal(expected[1], result[0].ID)
+
+	result, err = s.store.GetByFilter(f, result[0].ID, 1)
+	require.NoError(err)
+	require.Len(result, 0)
+
+	n, err = s.store.CountByFilter(&RepositoryFilter{})
+	require.NoError(err)
+	require.Equal(len(repos), n)
+}
+
+func (s *StoreSuite) TestSetStatus() {
+	require := s.Require()
+	repo := s.createRepo(model.Pending, "foo")
+
+	err := s.store.SetStatus(repo, model.Fetching)
+	require.NoError(err)
+	require.Equal(model.Fetching, repo.Status)
+
+	repo, err = s.store.Get(repo.ID)
+	require.NoError(err)
+	require.Equal(model.Fetching, repo.Status)
+}
+
+func (s *StoreSuite) TestSetEndpoints() {
+	require := s.Require()
+	repo := s.createRepo(model.Pending, "foo")
+
+	endpoints := []string{"bar", "baz"}
+	err := s.store.SetEndpoints(repo, endpoints...)
+	require.NoError(err)
+	require.Len(repo.Endpoints, 2)
+	require.Equal(endpoints, repo.Endpoints)
+
+	repo, err = s.store.Get(repo.ID)
+	require.NoError(err)
+	require.Equal(endpoints, repo.Endpoints)
+}
+
+func (s *StoreSuite) TestUpdateFailed() {
+	require := s.Require()
+	repo := s.createRepo(model.Fetching, "foo")
+
+	err := s.store.UpdateFailed(repo, model.Pending)
+	require.NoError(err)
+	require.Equal(model.Pending, repo.Status)
+
+	repo, err = s.store.Get(repo.ID)
+	require.NoError(err)
+	require.Equal(model.Pending, repo.Status)
+}
+
+func (s *StoreSuite) TestUpdateFetched() {
+	require := s.Require()
+	repo := s.createRepo(model.Fetching, "foo")
+	t := withoutNs(time.Now())
+
+	err := s.store.UpdateFetched(repo, t)
+	require.NoError(err)
+	require.Len(repo.Endpoints, 1)
+	require.Equal(&t, repo.FetchedAt)
+	require.Equal(model.Fetched, repo.Status)
+	require.NotNil(repo.LastCommitAt)
+	require.NotEqual(new(time.Time), repo.LastCommitAt)
+
+	repo, err = s.store.Get(repo.ID)
+	require.NoError(err)
+	require.Equal(model.Fetched, repo.Status)
+	require.NotNil(repo.LastCommitAt)
+	require.NotEqual(new(time.Time), repo.LastCommitAt)
+}
+
+func (s *StoreSuite) TestUpdateWithRefsChanged() {
+	require := s.Require()
+
+	repo := s.createRepo(model.Fetching, "foo")
+	repo.References[0].Name = "foo"
+	repo.References[1].Name = "bar"
+
+	newRef := model.NewReference()
+	newRef.Name = "baz"
+	repo.References = append(repo.References[1:], newRef)
+
+	require.NoError(s.store.SetStatus(repo, model.Fetched))
+
+	r, err := s.store.Get(repo.ID)
+	require.NoError(err)
+	require.Equal(model.Fetched, r.Status)
+
+	require.Len(r.References, 2)
+	refNames := []string{r.References[0].Name, r.References[1].Name}
+	sort.Strings(refNames)
+	require.Equal([]string{"bar", "baz"}, refNames)
+}
+
+func (s *StoreSuite) TestGetByInitCommit() {
+	require := s.Require()
+
+	h0 := model.NewSHA1("1000")
+	h1 := model.NewSHA1("1001")
+	h2 := model.NewSHA1("1002")
+	h3 := model.NewSHA1("1003")
+
+	r1 := s.createRepo(model.Fetching, "0,1")
+	refs := []*model.Reference{
+		model.NewReference(),
+		model.NewReference(),
+	}
+
+	refs[0].Init = h0
+	refs[1].Init = h1
+	r1.References = refs
+	require.NoError(s.store.SetStatus(r1, model.Fetching))
+
+	r2 := s.createRepo(model.Fetching, "1,2")
+	refs = []*model.Reference{
+		model.NewReference(),
+		model.NewReference(),
+	}
+
+	refs[0].Init = h1
+	refs[1].Init = h2
+	r2.References = refs
+	require.NoError(s.store.SetStatus(r2, model.Fetching))
+
+	// check h0, in r1
+
+	r, err := s.store.GetRefsByInit(h0)
+	require.NoError(err)
+	require.Len(r, 1)
+	require.Equal(r1.ID, r[0].Repository.ID)
+
+	ok, err := s.store.InitHasRefs(h0)
+	require.NoError(err)
+	require.True(ok)
+
+	// check h1, in r1 and r2
+
+	r, err = s.store.GetRefsByInit(h1)
+	require.NoError(err)
+	require.Len(r, 2)
+	require.Equal(r1.ID, r[0].Repository.ID)
+	require.Equal(r2.ID, r[1].Repository.ID)
+
+	ok, err = s.store.InitHasRefs(h1)
+	require.NoError(err)
+	require.True(ok)
+
+	// check h2, in r2
+
+	r, err = s.store.GetRefsByInit(h2)
+	require.NoError(err)
+	require.Len(r, 1)
+	require.Equal(r2.ID, r[0].Repository.ID)
+
+	ok, err = s.store.InitHasRefs(h2)
+	require.NoError(err)
+	require.True(ok)
+
+	// check h3
+
+	r, err = s.store.GetRefsByInit(h3)
+	require.NoError(err)
+	require.Len(r, 0)
+
+	ok, err = s.store.InitHasRefs(h3)
+	require.NoError(err)
+	require.False(ok)
+}
+
+func (s *StoreSuite) TestBlocklist() {
+	require := s.Require()
+
+	rules, err := s.store.GetBlocklist()
+	require.NoError(err)
+	require.Len(rules, 0)
+
+	host := &BlockRule{Kind: BlockHost, Value: "example.com", Reason: "spam"}
+	require.NoError(s.store.AddBlockRule(host))
+	require.False(host.ID.IsEmpty())
+
+	org := &BlockRule{Kind: BlockOrganization, Value: "github.com/foo", Reason: "legal"}
+	require.NoError(s.store.AddBlockRule(org))
+
+	require.Error(s.store.AddBlockRule(
+		&BlockRule{Kind: BlockHost, Value: "example.com", Reason: "again"}))
+
+	rules, err = s.store.GetBlocklist()
+	require.NoError(err)
+	require.Len(rules, 2)
+	if rules[0].ID != host.ID {
+		rules[0], rules[1] = rules[1], rules[0]
+	}
+
+	require.Equal(host.ID, rules[0].ID)
+	require.Equal(BlockHost, rules[0].Kind)
+	require.Equal("example.com", rules[0].Value)
+	require.Equal("spam", rules[0].Reason)
+	require.Equal(org.ID, rules[1].ID)
+
+	require.NoError(s.store.RemoveBlockRule(host.ID))
+	require.Equal(kallax.ErrNotFound, s.store.RemoveBlockRule(host.ID))
+
+	rules, err = s.store.GetBlocklist()
+	require.NoError(err)
+	require.Len(rules, 1)
+	require.Equal(org.ID, rules[0].ID)
+}
+
+func (s *StoreSuite) TestTiers() {
+	require := s.Require()
+
+	init := model.NewSHA1("1111111111111111111111111111111111111111")
+	t, err := s.store.GetTier(init)
+	require.NoError(err)
+	require.Nil(t)
+
+	written := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(s.store.SetTier(&SivaTier{
+		Init:      init,
+		Tier:      HotTier,
+		WrittenAt: written,
+	}))
+
+	t, err = s.store.GetTier(init)
+	require.NoError(err)
+	require.Equal(HotTier, t.Tier)
+	require.True(written.Equal(t.WrittenAt))
+	require.False(t.UpdatedAt.IsZero())
+
+	require.NoError(s.store.SetTier(&SivaTier{
+		Init:      init,
+		Tier:      ColdTier,
+		WrittenAt: written,
+	}))
+
+	t, err = s.store.GetTier(init)
+	require.NoError(err)
+	require.Equal(ColdTier, t.Tier)
+	require.True(written.Equal(t.WrittenAt))
+
+	t, err = s.store.GetTier(model.NewSHA1("2222222222222222222222222222222222222222"))
+	require.NoError(err)
+	require.Nil(t)
+}
+
+func (s *StoreSuite) TestLeases() {
+	require := s.Require()
+
+	srv := s.store.LeaseService()
+	require.True(lock.IsDistributed(srv))
+
+	cfg := &lock.SessionConfig{TTL: 300 * time.Millisecond, Timeout: 50 * time.Millisecond}
+	sess1, err := srv.NewSession(cfg)
+	require.NoError(err)
+	sess2, err := srv.NewSession(cfg)
+	require.NoError(err)
+
+	l1 := sess1.NewLocker("foo")
+	lost, err := l1.Lock()
+	require.NoError(err)
+
+	_, err = sess2.NewLocker("foo").Lock()
+	require.True(lock.ErrCanceled.Is(err))
+
+	// the lock is renewed while it is held
+	time.Sleep(time.Second)
+	_, err = sess2.NewLocker("foo").Lock()
+	require.True(lock.ErrCanceled.Is(err))
+
+	l2 := sess2.NewLocker("bar")
+	_, err = l2.Lock()
+	require.NoError(err)
+	require.NoError(l2.Unlock())
+
+	require.NoError(l1.Unlock())
+	<-lost
+
+	l2 = sess2.NewLocker("foo")
+	_, err = l2.Lock()
+	require.NoError(err)
+	require.NoError(l2.Unlock())
+
+	require.NoError(sess1.Close())
+	require.True(lock.ErrAlreadyClosed.Is(sess1.Close()))
+	require.NoError(sess2.Close())
+	require.NoError(srv.Close())
+}
+
+func (s *StoreSuite) TestLeaseExpired() {
+	require := s.Require()
+
+	srv := s.store.LeaseService()
+	cfg := &lock.SessionConfig{TTL: 300 * time.Millisecond, Timeout: time.Second}
+	sess1, err := srv.NewSession(cfg)
+	require.NoError(err)
+	sess2, err := srv.NewSession(cfg)
+	require.NoError(err)
+
+	_, err = sess1.NewLocker("foo").Lock()
+	require.NoError(err)
+
+	// a closed session stops renewing its locks, as a crashed process
+	close(sess1.(*leaseSession).done)
+
+	l2 := sess2.NewLocker("foo")
+	_, err = l2.Lock()
+	require.NoError(err)
+	require.NoError(l2.Unlock())
+	require.NoError(sess2.Close())
+}
+
+func (s *StoreSuite) createRepo(status model.FetchStatus, remotes ...string) *model.Repository {
+	repo := model.NewRepository()
+	repo.Status = status
+	repo.Endpoints = remotes
+	repo.References = []*model.Reference{
+		makeRef(model.NewSHA1("1"), time.Now()),
+		makeRef(model.NewSHA1("2"), time.Now().Add(-5*time.Hour)),
+	}
+
+	s.Require().NoError(s.store.Create(repo))
+	return repo
+}
+
+func (s *StoreSuite) createFetchedRepo(fetchedAt time.Time, remotes ...string) *model.Repository {
+	repo := s.createRepo(model.Pending, remotes...)
+	s.Require().NoError(s.store.UpdateFetched(repo, fetchedAt))
+	return repo
+}
+
+func makeRef(hash model.SHA1, time time.Time) *model.Reference {
+	ref := model.NewReference()
+	ref.Hash = hash
+	ref.Time = time
+	return ref
+}
+
+func withoutNs(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+}
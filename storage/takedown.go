@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// IsTakenDown returns true if any of the given endpoints belongs to a
+// repository that was taken down, so it must not be archived again.
+func (s *DatabaseStore) IsTakenDown(endpoints ...string) (bool, error) {
+	if len(endpoints) == 0 {
+		return false, nil
+	}
+
+	start := time.Now()
+
+	var found bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM repository_takedowns WHERE endpoints && $1)`,
+		pq.Array(endpoints),
+	).Scan(&found)
+
+	logger := log.With(log.Fields{
+		"duration":  time.Since(start),
+		"endpoints": endpoints,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not check repository takedowns")
+		return false, err
+	}
+
+	logger.Debugf("check repository takedowns finished")
+	return found, nil
+}
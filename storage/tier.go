@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// Tier is the storage tier where the siva file of a rooted repository is.
+type Tier string
+
+const (
+	// HotTier is the primary storage, where siva files are read and written
+	// by the consumers.
+	HotTier Tier = "hot"
+	// ColdTier is the secondary storage for the siva files that are not
+	// written anymore.
+	ColdTier Tier = "cold"
+)
+
+// SivaTier records the storage tier of the siva file of a rooted
+// repository.
+type SivaTier struct {
+	// Init is the init commit of the rooted repository.
+	Init model.SHA1
+	// Tier is the tier where the siva file is.
+	Tier Tier
+	// WrittenAt is the last time the siva file was written.
+	WrittenAt time.Time
+	// UpdatedAt is the last time the record was updated.
+	UpdatedAt time.Time
+}
+
+// GetTier returns the tier of the siva file of the given rooted repository,
+// or nil if it has not been recorded.
+func (s *DatabaseStore) GetTier(init model.SHA1) (*SivaTier, error) {
+	return getTier(s.db, postgresDialect, init)
+}
+
+// SetTier creates or replaces the tier of the siva file of a rooted
+// repository.
+func (s *DatabaseStore) SetTier(t *SivaTier) error {
+	return setTier(s.db, postgresDialect, t)
+}
+
+// GetTier returns the tier of the siva file of the given rooted repository,
+// or nil if it has not been recorded.
+func (s *SQLiteStore) GetTier(init model.SHA1) (*SivaTier, error) {
+	return getTier(s.db, sqliteDialect, init)
+}
+
+// SetTier creates or replaces the tier of the siva file of a rooted
+// repository.
+func (s *SQLiteStore) SetTier(t *SivaTier) error {
+	return setTier(s.db, sqliteDialect, t)
+}
+
+func getTier(db *sql.DB, d *dialect, init model.SHA1) (*SivaTier, error) {
+	start := time.Now()
+
+	t := &SivaTier{Init: init}
+	err := db.QueryRow(fmt.Sprintf(
+		`SELECT tier, written_at, updated_at
+		FROM repository_tiers WHERE init = %s`, d.param(1),
+	), init).Scan(&t.Tier, &t.WrittenAt, &t.UpdatedAt)
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"init":     init,
+	})
+
+	if err == sql.ErrNoRows {
+		logger.Debugf("siva tier not recorded")
+		return nil, nil
+	}
+
+	if err != nil {
+		logger.Errorf(err, "could not get siva tier")
+		return nil, err
+	}
+
+	logger.Debugf("get siva tier finished")
+	return t, nil
+}
+
+func setTier(db *sql.DB, d *dialect, t *SivaTier) error {
+	start := time.Now()
+
+	if t.UpdatedAt.IsZero() {
+		t.UpdatedAt = time.Now()
+	}
+
+	_, err := db.Exec(fmt.Sprintf(
+		`INSERT INTO repository_tiers (init, tier, written_at, updated_at)
+		VALUES (%s, %s, %s, %s)
+		ON CONFLICT (init) DO UPDATE SET
+			tier = excluded.tier,
+			written_at = excluded.written_at,
+			updated_at = excluded.updated_at`,
+		d.param(1), d.param(2), d.param(3), d.param(4),
+	), t.Init, t.Tier, t.WrittenAt.UTC(), t.UpdatedAt.UTC())
+
+	logger := log.With(log.Fields{
+		"duration": time.Since(start),
+		"init":     t.Init,
+		"tier":     t.Tier,
+	})
+
+	if err != nil {
+		logger.Errorf(err, "could not set siva tier")
+		return err
+	}
+
+	logger.Debugf("set siva tier finished")
+	return nil
+}
@@ -0,0 +1,408 @@
+package borges
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	bstorage "github.com/src-d/borges/storage"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// ErrSivaNotFound is returned when the siva file of a rooted repository is
+// in none of the tiers.
+var ErrSivaNotFound = errors.NewKind("siva file of rooted repository %s not found")
+
+// TierStore is the storage where the tiers of the siva files are recorded.
+type TierStore interface {
+	// GetTier returns the tier of the siva file of the given rooted
+	// repository, or nil if it has not been recorded.
+	GetTier(init model.SHA1) (*bstorage.SivaTier, error)
+	// SetTier creates or replaces the tier of the siva file of a rooted
+	// repository.
+	SetTier(t *bstorage.SivaTier) error
+}
+
+// Tiers keeps the siva files of the rooted repositories in two filesystems.
+// The hot tier is where the transactioner reads and writes them, the cold
+// tier is a cheaper filesystem for the siva files that are not written
+// anymore. Both tiers use the same bucket size. The filesystems are the
+// source of truth, the tiers recorded in the TierStore are only used to find
+// the siva files to move. A nil *Tiers has no cold tier.
+type Tiers struct {
+	hot, cold  repository.Fs
+	bucketSize int
+	store      TierStore
+}
+
+// NewTiers creates a new Tiers with the given hot and cold filesystems. The
+// moves and writes are recorded in store, unless it is nil.
+func NewTiers(
+	hot, cold repository.Fs,
+	bucketSize int,
+	store TierStore,
+) *Tiers {
+	return &Tiers{
+		hot:        hot,
+		cold:       cold,
+		bucketSize: bucketSize,
+		store:      store,
+	}
+}
+
+// Cold returns the filesystem of the cold tier.
+func (t *Tiers) Cold() repository.Fs {
+	return t.cold
+}
+
+// Locate returns the tier where the siva file of a rooted repository is. The
+// hot tier is returned when it is in both of them, as the hot copy is
+// always the newest one.
+func (t *Tiers) Locate(init model.SHA1) (bstorage.Tier, error) {
+	ok, err := t.exists(t.hot, init)
+	if err != nil || ok {
+		return bstorage.HotTier, err
+	}
+
+	ok, err = t.exists(t.cold, init)
+	if err != nil || ok {
+		return bstorage.ColdTier, err
+	}
+
+	return "", ErrSivaNotFound.New(init)
+}
+
+// Freeze moves the siva file of a rooted repository to the cold tier. The
+// lock of the rooted repository must be held while it is moved.
+func (t *Tiers) Freeze(ctx context.Context, init model.SHA1) error {
+	written, err := t.writtenAt(init)
+	if err != nil {
+		return err
+	}
+
+	moved, err := t.move(ctx, t.hot, t.cold, init)
+	if err != nil {
+		return err
+	}
+
+	if !moved {
+		ok, err := t.exists(t.cold, init)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return ErrSivaNotFound.New(init)
+		}
+	}
+
+	log.With(log.Fields{
+		"init":  init,
+		"moved": moved,
+	}).Debugf("siva file frozen")
+
+	return t.record(init, bstorage.ColdTier, written)
+}
+
+// Thaw moves the siva file of a rooted repository back to the hot tier.
+// Nothing is done if it is not in the cold tier. The lock of the rooted
+// repository must be held while it is moved.
+func (t *Tiers) Thaw(ctx context.Context, init model.SHA1) error {
+	if t == nil {
+		return nil
+	}
+
+	ok, err := t.exists(t.cold, init)
+	if err != nil || !ok {
+		return err
+	}
+
+	written, err := t.writtenAt(init)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	// a move interrupted after copying the file leaves it in both tiers,
+	// the copy in the hot tier is kept as it may have been written since.
+	ok, err = t.exists(t.hot, init)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		err = t.cold.DeleteIfExists(t.sivaPath(t.cold, init))
+	} else {
+		_, err = t.move(ctx, t.cold, t.hot, init)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.With(log.Fields{
+		"init":     init,
+		"duration": time.Since(start),
+	}).Debugf("siva file thawed")
+
+	return t.record(init, bstorage.HotTier, written)
+}
+
+// Written records that the siva file of a rooted repository was written in
+// the hot tier.
+func (t *Tiers) Written(init model.SHA1) error {
+	if t == nil {
+		return nil
+	}
+
+	return t.record(init, bstorage.HotTier, time.Now())
+}
+
+// recordWritten records a write like Written, but only logs the errors. The
+// siva file is already written, failing to record it only makes it a
+// candidate to be frozen earlier than expected.
+func (t *Tiers) recordWritten(init model.SHA1) {
+	if err := t.Written(init); err != nil {
+		log.With(log.Fields{"init": init}).
+			Errorf(err, "could not record siva file write")
+	}
+}
+
+func (t *Tiers) record(init model.SHA1, tier bstorage.Tier, written time.Time) error {
+	if t.store == nil {
+		return nil
+	}
+
+	return t.store.SetTier(&bstorage.SivaTier{
+		Init:      init,
+		Tier:      tier,
+		WrittenAt: written,
+	})
+}
+
+// writtenAt returns the last time the siva file of a rooted repository was
+// written, or the zero time if it is not known.
+func (t *Tiers) writtenAt(init model.SHA1) (time.Time, error) {
+	if t.store == nil {
+		return time.Time{}, nil
+	}
+
+	st, err := t.store.GetTier(init)
+	if err != nil || st == nil {
+		return time.Time{}, err
+	}
+
+	return st.WrittenAt, nil
+}
+
+func (t *Tiers) sivaPath(fs repository.Fs, init model.SHA1) string {
+	name := fmt.Sprintf("%s.siva", init)
+	if t.bucketSize > 0 {
+		name = path.Join(name[:t.bucketSize], name)
+	}
+
+	return filepath.Join(fs.Base(), name)
+}
+
+func (t *Tiers) exists(fs repository.Fs, init model.SHA1) (bool, error) {
+	return fileExists(fs, t.sivaPath(fs, init))
+}
+
+// move moves the siva file of a rooted repository from one filesystem to
+// the other. It returns false if the file does not exist in the source
+// filesystem.
+func (t *Tiers) move(
+	ctx context.Context,
+	src, dst repository.Fs,
+	init model.SHA1,
+) (bool, error) {
+	return moveFile(ctx, src, dst, t.sivaPath(src, init), t.sivaPath(dst, init))
+}
+
+func fileExists(fs repository.Fs, path string) (bool, error) {
+	f, err := fs.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, f.Close()
+}
+
+// moveFile copies a file from one filesystem to the other and deletes it
+// from the first one. It returns false if the file does not exist in the
+// source filesystem.
+func moveFile(
+	ctx context.Context,
+	src, dst repository.Fs,
+	srcPath, dstPath string,
+) (bool, error) {
+	ok, err := copyFile(ctx, src, dst, srcPath, dstPath)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return true, src.DeleteIfExists(srcPath)
+}
+
+// copyFile copies a file from one filesystem to the other. The file is
+// written with a temporary name and renamed once complete. It returns false
+// if the file does not exist in the source filesystem.
+func copyFile(
+	ctx context.Context,
+	src, dst repository.Fs,
+	srcPath, dstPath string,
+) (bool, error) {
+	dstCopy := dstPath + ".copy"
+
+	r, err := src.Open(srcPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	w, err := dst.WriteTo(dstCopy)
+	if err != nil {
+		_ = r.Close()
+		return false, err
+	}
+
+	err = copyWithContext(ctx, w, r)
+	if e := r.Close(); err == nil {
+		err = e
+	}
+
+	if e := w.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		_ = dst.DeleteIfExists(dstCopy)
+		return false, err
+	}
+
+	if err := dst.Rename(dstCopy, dstPath); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func copyWithContext(ctx context.Context, w io.Writer, r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// TieredTransactioner is a RootedTransactioner that keeps the siva files in
+// Tiers.
+type TieredTransactioner interface {
+	repository.RootedTransactioner
+	// Tiers returns the tiers of the siva files.
+	Tiers() *Tiers
+}
+
+type tieredTransactioner struct {
+	repository.RootedTransactioner
+	tiers *Tiers
+}
+
+// NewTieredTransactioner returns a RootedTransactioner that moves the siva
+// files back to the hot tier before beginning a transaction and records when
+// they are written. The given transactioner must use the hot filesystem of
+// the tiers. It is returned as is if tiers is nil.
+func NewTieredTransactioner(
+	txer repository.RootedTransactioner,
+	tiers *Tiers,
+) repository.RootedTransactioner {
+	if tiers == nil {
+		return txer
+	}
+
+	return &tieredTransactioner{txer, tiers}
+}
+
+// Begin implements the repository.RootedTransactioner interface.
+func (t *tieredTransactioner) Begin(
+	ctx context.Context,
+	h plumbing.Hash,
+) (repository.Tx, error) {
+	init := model.SHA1(h)
+	if err := t.tiers.Thaw(ctx, init); err != nil {
+		return nil, err
+	}
+
+	tx, err := t.RootedTransactioner.Begin(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tieredTx{Tx: tx, tiers: t.tiers, init: init}, nil
+}
+
+// Tiers implements the TieredTransactioner interface.
+func (t *tieredTransactioner) Tiers() *Tiers {
+	return t.tiers
+}
+
+type tieredTx struct {
+	repository.Tx
+	tiers *Tiers
+	init  model.SHA1
+}
+
+// Commit implements the repository.Tx interface.
+func (tx *tieredTx) Commit(ctx context.Context) error {
+	if err := tx.Tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	tx.tiers.recordWritten(tx.init)
+	return nil
+}
+
+// rootedTiers returns the tiers of a RootedTransactioner, or nil if it does
+// not keep the siva files in tiers.
+func rootedTiers(txer repository.RootedTransactioner) *Tiers {
+	if t, ok := txer.(TieredTransactioner); ok {
+		return t.Tiers()
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package borges
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	bstorage "github.com/src-d/borges/storage"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+type memoryTiers map[model.SHA1]*bstorage.SivaTier
+
+func (m memoryTiers) GetTier(init model.SHA1) (*bstorage.SivaTier, error) {
+	return m[init], nil
+}
+
+func (m memoryTiers) SetTier(t *bstorage.SivaTier) error {
+	m[t.Init] = t
+	return nil
+}
+
+const tierInit = "fe3a2d6f4c1b9e8a7d6c5b4a3f2e1d0c9b8a7f6e"
+
+func newTestTiers() (*Tiers, billy.Filesystem, billy.Filesystem, memoryTiers) {
+	hot, cold := memfs.New(), memfs.New()
+	store := make(memoryTiers)
+	tiers := NewTiers(
+		repository.NewLocalFs(hot),
+		repository.NewLocalFs(cold),
+		2,
+		store,
+	)
+
+	return tiers, hot, cold, store
+}
+
+func readFile(fs billy.Filesystem, path string) ([]byte, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+func TestTiersFreezeThaw(t *testing.T) {
+	require := require.New(t)
+
+	tiers, hot, cold, store := newTestTiers()
+	ctx := context.TODO()
+	init := model.NewSHA1(tierInit)
+	path := "fe/" + tierInit + ".siva"
+
+	_, err := tiers.Locate(init)
+	require.True(ErrSivaNotFound.Is(err))
+	require.True(ErrSivaNotFound.Is(tiers.Freeze(ctx, init)))
+	require.NoError(tiers.Thaw(ctx, init))
+
+	require.NoError(util.WriteFile(hot, path, []byte("siva"), 0644))
+	require.NoError(tiers.Written(init))
+	written := store[init].WrittenAt
+
+	require.NoError(tiers.Freeze(ctx, init))
+	_, err = hot.Stat(path)
+	require.Error(err)
+	_, err = cold.Stat(path + ".copy")
+	require.Error(err)
+	content, err := readFile(cold, path)
+	require.NoError(err)
+	require.Equal("siva", string(content))
+	require.Equal(bstorage.ColdTier, store[init].Tier)
+	require.Equal(written, store[init].WrittenAt)
+
+	tier, err := tiers.Locate(init)
+	require.NoError(err)
+	require.Equal(bstorage.ColdTier, tier)
+
+	// freezing it again only records it
+	require.NoError(tiers.Freeze(ctx, init))
+
+	require.NoError(tiers.Thaw(ctx, init))
+	_, err = cold.Stat(path)
+	require.Error(err)
+	content, err = readFile(hot, path)
+	require.NoError(err)
+	require.Equal("siva", string(content))
+	require.Equal(bstorage.HotTier, store[init].Tier)
+	require.Equal(written, store[init].WrittenAt)
+
+	tier, err = tiers.Locate(init)
+	require.NoError(err)
+	require.Equal(bstorage.HotTier, tier)
+}
+
+func TestTiersThawKeepsHot(t *testing.T) {
+	require := require.New(t)
+
+	tiers, hot, cold, _ := newTestTiers()
+	init := model.NewSHA1(tierInit)
+	path := "fe/" + tierInit + ".siva"
+
+	require.NoError(util.WriteFile(hot, path, []byte("new"), 0644))
+	require.NoError(util.WriteFile(cold, path, []byte("old"), 0644))
+
+	tier, err := tiers.Locate(init)
+	require.NoError(err)
+	require.Equal(bstorage.HotTier, tier)
+
+	require.NoError(tiers.Thaw(context.TODO(), init))
+	_, err = cold.Stat(path)
+	require.Error(err)
+	content, err := readFile(hot, path)
+	require.NoError(err)
+	require.Equal("new", string(content))
+}
+
+func TestTieredTransactioner(t *testing.T) {
+	require := require.New(t)
+
+	tiers, hot, cold, store := newTestTiers()
+	copier := repository.NewCopier(memfs.New(), repository.NewLocalFs(hot), 2)
+	txer := NewTieredTransactioner(
+		repository.NewSivaRootedTransactioner(copier),
+		tiers,
+	)
+	require.Equal(tiers, rootedTiers(txer))
+	require.Nil(rootedTiers(repository.NewSivaRootedTransactioner(copier)))
+
+	ctx := context.TODO()
+	init := model.NewSHA1(tierInit)
+	h := plumbing.Hash(init)
+
+	tx, err := txer.Begin(ctx, h)
+	require.NoError(err)
+	r, err := git.Open(tx.Storer(), nil)
+	require.NoError(err)
+	repo := model.NewRepository()
+	repo.Endpoints = []string{"https://github.com/src-d/borges"}
+	require.NoError(StoreConfig(r, repo))
+	require.NoError(tx.Commit(ctx))
+
+	require.Equal(bstorage.HotTier, store[init].Tier)
+	written := store[init].WrittenAt
+	require.False(written.IsZero())
+
+	require.NoError(tiers.Freeze(ctx, init))
+	path := "fe/" + tierInit + ".siva"
+	_, err = hot.Stat(path)
+	require.Error(err)
+
+	time.Sleep(time.Millisecond)
+	tx, err = txer.Begin(ctx, h)
+	require.NoError(err)
+	_, err = cold.Stat(path)
+	require.Error(err)
+
+	c, err := tx.Storer().Config()
+	require.NoError(err)
+	require.Len(c.Remotes, 1)
+
+	require.NoError(tx.Rollback())
+	require.Equal(bstorage.HotTier, store[init].Tier)
+	require.Equal(written, store[init].WrittenAt)
+
+	tx, err = txer.Begin(ctx, h)
+	require.NoError(err)
+	require.NoError(tx.Commit(ctx))
+	require.True(store[init].WrittenAt.After(written))
+}
@@ -0,0 +1,246 @@
+package tool
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/src-d/borges"
+
+	"github.com/lib/pq"
+	"gopkg.in/src-d/go-errors.v1"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+const (
+	dbEndpointsSQL      = "select id, endpoints from repositories order by id"
+	dbRepositoryRefsSQL = "select distinct repository_id from repository_references"
+	dbSetEndpointsSQL   = "update repositories set endpoints = $1, updated_at = $2 where id = $3"
+	dbRepoRemoveSQL     = "delete from repositories where id = any($1) and not exists " +
+		"(select 1 from repository_references where repository_id = repositories.id)"
+)
+
+// ErrNotMergeable is returned when a group of duplicated repositories cannot
+// be merged because more than one of them has references.
+var ErrNotMergeable = errors.NewKind("repositories %v have references, they must be merged with merge-repos")
+
+// DuplicateGroup is a group of repositories whose endpoints are the same
+// once canonicalized.
+type DuplicateGroup struct {
+	// Endpoints are the endpoints of all the repositories, as they are
+	// stored, as the repositories may not be fetched from the canonical ones.
+	Endpoints []string
+	// Repositories are the IDs of the repositories, the oldest first.
+	Repositories []kallax.ULID
+	// WithReferences are the IDs of the repositories with references.
+	WithReferences []kallax.ULID
+}
+
+// Target returns the repository kept when the group is merged: the only one
+// with references, or the oldest one if none of them has references. It
+// returns false if more than one of them has references.
+func (g *DuplicateGroup) Target() (kallax.ULID, bool) {
+	switch len(g.WithReferences) {
+	case 0:
+		return g.Repositories[0], true
+	case 1:
+		return g.WithReferences[0], true
+	default:
+		return kallax.ULID{}, false
+	}
+}
+
+// Duplicates returns the groups of repositories that share some endpoint once
+// canonicalized with the given Canonicalizer.
+func (d *Database) Duplicates(c borges.Canonicalizer) ([]*DuplicateGroup, error) {
+	log.Infof("querying repository endpoints")
+	start := time.Now()
+
+	withRefs, err := d.repositoriesWithReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.Query(dbEndpointsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type repository struct {
+		id        kallax.ULID
+		endpoints []string
+	}
+
+	var (
+		repos []*repository
+		// parents is the union-find forest of the repositories sharing
+		// endpoints, indexed as repos.
+		parents    []int
+		byEndpoint = make(map[string]int)
+	)
+
+	find := func(i int) int {
+		for parents[i] != i {
+			parents[i] = parents[parents[i]]
+			i = parents[i]
+		}
+
+		return i
+	}
+
+	for rows.Next() {
+		var (
+			id        kallax.ULID
+			endpoints []string
+		)
+
+		if err := rows.Scan(&id, pq.Array(&endpoints)); err != nil {
+			return nil, err
+		}
+
+		i := len(repos)
+		repos = append(repos, &repository{
+			id:        id,
+			endpoints: endpoints,
+		})
+		parents = append(parents, i)
+
+		for _, e := range borges.CanonicalEndpoints(c, endpoints) {
+			j, ok := byEndpoint[e]
+			if !ok {
+				byEndpoint[e] = i
+				continue
+			}
+
+			parents[find(j)] = find(i)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var (
+		groups []*DuplicateGroup
+		byRoot = make(map[int]*DuplicateGroup)
+		seen   = make(map[*DuplicateGroup]map[string]bool)
+	)
+
+	for i, r := range repos {
+		root := find(i)
+		g, ok := byRoot[root]
+		if !ok {
+			g = &DuplicateGroup{}
+			byRoot[root] = g
+			seen[g] = make(map[string]bool)
+			groups = append(groups, g)
+		}
+
+		g.Repositories = append(g.Repositories, r.id)
+		if withRefs[r.id] {
+			g.WithReferences = append(g.WithReferences, r.id)
+		}
+
+		for _, e := range r.endpoints {
+			if !seen[g][e] {
+				seen[g][e] = true
+				g.Endpoints = append(g.Endpoints, e)
+			}
+		}
+	}
+
+	var result []*DuplicateGroup
+	for _, g := range groups {
+		if len(g.Repositories) > 1 {
+			result = append(result, g)
+		}
+	}
+
+	log.With(log.Fields{
+		"duration":     time.Since(start),
+		"repositories": len(repos),
+		"groups":       len(result),
+	}).Infof("finished finding duplicated repositories")
+
+	return result, nil
+}
+
+// MergeDuplicates merges the repositories of the group into its target,
+// which is given all their endpoints, and deletes the rest of them. It fails with ErrNotMergeable if more than one of them has
+// references.
+func (d *Database) MergeDuplicates(ctx context.Context, g *DuplicateGroup) error {
+	target, ok := g.Target()
+	if !ok {
+		return ErrNotMergeable.New(g.WithReferences)
+	}
+
+	var remove []string
+	for _, id := range g.Repositories {
+		if id != target {
+			remove = append(remove, id.String())
+		}
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = mergeDuplicates(ctx, tx, target, g.Endpoints, remove)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func mergeDuplicates(
+	ctx context.Context,
+	tx *sql.Tx,
+	target kallax.ULID,
+	endpoints []string,
+	remove []string,
+) error {
+	if len(remove) > 0 {
+		res, err := tx.ExecContext(ctx, dbRepoRemoveSQL, pq.Array(remove))
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if int(n) != len(remove) {
+			return ErrNotMergeable.New(remove)
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, dbSetEndpointsSQL,
+		pq.Array(endpoints), time.Now(), target)
+	return err
+}
+
+func (d *Database) repositoriesWithReferences() (map[kallax.ULID]bool, error) {
+	rows, err := d.db.Query(dbRepositoryRefsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[kallax.ULID]bool)
+	for rows.Next() {
+		var id kallax.ULID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids[id] = true
+	}
+
+	return ids, rows.Err()
+}
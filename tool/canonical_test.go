@@ -0,0 +1,115 @@
+package tool
+
+import (
+	"context"
+	"testing"
+
+	"github.com/src-d/borges"
+
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestCanonical(t *testing.T) {
+	suite.Run(t, new(CanonicalSuite))
+}
+
+type CanonicalSuite struct {
+	ToolSuite
+	database *Database
+}
+
+func (s *CanonicalSuite) SetupTest() {
+	s.ToolSuite.SetupTest()
+	s.database = NewDatabase(s.DB)
+}
+
+func (s *CanonicalSuite) TearDownTest() {
+	s.ToolSuite.TearDownTest()
+}
+
+func (s *CanonicalSuite) TestDuplicates() {
+	require := s.Require()
+
+	a := s.createEndpointsRepo(false, "git://github.com/src-d/borges.git")
+	b := s.createEndpointsRepo(true, "https://github.com/src-d/borges/")
+	c := s.createEndpointsRepo(false, "https://github.com/SRC-D/Borges", "https://example.com/borges")
+	s.createEndpointsRepo(true, "https://github.com/src-d/go-git")
+	s.createEndpointsRepo(false, "https://GitHub.com/src-d/gitbase.git")
+
+	groups, err := s.database.Duplicates(borges.DefaultCanonicalizer)
+	require.NoError(err)
+	require.Len(groups, 1)
+
+	g := groups[0]
+	require.ElementsMatch([]kallax.ULID{a, b, c}, g.Repositories)
+	require.Equal([]kallax.ULID{b}, g.WithReferences)
+	require.ElementsMatch([]string{
+		"git://github.com/src-d/borges.git",
+		"https://github.com/src-d/borges/",
+		"https://github.com/SRC-D/Borges",
+		"https://example.com/borges",
+	}, g.Endpoints)
+
+	target, ok := g.Target()
+	require.True(ok)
+	require.Equal(b, target)
+
+	require.NoError(s.database.MergeDuplicates(context.TODO(), g))
+
+	repo, err := s.store.Get(b)
+	require.NoError(err)
+	require.Equal(g.Endpoints, repo.Endpoints)
+	require.Len(repo.References, 1)
+
+	for _, id := range []kallax.ULID{a, c} {
+		_, err = s.store.Get(id)
+		require.Equal(kallax.ErrNotFound, err)
+	}
+
+	groups, err = s.database.Duplicates(borges.DefaultCanonicalizer)
+	require.NoError(err)
+	require.Len(groups, 0)
+}
+
+func (s *CanonicalSuite) TestNotMergeable() {
+	require := s.Require()
+
+	a := s.createEndpointsRepo(true, "git://github.com/src-d/borges.git")
+	b := s.createEndpointsRepo(true, "https://github.com/src-d/borges")
+
+	groups, err := s.database.Duplicates(borges.DefaultCanonicalizer)
+	require.NoError(err)
+	require.Len(groups, 1)
+	require.ElementsMatch([]kallax.ULID{a, b}, groups[0].WithReferences)
+
+	_, ok := groups[0].Target()
+	require.False(ok)
+
+	err = s.database.MergeDuplicates(context.TODO(), groups[0])
+	require.True(ErrNotMergeable.Is(err))
+
+	for _, id := range []kallax.ULID{a, b} {
+		_, err = s.store.Get(id)
+		require.NoError(err)
+	}
+}
+
+func (s *CanonicalSuite) createEndpointsRepo(
+	withRefs bool,
+	endpoints ...string,
+) kallax.ULID {
+	repo := model.NewRepository()
+	repo.Endpoints = endpoints
+	if withRefs {
+		ref := model.NewReference()
+		ref.Name = "refs/heads/master"
+		ref.Hash = model.NewSHA1(inits[0])
+		ref.Init = model.NewSHA1(inits[0])
+		repo.References = []*model.Reference{ref}
+	}
+
+	s.Require().NoError(s.store.Create(repo))
+	return repo.ID
+}
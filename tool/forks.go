@@ -0,0 +1,354 @@
+package tool
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+
+	"github.com/lib/pq"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+const (
+	dbForkRefsSQL = "select repository_id, init, count(*), min(reference_time) " +
+		"from repository_references group by repository_id, init"
+	dbGroupsRemoveSQL = "delete from repository_groups"
+	dbGroupInsertSQL  = "insert into repository_groups " +
+		"(label, main_repository, repositories, updated_at) values ($1, $2, $3, $4)"
+	dbSetIsForkSQL = "update repositories set is_fork = (id <> $1), updated_at = $2 " +
+		"where id = any($3)"
+)
+
+// ForkGroup is a group of repositories that share root commits, that is,
+// a repository and its forks. MainRepository is the one considered the
+// original and Repositories are its forks.
+type ForkGroup struct {
+	model.RepositoryGroup
+	// Inits are the rooted repositories with references of any repository
+	// of the group.
+	Inits []model.SHA1
+}
+
+// All returns the IDs of all the repositories of the group, the main one
+// first.
+func (g *ForkGroup) All() []kallax.ULID {
+	return append([]kallax.ULID{g.MainRepository}, g.Repositories...)
+}
+
+// forkCandidate holds the data of a repository used to find its fork group
+// and to choose the main repository of the group.
+type forkCandidate struct {
+	id     kallax.ULID
+	inits  []model.SHA1
+	refs   int
+	oldest time.Time
+}
+
+// before tells if the candidate is a better main repository than the other:
+// the one with the oldest referenced commit, then the one with more
+// references and then the one created first.
+func (c *forkCandidate) before(o *forkCandidate) bool {
+	if !c.oldest.Equal(o.oldest) {
+		return c.oldest.Before(o.oldest)
+	}
+
+	if c.refs != o.refs {
+		return c.refs > o.refs
+	}
+
+	return c.id.String() < o.id.String()
+}
+
+// ForkGroups returns the groups of repositories that have references with
+// the same root commits. Repositories that do not share them with any other
+// are not returned. The groups are labelled after the smallest of their
+// root commits.
+func (d *Database) ForkGroups() ([]*ForkGroup, error) {
+	log.Infof("querying repository references")
+	start := time.Now()
+
+	rows, err := d.db.Query(dbForkRefsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[kallax.ULID]*forkCandidate)
+	var candidates []*forkCandidate
+	for rows.Next() {
+		var (
+			id     kallax.ULID
+			init   string
+			refs   int
+			oldest time.Time
+		)
+
+		if err := rows.Scan(&id, &init, &refs, &oldest); err != nil {
+			return nil, err
+		}
+
+		c, ok := byID[id]
+		if !ok {
+			c = &forkCandidate{id: id, oldest: oldest}
+			byID[id] = c
+			candidates = append(candidates, c)
+		}
+
+		c.inits = append(c.inits, model.NewSHA1(init))
+		c.refs += refs
+		if oldest.Before(c.oldest) {
+			c.oldest = oldest
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups := groupForks(candidates)
+
+	log.With(log.Fields{
+		"duration":     time.Since(start),
+		"repositories": len(candidates),
+		"groups":       len(groups),
+	}).Infof("finished finding fork groups")
+
+	return groups, nil
+}
+
+// groupForks groups the candidates sharing some init and chooses the main
+// repository of every group.
+func groupForks(candidates []*forkCandidate) []*ForkGroup {
+	// parents is the union-find forest of the candidates sharing inits,
+	// indexed as candidates.
+	parents := make([]int, len(candidates))
+	byInit := make(map[model.SHA1]int)
+
+	find := func(i int) int {
+		for parents[i] != i {
+			parents[i] = parents[parents[i]]
+			i = parents[i]
+		}
+
+		return i
+	}
+
+	for i, c := range candidates {
+		parents[i] = i
+		for _, ic := range c.inits {
+			j, ok := byInit[ic]
+			if !ok {
+				byInit[ic] = i
+				continue
+			}
+
+			parents[find(j)] = find(i)
+		}
+	}
+
+	members := make(map[int][]*forkCandidate)
+	var roots []int
+	for i, c := range candidates {
+		root := find(i)
+		if _, ok := members[root]; !ok {
+			roots = append(roots, root)
+		}
+
+		members[root] = append(members[root], c)
+	}
+
+	var groups []*ForkGroup
+	for _, root := range roots {
+		cs := members[root]
+		if len(cs) < 2 {
+			continue
+		}
+
+		sort.Slice(cs, func(i, j int) bool { return cs[i].before(cs[j]) })
+
+		g := &ForkGroup{}
+		g.MainRepository = cs[0].id
+		seen := make(map[model.SHA1]bool)
+		for i, c := range cs {
+			if i > 0 {
+				g.Repositories = append(g.Repositories, c.id)
+			}
+
+			for _, ic := range c.inits {
+				if !seen[ic] {
+					seen[ic] = true
+					g.Inits = append(g.Inits, ic)
+				}
+			}
+		}
+
+		sort.Slice(g.Inits, func(i, j int) bool {
+			return g.Inits[i].String() < g.Inits[j].String()
+		})
+		g.Label = g.Inits[0].String()
+
+		groups = append(groups, g)
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Label < groups[j].Label })
+	return groups
+}
+
+// SaveForkGroups replaces the repository groups stored in the database with
+// the given ones.
+func (d *Database) SaveForkGroups(ctx context.Context, groups []*ForkGroup) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, dbGroupsRemoveSQL); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	now := time.Now()
+	for _, g := range groups {
+		_, err := tx.ExecContext(ctx, dbGroupInsertSQL,
+			g.Label, g.MainRepository, pq.Array(ulidStrings(g.Repositories)), now)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SetForks marks the repositories of the group as forks in the database,
+// except the main one, which is marked as not being a fork.
+func (d *Database) SetForks(ctx context.Context, g *ForkGroup) error {
+	_, err := d.db.ExecContext(ctx, dbSetIsForkSQL,
+		g.MainRepository, time.Now(), pq.Array(ulidStrings(g.All())))
+	return err
+}
+
+// ForkUpdater sets the isfork option of the remotes of the fork groups in
+// the rooted repositories.
+type ForkUpdater struct {
+	txer    repository.RootedTransactioner
+	session lock.Session
+}
+
+// NewForkUpdater creates and initializes a new ForkUpdater. The session is
+// used to lock the rooted repositories while they are modified, so it must
+// be connected to the same locking service as the consumers.
+func NewForkUpdater(
+	txer repository.RootedTransactioner,
+	session lock.Session,
+) *ForkUpdater {
+	return &ForkUpdater{
+		txer:    txer,
+		session: session,
+	}
+}
+
+// Update sets isfork to false in the remote of the main repository of the
+// group and to true in the rest of them, in every rooted repository of the
+// group.
+func (u *ForkUpdater) Update(ctx context.Context, g *ForkGroup) error {
+	for _, ic := range g.Inits {
+		if err := u.updateRooted(ctx, ic, g); err != nil {
+			return fmt.Errorf("could not update rooted repository %s: %s", ic, err)
+		}
+	}
+
+	return nil
+}
+
+func (u *ForkUpdater) updateRooted(
+	ctx context.Context,
+	ic model.SHA1,
+	g *ForkGroup,
+) error {
+	locker := u.session.NewLocker(borges.RootedLockID(ic))
+	if _, err := locker.Lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := locker.Unlock(); err != nil {
+			log.Errorf(err, "could not unlock rooted repository")
+		}
+	}()
+
+	tx, err := u.txer.Begin(ctx, plumbing.Hash(ic))
+	if err != nil {
+		return err
+	}
+
+	updated, err := setRootedForks(tx.Storer(), g)
+	if err != nil || !updated {
+		if e := tx.Rollback(); e != nil {
+			log.Errorf(e, "could not rollback rooted repository")
+		}
+
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// setRootedForks sets the isfork option of the remotes of the group in the
+// config of a rooted repository. Repositories without a remote in it are
+// skipped. It returns false if the config did not change.
+func setRootedForks(s storage.Storer, g *ForkGroup) (bool, error) {
+	const (
+		section = "remote"
+		key     = "isfork"
+	)
+
+	c, err := s.Config()
+	if err != nil {
+		return false, err
+	}
+
+	// the raw config must reflect the remotes before modifying it
+	_, _ = c.Marshal()
+
+	var updated bool
+	for _, id := range g.All() {
+		name := id.String()
+		if _, ok := c.Remotes[name]; !ok {
+			continue
+		}
+
+		val := strconv.FormatBool(id != g.MainRepository)
+		ss := c.Raw.Section(section).Subsection(name)
+		if ss.Option(key) == val {
+			continue
+		}
+
+		ss.SetOption(key, val)
+		updated = true
+	}
+
+	if !updated {
+		return false, nil
+	}
+
+	return true, s.SetConfig(c)
+}
+
+func ulidStrings(ids []kallax.ULID) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+
+	return strs
+}
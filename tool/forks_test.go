@@ -0,0 +1,161 @@
+package tool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestGroupForks(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	ids := make([]kallax.ULID, 6)
+	for i := range ids {
+		ids[i] = kallax.NewULID()
+	}
+
+	sha1 := func(i int) model.SHA1 { return model.NewSHA1(inits[i]) }
+	candidates := []*forkCandidate{
+		// a fork with more references but newer history
+		{id: ids[0], inits: []model.SHA1{sha1(1)}, refs: 10, oldest: now},
+		{id: ids[1], inits: []model.SHA1{sha1(1), sha1(2)}, refs: 2, oldest: now.Add(-time.Hour)},
+		// shares init 2 with the previous one, not init 1
+		{id: ids[2], inits: []model.SHA1{sha1(2)}, refs: 1, oldest: now.Add(-time.Hour)},
+		// not a fork of anything
+		{id: ids[3], inits: []model.SHA1{sha1(3)}, refs: 5, oldest: now},
+		// same history, the one with more references is the main one
+		{id: ids[4], inits: []model.SHA1{sha1(4)}, refs: 1, oldest: now},
+		{id: ids[5], inits: []model.SHA1{sha1(4)}, refs: 3, oldest: now},
+	}
+
+	groups := groupForks(candidates)
+	require.Len(groups, 2)
+
+	require.Equal(inits[1], groups[0].Label)
+	require.Equal(ids[1], groups[0].MainRepository)
+	require.Equal([]kallax.ULID{ids[2], ids[0]}, groups[0].Repositories)
+	require.Equal([]model.SHA1{sha1(1), sha1(2)}, groups[0].Inits)
+	require.Equal([]kallax.ULID{ids[1], ids[2], ids[0]}, groups[0].All())
+
+	require.Equal(inits[4], groups[1].Label)
+	require.Equal(ids[5], groups[1].MainRepository)
+	require.Equal([]kallax.ULID{ids[4]}, groups[1].Repositories)
+	require.Equal([]model.SHA1{sha1(4)}, groups[1].Inits)
+}
+
+func TestForkUpdater(t *testing.T) {
+	require := require.New(t)
+
+	copier := repository.NewCopier(
+		memfs.New(),
+		repository.NewLocalFs(memfs.New()),
+		0,
+	)
+	txer := repository.NewSivaRootedTransactioner(copier)
+
+	session, err := lock.NewLocal().NewSession(&lock.SessionConfig{})
+	require.NoError(err)
+
+	isFork := true
+	main := model.NewRepository()
+	main.Endpoints = []string{"https://github.com/src-d/borges"}
+	main.IsFork = &isFork
+	fork := model.NewRepository()
+	fork.Endpoints = []string{"https://github.com/smola/borges"}
+	other := model.NewRepository()
+	other.Endpoints = []string{"https://github.com/src-d/go-git"}
+
+	ic := model.NewSHA1(inits[0])
+	ctx := context.TODO()
+	tx, err := txer.Begin(ctx, plumbing.Hash(ic))
+	require.NoError(err)
+	r, err := git.Open(tx.Storer(), nil)
+	require.NoError(err)
+	require.NoError(borges.StoreConfig(r, main))
+	require.NoError(borges.StoreConfig(r, other))
+	require.NoError(tx.Commit(ctx))
+
+	g := &ForkGroup{Inits: []model.SHA1{ic}}
+	g.Label = ic.String()
+	g.MainRepository = main.ID
+	g.Repositories = []kallax.ULID{fork.ID}
+
+	updater := NewForkUpdater(txer, session)
+	require.NoError(updater.Update(ctx, g))
+	// nothing changes the second time
+	require.NoError(updater.Update(ctx, g))
+
+	tx, err = txer.Begin(ctx, plumbing.Hash(ic))
+	require.NoError(err)
+	defer tx.Rollback()
+
+	c, err := tx.Storer().Config()
+	require.NoError(err)
+
+	remotes := c.Raw.Section("remote")
+	require.Equal("false", remotes.Subsection(main.ID.String()).Option("isfork"))
+	require.Equal("false", remotes.Subsection(other.ID.String()).Option("isfork"))
+	require.False(remotes.HasSubsection(fork.ID.String()))
+	require.Len(c.Remotes, 2)
+}
+
+func TestForks(t *testing.T) {
+	suite.Run(t, new(ForksSuite))
+}
+
+type ForksSuite struct {
+	ToolSuite
+}
+
+func (s *ForksSuite) TestForkGroups() {
+	require := s.Require()
+	db := NewDatabase(s.DB)
+
+	groups, err := db.ForkGroups()
+	require.NoError(err)
+	require.Len(groups, 1)
+
+	g := groups[0]
+	require.Equal(inits[0], g.Label)
+	require.Equal(ulid[5], g.MainRepository.String())
+	require.Len(g.Repositories, len(testRepos)-1)
+	require.Len(g.Inits, len(inits))
+
+	ctx := context.TODO()
+	require.NoError(db.SaveForkGroups(ctx, groups))
+	require.NoError(db.SaveForkGroups(ctx, groups))
+
+	var (
+		main  kallax.ULID
+		forks []string
+	)
+	err = s.DB.QueryRow(
+		"select main_repository, repositories from repository_groups where label = $1",
+		g.Label,
+	).Scan(&main, pq.Array(&forks))
+	require.NoError(err)
+	require.Equal(g.MainRepository, main)
+	require.Len(forks, len(g.Repositories))
+
+	require.NoError(db.SetForks(ctx, g))
+	for _, id := range g.All() {
+		repo, err := s.store.Get(id)
+		require.NoError(err)
+		require.NotNil(repo.IsFork)
+		require.Equal(id != g.MainRepository, *repo.IsFork)
+	}
+}
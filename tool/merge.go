@@ -0,0 +1,462 @@
+package tool
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+
+	"github.com/lib/pq"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+const (
+	dbRepoRefsRemoveSQL = "delete from repository_references where repository_id = any($1)"
+	dbReposRemoveSQL    = "delete from repositories where id = any($1)"
+	dbRefInsertSQL      = "insert into repository_references " +
+		"(id, created_at, updated_at, name, repository_id, hash, init, roots, reference_time) " +
+		"values ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+)
+
+// ErrMergeRepositories is returned when less than two repositories are given
+// to be merged.
+var ErrMergeRepositories = errors.NewKind("at least two different repositories are needed to merge, got %v")
+
+// MergeResult is the outcome of merging repositories.
+type MergeResult struct {
+	// Target is the repository the rest of them were merged into.
+	Target kallax.ULID
+	// Merged are the repositories merged into Target, they do not exist
+	// anymore.
+	Merged []kallax.ULID
+	// Inits are the rooted repositories whose references and remotes were
+	// renamed.
+	Inits []model.SHA1
+	// Overlapping are other repositories that share some endpoint with the
+	// merged ones, but were not merged.
+	Overlapping []kallax.ULID
+}
+
+// Merger merges repositories that are the same into one of them, both in
+// the database and in the rooted repositories.
+type Merger struct {
+	db      *Database
+	txer    repository.RootedTransactioner
+	session lock.Session
+	dry     bool
+}
+
+// NewMerger creates and initializes a new Merger. The session is used to
+// lease the repositories and lock the rooted repositories while they are
+// modified, so it must be connected to the same locking service as the
+// consumers.
+func NewMerger(
+	db *Database,
+	txer repository.RootedTransactioner,
+	session lock.Session,
+) *Merger {
+	return &Merger{
+		db:      db,
+		txer:    txer,
+		session: session,
+	}
+}
+
+// Dry sets dry run mode. Nothing is modified, only the result is computed.
+func (m *Merger) Dry(d bool) {
+	m.dry = d
+}
+
+// Merge merges the repositories with the given IDs into the first one. The
+// target repository gets all the endpoints and references of the rest of
+// them, which are deleted. The references named after the merged
+// repositories in every rooted repository are renamed after the target one,
+// as well as their remotes. When both repositories have a reference with the
+// same name in the same rooted repository, the one of the target is kept.
+//
+// The rooted repositories are modified first and the database is changed at
+// the end in a single transaction, so the merged repositories and their
+// references are kept in the database until every rooted repository is
+// done. Renaming the references is idempotent, so a merge that failed or was
+// interrupted is completed running it again with the same repositories.
+func (m *Merger) Merge(ctx context.Context, ids []kallax.ULID) (*MergeResult, error) {
+	ids = uniqueULIDs(ids)
+	if len(ids) < 2 {
+		return nil, ErrMergeRepositories.New(ids)
+	}
+
+	leases, err := m.lease(ids)
+	defer m.unlock(leases)
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]*model.Repository, len(ids))
+	for i, id := range ids {
+		repos[i], err = m.db.store.Get(id)
+		if err != nil {
+			return nil, fmt.Errorf("could not get repository %s: %s", id, err)
+		}
+	}
+
+	target, sources := repos[0], repos[1:]
+	result := &MergeResult{Target: target.ID}
+
+	endpoints := target.Endpoints
+	for _, r := range sources {
+		result.Merged = append(result.Merged, r.ID)
+		endpoints = appendUnique(endpoints, r.Endpoints...)
+	}
+
+	result.Inits = referencesInits(sources)
+
+	l := log.With(log.Fields{
+		"target": target.ID,
+		"merged": result.Merged,
+	})
+
+	if !m.dry {
+		target.Endpoints = endpoints
+		for _, ic := range result.Inits {
+			if err := m.mergeRooted(ctx, ic, target, sources); err != nil {
+				l.With(log.Fields{"init": ic.String()}).
+					Errorf(err, "could not merge rooted repository")
+				return nil, err
+			}
+		}
+
+		if err := m.mergeDatabase(ctx, target, sources); err != nil {
+			l.Errorf(err, "could not merge repositories in database")
+			return nil, err
+		}
+	}
+
+	result.Overlapping, err = m.overlapping(ids, endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	l.With(log.Fields{
+		"inits":       len(result.Inits),
+		"overlapping": result.Overlapping,
+		"dry":         m.dry,
+	}).Infof("repositories merged")
+
+	return result, nil
+}
+
+// lease takes the leases of the repositories, so they are not fetched while
+// they are merged. They are taken in order to avoid deadlocks.
+func (m *Merger) lease(ids []kallax.ULID) ([]lock.Locker, error) {
+	sorted := append([]kallax.ULID(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].String() < sorted[j].String()
+	})
+
+	var leases []lock.Locker
+	for _, id := range sorted {
+		lease := m.session.NewLocker(borges.RepositoryLeaseID(id))
+		if _, err := lease.Lock(); err != nil {
+			return leases, fmt.Errorf("could not lease repository %s: %s", id, err)
+		}
+
+		leases = append(leases, lease)
+	}
+
+	return leases, nil
+}
+
+func (m *Merger) unlock(lockers []lock.Locker) {
+	for _, l := range lockers {
+		if err := l.Unlock(); err != nil {
+			log.Errorf(err, "failed to release lock")
+		}
+	}
+}
+
+// mergeRooted renames the references and remotes of the sources in the
+// rooted repository ic after the target.
+func (m *Merger) mergeRooted(
+	ctx context.Context,
+	ic model.SHA1,
+	target *model.Repository,
+	sources []*model.Repository,
+) error {
+	locker := m.session.NewLocker(borges.RootedLockID(ic))
+	if _, err := locker.Lock(); err != nil {
+		return err
+	}
+	defer m.unlock([]lock.Locker{locker})
+
+	tx, err := m.txer.Begin(ctx, plumbing.Hash(ic))
+	if err != nil {
+		return err
+	}
+
+	err = mergeRootedRepository(tx.Storer(), target, sources)
+	if err != nil {
+		if e := tx.Rollback(); e != nil {
+			log.Errorf(e, "could not rollback rooted repository")
+		}
+
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func mergeRootedRepository(
+	s storage.Storer,
+	target *model.Repository,
+	sources []*model.Repository,
+) error {
+	r, err := git.Open(s, nil)
+	if err != nil {
+		return err
+	}
+
+	suffixes := make(map[string]bool)
+	for _, src := range sources {
+		suffixes["/"+src.ID.String()] = true
+	}
+
+	targetSuffix := "/" + target.ID.String()
+	rename := func(name plumbing.ReferenceName) (plumbing.ReferenceName, bool) {
+		n := name.String()
+		i := strings.LastIndex(n, "/")
+		if i < 0 || !suffixes[n[i:]] {
+			return name, false
+		}
+
+		return plumbing.ReferenceName(n[:i] + targetSuffix), true
+	}
+
+	iter, err := r.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+
+	var (
+		refs     []*plumbing.Reference
+		existing = make(map[plumbing.ReferenceName]bool)
+	)
+
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		existing[ref.Name()] = true
+		if _, ok := rename(ref.Name()); ok {
+			refs = append(refs, ref)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		if err := r.Storer.RemoveReference(ref.Name()); err != nil {
+			return err
+		}
+
+		name, _ := rename(ref.Name())
+		if existing[name] {
+			continue
+		}
+
+		var newRef *plumbing.Reference
+		switch ref.Type() {
+		case plumbing.SymbolicReference:
+			t, _ := rename(ref.Target())
+			newRef = plumbing.NewSymbolicReference(name, t)
+		default:
+			newRef = plumbing.NewHashReference(name, ref.Hash())
+		}
+
+		if err := r.Storer.SetReference(newRef); err != nil {
+			return err
+		}
+
+		existing[name] = true
+	}
+
+	for _, src := range sources {
+		err := r.DeleteRemote(src.ID.String())
+		if err != nil && err != git.ErrRemoteNotFound {
+			return err
+		}
+	}
+
+	return borges.StoreConfig(r, target)
+}
+
+// mergeDatabase moves the references of the sources to the target, updates
+// its endpoints and deletes the sources in the same transaction.
+func (m *Merger) mergeDatabase(
+	ctx context.Context,
+	target *model.Repository,
+	sources []*model.Repository,
+) error {
+	type key struct {
+		init model.SHA1
+		name string
+	}
+
+	existing := make(map[key]bool)
+	for _, ref := range target.References {
+		existing[key{ref.Init, ref.Name}] = true
+	}
+
+	var (
+		remove []string
+		moved  []*model.Reference
+	)
+
+	for _, src := range sources {
+		remove = append(remove, src.ID.String())
+		for _, ref := range src.References {
+			k := key{ref.Init, ref.Name}
+			if existing[k] {
+				continue
+			}
+
+			existing[k] = true
+			moved = append(moved, ref)
+		}
+	}
+
+	tx, err := m.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, dbRepoRefsRemoveSQL, pq.Array(remove))
+	for _, ref := range moved {
+		if err != nil {
+			break
+		}
+
+		_, err = tx.ExecContext(ctx, dbRefInsertSQL,
+			kallax.NewULID(), now, now, ref.Name, target.ID,
+			ref.Hash, ref.Init, ref.Roots, ref.Time)
+	}
+
+	if err == nil {
+		_, err = tx.ExecContext(ctx, dbSetEndpointsSQL,
+			pq.Array(target.Endpoints), now, target.ID)
+	}
+
+	if err == nil {
+		_, err = tx.ExecContext(ctx, dbReposRemoveSQL, pq.Array(remove))
+	}
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, ref := range moved {
+		ref.Repository = target
+		target.References = append(target.References, ref)
+	}
+
+	return nil
+}
+
+// overlapping returns the repositories, other than the given ones, that
+// share any of the endpoints, as they are or canonicalized.
+func (m *Merger) overlapping(
+	ids []kallax.ULID,
+	endpoints []string,
+) ([]kallax.ULID, error) {
+	lookup := appendUnique(nil, endpoints...)
+	lookup = appendUnique(lookup,
+		borges.CanonicalEndpoints(borges.DefaultCanonicalizer, endpoints)...)
+
+	repos, err := m.db.store.GetByEndpoints(lookup...)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[kallax.ULID]bool)
+	for _, id := range ids {
+		merged[id] = true
+	}
+
+	var result []kallax.ULID
+	for _, r := range repos {
+		if !merged[r.ID] {
+			merged[r.ID] = true
+			result = append(result, r.ID)
+		}
+	}
+
+	return result, nil
+}
+
+// referencesInits returns the distinct inits of the references of the
+// repositories.
+func referencesInits(repos []*model.Repository) []model.SHA1 {
+	seen := make(map[model.SHA1]bool)
+	var inits []model.SHA1
+	for _, r := range repos {
+		for _, ref := range r.References {
+			if !seen[ref.Init] {
+				seen[ref.Init] = true
+				inits = append(inits, ref.Init)
+			}
+		}
+	}
+
+	sort.Slice(inits, func(i, j int) bool {
+		return inits[i].String() < inits[j].String()
+	})
+
+	return inits
+}
+
+func uniqueULIDs(ids []kallax.ULID) []kallax.ULID {
+	seen := make(map[kallax.ULID]bool)
+	var result []kallax.ULID
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+
+	return result
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, e := range list {
+			if e == v {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,266 @@
+package tool
+
+import (
+	"context"
+	"testing"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+)
+
+func TestMergeRootedRepository(t *testing.T) {
+	require := require.New(t)
+
+	target := model.NewRepository()
+	target.Endpoints = []string{"https://github.com/src-d/borges"}
+	source := model.NewRepository()
+	source.Endpoints = []string{"git://github.com/src-d/borges.git"}
+	other := model.NewRepository()
+	other.Endpoints = []string{"https://github.com/src-d/go-git"}
+
+	hashes := []plumbing.Hash{
+		plumbing.NewHash(inits[0]),
+		plumbing.NewHash(inits[1]),
+		plumbing.NewHash(inits[2]),
+	}
+
+	s := memory.NewStorage()
+	r, err := git.Init(s, nil)
+	require.NoError(err)
+
+	refs := []*plumbing.Reference{
+		plumbing.NewHashReference(refName("refs/heads/master", target), hashes[0]),
+		plumbing.NewHashReference(refName("refs/heads/master", source), hashes[1]),
+		plumbing.NewHashReference(refName("refs/heads/dev", source), hashes[2]),
+		plumbing.NewSymbolicReference(refName("refs/heads/head", source),
+			refName("refs/heads/dev", source)),
+		plumbing.NewHashReference(refName("refs/heads/master", other), hashes[2]),
+	}
+
+	for _, ref := range refs {
+		require.NoError(s.SetReference(ref))
+	}
+
+	for _, mr := range []*model.Repository{target, source, other} {
+		require.NoError(borges.StoreConfig(r, mr))
+	}
+
+	target.Endpoints = append(target.Endpoints, source.Endpoints...)
+	err = mergeRootedRepository(s, target, []*model.Repository{source})
+	require.NoError(err)
+
+	expected := map[plumbing.ReferenceName]*plumbing.Reference{
+		refName("refs/heads/master", target): plumbing.NewHashReference(
+			refName("refs/heads/master", target), hashes[0]),
+		refName("refs/heads/dev", target): plumbing.NewHashReference(
+			refName("refs/heads/dev", target), hashes[2]),
+		refName("refs/heads/head", target): plumbing.NewSymbolicReference(
+			refName("refs/heads/head", target), refName("refs/heads/dev", target)),
+		refName("refs/heads/master", other): plumbing.NewHashReference(
+			refName("refs/heads/master", other), hashes[2]),
+	}
+
+	iter, err := s.IterReferences()
+	require.NoError(err)
+
+	obtained := make(map[plumbing.ReferenceName]*plumbing.Reference)
+	require.NoError(iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			obtained[ref.Name()] = ref
+		}
+
+		return nil
+	}))
+	require.Equal(expected, obtained)
+
+	c, err := s.Config()
+	require.NoError(err)
+	require.Len(c.Remotes, 2)
+	require.NotContains(c.Remotes, source.ID.String())
+	require.Equal(target.Endpoints, c.Remotes[target.ID.String()].URLs)
+	require.Equal(other.Endpoints, c.Remotes[other.ID.String()].URLs)
+
+	// merging again, as a rerun after a failure does, changes nothing
+	err = mergeRootedRepository(s, target, []*model.Repository{source})
+	require.NoError(err)
+
+	iter, err = s.IterReferences()
+	require.NoError(err)
+
+	obtained = make(map[plumbing.ReferenceName]*plumbing.Reference)
+	require.NoError(iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			obtained[ref.Name()] = ref
+		}
+
+		return nil
+	}))
+	require.Equal(expected, obtained)
+
+	c, err = s.Config()
+	require.NoError(err)
+	require.Len(c.Remotes, 2)
+	require.Equal(target.Endpoints, c.Remotes[target.ID.String()].URLs)
+}
+
+func TestMergeRepositoriesErrors(t *testing.T) {
+	m := NewMerger(nil, nil, nil)
+
+	id := kallax.NewULID()
+	_, err := m.Merge(context.TODO(), []kallax.ULID{id, id})
+	require.True(t, ErrMergeRepositories.Is(err))
+}
+
+func TestMerge(t *testing.T) {
+	suite.Run(t, new(MergeSuite))
+}
+
+type MergeSuite struct {
+	ToolSuite
+	txer   repository.RootedTransactioner
+	merger *Merger
+}
+
+func (s *MergeSuite) SetupTest() {
+	s.ToolSuite.SetupTest()
+
+	copier := repository.NewCopier(
+		memfs.New(),
+		repository.NewLocalFs(memfs.New()),
+		0,
+	)
+	s.txer = repository.NewSivaRootedTransactioner(copier)
+
+	session, err := lock.NewLocal().NewSession(&lock.SessionConfig{})
+	s.Require().NoError(err)
+
+	s.merger = NewMerger(NewDatabase(s.DB), s.txer, session)
+}
+
+func (s *MergeSuite) TearDownTest() {
+	s.ToolSuite.TearDownTest()
+}
+
+func (s *MergeSuite) TestMerge() {
+	require := s.Require()
+
+	init := model.NewSHA1(inits[0])
+	a := s.createMergeRepo(init, "refs/heads/master",
+		"https://github.com/src-d/borges")
+	b := s.createMergeRepo(init, "refs/heads/dev",
+		"git://github.com/src-d/borges.git")
+	c := s.createMergeRepo(init, "refs/heads/master",
+		"https://github.com/src-d/borges", "https://example.com/borges")
+
+	res, err := s.merger.Merge(context.TODO(), []kallax.ULID{a.ID, b.ID})
+	require.NoError(err)
+	require.Equal(a.ID, res.Target)
+	require.Equal([]kallax.ULID{b.ID}, res.Merged)
+	require.Equal([]model.SHA1{init}, res.Inits)
+	require.Equal([]kallax.ULID{c.ID}, res.Overlapping)
+
+	_, err = s.store.Get(b.ID)
+	require.Error(err)
+
+	repo, err := s.store.Get(a.ID)
+	require.NoError(err)
+	require.Equal([]string{
+		"https://github.com/src-d/borges",
+		"git://github.com/src-d/borges.git",
+	}, repo.Endpoints)
+
+	var names []string
+	for _, ref := range repo.References {
+		names = append(names, ref.Name)
+	}
+	require.ElementsMatch([]string{"refs/heads/master", "refs/heads/dev"}, names)
+
+	tx, err := s.txer.Begin(context.TODO(), plumbing.Hash(init))
+	require.NoError(err)
+	defer tx.Rollback()
+
+	_, err = tx.Storer().Reference(refName("refs/heads/dev", a))
+	require.NoError(err)
+	_, err = tx.Storer().Reference(refName("refs/heads/dev", b))
+	require.Equal(plumbing.ErrReferenceNotFound, err)
+
+	config, err := tx.Storer().Config()
+	require.NoError(err)
+	require.NotContains(config.Remotes, b.ID.String())
+	require.Equal(repo.Endpoints, config.Remotes[a.ID.String()].URLs)
+}
+
+func (s *MergeSuite) TestMergeDry() {
+	require := s.Require()
+
+	init := model.NewSHA1(inits[0])
+	a := s.createMergeRepo(init, "refs/heads/master", "https://github.com/src-d/borges")
+	b := s.createMergeRepo(init, "refs/heads/dev", "git://github.com/src-d/borges.git")
+
+	s.merger.Dry(true)
+	res, err := s.merger.Merge(context.TODO(), []kallax.ULID{a.ID, b.ID})
+	require.NoError(err)
+	require.Equal([]kallax.ULID{b.ID}, res.Merged)
+	require.Empty(res.Overlapping)
+
+	_, err = s.store.Get(b.ID)
+	require.NoError(err)
+
+	tx, err := s.txer.Begin(context.TODO(), plumbing.Hash(init))
+	require.NoError(err)
+	defer tx.Rollback()
+
+	_, err = tx.Storer().Reference(refName("refs/heads/dev", b))
+	require.NoError(err)
+}
+
+// createMergeRepo creates a repository in the database with a reference
+// stored in the rooted repository init.
+func (s *MergeSuite) createMergeRepo(
+	init model.SHA1,
+	name string,
+	endpoints ...string,
+) *model.Repository {
+	require := s.Require()
+
+	repo := model.NewRepository()
+	repo.Endpoints = endpoints
+
+	ref := model.NewReference()
+	ref.Name = name
+	ref.Hash = init
+	ref.Init = init
+	repo.References = []*model.Reference{ref}
+	require.NoError(s.store.Create(repo))
+
+	ctx := context.TODO()
+	tx, err := s.txer.Begin(ctx, plumbing.Hash(init))
+	require.NoError(err)
+
+	r, err := git.Open(tx.Storer(), nil)
+	if err == git.ErrRepositoryNotExists {
+		r, err = git.Init(tx.Storer(), nil)
+	}
+	require.NoError(err)
+
+	require.NoError(r.Storer.SetReference(plumbing.NewHashReference(
+		refName(name, repo), plumbing.Hash(init))))
+	require.NoError(borges.StoreConfig(r, repo))
+	require.NoError(tx.Commit(ctx))
+
+	return repo
+}
+
+func refName(name string, r *model.Repository) plumbing.ReferenceName {
+	return plumbing.ReferenceName(name + "/" + r.ID.String())
+}
@@ -0,0 +1,73 @@
+package tool
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// Rebalancer moves the siva files of a borges.ShardedFs to the shards
+// assigned to them, as adding, removing or changing the weight of shards
+// changes the shard of some of them. The rooted repositories are locked
+// while their siva files are moved.
+type Rebalancer struct {
+	fs      *borges.ShardedFs
+	session lock.Session
+	bucket  int
+	dry     bool
+}
+
+// NewRebalancer creates and initializes a new Rebalancer. The session must
+// be connected to the same locking service as the consumers.
+func NewRebalancer(fs *borges.ShardedFs, session lock.Session) *Rebalancer {
+	return &Rebalancer{
+		fs:      fs,
+		session: session,
+	}
+}
+
+// Bucket sets the bucket size of the siva files.
+func (r *Rebalancer) Bucket(b int) {
+	r.bucket = b
+}
+
+// Dry sets dry run mode. The misplaced siva files are found but not moved.
+func (r *Rebalancer) Dry(d bool) {
+	r.dry = d
+}
+
+// Rebalance moves the siva file of the rooted repository with the given init
+// to its shard. It returns the shards where it was misplaced.
+func (r *Rebalancer) Rebalance(
+	ctx context.Context,
+	init string,
+) ([]*borges.Shard, error) {
+	path := fmt.Sprintf("%s.siva", bucketPath(init, r.bucket))
+
+	locker := r.session.NewLocker(borges.RootedLockID(model.NewSHA1(init)))
+	if _, err := locker.Lock(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := locker.Unlock(); err != nil {
+			log.Errorf(err, "could not unlock rooted repository")
+		}
+	}()
+
+	if r.dry {
+		return r.fs.Misplaced(path)
+	}
+
+	return r.fs.Place(ctx, path)
+}
+
+// Assigned returns the shard assigned to the siva file of the rooted
+// repository with the given init.
+func (r *Rebalancer) Assigned(init string) *borges.Shard {
+	return r.fs.Locate(fmt.Sprintf("%s.siva", init))
+}
@@ -0,0 +1,87 @@
+package tool
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+func TestRebalancer(t *testing.T) {
+	require := require.New(t)
+
+	fss := []billy.Filesystem{memfs.New(), memfs.New()}
+	shards := make([]*borges.Shard, len(fss))
+	for i, fs := range fss {
+		shards[i] = &borges.Shard{
+			Name:   fmt.Sprintf("shard-%d", i),
+			Fs:     repository.NewLocalFs(fs),
+			Weight: 1,
+		}
+	}
+
+	sharded, err := borges.NewShardedFs(shards...)
+	require.NoError(err)
+
+	session, err := lock.NewLocal().NewSession(&lock.SessionConfig{})
+	require.NoError(err)
+
+	r := NewRebalancer(sharded, session)
+	r.Bucket(2)
+	r.Dry(true)
+
+	// half of the siva files are in the shard not assigned to them
+	ctx := context.TODO()
+	for i, init := range inits {
+		wrong := 0
+		if r.Assigned(init) == shards[0] {
+			wrong = 1
+		}
+
+		in := wrong
+		if i%2 == 0 {
+			in = 1 - wrong
+		}
+
+		path := fmt.Sprintf("%s.siva", bucketPath(init, 2))
+		require.NoError(util.WriteFile(fss[in], path, []byte(init), 0644))
+
+		from, err := r.Rebalance(ctx, init)
+		require.NoError(err)
+		if in == wrong {
+			require.Equal([]*borges.Shard{shards[wrong]}, from)
+		} else {
+			require.Len(from, 0)
+		}
+	}
+
+	r.Dry(false)
+	for _, init := range inits {
+		_, err := r.Rebalance(ctx, init)
+		require.NoError(err)
+	}
+
+	for _, init := range inits {
+		path := fmt.Sprintf("%s.siva", bucketPath(init, 2))
+		for i, sh := range shards {
+			_, err := fss[i].Stat(path)
+			if sh == r.Assigned(init) {
+				require.NoError(err)
+			} else {
+				require.Error(err)
+			}
+		}
+
+		from, err := r.Rebalance(ctx, init)
+		require.NoError(err)
+		require.Len(from, 0)
+	}
+}
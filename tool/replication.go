@@ -0,0 +1,168 @@
+package tool
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+	"github.com/src-d/borges/storage"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// ReplicaVerifier compares the siva files of a borges.ReplicatedFs in the
+// primary and the replica, and optionally repairs the divergences. The
+// rooted repositories are locked while their siva files are verified.
+type ReplicaVerifier struct {
+	fs      *borges.ReplicatedFs
+	session lock.Session
+	tiers   *borges.Tiers
+	logs    []string
+	bucket  int
+	repair  bool
+	restore bool
+}
+
+// NewReplicaVerifier creates and initializes a new ReplicaVerifier. The
+// session must be connected to the same locking service as the consumers.
+func NewReplicaVerifier(
+	fs *borges.ReplicatedFs,
+	session lock.Session,
+) *ReplicaVerifier {
+	return &ReplicaVerifier{
+		fs:      fs,
+		session: session,
+	}
+}
+
+// Bucket sets the bucket size of the siva files.
+func (v *ReplicaVerifier) Bucket(b int) {
+	v.bucket = b
+}
+
+// Tiers sets the tiers of the primary. The siva files in the cold tier are
+// compared with the cold copy.
+func (v *ReplicaVerifier) Tiers(t *borges.Tiers) {
+	v.tiers = t
+}
+
+// Logs sets the replication logs of the processes replicating
+// asynchronously. The siva files with operations pending in them are not
+// compared nor repaired.
+func (v *ReplicaVerifier) Logs(paths ...string) {
+	v.logs = paths
+}
+
+// Repair sets whether the siva files missing or different in the replica are
+// repaired.
+func (v *ReplicaVerifier) Repair(r bool) {
+	v.repair = r
+}
+
+// Restore sets whether the siva files missing in the primary are restored
+// from the replica. They may have been deleted on purpose, so it must only
+// be set when they are known to be lost.
+func (v *ReplicaVerifier) Restore(r bool) {
+	v.restore = r
+}
+
+// Verify compares the siva file of the rooted repository with the given init
+// in the primary and the replica, repairing it if it diverges and repair or
+// restore are enabled. It returns the check done before repairing.
+func (v *ReplicaVerifier) Verify(
+	ctx context.Context,
+	init string,
+) (*borges.ReplicaCheck, error) {
+	path := fmt.Sprintf("%s.siva", bucketPath(init, v.bucket))
+
+	locker := v.session.NewLocker(borges.RootedLockID(model.NewSHA1(init)))
+	if _, err := locker.Lock(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := locker.Unlock(); err != nil {
+			log.Errorf(err, "could not unlock rooted repository")
+		}
+	}()
+
+	fs, err := v.primary(init)
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := fs.Check(ctx, path)
+	if err != nil || check.Status == borges.ReplicaOK {
+		return check, err
+	}
+
+	pending, err := v.isPending(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if pending {
+		check.Status = borges.ReplicaPending
+		return check, nil
+	}
+
+	if v.repair {
+		if err := fs.Repair(ctx, check); err != nil {
+			return nil, err
+		}
+	}
+
+	if v.restore {
+		if err := fs.Restore(ctx, check); err != nil {
+			return nil, err
+		}
+	}
+
+	return check, nil
+}
+
+// primary returns the filesystem with the primary copy of the siva file, the
+// cold tier if it was moved there.
+func (v *ReplicaVerifier) primary(init string) (*borges.ReplicatedFs, error) {
+	if v.tiers == nil {
+		return v.fs, nil
+	}
+
+	tier, err := v.tiers.Locate(model.NewSHA1(init))
+	if borges.ErrSivaNotFound.Is(err) {
+		return v.fs, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tier == storage.ColdTier {
+		return v.fs.WithPrimary(v.tiers.Cold()), nil
+	}
+
+	return v.fs, nil
+}
+
+// isPending returns whether there are operations of the given path pending
+// in the replication logs. The logs are read every time as they are being
+// written by other processes.
+func (v *ReplicaVerifier) isPending(path string) (bool, error) {
+	path = filepath.Join("/", path)
+	for _, l := range v.logs {
+		entries, err := borges.ReadReplicationLog(l)
+		if err != nil {
+			return false, err
+		}
+
+		for _, e := range entries {
+			if filepath.Join("/", e.Path) == path {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
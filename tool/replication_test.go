@@ -0,0 +1,178 @@
+package tool
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+func TestReplicaVerifier(t *testing.T) {
+	require := require.New(t)
+
+	primary, replica := memfs.New(), memfs.New()
+	fs := borges.NewReplicatedFs(
+		repository.NewLocalFs(primary),
+		repository.NewLocalFs(replica),
+	)
+
+	session, err := lock.NewLocal().NewSession(&lock.SessionConfig{})
+	require.NoError(err)
+
+	path := func(init string) string {
+		return init[:2] + "/" + init + ".siva"
+	}
+
+	require.NoError(util.WriteFile(primary, path(inits[0]), []byte("siva"), 0644))
+	require.NoError(util.WriteFile(replica, path(inits[0]), []byte("siva"), 0644))
+	require.NoError(util.WriteFile(primary, path(inits[1]), []byte("siva"), 0644))
+	require.NoError(util.WriteFile(primary, path(inits[2]), []byte("siva"), 0644))
+	require.NoError(util.WriteFile(replica, path(inits[2]), []byte("avis"), 0644))
+	require.NoError(util.WriteFile(replica, path(inits[3]), []byte("siva"), 0644))
+
+	expected := []borges.ReplicaStatus{
+		borges.ReplicaOK,
+		borges.ReplicaMissing,
+		borges.ReplicaDiffers,
+		borges.PrimaryMissing,
+		borges.BothMissing,
+	}
+
+	ctx := context.TODO()
+	v := NewReplicaVerifier(fs, session)
+	v.Bucket(2)
+
+	for i, status := range expected {
+		check, err := v.Verify(ctx, inits[i])
+		require.NoError(err)
+		require.Equal(status, check.Status, inits[i])
+	}
+
+	v.Repair(true)
+	for i, status := range expected {
+		check, err := v.Verify(ctx, inits[i])
+		require.NoError(err)
+		require.Equal(status, check.Status, inits[i])
+	}
+
+	repaired := []borges.ReplicaStatus{
+		borges.ReplicaOK,
+		borges.ReplicaOK,
+		borges.ReplicaOK,
+		borges.PrimaryMissing,
+		borges.BothMissing,
+	}
+
+	for i, status := range repaired {
+		check, err := v.Verify(ctx, inits[i])
+		require.NoError(err)
+		require.Equal(status, check.Status, inits[i])
+	}
+
+	v.Restore(true)
+	_, err = v.Verify(ctx, inits[3])
+	require.NoError(err)
+	check, err := v.Verify(ctx, inits[3])
+	require.NoError(err)
+	require.Equal(borges.ReplicaOK, check.Status)
+}
+
+func TestReplicaVerifierColdTier(t *testing.T) {
+	require := require.New(t)
+
+	hot, cold, replica := memfs.New(), memfs.New(), memfs.New()
+	fs := borges.NewReplicatedFs(
+		repository.NewLocalFs(hot),
+		repository.NewLocalFs(replica),
+	)
+	tiers := borges.NewTiers(
+		repository.NewLocalFs(hot),
+		repository.NewLocalFs(cold),
+		2,
+		nil,
+	)
+
+	session, err := lock.NewLocal().NewSession(&lock.SessionConfig{})
+	require.NoError(err)
+
+	path := inits[0][:2] + "/" + inits[0] + ".siva"
+	require.NoError(util.WriteFile(cold, path, []byte("siva"), 0644))
+	require.NoError(util.WriteFile(replica, path, []byte("old"), 0644))
+
+	ctx := context.TODO()
+	v := NewReplicaVerifier(fs, session)
+	v.Bucket(2)
+
+	check, err := v.Verify(ctx, inits[0])
+	require.NoError(err)
+	require.Equal(borges.PrimaryMissing, check.Status)
+
+	// the siva file is compared with the cold copy and never restored
+	v = NewReplicaVerifier(fs, session)
+	v.Bucket(2)
+	v.Tiers(tiers)
+	v.Repair(true)
+	v.Restore(true)
+
+	check, err = v.Verify(ctx, inits[0])
+	require.NoError(err)
+	require.Equal(borges.ReplicaDiffers, check.Status)
+
+	check, err = v.Verify(ctx, inits[0])
+	require.NoError(err)
+	require.Equal(borges.ReplicaOK, check.Status)
+
+	_, err = hot.Stat(path)
+	require.Error(err)
+}
+
+func TestReplicaVerifierPending(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "borges-replication")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	primary, replica := memfs.New(), memfs.New()
+	fs := borges.NewReplicatedFs(
+		repository.NewLocalFs(primary),
+		repository.NewLocalFs(replica),
+	)
+
+	session, err := lock.NewLocal().NewSession(&lock.SessionConfig{})
+	require.NoError(err)
+
+	// the siva file was taken down but the replica is not deleted yet
+	path := inits[0][:2] + "/" + inits[0] + ".siva"
+	require.NoError(util.WriteFile(replica, path, []byte("siva"), 0644))
+
+	logPath := filepath.Join(dir, "replication.log")
+	l, err := borges.OpenReplicationLog(logPath)
+	require.NoError(err)
+	defer l.Close()
+	_, err = l.Add(borges.ReplicateDelete, "/"+path)
+	require.NoError(err)
+
+	ctx := context.TODO()
+	v := NewReplicaVerifier(fs, session)
+	v.Bucket(2)
+	v.Logs(logPath)
+	v.Repair(true)
+	v.Restore(true)
+
+	check, err := v.Verify(ctx, inits[0])
+	require.NoError(err)
+	require.Equal(borges.ReplicaPending, check.Status)
+
+	_, err = primary.Stat(path)
+	require.Error(err)
+}
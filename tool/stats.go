@@ -0,0 +1,446 @@
+package tool
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-billy.v4"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+const (
+	dbStatusCountSQL = "select status, count(*) from repositories group by status"
+	dbInitCountSQL   = "select init, count(distinct repository_id), count(*) " +
+		"from repository_references group by init"
+	dbRepoInitRefsSQL = "select repository_id, init, count(*) " +
+		"from repository_references group by repository_id, init"
+
+	sivaExt = ".siva"
+)
+
+// SizeLimits are the upper limits of the bars of the siva size histogram,
+// the last bar holds the siva files bigger than all of them.
+var SizeLimits = []int64{
+	1 << 20,   // 1 MiB
+	10 << 20,  // 10 MiB
+	100 << 20, // 100 MiB
+	1 << 30,   // 1 GiB
+	10 << 30,  // 10 GiB
+}
+
+// Stats are the statistics of the repositories in the database and the
+// siva files in the storage filesystems.
+type Stats struct {
+	// Repositories is the number of repositories per status.
+	Repositories map[model.FetchStatus]int `json:"repositories"`
+	// References is the total number of references.
+	References int `json:"references"`
+	// Sivas is the number of siva files found in the filesystems. A siva
+	// file found in several of them is counted once, with the size of the
+	// first one.
+	Sivas int `json:"sivas"`
+	// Bytes is the total size of the siva files.
+	Bytes int64 `json:"bytes"`
+	// Histogram is the number of siva files and their size by size.
+	Histogram []*SizeBar `json:"histogram"`
+	// Buckets is the number of siva files per bucket directory, the ones
+	// in the root directory are under an empty name.
+	Buckets map[string]int `json:"buckets"`
+	// Inits are the statistics of every rooted repository and siva file,
+	// the largest first. Only the top ones are kept unless all of them are
+	// requested.
+	Inits []*InitStats `json:"inits"`
+	// InitsSummary summarizes the statistics of all the rooted
+	// repositories.
+	InitsSummary InitsSummary `json:"inits_summary"`
+	// Missing is the number of rooted repositories with references in the
+	// database but without siva file.
+	Missing int `json:"missing"`
+	// Unreferenced is the number of siva files without references in the
+	// database.
+	Unreferenced int `json:"unreferenced"`
+	// RepositoryBytes is the estimated size of the repositories with the
+	// most bytes in the siva files, the largest first. It is only computed
+	// if requested.
+	RepositoryBytes []*RepositoryBytes `json:"repository_bytes,omitempty"`
+}
+
+// SizeBar is a bar of the siva size histogram.
+type SizeBar struct {
+	// Max is the upper limit of the size of the siva files in the bar, 0
+	// means no limit.
+	Max int64 `json:"max"`
+	// Sivas is the number of siva files in the bar.
+	Sivas int `json:"sivas"`
+	// Bytes is the total size of the siva files in the bar.
+	Bytes int64 `json:"bytes"`
+}
+
+// InitStats are the statistics of a rooted repository.
+type InitStats struct {
+	// Init is the init commit of the rooted repository.
+	Init string `json:"init"`
+	// Bytes is the size of the siva file, -1 if it does not exist.
+	Bytes int64 `json:"bytes"`
+	// Repositories is the number of repositories with references in it.
+	Repositories int `json:"repositories"`
+	// References is the number of references stored in it.
+	References int `json:"references"`
+}
+
+// InitsSummary summarizes the repositories and references of the rooted
+// repositories.
+type InitsSummary struct {
+	// Inits is the number of rooted repositories with references.
+	Inits int `json:"inits"`
+	// MaxRepositories is the maximum number of repositories in a rooted
+	// repository.
+	MaxRepositories int `json:"max_repositories"`
+	// AvgRepositories is the average number of repositories per rooted
+	// repository.
+	AvgRepositories float64 `json:"avg_repositories"`
+	// MaxReferences is the maximum number of references in a rooted
+	// repository.
+	MaxReferences int `json:"max_references"`
+	// AvgReferences is the average number of references per rooted
+	// repository.
+	AvgReferences float64 `json:"avg_references"`
+}
+
+// RepositoryBytes is the estimated size of a repository in the siva files.
+type RepositoryBytes struct {
+	// ID is the repository ID.
+	ID kallax.ULID `json:"id"`
+	// Bytes is the estimated size.
+	Bytes int64 `json:"bytes"`
+	// Inits is the number of rooted repositories where it has references.
+	Inits int `json:"inits"`
+}
+
+// StatsCollector gathers the Stats of a database and the storage filesystems
+// of its siva files.
+type StatsCollector struct {
+	db           *Database
+	fss          []billy.Basic
+	top          int
+	allInits     bool
+	repoEstimate bool
+}
+
+// NewStatsCollector creates and initializes a new StatsCollector. The siva
+// files are searched in all the given filesystems, such as the shards of the
+// hot tier and the cold tier, in order. Nil filesystems are ignored, and
+// only the database statistics are gathered if there are none.
+func NewStatsCollector(db *Database, fss ...billy.Basic) *StatsCollector {
+	c := &StatsCollector{
+		db:  db,
+		top: 10,
+	}
+
+	for _, fs := range fss {
+		if fs != nil {
+			c.fss = append(c.fss, fs)
+		}
+	}
+
+	return c
+}
+
+// Top sets the number of largest rooted repositories and repositories
+// reported.
+func (c *StatsCollector) Top(n int) {
+	c.top = n
+}
+
+// AllInits makes the stats keep all the rooted repositories instead of only
+// the top ones.
+func (c *StatsCollector) AllInits(a bool) {
+	c.allInits = a
+}
+
+// RepositoryBytes enables the estimation of the bytes of every repository.
+// The size of every siva file is split among its repositories in proportion
+// to their number of references in it.
+func (c *StatsCollector) RepositoryBytes(e bool) {
+	c.repoEstimate = e
+}
+
+// Collect gathers the statistics.
+func (c *StatsCollector) Collect() (*Stats, error) {
+	start := time.Now()
+	stats := &Stats{
+		Repositories: make(map[model.FetchStatus]int),
+		Buckets:      make(map[string]int),
+	}
+
+	for _, max := range SizeLimits {
+		stats.Histogram = append(stats.Histogram, &SizeBar{Max: max})
+	}
+	stats.Histogram = append(stats.Histogram, &SizeBar{})
+
+	if err := c.db.countStatuses(stats.Repositories); err != nil {
+		return nil, err
+	}
+
+	inits, err := c.db.initStats()
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64)
+	for _, fs := range c.fss {
+		if err := walkSivas(fs, "", sizes, stats.Buckets); err != nil {
+			return nil, err
+		}
+	}
+
+	for init, size := range sizes {
+		stats.Sivas++
+		stats.Bytes += size
+		stats.Histogram[sizeBar(size)].Sivas++
+		stats.Histogram[sizeBar(size)].Bytes += size
+
+		if _, ok := inits[init]; !ok {
+			stats.Unreferenced++
+		}
+	}
+
+	list := make([]*InitStats, 0, len(inits))
+	for init, is := range inits {
+		is.Bytes = -1
+		if size, ok := sizes[init]; ok {
+			is.Bytes = size
+		} else if len(c.fss) > 0 {
+			stats.Missing++
+		}
+
+		stats.References += is.References
+		list = append(list, is)
+	}
+
+	stats.InitsSummary = summarizeInits(list)
+
+	// unreferenced siva files are also listed, as they take space too
+	for init, size := range sizes {
+		if _, ok := inits[init]; !ok {
+			list = append(list, &InitStats{Init: init, Bytes: size})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+
+		return list[i].Init < list[j].Init
+	})
+
+	if !c.allInits && len(list) > c.top {
+		list = list[:c.top]
+	}
+	stats.Inits = list
+
+	if c.repoEstimate {
+		stats.RepositoryBytes, err = c.db.repositoryBytes(sizes, c.top)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.With(log.Fields{
+		"duration": time.Since(start),
+		"sivas":    stats.Sivas,
+		"inits":    stats.InitsSummary.Inits,
+	}).Infof("finished collecting stats")
+
+	return stats, nil
+}
+
+func (d *Database) countStatuses(counts map[model.FetchStatus]int) error {
+	rows, err := d.db.Query(dbStatusCountSQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			status model.FetchStatus
+			n      int
+		)
+
+		if err := rows.Scan(&status, &n); err != nil {
+			return err
+		}
+
+		counts[status] = n
+	}
+
+	return rows.Err()
+}
+
+func (d *Database) initStats() (map[string]*InitStats, error) {
+	rows, err := d.db.Query(dbInitCountSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	inits := make(map[string]*InitStats)
+	for rows.Next() {
+		var is InitStats
+		if err := rows.Scan(&is.Init, &is.Repositories, &is.References); err != nil {
+			return nil, err
+		}
+
+		inits[is.Init] = &is
+	}
+
+	return inits, rows.Err()
+}
+
+// repositoryBytes estimates the bytes of every repository splitting the size
+// of the siva files among their repositories in proportion to their
+// references. It returns the top largest ones.
+func (d *Database) repositoryBytes(sizes map[string]int64, top int) ([]*RepositoryBytes, error) {
+	rows, err := d.db.Query(dbRepoInitRefsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type share struct {
+		id   kallax.ULID
+		init string
+		refs int
+	}
+
+	var (
+		shares []share
+		totals = make(map[string]int)
+	)
+
+	for rows.Next() {
+		var s share
+		if err := rows.Scan(&s.id, &s.init, &s.refs); err != nil {
+			return nil, err
+		}
+
+		shares = append(shares, s)
+		totals[s.init] += s.refs
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[kallax.ULID]*RepositoryBytes)
+	for _, s := range shares {
+		rb, ok := byID[s.id]
+		if !ok {
+			rb = &RepositoryBytes{ID: s.id}
+			byID[s.id] = rb
+		}
+
+		rb.Inits++
+		rb.Bytes += sizes[s.init] * int64(s.refs) / int64(totals[s.init])
+	}
+
+	list := make([]*RepositoryBytes, 0, len(byID))
+	for _, rb := range byID {
+		list = append(list, rb)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+
+		return list[i].ID.String() < list[j].ID.String()
+	})
+
+	if len(list) > top {
+		list = list[:top]
+	}
+
+	return list, nil
+}
+
+// walkSivas adds the size of every siva file under dir to sizes, by init,
+// and counts them by bucket directory. The siva files already in sizes are
+// skipped.
+func walkSivas(fs billy.Basic, dir string, sizes map[string]int64, buckets map[string]int) error {
+	dfs, ok := fs.(billy.Dir)
+	if !ok {
+		return fmt.Errorf("filesystem does not support listing directories")
+	}
+
+	entries, err := dfs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		if e.IsDir() {
+			if err := walkSivas(fs, name, sizes, buckets); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !strings.HasSuffix(e.Name(), sivaExt) {
+			continue
+		}
+
+		init := strings.TrimSuffix(e.Name(), sivaExt)
+		if _, ok := sizes[init]; ok {
+			continue
+		}
+
+		sizes[init] = e.Size()
+		buckets[dir]++
+	}
+
+	return nil
+}
+
+func sizeBar(size int64) int {
+	for i, max := range SizeLimits {
+		if size <= max {
+			return i
+		}
+	}
+
+	return len(SizeLimits)
+}
+
+func summarizeInits(inits []*InitStats) InitsSummary {
+	s := InitsSummary{Inits: len(inits)}
+	if len(inits) == 0 {
+		return s
+	}
+
+	var repos, refs int
+	for _, is := range inits {
+		repos += is.Repositories
+		refs += is.References
+		if is.Repositories > s.MaxRepositories {
+			s.MaxRepositories = is.Repositories
+		}
+
+		if is.References > s.MaxReferences {
+			s.MaxReferences = is.References
+		}
+	}
+
+	s.AvgRepositories = float64(repos) / float64(len(inits))
+	s.AvgReferences = float64(refs) / float64(len(inits))
+	return s
+}
@@ -0,0 +1,149 @@
+package tool
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+func TestWalkSivas(t *testing.T) {
+	require := require.New(t)
+
+	fs := memfs.New()
+	files := map[string]int{
+		"aa/aabbcc.siva": 10,
+		"aa/aaddee.siva": 20,
+		"bb/bbccdd.siva": 30,
+		"root.siva":      40,
+		"aa/tmp.txt":     50,
+	}
+
+	for name, size := range files {
+		require.NoError(util.WriteFile(fs, name, make([]byte, size), 0644))
+	}
+
+	sizes := make(map[string]int64)
+	buckets := make(map[string]int)
+	require.NoError(walkSivas(fs, "", sizes, buckets))
+
+	require.Equal(map[string]int64{
+		"aabbcc": 10,
+		"aaddee": 20,
+		"bbccdd": 30,
+		"root":   40,
+	}, sizes)
+	require.Equal(map[string]int{"aa": 2, "bb": 1, "": 1}, buckets)
+
+	cold := memfs.New()
+	require.NoError(util.WriteFile(cold, "aa/aabbcc.siva", make([]byte, 5), 0644))
+	require.NoError(util.WriteFile(cold, "cc/ccddee.siva", make([]byte, 60), 0644))
+	require.NoError(walkSivas(cold, "", sizes, buckets))
+
+	require.Equal(map[string]int64{
+		"aabbcc": 10,
+		"aaddee": 20,
+		"bbccdd": 30,
+		"ccddee": 60,
+		"root":   40,
+	}, sizes)
+	require.Equal(map[string]int{"aa": 2, "bb": 1, "cc": 1, "": 1}, buckets)
+}
+
+func TestSizeBar(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(0, sizeBar(0))
+	require.Equal(0, sizeBar(1<<20))
+	require.Equal(1, sizeBar(1<<20+1))
+	require.Equal(3, sizeBar(1<<30))
+	require.Equal(len(SizeLimits), sizeBar(100<<30))
+}
+
+func TestSummarizeInits(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(InitsSummary{}, summarizeInits(nil))
+	require.Equal(InitsSummary{
+		Inits:           2,
+		MaxRepositories: 3,
+		AvgRepositories: 2,
+		MaxReferences:   10,
+		AvgReferences:   6,
+	}, summarizeInits([]*InitStats{
+		{Repositories: 1, References: 2},
+		{Repositories: 3, References: 10},
+	}))
+}
+
+func TestStats(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "borges")
+	require.NoError(t, err)
+
+	suite.Run(t, &StatsSuite{FS: osfs.New(tmp)})
+}
+
+type StatsSuite struct {
+	ToolSuite
+	FS billy.Basic
+}
+
+func (s *StatsSuite) SetupTest() {
+	s.ToolSuite.FS = s.FS
+	s.ToolSuite.bucket = 2
+	s.ToolSuite.SetupTest()
+}
+
+func (s *StatsSuite) TestCollect() {
+	require := s.Require()
+
+	require.NoError(util.WriteFile(s.testFS, "ff/ffff.siva", []byte("unreferenced"), 0644))
+
+	c := NewStatsCollector(NewDatabase(s.DB), s.testFS)
+	c.Top(3)
+	c.RepositoryBytes(true)
+
+	stats, err := c.Collect()
+	require.NoError(err)
+
+	require.Equal(map[model.FetchStatus]int{
+		model.Pending:      2,
+		model.Fetched:      2,
+		model.Fetching:     1,
+		model.NotFound:     1,
+		model.AuthRequired: 1,
+	}, stats.Repositories)
+	require.Equal(16, stats.References)
+	require.Equal(len(inits)+1, stats.Sivas)
+	require.Equal(int64(len(inits)*4+12), stats.Bytes)
+	require.Equal(len(inits)+1, stats.Histogram[0].Sivas)
+	require.Equal(map[string]int{
+		"03": 1, "0b": 2, "10": 1, "11": 1, "14": 1, "15": 1, "ff": 1,
+	}, stats.Buckets)
+	require.Equal(0, stats.Missing)
+	require.Equal(1, stats.Unreferenced)
+
+	require.Len(stats.Inits, 3)
+	require.Equal(&InitStats{Init: "ffff", Bytes: 12}, stats.Inits[0])
+	require.Equal(&InitStats{
+		Init:         inits[0],
+		Bytes:        4,
+		Repositories: len(testRepos),
+		References:   8,
+	}, stats.Inits[1])
+
+	require.Equal(len(inits), stats.InitsSummary.Inits)
+	require.Equal(len(testRepos), stats.InitsSummary.MaxRepositories)
+	require.Equal(8, stats.InitsSummary.MaxReferences)
+
+	require.Len(stats.RepositoryBytes, 3)
+	for _, rb := range stats.RepositoryBytes {
+		require.True(rb.Bytes > 0)
+	}
+}
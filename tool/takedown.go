@@ -0,0 +1,481 @@
+package tool
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+	bstorage "github.com/src-d/borges/storage"
+
+	"github.com/lib/pq"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	sivafs "gopkg.in/src-d/go-billy-siva.v4"
+	"gopkg.in/src-d/go-billy.v4/util"
+	"gopkg.in/src-d/go-errors.v1"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/revlist"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+const (
+	dbTakedownRefsSQL   = "delete from repository_references where repository_id = $1"
+	dbTakedownRepoSQL   = "delete from repositories where id = $1"
+	dbTakedownStatusSQL = "update repositories set status = $1, updated_at = $2 where id = $3"
+	dbTakedownInsertSQL = `insert into repository_takedowns
+	(id, repository_id, endpoints, inits, "references", reason, created_at)
+	values ($1, $2, $3, $4, $5, $6, $7)`
+	dbTakedownFindSQL = `select id, "references", reason, created_at
+	from repository_takedowns where repository_id = $1`
+	dbTakedownCountSQL = `update repository_takedowns
+	set "references" = "references" + $1 where id = $2`
+)
+
+// ErrTakedownReason is returned when a repository is taken down without a
+// reason.
+var ErrTakedownReason = errors.NewKind("a reason is needed to take down repository %s")
+
+// TakedownRecord is the audit record of a repository taken down.
+type TakedownRecord struct {
+	// ID is the identifier of the record.
+	ID kallax.ULID
+	// RepositoryID is the ID the repository had.
+	RepositoryID kallax.ULID
+	// Endpoints are the endpoints of the repository and their canonical
+	// form. They are not archived again.
+	Endpoints []string
+	// Inits are the rooted repositories the repository was removed from.
+	Inits []model.SHA1
+	// References is the number of references removed from the rooted
+	// repositories.
+	References int
+	// Reason is the reason given to take down the repository.
+	Reason string
+	// CreatedAt is the time when the repository was taken down.
+	CreatedAt time.Time
+}
+
+// Takedown removes single repositories from the archive. The references and
+// the remote of the repository are removed from every rooted repository it
+// is in, which are written again without the objects not referenced by any
+// other repository. The repository is deleted from the database, recording
+// its endpoints so it is not archived again.
+type Takedown struct {
+	db      *Database
+	copier  *repository.Copier
+	txer    repository.RootedTransactioner
+	tiers   *borges.Tiers
+	remote  repository.Fs
+	session lock.Session
+	bucket  int
+	dry     bool
+}
+
+// NewTakedown creates and initializes a new Takedown. The copier and the
+// remote filesystem must be the ones of the rooted repositories, and the
+// session must be connected to the same locking service as the consumers.
+func NewTakedown(
+	db *Database,
+	copier *repository.Copier,
+	remote repository.Fs,
+	session lock.Session,
+) *Takedown {
+	return &Takedown{
+		db:      db,
+		copier:  copier,
+		txer:    repository.NewSivaRootedTransactioner(copier),
+		remote:  remote,
+		session: session,
+	}
+}
+
+// Bucket sets the bucket size of the siva files, it must be the same used by
+// the copier.
+func (t *Takedown) Bucket(b int) {
+	t.bucket = b
+}
+
+// Tiers sets the tiers of the siva files, the ones in the cold tier are moved
+// back to the hot one before removing the repository from them. In dry run
+// mode they are read from the cold tier instead.
+func (t *Takedown) Tiers(tiers *borges.Tiers) {
+	t.tiers = tiers
+	t.txer = borges.NewTieredTransactioner(
+		repository.NewSivaRootedTransactioner(t.copier),
+		tiers,
+	)
+}
+
+// Dry sets dry run mode. Nothing is modified, only the record is computed.
+func (t *Takedown) Dry(d bool) {
+	t.dry = d
+}
+
+// Remove takes down the repository with the given ID and returns the audit
+// record stored in the database.
+//
+// The record is stored first and the repository is set to Blocked, so its
+// endpoints are not archived again even if the takedown does not finish.
+// Then the repository is removed from the rooted repositories and, at the
+// end, deleted from the database. A takedown that failed or was interrupted
+// is completed running it again for the same repository: the record stored
+// is reused and the rooted repositories already done are left as they are.
+func (t *Takedown) Remove(
+	ctx context.Context,
+	id kallax.ULID,
+	reason string,
+) (*TakedownRecord, error) {
+	if strings.TrimSpace(reason) == "" {
+		return nil, ErrTakedownReason.New(id)
+	}
+
+	lease := t.session.NewLocker(borges.RepositoryLeaseID(id))
+	if _, err := lease.Lock(); err != nil {
+		return nil, fmt.Errorf("could not lease repository %s: %s", id, err)
+	}
+	defer func() {
+		if err := lease.Unlock(); err != nil {
+			log.Errorf(err, "failed to release lock")
+		}
+	}()
+
+	repo, err := t.db.store.Get(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not get repository %s: %s", id, err)
+	}
+
+	record := &TakedownRecord{
+		ID:           kallax.NewULID(),
+		RepositoryID: id,
+		Endpoints: appendUnique(append([]string(nil), repo.Endpoints...),
+			borges.CanonicalEndpoints(borges.DefaultCanonicalizer, repo.Endpoints)...),
+		Inits:     referencesInits([]*model.Repository{repo}),
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+
+	l := log.With(log.Fields{
+		"id":        id,
+		"endpoints": repo.Endpoints,
+		"dry":       t.dry,
+	})
+
+	if !t.dry {
+		if err := t.storeRecord(ctx, record); err != nil {
+			l.Errorf(err, "could not store takedown record")
+			return nil, err
+		}
+	}
+
+	for _, ic := range record.Inits {
+		n, err := t.removeRooted(ctx, ic, id)
+		if err != nil {
+			l.With(log.Fields{"init": ic.String()}).
+				Errorf(err, "could not remove repository from rooted repository")
+			return nil, err
+		}
+
+		record.References += n
+		if t.dry || n == 0 {
+			continue
+		}
+
+		_, err = t.db.db.ExecContext(ctx, dbTakedownCountSQL, n, record.ID)
+		if err != nil {
+			l.Errorf(err, "could not update takedown record")
+			return nil, err
+		}
+	}
+
+	if !t.dry {
+		if err := t.removeDatabase(ctx, record); err != nil {
+			l.Errorf(err, "could not remove repository from database")
+			return nil, err
+		}
+	}
+
+	l.With(log.Fields{
+		"inits":      len(record.Inits),
+		"references": record.References,
+	}).Infof("repository taken down")
+
+	return record, nil
+}
+
+// removeRooted removes the references and the remote of the repository from
+// the rooted repository ic and returns the number of references removed.
+func (t *Takedown) removeRooted(
+	ctx context.Context,
+	ic model.SHA1,
+	id kallax.ULID,
+) (int, error) {
+	locker := t.session.NewLocker(borges.RootedLockID(ic))
+	if _, err := locker.Lock(); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := locker.Unlock(); err != nil {
+			log.Errorf(err, "failed to release lock")
+		}
+	}()
+
+	txer, err := t.transactioner(ic)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := txer.Begin(ctx, plumbing.Hash(ic))
+	if err != nil {
+		return 0, err
+	}
+
+	// The transaction is only used to read the rooted repository, it is
+	// written again from scratch so the removed objects are not kept.
+	defer func() {
+		if err := tx.Rollback(); err != nil {
+			log.Errorf(err, "could not clean up rooted repository")
+		}
+	}()
+
+	kept, removed, err := splitRootedReferences(tx.Storer(), id)
+	if err != nil || t.dry || removed == 0 {
+		return removed, err
+	}
+
+	if !hasRootedReferences(kept) {
+		name := fmt.Sprintf("%s.siva", ic.String())
+		path := filepath.Join(t.remote.Base(), bucketPath(name, t.bucket))
+		return removed, t.remote.DeleteIfExists(path)
+	}
+
+	return removed, t.rewriteRooted(ctx, ic, id, tx.Storer(), kept)
+}
+
+// transactioner returns the transactioner used to read the rooted repository
+// ic. In dry run mode the siva files in the cold tier are read from there, as
+// the tiered transactioner would move them back to the hot tier.
+func (t *Takedown) transactioner(ic model.SHA1) (repository.RootedTransactioner, error) {
+	if !t.dry || t.tiers == nil {
+		return t.txer, nil
+	}
+
+	tier, err := t.tiers.Locate(ic)
+	if err != nil && !borges.ErrSivaNotFound.Is(err) {
+		return nil, err
+	}
+
+	if tier != bstorage.ColdTier {
+		return t.txer, nil
+	}
+
+	return repository.NewSivaRootedTransactioner(
+		repository.NewCopier(t.copier.Local(), t.tiers.Cold(), t.bucket),
+	), nil
+}
+
+// rewriteRooted writes again the siva file of the rooted repository ic with
+// only the kept references, the objects reachable from them and the config
+// without the remote of the repository.
+func (t *Takedown) rewriteRooted(
+	ctx context.Context,
+	ic model.SHA1,
+	id kallax.ULID,
+	src storage.Storer,
+	kept []*plumbing.Reference,
+) error {
+	r, err := git.Open(src, nil)
+	if err != nil {
+		return err
+	}
+
+	err = r.DeleteRemote(id.String())
+	if err != nil && err != git.ErrRemoteNotFound {
+		return err
+	}
+
+	cfg, err := src.Config()
+	if err != nil {
+		return err
+	}
+
+	var hashes []plumbing.Hash
+	for _, ref := range kept {
+		if ref.Type() == plumbing.HashReference {
+			hashes = append(hashes, ref.Hash())
+		}
+	}
+
+	objects, err := revlist.Objects(src, hashes, nil)
+	if err != nil {
+		return err
+	}
+
+	local := t.copier.Local()
+	localPath := local.Join(fmt.Sprintf(
+		"%s_takedown_%s", ic.String(),
+		strconv.FormatInt(time.Now().UnixNano(), 10),
+	))
+	localSivaPath := filepath.Join(localPath, "siva")
+	localTmpPath := filepath.Join(localPath, "tmp")
+
+	defer util.RemoveAll(local, localPath)
+
+	tmpFs, err := local.Chroot(localTmpPath)
+	if err != nil {
+		return err
+	}
+
+	fs, err := sivafs.NewFilesystem(local, localSivaPath, tmpFs)
+	if err != nil {
+		return err
+	}
+
+	dst := filesystem.NewStorage(fs, cache.NewObjectLRUDefault())
+	if err := dst.SetConfig(cfg); err != nil {
+		return err
+	}
+
+	w, err := dst.PackfileWriter()
+	if err != nil {
+		return err
+	}
+
+	_, err = packfile.NewEncoder(w, src, false).Encode(objects, cfg.Pack.Window)
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	for _, ref := range kept {
+		if err := dst.SetReference(ref); err != nil {
+			return err
+		}
+	}
+
+	if err := fs.Sync(); err != nil {
+		return err
+	}
+
+	return t.copier.CopyToRemote(ctx, localSivaPath, fmt.Sprintf("%s.siva", ic.String()))
+}
+
+// storeRecord stores the audit record and sets the repository to Blocked. If
+// the repository already has a record, left by a previous takedown that did
+// not finish, the record is loaded from the database instead.
+func (t *Takedown) storeRecord(ctx context.Context, record *TakedownRecord) error {
+	err := t.db.db.QueryRowContext(ctx, dbTakedownFindSQL, record.RepositoryID).
+		Scan(&record.ID, &record.References, &record.Reason, &record.CreatedAt)
+	if err == nil {
+		log.With(log.Fields{
+			"id":     record.RepositoryID,
+			"record": record.ID,
+		}).Infof("resuming unfinished takedown")
+		return nil
+	}
+
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	inits := make([]string, len(record.Inits))
+	for i, ic := range record.Inits {
+		inits[i] = ic.String()
+	}
+
+	tx, err := t.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, dbTakedownInsertSQL,
+		record.ID, record.RepositoryID, pq.Array(record.Endpoints),
+		pq.Array(inits), record.References, record.Reason, record.CreatedAt)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, dbTakedownStatusSQL,
+			string(borges.Blocked), time.Now(), record.RepositoryID)
+	}
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// removeDatabase deletes the repository and its references.
+func (t *Takedown) removeDatabase(ctx context.Context, record *TakedownRecord) error {
+	tx, err := t.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, dbTakedownRefsSQL, record.RepositoryID)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, dbTakedownRepoSQL, record.RepositoryID)
+	}
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// splitRootedReferences returns the references of the rooted repository that
+// do not belong to the repository and the number of references that do.
+func splitRootedReferences(
+	s storage.Storer,
+	id kallax.ULID,
+) ([]*plumbing.Reference, int, error) {
+	iter, err := s.IterReferences()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	suffix := "/" + id.String()
+
+	var (
+		kept    []*plumbing.Reference
+		removed int
+	)
+
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasSuffix(ref.Name().String(), suffix) {
+			removed++
+			return nil
+		}
+
+		kept = append(kept, ref)
+		return nil
+	})
+
+	return kept, removed, err
+}
+
+func hasRootedReferences(refs []*plumbing.Reference) bool {
+	for _, ref := range refs {
+		if strings.HasPrefix(ref.Name().String(), "refs/") {
+			return true
+		}
+	}
+
+	return false
+}
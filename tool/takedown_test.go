@@ -0,0 +1,358 @@
+package tool
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	kallax "gopkg.in/src-d/go-kallax.v1"
+)
+
+// rootedFixture holds a rooted repository shared by two repositories, each
+// one with a commit only referenced by itself and a common one.
+type rootedFixture struct {
+	remote    billy.Filesystem
+	copier    *repository.Copier
+	session   lock.Session
+	init      model.SHA1
+	a, b      *model.Repository
+	common    plumbing.Hash
+	onlyA     plumbing.Hash
+	onlyB     plumbing.Hash
+	blobOnlyB plumbing.Hash
+}
+
+func newRootedFixture(t *testing.T) *rootedFixture {
+	require := require.New(t)
+
+	f := &rootedFixture{remote: memfs.New()}
+	f.copier = repository.NewCopier(memfs.New(), repository.NewLocalFs(f.remote), 0)
+
+	var err error
+	f.session, err = lock.NewLocal().NewSession(&lock.SessionConfig{})
+	require.NoError(err)
+
+	f.a = model.NewRepository()
+	f.a.Endpoints = []string{"https://github.com/src-d/borges"}
+	f.b = model.NewRepository()
+	f.b.Endpoints = []string{"https://github.com/foo/borges"}
+
+	ctx := context.TODO()
+	txer := repository.NewSivaRootedTransactioner(f.copier)
+
+	f.init = model.NewSHA1(inits[0])
+	tx, err := txer.Begin(ctx, plumbing.Hash(f.init))
+	require.NoError(err)
+	s := tx.Storer()
+
+	f.common = storeCommit(t, s, "common")
+	f.onlyA = storeCommit(t, s, "a", f.common)
+	f.onlyB = storeCommit(t, s, "b", f.common)
+
+	c, err := object.GetCommit(s, f.onlyB)
+	require.NoError(err)
+	tree, err := c.Tree()
+	require.NoError(err)
+	f.blobOnlyB = tree.Entries[0].Hash
+
+	refs := []*plumbing.Reference{
+		plumbing.NewHashReference(refName("refs/heads/master", f.a), f.onlyA),
+		plumbing.NewHashReference(refName("refs/heads/master", f.b), f.onlyB),
+		plumbing.NewHashReference(refName("refs/tags/v1", f.b), f.common),
+		plumbing.NewSymbolicReference(refName("refs/heads/HEAD", f.b),
+			refName("refs/heads/master", f.b)),
+	}
+
+	for _, ref := range refs {
+		require.NoError(s.SetReference(ref))
+	}
+
+	r, err := git.Open(s, nil)
+	require.NoError(err)
+	require.NoError(borges.StoreConfig(r, f.a))
+	require.NoError(borges.StoreConfig(r, f.b))
+	require.NoError(tx.Commit(ctx))
+
+	return f
+}
+
+// storeCommit stores a commit with a single file with the given content.
+func storeCommit(
+	t *testing.T,
+	s storer.EncodedObjectStorer,
+	content string,
+	parents ...plumbing.Hash,
+) plumbing.Hash {
+	require := require.New(t)
+
+	blob := s.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, err := blob.Writer()
+	require.NoError(err)
+	_, err = w.Write([]byte(content))
+	require.NoError(err)
+	require.NoError(w.Close())
+	blobHash, err := s.SetEncodedObject(blob)
+	require.NoError(err)
+
+	tree := &object.Tree{Entries: []object.TreeEntry{
+		{Name: "file", Mode: filemode.Regular, Hash: blobHash},
+	}}
+	obj := s.NewEncodedObject()
+	require.NoError(tree.Encode(obj))
+	treeHash, err := s.SetEncodedObject(obj)
+	require.NoError(err)
+
+	sig := object.Signature{Name: "foo", Email: "foo@bar", When: time.Unix(0, 0)}
+	commit := &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      content,
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	}
+
+	obj = s.NewEncodedObject()
+	require.NoError(commit.Encode(obj))
+	h, err := s.SetEncodedObject(obj)
+	require.NoError(err)
+
+	return h
+}
+
+func (f *rootedFixture) takedown() *Takedown {
+	return NewTakedown(nil, f.copier, repository.NewLocalFs(f.remote), f.session)
+}
+
+func TestTakedownRemoveRooted(t *testing.T) {
+	require := require.New(t)
+	f := newRootedFixture(t)
+
+	n, err := f.takedown().removeRooted(context.TODO(), f.init, f.b.ID)
+	require.NoError(err)
+	require.Equal(3, n)
+
+	txer := repository.NewSivaRootedTransactioner(f.copier)
+	tx, err := txer.Begin(context.TODO(), plumbing.Hash(f.init))
+	require.NoError(err)
+	defer tx.Rollback()
+	s := tx.Storer()
+
+	kept, removed, err := splitRootedReferences(s, f.b.ID)
+	require.NoError(err)
+	require.Equal(0, removed)
+
+	ref, err := s.Reference(refName("refs/heads/master", f.a))
+	require.NoError(err)
+	require.Equal(f.onlyA, ref.Hash())
+	require.True(hasRootedReferences(kept))
+
+	for _, h := range []plumbing.Hash{f.onlyA, f.common} {
+		_, err := object.GetCommit(s, h)
+		require.NoError(err)
+	}
+
+	for _, h := range []plumbing.Hash{f.onlyB, f.blobOnlyB} {
+		_, err := s.EncodedObject(plumbing.AnyObject, h)
+		require.Equal(plumbing.ErrObjectNotFound, err)
+	}
+
+	c, err := s.Config()
+	require.NoError(err)
+	require.NotContains(c.Remotes, f.b.ID.String())
+	require.Contains(c.Remotes, f.a.ID.String())
+}
+
+func TestTakedownRemoveRootedLast(t *testing.T) {
+	require := require.New(t)
+	f := newRootedFixture(t)
+
+	td := f.takedown()
+	_, err := td.removeRooted(context.TODO(), f.init, f.b.ID)
+	require.NoError(err)
+
+	n, err := td.removeRooted(context.TODO(), f.init, f.a.ID)
+	require.NoError(err)
+	require.Equal(1, n)
+
+	_, err = f.remote.Stat(f.init.String() + ".siva")
+	require.True(os.IsNotExist(err))
+}
+
+func TestTakedownRemoveRootedDry(t *testing.T) {
+	require := require.New(t)
+	f := newRootedFixture(t)
+
+	before, err := f.remote.Stat(f.init.String() + ".siva")
+	require.NoError(err)
+
+	td := f.takedown()
+	td.Dry(true)
+	n, err := td.removeRooted(context.TODO(), f.init, f.b.ID)
+	require.NoError(err)
+	require.Equal(3, n)
+
+	after, err := f.remote.Stat(f.init.String() + ".siva")
+	require.NoError(err)
+	require.Equal(before.Size(), after.Size())
+}
+
+func TestTakedownRemoveRootedDryCold(t *testing.T) {
+	require := require.New(t)
+	f := newRootedFixture(t)
+
+	cold := memfs.New()
+	tiers := borges.NewTiers(
+		repository.NewLocalFs(f.remote),
+		repository.NewLocalFs(cold),
+		0, nil,
+	)
+	require.NoError(tiers.Freeze(context.TODO(), f.init))
+
+	td := f.takedown()
+	td.Tiers(tiers)
+	td.Dry(true)
+	n, err := td.removeRooted(context.TODO(), f.init, f.b.ID)
+	require.NoError(err)
+	require.Equal(3, n)
+
+	_, err = f.remote.Stat(f.init.String() + ".siva")
+	require.True(os.IsNotExist(err))
+
+	_, err = cold.Stat(f.init.String() + ".siva")
+	require.NoError(err)
+}
+
+func TestTakedownReason(t *testing.T) {
+	_, err := NewTakedown(nil, nil, nil, nil).
+		Remove(context.TODO(), kallax.NewULID(), " ")
+	require.True(t, ErrTakedownReason.Is(err))
+}
+
+func TestTakedown(t *testing.T) {
+	suite.Run(t, new(TakedownSuite))
+}
+
+type TakedownSuite struct {
+	ToolSuite
+}
+
+func (s *TakedownSuite) TestRemove() {
+	require := s.Require()
+	f := newRootedFixture(s.T())
+
+	for _, r := range []*model.Repository{f.a, f.b} {
+		ref := model.NewReference()
+		ref.Name = "refs/heads/master"
+		ref.Hash = f.init
+		ref.Init = f.init
+		r.References = []*model.Reference{ref}
+		require.NoError(s.store.Create(r))
+	}
+
+	td := f.takedown()
+	td.db = NewDatabase(s.DB)
+
+	record, err := td.Remove(context.TODO(), f.b.ID, "legal request")
+	require.NoError(err)
+	require.Equal(f.b.ID, record.RepositoryID)
+	require.Equal([]model.SHA1{f.init}, record.Inits)
+	require.Equal(3, record.References)
+
+	_, err = s.store.Get(f.b.ID)
+	require.Error(err)
+
+	_, err = s.store.Get(f.a.ID)
+	require.NoError(err)
+
+	takenDown, err := s.store.IsTakenDown("git://github.com/foo/borges.git")
+	require.NoError(err)
+	require.False(takenDown)
+
+	takenDown, err = s.store.IsTakenDown(f.b.Endpoints...)
+	require.NoError(err)
+	require.True(takenDown)
+
+	_, err = borges.RepositoryID(
+		[]string{"git://github.com/foo/borges.git"}, nil, s.store)
+	require.True(borges.ErrRepositoryTakenDown.Is(err))
+
+	var reason string
+	err = s.DB.QueryRow(
+		"select reason from repository_takedowns where repository_id = $1",
+		f.b.ID,
+	).Scan(&reason)
+	require.NoError(err)
+	require.Equal("legal request", reason)
+}
+
+func (s *TakedownSuite) TestRemoveResume() {
+	require := s.Require()
+	f := newRootedFixture(s.T())
+
+	ref := model.NewReference()
+	ref.Name = "refs/heads/master"
+	ref.Hash = f.init
+	ref.Init = f.init
+	f.b.References = []*model.Reference{ref}
+	require.NoError(s.store.Create(f.b))
+
+	td := f.takedown()
+	td.db = NewDatabase(s.DB)
+
+	// a takedown interrupted after storing its record and removing the
+	// repository from the rooted repository
+	first := &TakedownRecord{
+		ID:           kallax.NewULID(),
+		RepositoryID: f.b.ID,
+		Endpoints:    f.b.Endpoints,
+		Inits:        []model.SHA1{f.init},
+		Reason:       "legal request",
+		CreatedAt:    time.Now(),
+	}
+	require.NoError(td.storeRecord(context.TODO(), first))
+
+	r, err := s.store.Get(f.b.ID)
+	require.NoError(err)
+	require.Equal(borges.Blocked, r.Status)
+
+	takenDown, err := s.store.IsTakenDown(f.b.Endpoints...)
+	require.NoError(err)
+	require.True(takenDown)
+
+	n, err := td.removeRooted(context.TODO(), f.init, f.b.ID)
+	require.NoError(err)
+	require.Equal(3, n)
+
+	record, err := td.Remove(context.TODO(), f.b.ID, "other reason")
+	require.NoError(err)
+	require.Equal(first.ID, record.ID)
+	require.Equal("legal request", record.Reason)
+	require.Equal(0, record.References)
+
+	_, err = s.store.Get(f.b.ID)
+	require.Error(err)
+
+	var count int
+	err = s.DB.QueryRow(
+		"select count(*) from repository_takedowns where repository_id = $1",
+		f.b.ID,
+	).Scan(&count)
+	require.NoError(err)
+	require.Equal(1, count)
+}
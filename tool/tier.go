@@ -0,0 +1,116 @@
+package tool
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+	"github.com/src-d/borges/storage"
+
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// dbColdCandidatesSQL selects the rooted repositories in the hot tier not
+// written since a time. Siva files written before tiering was enabled have no
+// tier recorded, their references are checked instead.
+const dbColdCandidatesSQL = `select refs.init from (
+	select init, max(updated_at) as updated_at
+	from repository_references group by init
+) refs left join repository_tiers t on t.init = refs.init
+where coalesce(t.tier, 'hot') = 'hot'
+and greatest(t.written_at, refs.updated_at) < $1
+order by refs.init`
+
+// GetTier returns the tier of the siva file of the given rooted repository,
+// or nil if it has not been recorded.
+func (d *Database) GetTier(init model.SHA1) (*storage.SivaTier, error) {
+	return d.store.GetTier(init)
+}
+
+// SetTier creates or replaces the tier of the siva file of a rooted
+// repository.
+func (d *Database) SetTier(t *storage.SivaTier) error {
+	return d.store.SetTier(t)
+}
+
+// ColdCandidates returns the rooted repositories in the hot tier that were
+// not written since the given time.
+func (d *Database) ColdCandidates(before time.Time) ([]model.SHA1, error) {
+	rows, err := d.db.Query(dbColdCandidatesSQL, before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var inits []model.SHA1
+	for rows.Next() {
+		var init model.SHA1
+		if err := rows.Scan(&init); err != nil {
+			return nil, err
+		}
+
+		inits = append(inits, init)
+	}
+
+	return inits, rows.Err()
+}
+
+// Tierer moves siva files between the hot and cold tiers holding the lock of
+// their rooted repositories, so they are not moved while being written.
+type Tierer struct {
+	tiers   *borges.Tiers
+	session lock.Session
+	dry     bool
+}
+
+// NewTierer creates and initializes a new Tierer. The session must be
+// connected to the same locking service as the consumers.
+func NewTierer(tiers *borges.Tiers, session lock.Session) *Tierer {
+	return &Tierer{
+		tiers:   tiers,
+		session: session,
+	}
+}
+
+// Dry sets dry run mode. The siva files are only located, not moved.
+func (t *Tierer) Dry(d bool) {
+	t.dry = d
+}
+
+// Move moves the siva file of a rooted repository to the given tier. It
+// returns the tier where it was before.
+func (t *Tierer) Move(
+	ctx context.Context,
+	init model.SHA1,
+	to storage.Tier,
+) (storage.Tier, error) {
+	if to != storage.HotTier && to != storage.ColdTier {
+		return "", fmt.Errorf("invalid tier %q", to)
+	}
+
+	locker := t.session.NewLocker(borges.RootedLockID(init))
+	if _, err := locker.Lock(); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := locker.Unlock(); err != nil {
+			log.Errorf(err, "could not unlock rooted repository")
+		}
+	}()
+
+	from, err := t.tiers.Locate(init)
+	if err != nil || t.dry || from == to {
+		return from, err
+	}
+
+	if to == storage.ColdTier {
+		err = t.tiers.Freeze(ctx, init)
+	} else {
+		err = t.tiers.Thaw(ctx, init)
+	}
+
+	return from, err
+}
@@ -0,0 +1,113 @@
+package tool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/src-d/borges"
+	"github.com/src-d/borges/lock"
+	"github.com/src-d/borges/storage"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"gopkg.in/src-d/core-retrieval.v0/model"
+	"gopkg.in/src-d/core-retrieval.v0/repository"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/util"
+)
+
+func TestTierer(t *testing.T) {
+	require := require.New(t)
+
+	hot, cold := memfs.New(), memfs.New()
+	tiers := borges.NewTiers(
+		repository.NewLocalFs(hot),
+		repository.NewLocalFs(cold),
+		0,
+		nil,
+	)
+
+	session, err := lock.NewLocal().NewSession(&lock.SessionConfig{})
+	require.NoError(err)
+
+	ic := model.NewSHA1(inits[0])
+	path := inits[0] + ".siva"
+	require.NoError(util.WriteFile(hot, path, []byte("siva"), 0644))
+
+	ctx := context.TODO()
+	tierer := NewTierer(tiers, session)
+
+	_, err = tierer.Move(ctx, ic, storage.Tier("warm"))
+	require.Error(err)
+
+	tierer.Dry(true)
+	from, err := tierer.Move(ctx, ic, storage.ColdTier)
+	require.NoError(err)
+	require.Equal(storage.HotTier, from)
+	_, err = hot.Stat(path)
+	require.NoError(err)
+
+	tierer.Dry(false)
+	from, err = tierer.Move(ctx, ic, storage.ColdTier)
+	require.NoError(err)
+	require.Equal(storage.HotTier, from)
+	_, err = cold.Stat(path)
+	require.NoError(err)
+
+	from, err = tierer.Move(ctx, ic, storage.ColdTier)
+	require.NoError(err)
+	require.Equal(storage.ColdTier, from)
+
+	from, err = tierer.Move(ctx, ic, storage.HotTier)
+	require.NoError(err)
+	require.Equal(storage.ColdTier, from)
+	_, err = hot.Stat(path)
+	require.NoError(err)
+	_, err = cold.Stat(path)
+	require.Error(err)
+}
+
+func TestTier(t *testing.T) {
+	suite.Run(t, new(TierSuite))
+}
+
+type TierSuite struct {
+	ToolSuite
+}
+
+func (s *TierSuite) TestColdCandidates() {
+	require := s.Require()
+	db := NewDatabase(s.DB)
+
+	candidates, err := db.ColdCandidates(time.Now().Add(-time.Hour))
+	require.NoError(err)
+	require.Len(candidates, 0)
+
+	candidates, err = db.ColdCandidates(time.Now().Add(time.Hour))
+	require.NoError(err)
+	require.Len(candidates, len(inits))
+
+	frozen := model.NewSHA1(inits[0])
+	require.NoError(db.SetTier(&storage.SivaTier{
+		Init: frozen,
+		Tier: storage.ColdTier,
+	}))
+
+	written := model.NewSHA1(inits[1])
+	require.NoError(db.SetTier(&storage.SivaTier{
+		Init:      written,
+		Tier:      storage.HotTier,
+		WrittenAt: time.Now().Add(2 * time.Hour),
+	}))
+
+	candidates, err = db.ColdCandidates(time.Now().Add(time.Hour))
+	require.NoError(err)
+	require.Len(candidates, len(inits)-2)
+	require.NotContains(candidates, frozen)
+	require.NotContains(candidates, written)
+
+	t, err := db.GetTier(frozen)
+	require.NoError(err)
+	require.Equal(storage.ColdTier, t.Tier)
+}
@@ -59,6 +59,7 @@ type ToolSuite struct {
 
 func (s *ToolSuite) SetupTest() {
 	s.Setup()
+	s.Require().NoError(storage.CreateSchema(s.DB))
 	s.store = storage.FromDatabase(s.DB)
 	s.createEnv()
 }
@@ -26,6 +26,9 @@ type WorkerPool struct {
 	workers    []*Worker
 	wg         *sync.WaitGroup
 	m          *sync.Mutex
+	// close releases the resources shared by the jobs, if any, once the
+	// workers are stopped.
+	close func()
 }
 
 // NewWorkerPool creates a new empty worker pool. It takes a function to be used
@@ -104,6 +107,7 @@ func (wp *WorkerPool) Close() error {
 	wp.SetWorkerCount(0)
 	wp.wg.Wait()
 	close(wp.jobChannel)
+	wp.release()
 	return nil
 }
 
@@ -116,5 +120,12 @@ func (wp *WorkerPool) Stop() error {
 	wp.wg.Wait()
 	wp.workers = nil
 	close(wp.jobChannel)
+	wp.release()
 	return nil
 }
+
+func (wp *WorkerPool) release() {
+	if wp.close != nil {
+		wp.close()
+	}
+}